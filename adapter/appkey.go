@@ -0,0 +1,371 @@
+package adapter
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	cl "github.com/ewangplay/cryptolib"
+)
+
+// Sources of the application key
+const (
+	// AppKeySourceConfig reads the key from privateKeyHex, for development
+	AppKeySourceConfig = "config"
+	// AppKeySourceKeystore decrypts the key from a keystore file
+	AppKeySourceKeystore = "keystore"
+	// AppKeySourcePKCS11 signs with a key that never leaves a PKCS#11 token
+	AppKeySourcePKCS11 = "pkcs11"
+)
+
+// Default environment variables of the secrets unlocking the key
+const (
+	DefaultPassphraseEnv = "SERVAL_KEYSTORE_PASSPHRASE"
+	DefaultPINEnv        = "SERVAL_PKCS11_PIN"
+)
+
+// AppKeyOptions defines the application key configure
+type AppKeyOptions struct {
+	// Source is config, keystore or pkcs11, config by default
+	Source string
+	// ID and Type name the key, the keystore holds its own
+	ID            string
+	Type          string
+	PrivateKeyHex string
+	// PublicKeyHex pins the public key when set
+	PublicKeyHex string
+	Keystore     KeystoreOptions
+	PKCS11       PKCS11Options
+	// Retired are the former keys, the exports they signed still verify
+	Retired []RetiredKey
+}
+
+// KeystoreOptions locates the keystore file and its passphrase
+type KeystoreOptions struct {
+	File string
+	// PassphraseEnv names the environment variable holding the passphrase,
+	// SERVAL_KEYSTORE_PASSPHRASE by default
+	PassphraseEnv string
+	// PassphraseFile is the path to a file holding the passphrase, it
+	// takes precedence over PassphraseEnv
+	PassphraseFile string
+}
+
+// PKCS11Options locates the key on a PKCS#11 token
+type PKCS11Options struct {
+	// Module is the path to the PKCS#11 library, like libsofthsm2.so
+	Module     string
+	TokenLabel string
+	// KeyLabel is the label of the key pair on the token
+	KeyLabel string
+	// PINEnv names the environment variable holding the user PIN,
+	// SERVAL_PKCS11_PIN by default
+	PINEnv string
+	// PINFile is the path to a file holding the PIN, it takes precedence
+	// over PINEnv
+	PINFile string
+}
+
+// RetiredKey is a former application key, it only verifies
+type RetiredKey struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	PublicKeyHex string `json:"publicKeyHex"`
+	// Retired is when the key was rotated, unknown for the keys of the config
+	Retired *time.Time `json:"retired,omitempty" mapstructure:"-"`
+}
+
+// AppKey is the key the service signs its own artifacts with
+type AppKey struct {
+	ID   string
+	Type string
+	// PrivateKey is nil when the key stays on a token
+	PrivateKey cl.Key
+	PublicKey  cl.Key
+	// Retired are the former keys, newest first
+	Retired []RetiredKey
+
+	// signer signs on the token, for the keys without PrivateKey
+	signer digestSigner
+}
+
+// digestSigner signs a digest with a key held outside of the process
+type digestSigner interface {
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Validate checks the options without reading the key, so that a config
+// can be checked where the keystore or the token is missing
+func (o *AppKeyOptions) Validate() error {
+	switch o.Source {
+	case "", AppKeySourceConfig:
+		if _, err := initConfigKey(o); err != nil {
+			return err
+		}
+	case AppKeySourceKeystore:
+		if o.PrivateKeyHex != "" {
+			return fmt.Errorf("privateKeyHex must be empty with the keystore source")
+		}
+		if o.Keystore.File == "" {
+			return fmt.Errorf("keystore.file is missing")
+		}
+	case AppKeySourcePKCS11:
+		if o.PrivateKeyHex != "" {
+			return fmt.Errorf("privateKeyHex must be empty with the pkcs11 source")
+		}
+		if o.ID == "" {
+			return fmt.Errorf("the application key id is missing")
+		}
+		if _, err := parseKeyType(o.Type); err != nil {
+			return err
+		}
+		if o.PKCS11.Module == "" {
+			return fmt.Errorf("pkcs11.module is missing")
+		}
+		if o.PKCS11.TokenLabel == "" {
+			return fmt.Errorf("pkcs11.tokenLabel is missing")
+		}
+		if o.PKCS11.KeyLabel == "" {
+			return fmt.Errorf("pkcs11.keyLabel is missing")
+		}
+	default:
+		return fmt.Errorf("unknown application key source %q, use config, keystore or pkcs11", o.Source)
+	}
+	return validateRetired(o.Retired)
+}
+
+// InitAppKey loads the application key from its source
+func InitAppKey(opts *AppKeyOptions) (*AppKey, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var (
+		key *AppKey
+		err error
+	)
+	switch opts.Source {
+	case AppKeySourceKeystore:
+		key, err = initKeystoreKey(opts)
+	case AppKeySourcePKCS11:
+		key, err = initPKCS11Key(opts)
+	default:
+		key, err = initConfigKey(opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PublicKeyHex != "" && !strings.EqualFold(key.PublicKeyHex(), opts.PublicKeyHex) {
+		key.Close()
+		return nil, fmt.Errorf("the application public key does not match the private key")
+	}
+	key.Retired = mergeRetired(key.Retired, opts.Retired)
+	return key, nil
+}
+
+func parseKeyType(t string) (string, error) {
+	keyType := strings.ToUpper(t)
+	switch keyType {
+	case cl.ED25519:
+	default:
+		return "", fmt.Errorf("unsupported application key type: %v", t)
+	}
+	return keyType, nil
+}
+
+func initConfigKey(opts *AppKeyOptions) (*AppKey, error) {
+	if opts.ID == "" {
+		return nil, fmt.Errorf("the application key id is missing")
+	}
+	keyType, err := parseKeyType(opts.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyBytes, err := hex.DecodeString(opts.PrivateKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("decode the application private key failed: %v", err)
+	}
+	key, err := newAppKey(opts.ID, keyType, privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PublicKeyHex != "" && !strings.EqualFold(key.PublicKeyHex(), opts.PublicKeyHex) {
+		return nil, fmt.Errorf("the application public key does not match the private key")
+	}
+	return key, nil
+}
+
+func initKeystoreKey(opts *AppKeyOptions) (*AppKey, error) {
+	ks, err := ReadKeystore(opts.Keystore.File)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ID != "" && opts.ID != ks.ID {
+		return nil, fmt.Errorf("the keystore holds the key %v, not %v", ks.ID, opts.ID)
+	}
+	passphrase, err := ReadSecret(opts.Keystore.PassphraseFile, opts.Keystore.PassphraseEnv, DefaultPassphraseEnv)
+	if err != nil {
+		return nil, fmt.Errorf("read the keystore passphrase failed: %v", err)
+	}
+	privKeyBytes, err := ks.Decrypt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	keyType, err := parseKeyType(ks.Type)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newAppKey(ks.ID, keyType, privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(key.PublicKeyHex(), ks.PublicKeyHex) {
+		return nil, fmt.Errorf("the keystore public key does not match its private key")
+	}
+	key.Retired = ks.Retired
+	return key, nil
+}
+
+func newAppKey(id, keyType string, privKeyBytes []byte) (*AppKey, error) {
+	if len(privKeyBytes) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("the application private key must be %d bytes", ed25519.PrivateKeySize)
+	}
+	privKey := &cl.Ed25519PrivateKey{PrivKey: privKeyBytes}
+	pubKey, err := privKey.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("derive the application public key failed: %v", err)
+	}
+	return &AppKey{
+		ID:         id,
+		Type:       keyType,
+		PrivateKey: privKey,
+		PublicKey:  pubKey,
+	}, nil
+}
+
+func validateRetired(keys []RetiredKey) error {
+	for i, k := range keys {
+		if k.ID == "" {
+			return fmt.Errorf("retired[%d]: the key id is missing", i)
+		}
+		if _, err := parseKeyType(k.Type); err != nil {
+			return fmt.Errorf("retired[%d]: %v", i, err)
+		}
+		if _, err := decodePublicKey(k.PublicKeyHex); err != nil {
+			return fmt.Errorf("retired[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// mergeRetired appends the retired keys of the config to the ones of the
+// keystore, the keystore wins when both list a key
+func mergeRetired(keys, more []RetiredKey) []RetiredKey {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		seen[k.ID] = true
+	}
+	for _, k := range more {
+		if !seen[k.ID] {
+			seen[k.ID] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func decodePublicKey(publicKeyHex string) (cl.Key, error) {
+	b, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("decode the public key failed: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("the public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return &cl.Ed25519PublicKey{PubKey: b}, nil
+}
+
+// ReadSecret reads a passphrase or a PIN from the file, or else from the
+// environment variable env, or else from defaultEnv. The trailing line
+// break of the file is dropped.
+func ReadSecret(file, env, defaultEnv string) ([]byte, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+	if env == "" {
+		env = defaultEnv
+	}
+	s, ok := os.LookupEnv(env)
+	if !ok || s == "" {
+		return nil, fmt.Errorf("%s is not set", env)
+	}
+	return []byte(s), nil
+}
+
+// PublicKeyHex returns the hex encoded public key
+func (k *AppKey) PublicKeyHex() string {
+	b, _ := k.PublicKey.Bytes()
+	return hex.EncodeToString(b)
+}
+
+// Sign signs the SHA256 digest of the data
+func (k *AppKey) Sign(csp cl.CSP, data []byte) ([]byte, error) {
+	digest, err := csp.Hash(data, &cl.SHA256Opts{})
+	if err != nil {
+		return nil, err
+	}
+	if k.signer != nil {
+		return k.signer.Sign(digest)
+	}
+	if k.PrivateKey == nil {
+		return nil, fmt.Errorf("the application key %v only verifies", k.ID)
+	}
+	return csp.Sign(k.PrivateKey, digest, nil)
+}
+
+// Verify verifies the signature of the SHA256 digest of the data
+func (k *AppKey) Verify(csp cl.CSP, data, signature []byte) (bool, error) {
+	digest, err := csp.Hash(data, &cl.SHA256Opts{})
+	if err != nil {
+		return false, err
+	}
+	return csp.Verify(k.PublicKey, digest, signature, nil)
+}
+
+// Lookup returns the key with the id and the hex encoded public key, the
+// current key or a retired one. A retired key only verifies.
+func (k *AppKey) Lookup(id, publicKeyHex string) (*AppKey, bool) {
+	if id == k.ID && strings.EqualFold(publicKeyHex, k.PublicKeyHex()) {
+		return k, true
+	}
+	for _, r := range k.Retired {
+		if id != r.ID || !strings.EqualFold(publicKeyHex, r.PublicKeyHex) {
+			continue
+		}
+		pubKey, err := decodePublicKey(r.PublicKeyHex)
+		if err != nil {
+			return nil, false
+		}
+		return &AppKey{ID: r.ID, Type: strings.ToUpper(r.Type), PublicKey: pubKey}, true
+	}
+	return nil, false
+}
+
+// Close releases the session of the token, if any
+func (k *AppKey) Close() error {
+	if c, ok := k.signer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package adapter
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/philippgille/gokv/badgerdb"
+	"github.com/philippgille/gokv/encoding"
+	"github.com/philippgille/gokv/util"
+)
+
+// BadgerStore is a gokv.Store implementation for BadgerDB.
+// It keeps the on-disk layout of the gokv badgerdb store,
+// and adds key enumeration on top of it.
+type BadgerStore struct {
+	db    *badger.DB
+	codec encoding.Codec
+}
+
+// NewBadgerStore opens the BadgerDB located in the options.Dir directory,
+// it will be created if it doesn't exist.
+func NewBadgerStore(options badgerdb.Options) (*BadgerStore, error) {
+	if options.Dir == "" {
+		options.Dir = badgerdb.DefaultOptions.Dir
+	}
+	if options.Codec == nil {
+		options.Codec = badgerdb.DefaultOptions.Codec
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(options.Dir))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStore{
+		db:    db,
+		codec: options.Codec,
+	}, nil
+}
+
+// Set stores the given value for the given key.
+func (s *BadgerStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(k), data)
+	})
+}
+
+// Get retrieves the stored value for the given key.
+// If no value is found it returns (false, nil).
+func (s *BadgerStore) Get(k string, v any) (found bool, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	var data []byte
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(k))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Delete deletes the stored value for the given key.
+// Deleting a non-existing key does not lead to an error.
+func (s *BadgerStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(k))
+	})
+}
+
+// Scan calls fn for every key with the given prefix, in ascending order.
+func (s *BadgerStore) Scan(prefix string, fn func(k string) error) error {
+	// Collect the keys first, so fn is free to write to the store
+	var keys []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			keys = append(keys, string(it.Item().KeyCopy(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the store.
+// It must be called to make sure that all pending updates make their way to disk.
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
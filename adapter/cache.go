@@ -0,0 +1,238 @@
+package adapter
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ewangplay/serval/metrics"
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/util"
+)
+
+// CacheOptions defines the options of the read-through cache
+type CacheOptions struct {
+	// Size is the max number of entries held in the cache, 0 disables the cache
+	Size int
+	// TTL is how long an entry stays valid, 0 means entries never expire
+	TTL time.Duration
+}
+
+// CacheStats holds the counters of a CacheStore
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// CacheStore is a LRU/TTL read-through cache of the verified values in
+// front of a gokv.Store. Only GetVerified reads from the cache, the other
+// reads and the writes go straight to the underlying store, and the writes
+// invalidate the cached entry. The cache is local to the process: a value
+// written by another node sharing the backend is seen once the entry
+// expires.
+type CacheStore struct {
+	store gokv.Store
+	opts  CacheOptions
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	// gen is bumped on every invalidation, so a read that raced with a write
+	// does not put a stale value back into the cache
+	gen uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewCacheStore wraps the store with a read-through cache
+func NewCacheStore(store gokv.Store, opts CacheOptions) *CacheStore {
+	return &CacheStore{
+		store: store,
+		opts:  opts,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Uncached returns the store under the read cache of the stack, for the
+// records written by the other nodes sharing the backend. The stack is
+// returned as is when it has no cache.
+func Uncached(store gokv.Store) gokv.Store {
+	if c, ok := Find[*CacheStore](store); ok {
+		return c.Unwrap()
+	}
+	return store
+}
+
+// Set stores the value in the underlying store and invalidates the cached entry.
+func (s *CacheStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+	defer s.invalidate(k)
+	return s.store.Set(k, v)
+}
+
+// Get retrieves the value from the underlying store.
+func (s *CacheStore) Get(k string, v any) (found bool, err error) {
+	return s.store.Get(k, v)
+}
+
+// Delete deletes the value from the underlying store and invalidates the cached entry.
+func (s *CacheStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+	defer s.invalidate(k)
+	return s.store.Delete(k)
+}
+
+// Scan enumerates the keys of the underlying store.
+func (s *CacheStore) Scan(prefix string, fn func(k string) error) error {
+	return Scan(s.store, prefix, fn)
+}
+
+// Close purges the cache and closes the underlying store.
+func (s *CacheStore) Close() error {
+	s.mu.Lock()
+	s.ll.Init()
+	s.items = make(map[string]*list.Element)
+	s.mu.Unlock()
+	return s.store.Close()
+}
+
+// Unwrap returns the underlying store
+func (s *CacheStore) Unwrap() gokv.Store {
+	return s.store
+}
+
+// Stats returns a snapshot of the cache counters
+func (s *CacheStore) Stats() CacheStats {
+	s.mu.Lock()
+	entries := s.ll.Len()
+	s.mu.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&s.hits),
+		Misses:    atomic.LoadUint64(&s.misses),
+		Evictions: atomic.LoadUint64(&s.evictions),
+		Entries:   entries,
+	}
+}
+
+// GetVerified returns the value from the cache, else it reads it from the
+// underlying store and runs verify on it. Values that passed verify are
+// served from the cache afterwards without being verified again.
+func (s *CacheStore) GetVerified(k string, v any, verify func() error) (found bool, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	if e, ok := s.items[k]; ok {
+		entry := e.Value.(*cacheEntry)
+		if s.opts.TTL <= 0 || time.Now().Before(entry.expires) {
+			s.ll.MoveToFront(e)
+			data := entry.data
+			s.mu.Unlock()
+
+			atomic.AddUint64(&s.hits, 1)
+			metrics.ObserveCache(metrics.CacheHit)
+			return true, json.Unmarshal(data, v)
+		}
+		s.remove(e)
+	}
+	// gen is the one of the read, a write during it makes the value stale
+	gen := s.gen
+	s.mu.Unlock()
+
+	atomic.AddUint64(&s.misses, 1)
+	metrics.ObserveCache(metrics.CacheMiss)
+	found, err = s.store.Get(k, v)
+	if err != nil || !found {
+		return
+	}
+	if err = verify(); err != nil {
+		return
+	}
+	s.add(k, v, gen)
+	return
+}
+
+// add puts the value into the cache unless an invalidation happened since gen
+func (s *CacheStore) add(k string, v any, gen uint64) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gen != gen {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:     k,
+		data:    data,
+		expires: time.Now().Add(s.opts.TTL),
+	}
+	if e, ok := s.items[k]; ok {
+		e.Value = entry
+		s.ll.MoveToFront(e)
+		return
+	}
+	s.items[k] = s.ll.PushFront(entry)
+
+	for s.opts.Size > 0 && s.ll.Len() > s.opts.Size {
+		s.remove(s.ll.Back())
+		atomic.AddUint64(&s.evictions, 1)
+		metrics.ObserveEviction()
+	}
+}
+
+func (s *CacheStore) invalidate(k string) {
+	s.mu.Lock()
+	s.gen++
+	if e, ok := s.items[k]; ok {
+		s.remove(e)
+	}
+	s.mu.Unlock()
+}
+
+func (s *CacheStore) remove(e *list.Element) {
+	s.ll.Remove(e)
+	delete(s.items, e.Value.(*cacheEntry).key)
+}
+
+// VerifiedGetter is implemented by stores that remember which values were verified
+type VerifiedGetter interface {
+	GetVerified(k string, v any, verify func() error) (found bool, err error)
+}
+
+// GetVerified retrieves the value for the given key and checks it with verify.
+// When the store is a VerifiedGetter such as CacheStore, values verified
+// before are served without calling verify again.
+func GetVerified(store gokv.Store, k string, v any, verify func() error) (found bool, err error) {
+	if vg, ok := store.(VerifiedGetter); ok {
+		return vg.GetVerified(k, v, verify)
+	}
+
+	found, err = store.Get(k, v)
+	if err != nil || !found {
+		return
+	}
+	return true, verify()
+}
@@ -0,0 +1,165 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter/storetest"
+	"github.com/philippgille/gokv"
+)
+
+func TestCacheStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		return NewCacheStore(NewMemoryStore(), CacheOptions{Size: 4, TTL: time.Minute})
+	})
+}
+
+// noVerify accepts every value
+func noVerify() error { return nil }
+
+func TestCacheStoreReadThrough(t *testing.T) {
+	backend := NewMemoryStore()
+	s := NewCacheStore(backend, CacheOptions{Size: 2})
+	defer s.Close()
+
+	var v string
+	if err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	s.GetVerified("a", &v, noVerify)
+	s.GetVerified("a", &v, noVerify)
+	if stats := s.Stats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Writes invalidate the cached entry
+	if err := s.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetVerified("a", &v, noVerify); err != nil || v != "2" {
+		t.Fatalf("Stale value after write: %v %v", v, err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := s.GetVerified("a", &v, noVerify); found {
+		t.Fatal("Deleted value should not be served from the cache")
+	}
+
+	// The least recently used entry gets evicted
+	for _, k := range []string{"b", "c", "d"} {
+		backend.Set(k, k)
+		s.GetVerified(k, &v, noVerify)
+	}
+	if stats := s.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheStoreGet(t *testing.T) {
+	backend := NewMemoryStore()
+	s := NewCacheStore(backend, CacheOptions{Size: 2})
+	defer s.Close()
+
+	// The plain reads are not cached, they see the writes of the other nodes
+	var v string
+	backend.Set("a", "1")
+	s.Get("a", &v)
+	backend.Set("a", "2")
+	if _, err := s.Get("a", &v); err != nil || v != "2" {
+		t.Fatalf("Expected the value of the backend: %v %v", v, err)
+	}
+	if stats := s.Stats(); stats.Entries != 0 || stats.Hits+stats.Misses != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheStoreTTL(t *testing.T) {
+	backend := NewMemoryStore()
+	s := NewCacheStore(backend, CacheOptions{Size: 2, TTL: 10 * time.Millisecond})
+	defer s.Close()
+
+	var v string
+	backend.Set("a", "1")
+	s.GetVerified("a", &v, noVerify)
+
+	// Changes made behind the cache show up once the entry expires
+	backend.Set("a", "2")
+	time.Sleep(20 * time.Millisecond)
+	if _, err := s.GetVerified("a", &v, noVerify); err != nil || v != "2" {
+		t.Fatalf("Expired entry should be reloaded: %v %v", v, err)
+	}
+}
+
+func TestGetVerified(t *testing.T) {
+	s := NewCacheStore(NewMemoryStore(), CacheOptions{Size: 2})
+	defer s.Close()
+	s.Set("a", "1")
+
+	calls := 0
+	verify := func() error {
+		calls++
+		return nil
+	}
+
+	var v string
+	for i := 0; i < 3; i++ {
+		found, err := GetVerified(s, "a", &v, verify)
+		if err != nil || !found || v != "1" {
+			t.Fatalf("GetVerified failed: %v %v %v", found, v, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Verified value should be served from the cache, verify called %d times", calls)
+	}
+
+	// Values failing verification are never marked as verified
+	s.Set("b", "1")
+	errBad := errors.New("bad")
+	for i := 0; i < 2; i++ {
+		if _, err := GetVerified(s, "b", &v, func() error { return errBad }); err != errBad {
+			t.Fatalf("GetVerified should return the verify error, got %v", err)
+		}
+	}
+}
+
+// racingStore runs onGet after reading a value, like a write landing while
+// the read is in flight
+type racingStore struct {
+	*MemoryStore
+	onGet func()
+}
+
+func (s *racingStore) Get(k string, v any) (bool, error) {
+	found, err := s.MemoryStore.Get(k, v)
+	if s.onGet != nil {
+		onGet := s.onGet
+		s.onGet = nil
+		onGet()
+	}
+	return found, err
+}
+
+func TestGetVerifiedRacingWrite(t *testing.T) {
+	backend := &racingStore{MemoryStore: NewMemoryStore()}
+	s := NewCacheStore(backend, CacheOptions{Size: 2})
+	defer s.Close()
+	s.Set("a", "1")
+
+	backend.onGet = func() {
+		if err := s.Set("a", "2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var v string
+	if _, err := GetVerified(s, "a", &v, func() error { return nil }); err != nil || v != "1" {
+		t.Fatalf("GetVerified failed: %v %v", v, err)
+	}
+
+	// The value read before the write must not be served as verified
+	calls := 0
+	if _, err := GetVerified(s, "a", &v, func() error { calls++; return nil }); err != nil || v != "2" || calls != 1 {
+		t.Fatalf("Stale value served after a racing write: %v %v, verify called %d times", v, err, calls)
+	}
+}
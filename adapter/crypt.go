@@ -0,0 +1,591 @@
+package adapter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/util"
+)
+
+const (
+	cryptKeyringKey = "serval:crypt:keyring"
+	cryptAlg        = "AES-256-GCM"
+	cryptLockStripe = 64
+)
+
+// CryptOptions defines the options of the encryption at rest
+type CryptOptions struct {
+	// KEK is the hex encoded key-encryption key (16, 24 or 32 bytes)
+	KEK string
+	// KEKFile is the path to a file holding the hex encoded key-encryption key
+	KEKFile string
+	// PreviousKEK is the former key-encryption key, set it while rotating the KEK
+	PreviousKEK string
+	// PreviousKEKFile is the path to a file holding the former key-encryption key
+	PreviousKEKFile string
+	// RotateInterval rotates the data key periodically, 0 disables the rotation
+	RotateInterval time.Duration
+	// RejectPlaintext fails the reads of the records written before the
+	// encryption was enabled, set it once they are all re-encrypted
+	RejectPlaintext bool
+}
+
+// CryptStatus describes the state of the data keys of a CryptStore
+type CryptStatus struct {
+	ActiveKey    string `json:"activeKey"`
+	Keys         int    `json:"keys"`
+	Reencrypting bool   `json:"reencrypting"`
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// dataKey is a data key wrapped by the key-encryption key
+type dataKey struct {
+	ID      string    `json:"id"`
+	Wrapped []byte    `json:"wrapped"`
+	Created time.Time `json:"created"`
+}
+
+type keyring struct {
+	Active string    `json:"active"`
+	Keys   []dataKey `json:"keys"`
+}
+
+// cryptEnvelope is the form in which a value is written to the backend
+type cryptEnvelope struct {
+	Alg        string `json:"alg"`
+	KeyID      string `json:"kid"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// CryptStore encrypts the values of the underlying store with AES-GCM.
+// Values are sealed with a data key, and the data keys are kept in the
+// store wrapped by a key-encryption key that never touches the backend.
+// After a data key rotation the records are re-encrypted in the background.
+type CryptStore struct {
+	store gokv.Store
+	kek   cipher.AEAD
+	// rejectPlaintext fails the reads of the plaintext records
+	rejectPlaintext bool
+
+	mu    sync.RWMutex
+	ring  keyring
+	aeads map[string]cipher.AEAD
+
+	// locks serializes writes of the same key with the re-encryption
+	locks [cryptLockStripe]sync.Mutex
+
+	statusMu     sync.Mutex
+	reencrypting bool
+	pending      bool
+	lastErr      error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCryptStore wraps the store with encryption at rest
+func NewCryptStore(store gokv.Store, opts CryptOptions) (*CryptStore, error) {
+	kekBytes, err := loadKEK(opts.KEK, opts.KEKFile)
+	if err != nil {
+		return nil, err
+	}
+	if kekBytes == nil {
+		return nil, fmt.Errorf("the key-encryption key is missing")
+	}
+	kek, err := newAEAD(kekBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key-encryption key: %v", err)
+	}
+
+	s := &CryptStore{
+		store:           store,
+		kek:             kek,
+		rejectPlaintext: opts.RejectPlaintext,
+		aeads:           make(map[string]cipher.AEAD),
+		done:            make(chan struct{}),
+	}
+
+	created, err := s.loadKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A fresh keyring may sit on top of plaintext records, and more than
+	// one data key means a rotation was interrupted, so re-encrypt in both cases
+	if created || len(s.ring.Keys) > 1 {
+		s.startReencrypt()
+	}
+
+	if opts.RotateInterval > 0 {
+		s.wg.Add(1)
+		go s.rotateLoop(opts.RotateInterval)
+	}
+
+	return s, nil
+}
+
+func loadKEK(hexKey, filename string) ([]byte, error) {
+	if hexKey == "" && filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("read the key-encryption key file failed: %v", err)
+		}
+		hexKey = string(data)
+	}
+	hexKey = strings.TrimSpace(hexKey)
+	if hexKey == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode the key-encryption key failed: %v", err)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, ad []byte) (nonce, ciphertext []byte, err error) {
+	nonce = make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// wrap encrypts a data key with the key-encryption key, the nonce is prepended
+func wrap(kek cipher.AEAD, id string, key []byte) ([]byte, error) {
+	nonce, ciphertext, err := seal(kek, key, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func unwrap(kek cipher.AEAD, id string, wrapped []byte) ([]byte, error) {
+	n := kek.NonceSize()
+	if len(wrapped) < n {
+		return nil, fmt.Errorf("wrapped data key %v is truncated", id)
+	}
+	return kek.Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+}
+
+// loadKeyring reads the keyring from the store, creating it on first use.
+// Data keys wrapped by the previous KEK are re-wrapped with the current one.
+func (s *CryptStore) loadKeyring(opts CryptOptions) (created bool, err error) {
+	found, err := s.store.Get(cryptKeyringKey, &s.ring)
+	if err != nil {
+		return false, fmt.Errorf("read the keyring failed: %v", err)
+	}
+	if !found {
+		if err = s.addDataKey(); err != nil {
+			return false, err
+		}
+		return true, s.saveKeyring()
+	}
+
+	var prevKEK cipher.AEAD
+	prevBytes, err := loadKEK(opts.PreviousKEK, opts.PreviousKEKFile)
+	if err != nil {
+		return false, err
+	}
+	if prevBytes != nil {
+		if prevKEK, err = newAEAD(prevBytes); err != nil {
+			return false, fmt.Errorf("invalid previous key-encryption key: %v", err)
+		}
+	}
+
+	rewrapped := false
+	for i, dk := range s.ring.Keys {
+		key, err := unwrap(s.kek, dk.ID, dk.Wrapped)
+		if err != nil && prevKEK != nil {
+			key, err = unwrap(prevKEK, dk.ID, dk.Wrapped)
+			if err == nil {
+				s.ring.Keys[i].Wrapped, err = wrap(s.kek, dk.ID, key)
+				rewrapped = true
+			}
+		}
+		if err != nil {
+			return false, fmt.Errorf("unwrap the data key %v failed, wrong key-encryption key? %v", dk.ID, err)
+		}
+		if s.aeads[dk.ID], err = newAEAD(key); err != nil {
+			return false, err
+		}
+	}
+	if _, ok := s.aeads[s.ring.Active]; !ok {
+		return false, fmt.Errorf("the active data key %v is missing from the keyring", s.ring.Active)
+	}
+
+	if rewrapped {
+		return false, s.saveKeyring()
+	}
+	return false, nil
+}
+
+// addDataKey generates a new data key and makes it the active one.
+// The caller must hold s.mu or own s exclusively.
+func (s *CryptStore) addDataKey() error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("dk-%d", time.Now().UnixNano())
+	wrapped, err := wrap(s.kek, id, key)
+	if err != nil {
+		return err
+	}
+
+	s.ring.Keys = append(s.ring.Keys, dataKey{ID: id, Wrapped: wrapped, Created: time.Now()})
+	s.ring.Active = id
+	s.aeads[id] = aead
+	return nil
+}
+
+// refresh reloads the keyring from the store for a data key added by
+// another process sharing the backend, and adopts its active key
+func (s *CryptStore) refresh(kid string) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if aead, ok := s.aeads[kid]; ok {
+		return aead, nil
+	}
+
+	var ring keyring
+	found, err := s.store.Get(cryptKeyringKey, &ring)
+	if err != nil {
+		return nil, fmt.Errorf("read the keyring failed: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("the keyring is missing")
+	}
+	for _, dk := range ring.Keys {
+		if _, ok := s.aeads[dk.ID]; ok {
+			continue
+		}
+		key, err := unwrap(s.kek, dk.ID, dk.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap the data key %v failed: %v", dk.ID, err)
+		}
+		if s.aeads[dk.ID], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	aead, ok := s.aeads[kid]
+	if !ok {
+		return nil, fmt.Errorf("%v is not in the keyring", kid)
+	}
+	if _, ok = s.aeads[ring.Active]; ok {
+		s.ring = ring
+	}
+	return aead, nil
+}
+
+func (s *CryptStore) saveKeyring() error {
+	if err := s.store.Set(cryptKeyringKey, s.ring); err != nil {
+		return fmt.Errorf("write the keyring failed: %v", err)
+	}
+	return nil
+}
+
+func (s *CryptStore) lock(k string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return &s.locks[h.Sum32()%cryptLockStripe]
+}
+
+func (s *CryptStore) encrypt(k string, plaintext []byte) (*cryptEnvelope, error) {
+	s.mu.RLock()
+	kid := s.ring.Active
+	aead := s.aeads[kid]
+	s.mu.RUnlock()
+
+	nonce, ciphertext, err := seal(aead, plaintext, []byte(k))
+	if err != nil {
+		return nil, err
+	}
+	return &cryptEnvelope{
+		Alg:        cryptAlg,
+		KeyID:      kid,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// read loads the value stored for k and returns its plaintext, along with
+// the data key it was sealed with ("" for records written before encryption)
+func (s *CryptStore) read(k string) (plaintext []byte, kid string, found bool, err error) {
+	var raw json.RawMessage
+	found, err = s.store.Get(k, &raw)
+	if err != nil || !found {
+		return
+	}
+
+	var env cryptEnvelope
+	if json.Unmarshal(raw, &env) != nil || env.Alg == "" {
+		// Plaintext record written before the encryption was enabled
+		if s.rejectPlaintext {
+			return nil, "", true, fmt.Errorf("the record %v is not encrypted", k)
+		}
+		return raw, "", true, nil
+	}
+	if env.Alg != cryptAlg {
+		return nil, "", true, fmt.Errorf("unsupported encryption algorithm of %v: %v", k, env.Alg)
+	}
+
+	s.mu.RLock()
+	aead, ok := s.aeads[env.KeyID]
+	s.mu.RUnlock()
+	if !ok {
+		if aead, err = s.refresh(env.KeyID); err != nil {
+			return nil, "", true, fmt.Errorf("unknown data key of %v: %v", k, err)
+		}
+	}
+
+	plaintext, err = aead.Open(nil, env.Nonce, env.Ciphertext, []byte(k))
+	if err != nil {
+		return nil, "", true, fmt.Errorf("decrypt %v failed: %v", k, err)
+	}
+	return plaintext, env.KeyID, true, nil
+}
+
+// Set encrypts the value and stores it in the underlying store.
+func (s *CryptStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Pick the data key while holding the lock, so a running
+	// re-encryption pass cannot miss this record
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+
+	env, err := s.encrypt(k, plaintext)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(k, env)
+}
+
+// Get retrieves and decrypts the stored value for the given key.
+func (s *CryptStore) Get(k string, v any) (found bool, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	plaintext, _, found, err := s.read(k)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, json.Unmarshal(plaintext, v)
+}
+
+// Delete deletes the stored value for the given key.
+func (s *CryptStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+	return s.store.Delete(k)
+}
+
+// Scan enumerates the keys of the underlying store, hiding the keyring.
+func (s *CryptStore) Scan(prefix string, fn func(k string) error) error {
+	return Scan(s.store, prefix, func(k string) error {
+		if k == cryptKeyringKey {
+			return nil
+		}
+		return fn(k)
+	})
+}
+
+// Close stops the background jobs and closes the underlying store.
+func (s *CryptStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.store.Close()
+}
+
+// Unwrap returns the underlying store
+func (s *CryptStore) Unwrap() gokv.Store {
+	return s.store
+}
+
+// Rotate generates a new data key for the following writes,
+// and re-encrypts the existing records with it in the background.
+func (s *CryptStore) Rotate() error {
+	s.mu.Lock()
+	err := s.addDataKey()
+	if err == nil {
+		err = s.saveKeyring()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.startReencrypt()
+	return nil
+}
+
+// Status reports the data keys and the progress of the re-encryption
+func (s *CryptStore) Status() CryptStatus {
+	s.mu.RLock()
+	status := CryptStatus{
+		ActiveKey: s.ring.Active,
+		Keys:      len(s.ring.Keys),
+	}
+	s.mu.RUnlock()
+
+	s.statusMu.Lock()
+	status.Reencrypting = s.reencrypting
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	s.statusMu.Unlock()
+	return status
+}
+
+func (s *CryptStore) rotateLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Rotate(); err != nil {
+				s.statusMu.Lock()
+				s.lastErr = err
+				s.statusMu.Unlock()
+			}
+		}
+	}
+}
+
+// startReencrypt runs a re-encryption pass in the background. A rotation
+// during a running pass schedules another pass once the current one is done.
+func (s *CryptStore) startReencrypt() {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if s.reencrypting {
+		s.pending = true
+		return
+	}
+	s.reencrypting = true
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			err := s.reencryptAll()
+
+			s.statusMu.Lock()
+			s.lastErr = err
+			if !s.pending || err != nil {
+				s.reencrypting = false
+				s.pending = false
+				s.statusMu.Unlock()
+				return
+			}
+			s.pending = false
+			s.statusMu.Unlock()
+		}
+	}()
+}
+
+var errCryptStopped = fmt.Errorf("crypt store closed")
+
+// reencryptAll seals every record with the active data key, then retires
+// the data keys that are no longer in use
+func (s *CryptStore) reencryptAll() error {
+	s.mu.RLock()
+	active := s.ring.Active
+	s.mu.RUnlock()
+
+	err := s.Scan("", func(k string) error {
+		select {
+		case <-s.done:
+			return errCryptStopped
+		default:
+		}
+		return s.reencrypt(k, active)
+	})
+	if err == errCryptStopped {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("re-encrypt the records failed: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring.Active != active {
+		// Rotated again meanwhile, the next pass retires the keys
+		return nil
+	}
+	keys := s.ring.Keys[:0]
+	for _, dk := range s.ring.Keys {
+		if dk.ID == active {
+			keys = append(keys, dk)
+		} else {
+			delete(s.aeads, dk.ID)
+		}
+	}
+	s.ring.Keys = keys
+	return s.saveKeyring()
+}
+
+func (s *CryptStore) reencrypt(k string, active string) error {
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+
+	plaintext, kid, found, err := s.read(k)
+	if err != nil {
+		return err
+	}
+	if !found || kid == active {
+		return nil
+	}
+
+	env, err := s.encrypt(k, plaintext)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(k, env)
+}
@@ -0,0 +1,179 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter/storetest"
+	"github.com/philippgille/gokv"
+)
+
+const (
+	testKEK     = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testNextKEK = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+// nopCloser keeps the backend open when the wrapper on top of it is closed
+type nopCloser struct {
+	*MemoryStore
+}
+
+func (nopCloser) Close() error { return nil }
+
+func newCryptStore(t *testing.T, backend gokv.Store, opts CryptOptions) *CryptStore {
+	s, err := NewCryptStore(backend, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReencrypted(t, s)
+	return s
+}
+
+func waitReencrypted(t *testing.T, s *CryptStore) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().Reencrypting {
+		if time.Now().After(deadline) {
+			t.Fatal("Re-encryption did not finish in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := s.Status(); st.LastError != "" {
+		t.Fatalf("Re-encryption failed: %v", st.LastError)
+	}
+}
+
+func rawValue(t *testing.T, s gokv.Store, k string) []byte {
+	var raw json.RawMessage
+	found, err := s.Get(k, &raw)
+	if err != nil || !found {
+		t.Fatalf("Get raw %v failed: %v %v", k, found, err)
+	}
+	return raw
+}
+
+func TestCryptStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		return newCryptStore(t, NewMemoryStore(), CryptOptions{KEK: testKEK})
+	})
+}
+
+func TestCryptStoreAtRest(t *testing.T) {
+	backend := nopCloser{NewMemoryStore()}
+
+	// Records written before the encryption was enabled
+	backend.Set("did:example:legacy", "legacy secret")
+
+	s := newCryptStore(t, backend, CryptOptions{KEK: testKEK})
+	if err := s.Set("did:example:a", "top secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"did:example:a", "did:example:legacy"} {
+		if raw := rawValue(t, backend, k); bytes.Contains(raw, []byte("secret")) {
+			t.Fatalf("Record %v is stored in plaintext: %s", k, raw)
+		}
+	}
+
+	var v string
+	if _, err := s.Get("did:example:legacy", &v); err != nil || v != "legacy secret" {
+		t.Fatalf("Get legacy record failed: %v %v", v, err)
+	}
+
+	// The keyring is not exposed by Scan
+	err := s.Scan("", func(k string) error {
+		if strings.HasPrefix(k, "serval:") {
+			t.Errorf("Scan exposes internal key %v", k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A wrong key-encryption key cannot open the store
+	if _, err := NewCryptStore(backend, CryptOptions{KEK: testNextKEK}); err == nil {
+		t.Fatal("NewCryptStore should fail with a wrong key-encryption key")
+	}
+}
+
+func TestCryptStoreRotation(t *testing.T) {
+	backend := nopCloser{NewMemoryStore()}
+
+	s := newCryptStore(t, backend, CryptOptions{KEK: testKEK})
+	s.Set("did:example:a", "a")
+	s.Set("did:example:b", "b")
+	before := s.Status().ActiveKey
+
+	// Rotate the data key
+	if err := s.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	waitReencrypted(t, s)
+	st := s.Status()
+	if st.ActiveKey == before || st.Keys != 1 {
+		t.Fatalf("Unexpected status after rotation: %+v", st)
+	}
+	var env cryptEnvelope
+	json.Unmarshal(rawValue(t, backend, "did:example:a"), &env)
+	if env.KeyID != st.ActiveKey {
+		t.Fatalf("Record not re-encrypted: %v != %v", env.KeyID, st.ActiveKey)
+	}
+	s.Close()
+
+	// Rotate the key-encryption key
+	s = newCryptStore(t, backend, CryptOptions{KEK: testNextKEK, PreviousKEK: testKEK})
+	s.Close()
+	s = newCryptStore(t, backend, CryptOptions{KEK: testNextKEK})
+	defer s.Close()
+
+	var v string
+	if _, err := s.Get("did:example:b", &v); err != nil || v != "b" {
+		t.Fatalf("Get after KEK rotation failed: %v %v", v, err)
+	}
+}
+
+func TestCryptStoreRejectPlaintext(t *testing.T) {
+	backend := nopCloser{NewMemoryStore()}
+	newCryptStore(t, backend, CryptOptions{KEK: testKEK}).Close()
+
+	// A plaintext record written to the backend once every record is encrypted
+	backend.Set("did:example:planted", "planted")
+
+	s, err := NewCryptStore(backend, CryptOptions{KEK: testKEK, RejectPlaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var v string
+	if _, err = s.Get("did:example:planted", &v); err == nil {
+		t.Fatalf("Expected the plaintext record to be rejected, got %v", v)
+	}
+}
+
+func TestCryptStoreNodes(t *testing.T) {
+	// Two processes sharing the backend
+	backend := nopCloser{NewMemoryStore()}
+	s1 := newCryptStore(t, backend, CryptOptions{KEK: testKEK})
+	defer s1.Close()
+	s2 := newCryptStore(t, backend, CryptOptions{KEK: testKEK})
+	defer s2.Close()
+	s1.Set("did:example:a", "a")
+
+	// The other process loads the data key of the rotation when it meets
+	// it, and writes with it afterwards
+	if err := s1.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	waitReencrypted(t, s1)
+	var v string
+	if _, err := s2.Get("did:example:a", &v); err != nil || v != "a" {
+		t.Fatalf("Get after a rotation by another process failed: %v %v", v, err)
+	}
+	if active := s2.Status().ActiveKey; active != s1.Status().ActiveKey {
+		t.Fatalf("Expected the active key of the rotation, got %v", active)
+	}
+}
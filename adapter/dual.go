@@ -0,0 +1,286 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ewangplay/serval/log"
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/util"
+)
+
+const (
+	dualLockStripe = 64
+	// dualReconcileEvery is the interval the failed secondary writes are retried at
+	dualReconcileEvery = 10 * time.Second
+)
+
+var logger = log.Module("store")
+
+// ErrDualStoreClosed is returned by the migration of a closed DualStore
+var ErrDualStoreClosed = errors.New("the dual write store is closed")
+
+// DualStore writes to a primary and a secondary store during the cutover
+// window of a migration. Reads are served by the primary store only.
+//
+// A write failing on the secondary store succeeds once the primary store
+// holds it: the key is queued, and copied again from the primary store
+// in the background until the secondary store takes it.
+type DualStore struct {
+	primary   gokv.Store
+	secondary gokv.Store
+	locks     [dualLockStripe]sync.Mutex
+
+	// checkpoint is the checkpoint file used by StartMigration
+	checkpoint string
+
+	mu        sync.Mutex
+	migrating bool
+	report    *MigrateReport
+	lastErr   error
+	// pending are the keys the secondary store is behind on
+	pending map[string]bool
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDualStore wraps the primary store, mirroring its writes to the secondary one
+func NewDualStore(primary, secondary gokv.Store) *DualStore {
+	s := &DualStore{
+		primary:   primary,
+		secondary: secondary,
+		pending:   make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.reconcileLoop()
+	return s
+}
+
+func (s *DualStore) lock(k string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return &s.locks[h.Sum32()%dualLockStripe]
+}
+
+// Set stores the value in both stores.
+func (s *DualStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := s.primary.Set(k, v); err != nil {
+		return err
+	}
+	if err := s.secondary.Set(k, v); err != nil {
+		s.queue(k, err)
+	}
+	return nil
+}
+
+// Get retrieves the value from the primary store.
+func (s *DualStore) Get(k string, v any) (found bool, err error) {
+	return s.primary.Get(k, v)
+}
+
+// Delete deletes the value from both stores.
+func (s *DualStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := s.primary.Delete(k); err != nil {
+		return err
+	}
+	if err := s.secondary.Delete(k); err != nil {
+		s.queue(k, err)
+	}
+	return nil
+}
+
+// Scan enumerates the keys of the primary store.
+func (s *DualStore) Scan(prefix string, fn func(k string) error) error {
+	return Scan(s.primary, prefix, fn)
+}
+
+// Close stops the migration and the reconciliation, then closes both stores.
+func (s *DualStore) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.stop)
+		s.mu.Unlock()
+	})
+	s.wg.Wait()
+
+	s.mu.Lock()
+	if n := len(s.pending); n > 0 {
+		logger.Warn("Closing with %v keys not written to the secondary store, verify the migration", n)
+	}
+	s.mu.Unlock()
+
+	err := s.primary.Close()
+	if err2 := s.secondary.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Unwrap returns the primary store
+func (s *DualStore) Unwrap() gokv.Store {
+	return s.primary
+}
+
+// Secondary returns the store the writes are mirrored to
+func (s *DualStore) Secondary() gokv.Store {
+	return s.secondary
+}
+
+// Pending returns the keys queued after a failed write to the secondary
+// store, sorted
+func (s *DualStore) Pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.pending))
+	for k := range s.pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reconcile copies the pending keys from the primary to the secondary store,
+// the keys failing again stay pending
+func (s *DualStore) Reconcile() error {
+	var err error
+	for _, k := range s.Pending() {
+		if err2 := s.sync(k); err2 != nil && err == nil {
+			err = fmt.Errorf("reconcile %v failed: %v", k, err2)
+		}
+	}
+	return err
+}
+
+// queue records a failed write to the secondary store. The caller must
+// hold the key lock.
+func (s *DualStore) queue(k string, err error) {
+	logger.Error("Write %v to the secondary store failed, queued for reconciliation: %v", k, err)
+	s.mu.Lock()
+	s.pending[k] = true
+	s.mu.Unlock()
+}
+
+func (s *DualStore) reconcileLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(dualReconcileEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Reconcile(); err != nil {
+				logger.Warn("%v", err)
+			}
+		}
+	}
+}
+
+// sync copies the value of k from the primary to the secondary store,
+// holding the key lock so it cannot overwrite a newer dual write
+func (s *DualStore) sync(k string) error {
+	l := s.lock(k)
+	l.Lock()
+	defer l.Unlock()
+	if err := copyKey(s.primary, s.secondary, k); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.pending, k)
+	s.mu.Unlock()
+	return nil
+}
+
+// StartMigration copies the records of the primary store to the secondary
+// store in the background, while the dual writes keep both in step
+func (s *DualStore) StartMigration(opts MigrateOptions) error {
+	if opts.Checkpoint == "" {
+		opts.Checkpoint = s.checkpoint
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+		return ErrDualStoreClosed
+	default:
+	}
+	if s.migrating {
+		return fmt.Errorf("a migration is already running")
+	}
+	s.migrating = true
+	s.report = &MigrateReport{}
+	s.lastErr = nil
+
+	// The migration stops at the next key once the store is closing, the
+	// checkpoint keeps its progress
+	opts.stop = s.stop
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		report, err := migrate(s.primary, s.secondary, opts, s.sync, func(r MigrateReport) {
+			s.mu.Lock()
+			*s.report = r
+			s.mu.Unlock()
+		})
+
+		s.mu.Lock()
+		if report != nil {
+			*s.report = *report
+		}
+		s.lastErr = err
+		s.migrating = false
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// MigrationStatus reports the progress of the last migration started by StartMigration
+func (s *DualStore) MigrationStatus() (report *MigrateReport, running bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report != nil {
+		r := *s.report
+		report = &r
+	}
+	return report, s.migrating, s.lastErr
+}
+
+func copyKey(src, dst gokv.Store, k string) error {
+	var raw json.RawMessage
+	found, err := src.Get(k, &raw)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return dst.Delete(k)
+	}
+	return dst.Set(k, raw)
+}
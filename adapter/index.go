@@ -0,0 +1,267 @@
+package adapter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/util"
+)
+
+const (
+	keyIndexHead     = "serval:index:keys"
+	keyIndexPage     = "serval:index:keys:%d"
+	keyIndexOwner    = "serval:index:owner"
+	keyIndexPageSize = 512
+	// keyIndexLease is how long the writes of a node keep the index its own
+	keyIndexLease = time.Minute
+)
+
+// ErrIndexOwned is returned when another node writes the key index
+var ErrIndexOwned = errors.New("the key index is written by another node")
+
+type keyIndexHeader struct {
+	Pages int `json:"pages"`
+}
+
+// keyIndexLeaseRecord names the node writing the index
+type keyIndexLeaseRecord struct {
+	Node    string    `json:"node"`
+	Updated time.Time `json:"updated"`
+}
+
+// IndexStore adds key enumeration to backends that cannot enumerate their
+// keys themselves, such as hlfabric. Every key written for the first time
+// is appended to an index kept in pages inside the backend, and removed
+// from it when deleted.
+//
+// The pages are updated by read-modify-write, so a single node may write
+// the index: a node takes a lease on the index with its writes, and the
+// writes of new keys on the other nodes fail with ErrIndexOwned until the
+// lease expires.
+type IndexStore struct {
+	store gokv.Store
+	node  string
+	now   func() time.Time
+
+	mu sync.Mutex
+	// pages and where are the index as loaded by the node owning it
+	loaded  bool
+	pages   [][]string
+	where   map[string]int
+	claimed time.Time
+}
+
+// NewIndexStore wraps the store with a key index
+func NewIndexStore(store gokv.Store) *IndexStore {
+	node := make([]byte, 8)
+	rand.Read(node)
+	return &IndexStore{store: store, node: hex.EncodeToString(node), now: time.Now}
+}
+
+// Set stores the value and records the key in the index.
+func (s *IndexStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.claim(); err != nil {
+		return err
+	}
+	if err := s.store.Set(k, v); err != nil {
+		return err
+	}
+	if _, ok := s.where[k]; ok {
+		return nil
+	}
+	return s.appendKey(k)
+}
+
+// Get retrieves the stored value for the given key.
+func (s *IndexStore) Get(k string, v any) (found bool, err error) {
+	return s.store.Get(k, v)
+}
+
+// Delete deletes the stored value for the given key, and its index entry.
+func (s *IndexStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.claim(); err != nil {
+		return err
+	}
+	if err := s.store.Delete(k); err != nil {
+		return err
+	}
+	return s.removeKey(k)
+}
+
+// Scan calls fn for every existing key with the given prefix, in ascending order.
+func (s *IndexStore) Scan(prefix string, fn func(k string) error) error {
+	pages, err := s.readPages()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, page := range pages {
+		for _, k := range page {
+			if !seen[k] && strings.HasPrefix(k, prefix) {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		// The entries of the keys deleted before they were pruned
+		exists, err := s.exists(k)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err = fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying store.
+func (s *IndexStore) Close() error {
+	return s.store.Close()
+}
+
+// Unwrap returns the underlying store
+func (s *IndexStore) Unwrap() gokv.Store {
+	return s.store
+}
+
+func (s *IndexStore) exists(k string) (bool, error) {
+	var raw json.RawMessage
+	return s.store.Get(k, &raw)
+}
+
+// claim takes or renews the lease of the node on the index, and loads the
+// index when another node wrote it since. The caller must hold s.mu.
+func (s *IndexStore) claim() error {
+	now := s.now()
+	if s.loaded && now.Sub(s.claimed) < keyIndexLease/4 {
+		return nil
+	}
+
+	var lease keyIndexLeaseRecord
+	if _, err := s.store.Get(keyIndexOwner, &lease); err != nil {
+		return err
+	}
+	if lease.Node != s.node && now.Sub(lease.Updated) < keyIndexLease {
+		return fmt.Errorf("%w: %v", ErrIndexOwned, lease.Node)
+	}
+	if lease.Node != s.node || !s.loaded {
+		if err := s.load(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.store.Set(keyIndexOwner, keyIndexLeaseRecord{Node: s.node, Updated: now}); err != nil {
+		return err
+	}
+	s.claimed = now
+	return nil
+}
+
+// load reads the index into memory. The caller must hold s.mu.
+func (s *IndexStore) load() error {
+	pages, err := s.readPages()
+	if err != nil {
+		return err
+	}
+	s.pages = pages
+	s.where = make(map[string]int)
+	for i, page := range pages {
+		for _, k := range page {
+			s.where[k] = i
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *IndexStore) readPages() ([][]string, error) {
+	var head keyIndexHeader
+	if _, err := s.store.Get(keyIndexHead, &head); err != nil {
+		return nil, err
+	}
+
+	pages := make([][]string, head.Pages)
+	for i := range pages {
+		if _, err := s.store.Get(fmt.Sprintf(keyIndexPage, i), &pages[i]); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// appendKey adds the key to the last page. The caller must hold s.mu.
+func (s *IndexStore) appendKey(k string) error {
+	last := len(s.pages) - 1
+	newPage := last < 0 || len(s.pages[last]) >= keyIndexPageSize
+	page := []string{k}
+	if newPage {
+		last++
+	} else {
+		page = append(append([]string(nil), s.pages[last]...), k)
+	}
+
+	if err := s.store.Set(fmt.Sprintf(keyIndexPage, last), page); err != nil {
+		return err
+	}
+	if newPage {
+		if err := s.store.Set(keyIndexHead, keyIndexHeader{Pages: last + 1}); err != nil {
+			return err
+		}
+		s.pages = append(s.pages, nil)
+	}
+	s.pages[last] = page
+	s.where[k] = last
+	return nil
+}
+
+// removeKey prunes the key from its page. The caller must hold s.mu.
+func (s *IndexStore) removeKey(k string) error {
+	i, ok := s.where[k]
+	if !ok {
+		return nil
+	}
+
+	page := make([]string, 0, len(s.pages[i]))
+	for _, key := range s.pages[i] {
+		if key != k {
+			page = append(page, key)
+		}
+	}
+	if err := s.store.Set(fmt.Sprintf(keyIndexPage, i), page); err != nil {
+		return err
+	}
+	s.pages[i] = page
+	delete(s.where, k)
+	return nil
+}
@@ -0,0 +1,211 @@
+package adapter
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "scrypt"
+	keystoreCipher  = "aes-256-gcm"
+)
+
+// scryptN is the CPU and memory cost of the key derivation, the tests lower it
+var scryptN = 1 << 15
+
+// Keystore is an application key encrypted with a key derived from a
+// passphrase by scrypt, the form written by `serval appkey`. The id, the
+// type and the public key are authenticated with the private key, so
+// they cannot be swapped without the passphrase.
+type Keystore struct {
+	Version      int            `json:"version"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	PublicKeyHex string         `json:"publicKeyHex"`
+	Crypto       keystoreCrypto `json:"crypto"`
+	// Retired are the former keys, newest first
+	Retired []RetiredKey `json:"retired,omitempty"`
+}
+
+type keystoreCrypto struct {
+	KDF        string       `json:"kdf"`
+	KDFParams  scryptParams `json:"kdfparams"`
+	Cipher     string       `json:"cipher"`
+	Nonce      string       `json:"nonce"`
+	Ciphertext string       `json:"ciphertext"`
+}
+
+type scryptParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+// NewKeystore encrypts the private key with the passphrase
+func NewKeystore(id, keyType string, privateKey, passphrase []byte) (*Keystore, error) {
+	keyType, err := parseKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newAppKey(id, keyType, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the passphrase is empty")
+	}
+
+	ks := &Keystore{
+		Version:      keystoreVersion,
+		ID:           id,
+		Type:         keyType,
+		PublicKeyHex: key.PublicKeyHex(),
+	}
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	params := scryptParams{N: scryptN, R: 8, P: 1, Salt: hex.EncodeToString(salt)}
+	aead, err := params.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ciphertext, err := seal(aead, privateKey, ks.additionalData())
+	if err != nil {
+		return nil, err
+	}
+	ks.Crypto = keystoreCrypto{
+		KDF:        keystoreKDF,
+		KDFParams:  params,
+		Cipher:     keystoreCipher,
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(ciphertext),
+	}
+	return ks, nil
+}
+
+// Decrypt returns the private key, it fails on a wrong passphrase
+func (ks *Keystore) Decrypt(passphrase []byte) ([]byte, error) {
+	if ks.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version: %d", ks.Version)
+	}
+	c := ks.Crypto
+	if c.KDF != keystoreKDF || c.Cipher != keystoreCipher {
+		return nil, fmt.Errorf("unsupported keystore crypto: %s and %s", c.KDF, c.Cipher)
+	}
+	aead, err := c.KDFParams.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("the keystore nonce is invalid")
+	}
+	ciphertext, err := hex.DecodeString(c.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("the keystore ciphertext is invalid")
+	}
+	privateKey, err := aead.Open(nil, nonce, ciphertext, ks.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("decrypt the keystore failed, wrong passphrase or a tampered file")
+	}
+	return privateKey, nil
+}
+
+// Rotate returns a keystore holding the new key, encrypted with the same
+// passphrase, where the current key is the newest retired key
+func (ks *Keystore) Rotate(id string, privateKey, passphrase []byte, now time.Time) (*Keystore, error) {
+	if id == ks.ID {
+		return nil, fmt.Errorf("the new key needs an id of its own, %v is taken", id)
+	}
+	for _, r := range ks.Retired {
+		if id == r.ID {
+			return nil, fmt.Errorf("the new key needs an id of its own, %v is retired", id)
+		}
+	}
+	// Check the passphrase before the current key is retired for good
+	if _, err := ks.Decrypt(passphrase); err != nil {
+		return nil, err
+	}
+
+	rotated, err := NewKeystore(id, ks.Type, privateKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	now = now.UTC()
+	rotated.Retired = append([]RetiredKey{{
+		ID:           ks.ID,
+		Type:         ks.Type,
+		PublicKeyHex: ks.PublicKeyHex,
+		Retired:      &now,
+	}}, ks.Retired...)
+	return rotated, nil
+}
+
+func (ks *Keystore) additionalData() []byte {
+	return []byte(strings.Join([]string{ks.ID, ks.Type, strings.ToLower(ks.PublicKeyHex)}, "\x00"))
+}
+
+func (p scryptParams) aead(passphrase []byte) (cipher.AEAD, error) {
+	salt, err := hex.DecodeString(p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("the keystore salt is invalid")
+	}
+	key, err := scrypt.Key(passphrase, salt, p.N, p.R, p.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive the keystore key failed: %v", err)
+	}
+	return newAEAD(key)
+}
+
+// ReadKeystore reads a keystore file
+func ReadKeystore(filename string) (*Keystore, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read the keystore failed: %v", err)
+	}
+	var ks Keystore
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, fmt.Errorf("parse the keystore %s failed: %v", filename, err)
+	}
+	return &ks, nil
+}
+
+// WriteKeystore writes the keystore file readable by its owner only. The
+// file is replaced atomically, a crash leaves either the old or the new one.
+func WriteKeystore(filename string, ks *Keystore) error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err = f.Write(append(data, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
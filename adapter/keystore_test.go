@@ -0,0 +1,197 @@
+package adapter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cl "github.com/ewangplay/cryptolib"
+)
+
+func init() {
+	// Keep the key derivation fast in the tests
+	scryptN = 1 << 10
+}
+
+func genPrivateKey(t *testing.T) []byte {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestKeystore(t *testing.T) {
+	priv := genPrivateKey(t)
+	passphrase := []byte("correct horse battery staple")
+	ks, err := NewKeystore("did:example:serval#keys-1", "Ed25519", priv, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Type != cl.ED25519 || ks.PublicKeyHex != hex.EncodeToString(priv[32:]) {
+		t.Fatalf("Unexpected keystore: %+v", ks)
+	}
+	if strings.Contains(ks.Crypto.Ciphertext, hex.EncodeToString(priv[:32])) {
+		t.Fatal("The keystore holds the private key in plaintext")
+	}
+
+	filename := filepath.Join(t.TempDir(), "appkey.json")
+	if err := WriteKeystore(filename, ks); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected keystore file: %v %v", fi, err)
+	}
+	ks, err = ReadKeystore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ks.Decrypt(passphrase)
+	if err != nil || hex.EncodeToString(got) != hex.EncodeToString(priv) {
+		t.Fatalf("Decrypt: %x %v", got, err)
+	}
+
+	if _, err := ks.Decrypt([]byte("wrong")); err == nil {
+		t.Fatal("Decrypt with a wrong passphrase should fail")
+	}
+
+	// The id is authenticated with the key
+	tampered := *ks
+	tampered.ID = "did:example:mallory#keys-1"
+	if _, err := tampered.Decrypt(passphrase); err == nil {
+		t.Fatal("Decrypt of a tampered keystore should fail")
+	}
+}
+
+func TestKeystoreRotate(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	ks, err := NewKeystore("did:example:serval#keys-1", cl.ED25519, genPrivateKey(t), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := genPrivateKey(t)
+	if _, err := ks.Rotate("did:example:serval#keys-2", next, []byte("wrong"), time.Now()); err == nil {
+		t.Fatal("Rotate with a wrong passphrase should fail")
+	}
+	if _, err := ks.Rotate(ks.ID, next, passphrase, time.Now()); err == nil {
+		t.Fatal("Rotate to the same id should fail")
+	}
+
+	rotated, err := ks.Rotate("did:example:serval#keys-2", next, passphrase, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID != "did:example:serval#keys-2" || len(rotated.Retired) != 1 {
+		t.Fatalf("Unexpected rotated keystore: %+v", rotated)
+	}
+	r := rotated.Retired[0]
+	if r.ID != ks.ID || r.PublicKeyHex != ks.PublicKeyHex || r.Retired == nil {
+		t.Fatalf("Unexpected retired key: %+v", r)
+	}
+	if _, err := rotated.Rotate(ks.ID, genPrivateKey(t), passphrase, time.Now()); err == nil {
+		t.Fatal("Rotate to a retired id should fail")
+	}
+}
+
+func TestKeystoreAppKey(t *testing.T) {
+	csp, err := InitCryptolib()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := "correct horse battery staple"
+	ks, err := NewKeystore("did:example:serval#keys-1", cl.ED25519, genPrivateKey(t), []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "appkey.json")
+	if err := WriteKeystore(filename, ks); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &AppKeyOptions{
+		Source:   AppKeySourceKeystore,
+		Keystore: KeystoreOptions{File: filename, PassphraseEnv: "SERVAL_TEST_PASSPHRASE"},
+	}
+	if _, err := InitAppKey(opts); err == nil || !strings.Contains(err.Error(), "SERVAL_TEST_PASSPHRASE is not set") {
+		t.Fatalf("Expected a missing passphrase error, got %v", err)
+	}
+	t.Setenv("SERVAL_TEST_PASSPHRASE", passphrase)
+	old, err := InitAppKey(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := old.Sign(csp, []byte("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The passphrase file takes precedence over the environment
+	os.WriteFile(filepath.Join(dir, "passphrase"), []byte(passphrase+"\n"), 0600)
+	t.Setenv("SERVAL_TEST_PASSPHRASE", "wrong")
+	opts.Keystore.PassphraseFile = filepath.Join(dir, "passphrase")
+
+	rotated, err := ks.Rotate("did:example:serval#keys-2", genPrivateKey(t), []byte(passphrase), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeystore(filename, rotated); err != nil {
+		t.Fatal(err)
+	}
+	key, err := InitAppKey(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != "did:example:serval#keys-2" || len(key.Retired) != 1 {
+		t.Fatalf("Unexpected key: %+v", key)
+	}
+
+	// The retired key still verifies what it signed, and only verifies
+	retired, ok := key.Lookup(old.ID, old.PublicKeyHex())
+	if !ok {
+		t.Fatal("The retired key is not found")
+	}
+	if valid, err := retired.Verify(csp, []byte("manifest"), signature); err != nil || !valid {
+		t.Fatalf("Verify with the retired key: %v %v", valid, err)
+	}
+	if _, err := retired.Sign(csp, []byte("manifest")); err == nil {
+		t.Fatal("Sign with a retired key should fail")
+	}
+	if _, ok := key.Lookup(old.ID, key.PublicKeyHex()); ok {
+		t.Fatal("Lookup should check the public key")
+	}
+}
+
+func TestAppKeyOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts AppKeyOptions
+		err  string
+	}{
+		{"unknown source", AppKeyOptions{Source: "vault"}, "unknown application key source"},
+		{"keystore without file", AppKeyOptions{Source: AppKeySourceKeystore}, "keystore.file is missing"},
+		{"keystore with plaintext", AppKeyOptions{Source: AppKeySourceKeystore, PrivateKeyHex: "00"}, "privateKeyHex must be empty"},
+		{"pkcs11 without token", AppKeyOptions{
+			Source: AppKeySourcePKCS11, ID: "did:example:serval#keys-1", Type: cl.ED25519,
+			PKCS11: PKCS11Options{Module: "libsofthsm2.so", KeyLabel: "serval"},
+		}, "pkcs11.tokenLabel is missing"},
+		{"retired without key", AppKeyOptions{
+			Source: AppKeySourceKeystore, Keystore: KeystoreOptions{File: "appkey.json"},
+			Retired: []RetiredKey{{ID: "did:example:serval#keys-0", Type: cl.ED25519}},
+		}, "retired[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Expected %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package adapter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/philippgille/gokv/encoding"
+	"github.com/philippgille/gokv/util"
+)
+
+// MemoryStore is a gokv.Store implementation that keeps all records in memory.
+// It is intended for unit tests and local development, nothing is persisted.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	data  map[string][]byte
+	codec encoding.Codec
+}
+
+// NewMemoryStore creates a new empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:  make(map[string][]byte),
+		codec: encoding.JSON,
+	}
+}
+
+// Set stores the given value for the given key.
+func (s *MemoryStore) Set(k string, v any) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.data[k] = data
+	s.mu.Unlock()
+	return nil
+}
+
+// Get retrieves the stored value for the given key.
+// If no value is found it returns (false, nil).
+func (s *MemoryStore) Get(k string, v any) (found bool, err error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	data, found := s.data[k]
+	s.mu.RUnlock()
+	if !found {
+		return false, nil
+	}
+
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Delete deletes the stored value for the given key.
+// Deleting a non-existing key does not lead to an error.
+func (s *MemoryStore) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.data, k)
+	s.mu.Unlock()
+	return nil
+}
+
+// Scan calls fn for every key with the given prefix, in ascending order.
+func (s *MemoryStore) Scan(prefix string, fn func(k string) error) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases all the records held by the store.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	s.data = make(map[string][]byte)
+	s.mu.Unlock()
+	return nil
+}
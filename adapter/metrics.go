@@ -0,0 +1,69 @@
+package adapter
+
+import (
+	"time"
+
+	"github.com/ewangplay/serval/metrics"
+	"github.com/philippgille/gokv"
+)
+
+// MetricsStore observes the latency and the failures of the operations
+// of a backend, labelled with the name of the backend
+type MetricsStore struct {
+	store   gokv.Store
+	backend string
+}
+
+// NewMetricsStore wraps the backend with the instrumentation
+func NewMetricsStore(store gokv.Store, backend string) *MetricsStore {
+	return &MetricsStore{store: store, backend: backend}
+}
+
+// Set stores the value in the backend.
+func (s *MetricsStore) Set(k string, v any) (err error) {
+	defer s.observe("set", time.Now(), &err)
+	return s.store.Set(k, v)
+}
+
+// Get retrieves the value from the backend.
+func (s *MetricsStore) Get(k string, v any) (found bool, err error) {
+	defer s.observe("get", time.Now(), &err)
+	return s.store.Get(k, v)
+}
+
+// Delete deletes the value from the backend.
+func (s *MetricsStore) Delete(k string) (err error) {
+	defer s.observe("delete", time.Now(), &err)
+	return s.store.Delete(k)
+}
+
+// Scan enumerates the keys of the backend.
+func (s *MetricsStore) Scan(prefix string, fn func(k string) error) (err error) {
+	// The errors returned by fn stop the scan, they are not failures of the backend
+	var fnErr error
+	start := time.Now()
+	err = Scan(s.store, prefix, func(k string) error {
+		fnErr = fn(k)
+		return fnErr
+	})
+	backendErr := err
+	if err == fnErr {
+		backendErr = nil
+	}
+	s.observe("scan", start, &backendErr)
+	return err
+}
+
+func (s *MetricsStore) observe(op string, start time.Time, err *error) {
+	metrics.ObserveStore(s.backend, op, start, *err)
+}
+
+// Close closes the backend.
+func (s *MetricsStore) Close() error {
+	return s.store.Close()
+}
+
+// Unwrap returns the backend
+func (s *MetricsStore) Unwrap() gokv.Store {
+	return s.store
+}
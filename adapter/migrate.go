@@ -0,0 +1,189 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/philippgille/gokv"
+)
+
+// MigrateOptions defines the options of a migration between two stores
+type MigrateOptions struct {
+	// Checkpoint is the file the progress is saved to, so an interrupted
+	// migration resumes where it stopped. Empty disables the checkpoints.
+	Checkpoint string
+	// CheckpointEvery is the number of keys copied between two checkpoints
+	CheckpointEvery int
+	// DryRun only reports the keys that would be copied
+	DryRun bool
+	// Verify compares every key of the source with the target instead of copying
+	Verify bool
+
+	// stop interrupts the migration when closed
+	stop <-chan struct{}
+}
+
+// MigrateReport summarizes a migration
+type MigrateReport struct {
+	Scanned    int       `json:"scanned"`
+	Copied     int       `json:"copied"`
+	Skipped    int       `json:"skipped"`
+	Missing    []string  `json:"missing,omitempty"`
+	Mismatched []string  `json:"mismatched,omitempty"`
+	ResumedAt  string    `json:"resumedAt,omitempty"`
+	LastKey    string    `json:"lastKey,omitempty"`
+	DryRun     bool      `json:"dryRun"`
+	Verify     bool      `json:"verify"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished,omitempty"`
+}
+
+// migrateCheckpoint is saved to the checkpoint file
+type migrateCheckpoint struct {
+	LastKey string    `json:"lastKey"`
+	Copied  int       `json:"copied"`
+	Updated time.Time `json:"updated"`
+}
+
+// Migrate copies every key of src to dst. Keys are copied in ascending
+// order, and with a checkpoint file an interrupted run resumes after the
+// last key it saved. In dry-run mode nothing is written, in verify mode
+// the stores are compared and the differences are reported.
+func Migrate(src, dst gokv.Store, opts MigrateOptions) (*MigrateReport, error) {
+	return migrate(src, dst, opts, func(k string) error {
+		return copyKey(src, dst, k)
+	}, nil)
+}
+
+func migrate(src, dst gokv.Store, opts MigrateOptions, copyFn func(k string) error, progress func(MigrateReport)) (*MigrateReport, error) {
+	if opts.CheckpointEvery <= 0 {
+		opts.CheckpointEvery = 100
+	}
+
+	report := &MigrateReport{
+		DryRun:  opts.DryRun,
+		Verify:  opts.Verify,
+		Started: time.Now(),
+	}
+
+	// Verifying and dry runs always walk the whole store
+	var cp migrateCheckpoint
+	useCheckpoint := opts.Checkpoint != "" && !opts.DryRun && !opts.Verify
+	if useCheckpoint {
+		if err := loadCheckpoint(opts.Checkpoint, &cp); err != nil {
+			return nil, err
+		}
+		report.ResumedAt = cp.LastKey
+		report.LastKey = cp.LastKey
+		report.Copied = cp.Copied
+	}
+
+	sinceCheckpoint := 0
+	err := Scan(src, "", func(k string) error {
+		select {
+		case <-opts.stop:
+			return ErrDualStoreClosed
+		default:
+		}
+
+		report.Scanned++
+		if cp.LastKey != "" && k <= cp.LastKey {
+			report.Skipped++
+			return nil
+		}
+
+		switch {
+		case opts.Verify || opts.DryRun:
+			same, found, err := compareKey(src, dst, k)
+			if err != nil {
+				return err
+			}
+			if !found {
+				report.Missing = append(report.Missing, k)
+			} else if !same {
+				report.Mismatched = append(report.Mismatched, k)
+			} else {
+				report.Skipped++
+			}
+		default:
+			if err := copyFn(k); err != nil {
+				return fmt.Errorf("copy %v failed: %v", k, err)
+			}
+			report.Copied++
+		}
+		report.LastKey = k
+
+		sinceCheckpoint++
+		if sinceCheckpoint >= opts.CheckpointEvery {
+			sinceCheckpoint = 0
+			if useCheckpoint {
+				if err := saveCheckpoint(opts.Checkpoint, report); err != nil {
+					return err
+				}
+			}
+			if progress != nil {
+				progress(*report)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if useCheckpoint {
+		if err = saveCheckpoint(opts.Checkpoint, report); err != nil {
+			return report, err
+		}
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// compareKey reports whether dst holds the same value as src for k
+func compareKey(src, dst gokv.Store, k string) (same bool, found bool, err error) {
+	var a, b any
+	if _, err = src.Get(k, &a); err != nil {
+		return
+	}
+	found, err = dst.Get(k, &b)
+	if err != nil || !found {
+		return
+	}
+	return reflect.DeepEqual(a, b), true, nil
+}
+
+func loadCheckpoint(filename string, cp *migrateCheckpoint) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read the checkpoint failed: %v", err)
+	}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return fmt.Errorf("parse the checkpoint failed: %v", err)
+	}
+	return nil
+}
+
+func saveCheckpoint(filename string, report *MigrateReport) error {
+	data, err := json.Marshal(migrateCheckpoint{
+		LastKey: report.LastKey,
+		Copied:  report.Copied,
+		Updated: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first, so a crash never leaves a torn checkpoint
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write the checkpoint failed: %v", err)
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,254 @@
+package adapter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter/storetest"
+	"github.com/ewangplay/serval/log"
+	"github.com/philippgille/gokv"
+)
+
+func fillStore(t *testing.T, s gokv.Store, n int) {
+	for i := 0; i < n; i++ {
+		if err := s.Set(fmt.Sprintf("did:example:%03d", i), map[string]any{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDualStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		return NewDualStore(NewMemoryStore(), NewMemoryStore())
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	src, dst := NewMemoryStore(), NewMemoryStore()
+	fillStore(t, src, 10)
+
+	report, err := Migrate(src, dst, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 0 || len(report.Missing) != 10 || len(dst.data) != 0 {
+		t.Fatalf("Dry run should not write: %+v", report)
+	}
+
+	if report, err = Migrate(src, dst, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 10 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	dst.Set("did:example:003", map[string]any{"n": -1})
+	if report, err = Migrate(src, dst, MigrateOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 0 || len(report.Mismatched) != 1 || report.Mismatched[0] != "did:example:003" {
+		t.Fatalf("Unexpected verify report: %+v", report)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	src, dst := NewMemoryStore(), NewMemoryStore()
+	fillStore(t, src, 10)
+
+	// Pretend an earlier run stopped after the fourth key
+	checkpoint := filepath.Join(t.TempDir(), "migrate.checkpoint")
+	err := os.WriteFile(checkpoint, []byte(`{"lastKey":"did:example:003","copied":4}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(src, dst, MigrateOptions{Checkpoint: checkpoint, CheckpointEvery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ResumedAt != "did:example:003" || report.Skipped != 4 || report.Copied != 10 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if found, _ := dst.Get("did:example:003", new(any)); found {
+		t.Fatal("Keys before the checkpoint should not be copied again")
+	}
+	if found, _ := dst.Get("did:example:009", new(any)); !found {
+		t.Fatal("Keys after the checkpoint should be copied")
+	}
+
+	var cp migrateCheckpoint
+	if err = loadCheckpoint(checkpoint, &cp); err != nil || cp.LastKey != "did:example:009" {
+		t.Fatalf("Unexpected checkpoint: %+v %v", cp, err)
+	}
+}
+
+func TestDualStoreMigration(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+	fillStore(t, primary, 50)
+	ds := NewDualStore(primary, secondary)
+
+	if err := ds.StartMigration(MigrateOptions{CheckpointEvery: 5}); err != nil {
+		t.Fatal(err)
+	}
+	// Writes during the migration reach both stores
+	fillStore(t, ds, 60)
+	ds.Delete("did:example:000")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, running, err := ds.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Migration did not finish in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	report, err := Migrate(primary, secondary, MigrateOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 59 || len(report.Missing) != 0 || len(report.Mismatched) != 0 {
+		t.Fatalf("Stores differ after the migration: %+v", report)
+	}
+	if found, _ := secondary.Get("did:example:000", new(any)); found {
+		t.Fatal("Deleted key should not be copied back")
+	}
+}
+
+// flakyStore fails the writes while err is set, and runs onSet before them
+type flakyStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	err   error
+	onSet func()
+}
+
+func (s *flakyStore) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *flakyStore) Set(k string, v any) error {
+	if s.onSet != nil {
+		s.onSet()
+	}
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.MemoryStore.Set(k, v)
+}
+
+func (s *flakyStore) Delete(k string) error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.MemoryStore.Delete(k)
+}
+
+func TestDualStoreReconcile(t *testing.T) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	primary, secondary := NewMemoryStore(), &flakyStore{MemoryStore: NewMemoryStore()}
+	ds := NewDualStore(primary, secondary)
+	defer ds.Close()
+
+	fillStore(t, ds, 3)
+	secondary.fail(errors.New("unavailable"))
+	// The writes succeed on the primary store alone
+	if err := ds.Set("did:example:000", map[string]any{"n": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Delete("did:example:001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Set("did:example:003", map[string]any{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"did:example:000", "did:example:001", "did:example:003"}
+	if got := ds.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v pending, got %v", want, got)
+	}
+	if err := ds.Reconcile(); err == nil {
+		t.Fatal("Reconcile should fail while the secondary store does")
+	}
+	if got := ds.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v still pending, got %v", want, got)
+	}
+
+	secondary.fail(nil)
+	if err := ds.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Pending(); len(got) != 0 {
+		t.Fatalf("Expected nothing pending, got %v", got)
+	}
+	report, err := Migrate(primary, secondary, MigrateOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 3 || len(report.Missing) != 0 || len(report.Mismatched) != 0 {
+		t.Fatalf("Stores differ after the reconciliation: %+v", report)
+	}
+	if found, _ := secondary.Get("did:example:001", new(any)); found {
+		t.Fatal("The failed delete should be reconciled")
+	}
+}
+
+func TestDualStoreCloseStopsMigration(t *testing.T) {
+	primary := NewMemoryStore()
+	fillStore(t, primary, 200)
+	secondary := &flakyStore{MemoryStore: NewMemoryStore(), onSet: func() {
+		time.Sleep(time.Millisecond)
+	}}
+	ds := NewDualStore(primary, secondary)
+
+	if err := ds.StartMigration(MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() {
+		closed <- ds.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close should stop the migration")
+	}
+
+	report, running, err := ds.MigrationStatus()
+	if running || !errors.Is(err, ErrDualStoreClosed) {
+		t.Fatalf("Expected the migration stopped, got running %v, %v", running, err)
+	}
+	if report.Copied == 0 || report.Copied == 200 {
+		t.Fatalf("Expected a partial copy, got %+v", report)
+	}
+	if err = ds.StartMigration(MigrateOptions{}); !errors.Is(err, ErrDualStoreClosed) {
+		t.Fatalf("Expected %v, got %v", ErrDualStoreClosed, err)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build pkcs11
+
+package adapter
+
+// The PKCS#11 source links the token library through cgo, so it is left
+// out of the default build. Build it with:
+//
+//	go get github.com/miekg/pkcs11
+//	go build -tags pkcs11
+//
+// The key pair is an Ed25519 key (CKK_EC_EDWARDS) labeled KeyLabel, like
+// the one generated by scripts/softhsm.sh. The digest is signed with
+// CKM_EDDSA, which gives the same signature as the keys of the config.
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"sync"
+
+	cl "github.com/ewangplay/cryptolib"
+	"github.com/miekg/pkcs11"
+)
+
+func initPKCS11Key(opts *AppKeyOptions) (*AppKey, error) {
+	pin, err := ReadSecret(opts.PKCS11.PINFile, opts.PKCS11.PINEnv, DefaultPINEnv)
+	if err != nil {
+		return nil, fmt.Errorf("read the PKCS#11 PIN failed: %v", err)
+	}
+	keyType, err := parseKeyType(opts.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openPKCS11(&opts.PKCS11, string(pin))
+	if err != nil {
+		return nil, err
+	}
+	pubKeyBytes, err := s.publicKey()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &AppKey{
+		ID:        opts.ID,
+		Type:      keyType,
+		PublicKey: &cl.Ed25519PublicKey{PubKey: pubKeyBytes},
+		signer:    s,
+	}, nil
+}
+
+// pkcs11Signer signs with the private key of the token, a session runs one
+// operation at a time
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	label   string
+	key     pkcs11.ObjectHandle
+}
+
+func openPKCS11(opts *PKCS11Options, pin string) (s *pkcs11Signer, err error) {
+	p := pkcs11.New(opts.Module)
+	if p == nil {
+		return nil, fmt.Errorf("load the PKCS#11 module %s failed", opts.Module)
+	}
+	if err := p.Initialize(); err != nil {
+		p.Destroy()
+		return nil, fmt.Errorf("initialize the PKCS#11 module failed: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			p.Finalize()
+			p.Destroy()
+		}
+	}()
+
+	slot, err := findSlot(p, opts.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("open the PKCS#11 session failed: %v", err)
+	}
+	if err := p.Login(session, pkcs11.CKU_USER, pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		p.CloseSession(session)
+		return nil, fmt.Errorf("log in the PKCS#11 token failed: %v", err)
+	}
+
+	s = &pkcs11Signer{ctx: p, session: session, label: opts.KeyLabel}
+	s.key, err = s.find(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		p.Logout(session)
+		p.CloseSession(session)
+		return nil, err
+	}
+	return s, nil
+}
+
+func findSlot(p *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("list the PKCS#11 slots failed: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(info.Label) == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("the PKCS#11 token %q is not found", label)
+}
+
+func (s *pkcs11Signer) find(class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.label),
+	}
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, fmt.Errorf("find the PKCS#11 key failed: %v", err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 1)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, fmt.Errorf("find the PKCS#11 key failed: %v", err)
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("the PKCS#11 key %q is not found", s.label)
+	}
+	return objs[0], nil
+}
+
+// publicKey reads the Ed25519 public key, some tokens wrap the point in a
+// DER octet string
+func (s *pkcs11Signer) publicKey() ([]byte, error) {
+	obj, err := s.find(pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil || len(attrs) == 0 {
+		return nil, fmt.Errorf("read the PKCS#11 public key failed: %v", err)
+	}
+	point := attrs[0].Value
+	if len(point) == ed25519.PublicKeySize+2 && point[0] == 0x04 && int(point[1]) == ed25519.PublicKeySize {
+		point = point[2:]
+	}
+	if len(point) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("the PKCS#11 key %q is not an Ed25519 key", s.label)
+	}
+	return point, nil
+}
+
+func (s *pkcs11Signer) Sign(digest []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EDDSA, nil)}
+	if err := s.ctx.SignInit(s.session, mech, s.key); err != nil {
+		return nil, fmt.Errorf("sign with the PKCS#11 key failed: %v", err)
+	}
+	signature, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("sign with the PKCS#11 key failed: %v", err)
+	}
+	return signature, nil
+}
+
+func (s *pkcs11Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx.Logout(s.session)
+	err := s.ctx.CloseSession(s.session)
+	s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
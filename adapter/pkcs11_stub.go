@@ -0,0 +1,11 @@
+//go:build !pkcs11
+
+package adapter
+
+import "fmt"
+
+// initPKCS11Key fails in the default build, which does not link the
+// PKCS#11 library, see pkcs11.go
+func initPKCS11Key(opts *AppKeyOptions) (*AppKey, error) {
+	return nil, fmt.Errorf("the pkcs11 application key source needs a build with -tags pkcs11")
+}
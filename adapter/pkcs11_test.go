@@ -0,0 +1,44 @@
+//go:build pkcs11
+
+package adapter
+
+import (
+	"os"
+	"testing"
+
+	cl "github.com/ewangplay/cryptolib"
+)
+
+// TestPKCS11AppKey runs against the token made by scripts/softhsm.sh
+func TestPKCS11AppKey(t *testing.T) {
+	module := os.Getenv("SERVAL_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("SERVAL_TEST_PKCS11_MODULE is not set, see scripts/softhsm.sh")
+	}
+	csp, err := InitCryptolib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := InitAppKey(&AppKeyOptions{
+		Source: AppKeySourcePKCS11,
+		ID:     "did:example:serval#keys-1",
+		Type:   cl.ED25519,
+		PKCS11: PKCS11Options{
+			Module:     module,
+			TokenLabel: os.Getenv("SERVAL_TEST_PKCS11_TOKEN"),
+			KeyLabel:   os.Getenv("SERVAL_TEST_PKCS11_KEY"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+
+	if key.PrivateKey != nil {
+		t.Fatal("The private key left the token")
+	}
+	if err := ProbeCSP(csp, key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package adapter
+
+import (
+	"fmt"
+
+	cl "github.com/ewangplay/cryptolib"
+	"github.com/philippgille/gokv"
+)
+
+// probeKey is read by the readiness probe, it is never written
+const probeKey = "serval:probe"
+
+// ProbeStore reads a key from the backend under the wrappers of the store,
+// a Badger read or a Fabric query, to check it answers
+func ProbeStore(store gokv.Store) error {
+	for {
+		u, ok := store.(Unwrapper)
+		if !ok {
+			break
+		}
+		store = u.Unwrap()
+	}
+	var v struct{}
+	_, err := store.Get(probeKey, &v)
+	return err
+}
+
+// ProbeCSP signs and verifies a message with the application key, to check
+// the crypto service provider works
+func ProbeCSP(csp cl.CSP, key *AppKey) error {
+	data := []byte(probeKey)
+	signature, err := key.Sign(csp, data)
+	if err != nil {
+		return fmt.Errorf("sign failed: %v", err)
+	}
+	valid, err := key.Verify(csp, data, signature)
+	if err != nil {
+		return fmt.Errorf("verify failed: %v", err)
+	}
+	if !valid {
+		return fmt.Errorf("the signature does not verify")
+	}
+	return nil
+}
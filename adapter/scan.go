@@ -0,0 +1,23 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/philippgille/gokv"
+)
+
+// Scanner is implemented by stores that can enumerate their keys
+type Scanner interface {
+	// Scan calls fn for every key with the given prefix, in ascending order.
+	// Scanning stops at the first error returned by fn.
+	Scan(prefix string, fn func(k string) error) error
+}
+
+// Scan enumerates the keys of the store with the given prefix
+func Scan(store gokv.Store, prefix string, fn func(k string) error) error {
+	s, ok := store.(Scanner)
+	if !ok {
+		return fmt.Errorf("store %T does not support scanning", store)
+	}
+	return s.Scan(prefix, fn)
+}
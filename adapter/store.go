@@ -9,20 +9,62 @@ import (
 )
 
 type StoreOptions struct {
-	Backend  string
-	Badgerdb *badgerdb.Options
-	Hlfabric *hlfabric.Options
+	Backend    string
+	Badgerdb   *badgerdb.Options
+	Hlfabric   *hlfabric.Options
+	Cache      *CacheOptions
+	Encryption *CryptOptions
+	// KeyIndex indexes the keys of the backends that cannot enumerate them,
+	// hlfabric, for the features scanning the store. A single node may
+	// write an indexed store.
+	KeyIndex bool
+	// DualWrite mirrors every write to a second store during a migration
+	DualWrite *StoreOptions
+	// MigrationCheckpoint is the checkpoint file of the online migration
+	MigrationCheckpoint string
 }
 
-// InitStore initializes the store instance with singleton mode
-func InitStore(opts *StoreOptions) (store gokv.Store, err error) {
+// Unwrapper is implemented by stores wrapping another store
+type Unwrapper interface {
+	Unwrap() gokv.Store
+}
+
+// Find walks down the chain of wrapped stores and returns the first one of type T
+func Find[T gokv.Store](store gokv.Store) (T, bool) {
+	for store != nil {
+		if t, ok := store.(T); ok {
+			return t, true
+		}
+		u, ok := store.(Unwrapper)
+		if !ok {
+			break
+		}
+		store = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// InitStore initializes the store instance with singleton mode, its calls
+// are traced once bound to a context by WithContext
+func InitStore(opts *StoreOptions) (gokv.Store, error) {
+	store, err := initStore(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewTracingStore(store, opts.Backend), nil
+}
+
+func initStore(opts *StoreOptions) (store gokv.Store, err error) {
 	switch opts.Backend {
+	case "memory":
+		store = NewMemoryStore()
 	case "badgerdb":
 		if opts.Badgerdb == nil {
 			return nil, fmt.Errorf("badgerdb backend options invalid")
 		}
 		fmt.Println("badger options:", *opts.Badgerdb)
-		store, err = badgerdb.NewStore(*opts.Badgerdb)
+		store, err = NewBadgerStore(*opts.Badgerdb)
 	case "hlfabric":
 		if opts.Hlfabric == nil {
 			return nil, fmt.Errorf("hlfabric backend options invalid")
@@ -32,6 +74,41 @@ func InitStore(opts *StoreOptions) (store gokv.Store, err error) {
 	default:
 		err = fmt.Errorf("backend not supported: %v", opts.Backend)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Backends that cannot enumerate their keys get an index maintained
+	// in the store when asked, it costs writes to the backend
+	_, scans := store.(Scanner)
+	store = NewMetricsStore(store, opts.Backend)
+	if !scans && opts.KeyIndex {
+		store = NewIndexStore(store)
+	}
+
+	if opts.Encryption != nil {
+		cs, err := NewCryptStore(store, *opts.Encryption)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("init encryption at rest failed: %v", err)
+		}
+		store = cs
+	}
+
+	if opts.DualWrite != nil {
+		secondary, err := initStore(opts.DualWrite)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("init the dual write store failed: %v", err)
+		}
+		ds := NewDualStore(store, secondary)
+		ds.checkpoint = opts.MigrationCheckpoint
+		store = ds
+	}
+
+	if opts.Cache != nil && opts.Cache.Size > 0 {
+		store = NewCacheStore(store, *opts.Cache)
+	}
 
-	return
+	return store, nil
 }
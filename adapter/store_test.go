@@ -0,0 +1,89 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter/storetest"
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/badgerdb"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		s, err := InitStore(&StoreOptions{Backend: "memory"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestBadgerdbStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		s, err := InitStore(&StoreOptions{
+			Backend:  "badgerdb",
+			Badgerdb: &badgerdb.Options{Dir: t.TempDir()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestInitStoreUnsupported(t *testing.T) {
+	_, err := InitStore(&StoreOptions{Backend: "unknown"})
+	if err == nil {
+		t.Fatal("InitStore should fail with an unsupported backend")
+	}
+}
+
+// scanless hides Scan of the memory store, like backends that cannot enumerate keys
+type scanless struct {
+	s *MemoryStore
+}
+
+func (s scanless) Set(k string, v any) error         { return s.s.Set(k, v) }
+func (s scanless) Get(k string, v any) (bool, error) { return s.s.Get(k, v) }
+func (s scanless) Delete(k string) error             { return s.s.Delete(k) }
+func (s scanless) Close() error                      { return s.s.Close() }
+
+func TestIndexStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) gokv.Store {
+		return NewIndexStore(scanless{NewMemoryStore()})
+	})
+}
+
+func TestIndexStoreSingleWriter(t *testing.T) {
+	backend := scanless{NewMemoryStore()}
+	a, b := NewIndexStore(backend), NewIndexStore(backend)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	b.now = func() time.Time { return now }
+
+	if err := a.Set("did:example:1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// The other node cannot write the index while the lease runs
+	if err := b.Set("did:example:2", "2"); !errors.Is(err, ErrIndexOwned) {
+		t.Fatalf("Expected ErrIndexOwned, got %v", err)
+	}
+
+	// It takes over once the lease expired, with the keys of the first node
+	now = now.Add(keyIndexLease)
+	if err := b.Set("did:example:2", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("did:example:1"); err != nil {
+		t.Fatal(err)
+	}
+	var page []string
+	backend.Get(fmt.Sprintf(keyIndexPage, 0), &page)
+	if strings.Join(page, ",") != "did:example:2" {
+		t.Fatalf("Expected the deleted key to be pruned from the index, got %v", page)
+	}
+}
@@ -0,0 +1,282 @@
+// Package storetest provides a conformance suite that every gokv.Store
+// backend used by serval must pass.
+package storetest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/philippgille/gokv"
+)
+
+// Record is the value type written by the conformance suite
+type Record struct {
+	ID      string            `json:"id"`
+	Version int               `json:"version"`
+	Labels  []string          `json:"labels"`
+	Attrs   map[string]string `json:"attrs"`
+}
+
+func newRecord(id string, version int) Record {
+	return Record{
+		ID:      id,
+		Version: version,
+		Labels:  []string{"serval", fmt.Sprintf("v%d", version)},
+		Attrs:   map[string]string{"writer": fmt.Sprintf("%s-%d", id, version)},
+	}
+}
+
+func (r Record) equal(o Record) bool {
+	if r.ID != o.ID || r.Version != o.Version {
+		return false
+	}
+	if len(r.Labels) != len(o.Labels) || len(r.Attrs) != len(o.Attrs) {
+		return false
+	}
+	for i := range r.Labels {
+		if r.Labels[i] != o.Labels[i] {
+			return false
+		}
+	}
+	for k, v := range r.Attrs {
+		if o.Attrs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs the whole conformance suite against the store returned by newStore.
+// A fresh store is requested for every case and closed when the case is done.
+func Run(t *testing.T, newStore func(t *testing.T) gokv.Store) {
+	cases := []struct {
+		name string
+		fn   func(t *testing.T, s gokv.Store)
+	}{
+		{"SetGet", testSetGet},
+		{"GetMissing", testGetMissing},
+		{"Delete", testDelete},
+		{"InvalidArgs", testInvalidArgs},
+		{"Conflicts", testConflicts},
+		{"History", testHistory},
+		{"Scan", testScan},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := newStore(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close the store failed: %v", err)
+				}
+			}()
+			c.fn(t, s)
+		})
+	}
+}
+
+func mustGet(t *testing.T, s gokv.Store, k string) (Record, bool) {
+	t.Helper()
+	var r Record
+	found, err := s.Get(k, &r)
+	if err != nil {
+		t.Fatalf("Get %v failed: %v", k, err)
+	}
+	return r, found
+}
+
+func testSetGet(t *testing.T, s gokv.Store) {
+	want := newRecord("did:example:setget", 1)
+	if err := s.Set(want.ID, want); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	got, found := mustGet(t, s, want.ID)
+	if !found {
+		t.Fatalf("Record %v should be found", want.ID)
+	}
+	if !got.equal(want) {
+		t.Fatalf("Record mismatch: got %+v, want %+v", got, want)
+	}
+
+	// Pointer values must be accepted as well
+	want = newRecord("did:example:pointer", 1)
+	if err := s.Set(want.ID, &want); err != nil {
+		t.Fatalf("Set pointer failed: %v", err)
+	}
+	got, found = mustGet(t, s, want.ID)
+	if !found || !got.equal(want) {
+		t.Fatalf("Record mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func testGetMissing(t *testing.T, s gokv.Store) {
+	_, found := mustGet(t, s, "did:example:missing")
+	if found {
+		t.Fatal("Missing record should not be found")
+	}
+}
+
+func testDelete(t *testing.T, s gokv.Store) {
+	r := newRecord("did:example:delete", 1)
+	if err := s.Set(r.ID, r); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := s.Delete(r.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, found := mustGet(t, s, r.ID); found {
+		t.Fatal("Deleted record should not be found")
+	}
+
+	// Deleting a non-existing key must not fail
+	if err := s.Delete("did:example:never-written"); err != nil {
+		t.Fatalf("Delete a non-existing key failed: %v", err)
+	}
+}
+
+func testInvalidArgs(t *testing.T, s gokv.Store) {
+	r := newRecord("did:example:invalid", 1)
+	if err := s.Set("", r); err == nil {
+		t.Error("Set with an empty key should fail")
+	}
+	if err := s.Set(r.ID, nil); err == nil {
+		t.Error("Set with a nil value should fail")
+	}
+	if _, err := s.Get("", &r); err == nil {
+		t.Error("Get with an empty key should fail")
+	}
+	if _, err := s.Get(r.ID, nil); err == nil {
+		t.Error("Get with a nil pointer should fail")
+	}
+	if err := s.Delete(""); err == nil {
+		t.Error("Delete with an empty key should fail")
+	}
+}
+
+// testConflicts has several writers race on the same key. Whichever write
+// wins, the stored value must be one of the written records in full.
+func testConflicts(t *testing.T, s gokv.Store) {
+	const writers = 8
+	const key = "did:example:conflict"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(version int) {
+			defer wg.Done()
+			errs <- s.Set(key, newRecord(key, version))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Concurrent Set failed: %v", err)
+		}
+	}
+
+	got, found := mustGet(t, s, key)
+	if !found {
+		t.Fatal("Record should be found after concurrent writes")
+	}
+	if got.Version < 1 || got.Version > writers || !got.equal(newRecord(key, got.Version)) {
+		t.Fatalf("Record is not one of the written values: %+v", got)
+	}
+
+	// A later write always supersedes the winner of the race
+	last := newRecord(key, writers+1)
+	if err := s.Set(key, last); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	got, _ = mustGet(t, s, key)
+	if !got.equal(last) {
+		t.Fatalf("Last write should win: got %+v, want %+v", got, last)
+	}
+}
+
+// testHistory walks a key through a sequence of writes and deletes and
+// checks that every read observes the latest state.
+func testHistory(t *testing.T, s gokv.Store) {
+	const key = "did:example:history"
+
+	steps := []struct {
+		version int // 0 means delete
+	}{
+		{1}, {2}, {0}, {3}, {4}, {0}, {0}, {5},
+	}
+	for i, step := range steps {
+		if step.version == 0 {
+			if err := s.Delete(key); err != nil {
+				t.Fatalf("Step %d: Delete failed: %v", i, err)
+			}
+			if _, found := mustGet(t, s, key); found {
+				t.Fatalf("Step %d: record should be gone", i)
+			}
+			continue
+		}
+
+		want := newRecord(key, step.version)
+		if err := s.Set(key, want); err != nil {
+			t.Fatalf("Step %d: Set failed: %v", i, err)
+		}
+		got, found := mustGet(t, s, key)
+		if !found || !got.equal(want) {
+			t.Fatalf("Step %d: got %+v, want %+v", i, got, want)
+		}
+	}
+
+	// Keys sharing a prefix must not affect each other
+	other := newRecord(key+"-other", 1)
+	if err := s.Set(other.ID, other); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	got, found := mustGet(t, s, other.ID)
+	if !found || !got.equal(other) {
+		t.Fatalf("Neighbour record changed: got %+v, want %+v", got, other)
+	}
+}
+
+// testScan checks key enumeration on stores that support it
+func testScan(t *testing.T, s gokv.Store) {
+	scanner, ok := s.(interface {
+		Scan(prefix string, fn func(k string) error) error
+	})
+	if !ok {
+		t.Skip("store does not support scanning")
+	}
+
+	want := []string{"did:example:scan-1", "did:example:scan-2", "did:example:scan-3"}
+	for _, k := range append([]string{"did:other:scan", "did:example:scan-gone"}, want...) {
+		if err := s.Set(k, newRecord(k, 1)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := s.Delete("did:example:scan-gone"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// Overwriting must not list a key twice
+	if err := s.Set(want[0], newRecord(want[0], 2)); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	var got []string
+	err := scanner.Scan("did:example:", func(k string) error {
+		got = append(got, k)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if !sort.StringsAreSorted(got) || strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Scan mismatch: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package adapter
+
+import (
+	"context"
+
+	"github.com/philippgille/gokv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/ewangplay/serval/adapter")
+
+// TracingStore traces every call to the store. gokv.Store has no context,
+// so the calls are children of the span of the context bound by WithContext.
+type TracingStore struct {
+	store   gokv.Store
+	backend string
+	ctx     context.Context
+}
+
+// NewTracingStore wraps the store with the tracing of its calls
+func NewTracingStore(store gokv.Store, backend string) *TracingStore {
+	return &TracingStore{store: store, backend: backend, ctx: context.Background()}
+}
+
+// WithContext returns the store tracing its calls as children of the span
+// of ctx, the stores that are not traced are returned as is
+func WithContext(store gokv.Store, ctx context.Context) gokv.Store {
+	s, ok := store.(*TracingStore)
+	if !ok {
+		return store
+	}
+	return &TracingStore{store: s.store, backend: s.backend, ctx: ctx}
+}
+
+func (s *TracingStore) start(op, k string) trace.Span {
+	_, span := tracer.Start(s.ctx, "store."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(s.backend),
+			semconv.DBOperationKey.String(op),
+			attribute.String("serval.store.key", k),
+		),
+	)
+	return span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Set stores the value in the store.
+func (s *TracingStore) Set(k string, v any) (err error) {
+	span := s.start("set", k)
+	defer func() { endSpan(span, err) }()
+	return s.store.Set(k, v)
+}
+
+// Get retrieves the value from the store.
+func (s *TracingStore) Get(k string, v any) (found bool, err error) {
+	span := s.start("get", k)
+	defer func() {
+		span.SetAttributes(attribute.Bool("serval.store.found", found))
+		endSpan(span, err)
+	}()
+	return s.store.Get(k, v)
+}
+
+// GetVerified retrieves the value like GetVerified of the store, the span
+// lasts until the value loaded from the backend is verified.
+func (s *TracingStore) GetVerified(k string, v any, verify func() error) (found bool, err error) {
+	span := s.start("get", k)
+	defer func() {
+		span.SetAttributes(attribute.Bool("serval.store.found", found))
+		endSpan(span, err)
+	}()
+	return GetVerified(s.store, k, v, verify)
+}
+
+// Delete deletes the value from the store.
+func (s *TracingStore) Delete(k string) (err error) {
+	span := s.start("delete", k)
+	defer func() { endSpan(span, err) }()
+	return s.store.Delete(k)
+}
+
+// Scan enumerates the keys of the store.
+func (s *TracingStore) Scan(prefix string, fn func(k string) error) (err error) {
+	span := s.start("scan", prefix)
+	defer func() { endSpan(span, err) }()
+	return Scan(s.store, prefix, fn)
+}
+
+// Close closes the store.
+func (s *TracingStore) Close() error {
+	return s.store.Close()
+}
+
+// Unwrap returns the traced store
+func (s *TracingStore) Unwrap() gokv.Store {
+	return s.store
+}
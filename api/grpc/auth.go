@@ -0,0 +1,124 @@
+package grpc
+
+import (
+	"context"
+
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/idempotency"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var logger = log.Module("grpc")
+
+// methodActions are the actions of the RPCs, the service checks the DIDs
+// against the namespaces of the policies
+var methodActions = map[string]auth.Action{
+	"/serval.v1.DidService/CreateDid":   auth.ActionCreate,
+	"/serval.v1.DidService/ResolveDid":  auth.ActionRead,
+	"/serval.v1.DidService/UpdateDid":   auth.ActionUpdate,
+	"/serval.v1.DidService/RevokeDid":   auth.ActionRevoke,
+	"/serval.v1.DidService/WatchEvents": auth.ActionRead,
+}
+
+// ServerOptions returns the interceptors authenticating the calls with the
+// guard, limiting their rate with the limiter, then replaying the writes
+// kept by the keeper, none when all of them are nil
+func ServerOptions(guard *auth.Guard, limiter *ratelimit.Limiter, keeper *idempotency.Keeper) []grpc.ServerOption {
+	var (
+		unary  []grpc.UnaryServerInterceptor
+		stream []grpc.StreamServerInterceptor
+	)
+	if guard != nil {
+		unary = append(unary, unaryInterceptor(guard))
+		stream = append(stream, streamInterceptor(guard))
+	}
+	if limiter != nil {
+		unary = append(unary, unaryLimiter(limiter))
+		stream = append(stream, streamLimiter(limiter))
+	}
+	if keeper != nil {
+		unary = append(unary, unaryIdempotent(keeper))
+	}
+	var opts []grpc.ServerOption
+	if len(unary) > 0 {
+		opts = append(opts, grpc.ChainUnaryInterceptor(unary...))
+	}
+	if len(stream) > 0 {
+		opts = append(opts, grpc.ChainStreamInterceptor(stream...))
+	}
+	return opts
+}
+
+func unaryInterceptor(guard *auth.Guard) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticate(ctx, guard, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamInterceptor(guard *auth.Guard) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), guard, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authStream passes the principal to the stream handlers
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate identifies the caller from the metadata and the TLS client
+// certificate, and checks a policy grants it the action of the method
+func authenticate(ctx context.Context, guard *auth.Guard, method string) (context.Context, error) {
+	action, ok := methodActions[method]
+	if !ok {
+		action = auth.ActionAdmin
+	}
+
+	var cred auth.Credentials
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			cred.Authorization = v[0]
+		}
+		if v := md.Get("x-api-key"); len(v) > 0 {
+			cred.APIKey = v[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cred.TLS = &info.State
+		}
+	}
+
+	p, err := guard.Authenticate(cred)
+	if err != nil {
+		logger.Ctx(ctx).Warn("Authenticate the call of %v failed: %v", method, err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !p.Allowed(action) {
+		if p.Anonymous() {
+			return nil, status.Error(codes.Unauthenticated, "The call has no credentials")
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "%s may not perform %s", p.Name, action)
+	}
+	return auth.NewContext(ctx, p), nil
+}
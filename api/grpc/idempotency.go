@@ -0,0 +1,112 @@
+package grpc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ewangplay/serval/idempotency"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// idempotentMethods are the writes replayed for an idempotency-key
+var idempotentMethods = map[string]bool{
+	"/serval.v1.DidService/CreateDid": true,
+	"/serval.v1.DidService/UpdateDid": true,
+	"/serval.v1.DidService/RevokeDid": true,
+}
+
+// transient are the codes of the failures not kept, the call runs again
+var transient = map[codes.Code]bool{
+	codes.Canceled:          true,
+	codes.Unknown:           true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+	codes.Internal:          true,
+	codes.Unavailable:       true,
+}
+
+// unaryIdempotent replays the result of a write sent again with the same
+// idempotency-key metadata by the same client, like the Idempotency-Key
+// header of the HTTP API
+func unaryIdempotent(keeper *idempotency.Keeper) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := md.Get("idempotency-key")
+		msg, ok := req.(proto.Message)
+		if !idempotentMethods[info.FullMethod] || len(keys) == 0 || !ok {
+			return handler(ctx, req)
+		}
+		key := keys[0]
+		if !idempotency.ValidKey(key) {
+			return nil, status.Errorf(codes.InvalidArgument, "The idempotency-key must be 1 to %d visible ASCII characters", idempotency.MaxKeyLength)
+		}
+
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Encode the request failed: %v", err)
+		}
+		fingerprint := idempotency.Fingerprint([]byte(info.FullMethod), []byte(strings.Join(md.Get("if-match"), ",")), data)
+
+		client := callerName(ctx)
+		rec, err := keeper.Begin(client, key, fingerprint)
+		switch err {
+		case nil:
+		case idempotency.ErrKeyReused:
+			return nil, status.Errorf(codes.InvalidArgument, "The idempotency-key %v was used with another request", key)
+		case idempotency.ErrInProgress:
+			return nil, status.Errorf(codes.Aborted, "The request with the idempotency-key %v is in progress", key)
+		default:
+			return nil, status.Errorf(codes.Unavailable, "Read the idempotency record failed: %v", err)
+		}
+		if rec != nil {
+			grpc.SetHeader(ctx, metadata.Pairs("idempotent-replayed", "true"))
+			return replay(rec)
+		}
+
+		resp, err := handler(ctx, req)
+		code := status.Code(err)
+		if transient[code] {
+			logKeep(ctx, key, keeper.Abort(client, key))
+			return resp, err
+		}
+
+		rec = &idempotency.Record{Fingerprint: fingerprint, Status: int(code)}
+		if err != nil {
+			rec.Body = []byte(status.Convert(err).Message())
+		} else if m, ok := resp.(proto.Message); ok {
+			rec.ContentType = string(m.ProtoReflect().Descriptor().FullName())
+			rec.Body, _ = proto.Marshal(m)
+		}
+		logKeep(ctx, key, keeper.Complete(client, key, rec))
+		return resp, err
+	}
+}
+
+// replay returns the kept result, the response is decoded by the name of
+// its message type
+func replay(rec *idempotency.Record) (any, error) {
+	if code := codes.Code(rec.Status); code != codes.OK {
+		return nil, status.Error(code, string(rec.Body))
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(rec.ContentType))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Decode the kept response failed: %v", err)
+	}
+	m := mt.New().Interface()
+	if err = proto.Unmarshal(rec.Body, m); err != nil {
+		return nil, status.Errorf(codes.Internal, "Decode the kept response failed: %v", err)
+	}
+	return m, nil
+}
+
+func logKeep(ctx context.Context, key string, err error) {
+	if err != nil {
+		logger.Ctx(ctx).Warn("Keep the result of the idempotency-key %v failed: %v", key, err)
+	}
+}
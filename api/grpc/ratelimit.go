@@ -0,0 +1,77 @@
+package grpc
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// didRequest is implemented by the requests targeting a DID
+type didRequest interface {
+	GetDid() string
+}
+
+func unaryLimiter(limiter *ratelimit.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		r := limitRequest(ctx, info.FullMethod)
+		if d, ok := req.(didRequest); ok && d.GetDid() != "" {
+			r.DIDs = []string{d.GetDid()}
+		}
+		if ok, wait := limiter.Allow(r); !ok {
+			grpc.SetHeader(ctx, retryAfter(wait))
+			return nil, limited(r, wait)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamLimiter(limiter *ratelimit.Limiter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r := limitRequest(ss.Context(), info.FullMethod)
+		if ok, wait := limiter.Allow(r); !ok {
+			ss.SetHeader(retryAfter(wait))
+			return limited(r, wait)
+		}
+		return handler(srv, ss)
+	}
+}
+
+func limitRequest(ctx context.Context, method string) ratelimit.Request {
+	action, ok := methodActions[method]
+	return ratelimit.Request{Write: !ok || action != auth.ActionRead, Client: callerName(ctx)}
+}
+
+// callerName returns the principal of the call, or the IP address of the
+// anonymous callers
+func callerName(ctx context.Context) string {
+	if p, ok := auth.FromContext(ctx); ok && !p.Anonymous() {
+		return p.Name
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return "ip:" + host
+}
+
+func retryAfter(wait time.Duration) metadata.MD {
+	return metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+func limited(r ratelimit.Request, wait time.Duration) error {
+	return status.Errorf(codes.ResourceExhausted, "%v exhausted its rate limit, retry in %ds", r.Client, int(math.Ceil(wait.Seconds())))
+}
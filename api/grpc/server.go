@@ -0,0 +1,188 @@
+// Package grpc implements the gRPC API of serval, on top of the DID
+// service shared with the HTTP handlers.
+package grpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry"
+	pb "github.com/ewangplay/serval/sdk/go/servalpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements pb.DidServiceServer
+type Server struct {
+	pb.UnimplementedDidServiceServer
+	svc *apiV1.Service
+
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+// NewServer creates the gRPC server on top of the registry
+func NewServer(reg *registry.Registry) *Server {
+	return &Server{svc: apiV1.NewService(reg), drain: make(chan struct{})}
+}
+
+// Drain ends the event streams, so that GracefulStop does not wait for them
+func (s *Server) Drain() {
+	s.drainOnce.Do(func() { close(s.drain) })
+}
+
+// CreateDid registers the DID document
+func (s *Server) CreateDid(ctx context.Context, req *pb.CreateDidRequest) (*pb.CreateDidResponse, error) {
+	err := s.svc.CreateDid(ctx, &io.CreateDidReq{
+		Did:      req.Did,
+		Document: pb.ToDDO(req.Document),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.CreateDidResponse{}, nil
+}
+
+// ResolveDid returns the verified DID document and its metadata
+func (s *Server) ResolveDid(ctx context.Context, req *pb.ResolveDidRequest) (*pb.ResolveDidResponse, error) {
+	resp, err := s.svc.ResolveDid(ctx, req.Did)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.ResolveDidResponse{
+		Did:      resp.Did,
+		Document: pb.FromDDO(&resp.Document),
+		Metadata: pb.FromMetadata(resp.Metadata),
+	}, nil
+}
+
+// UpdateDid replaces the DID document, the if-match metadata holds the
+// version expected, like the If-Match header
+func (s *Server) UpdateDid(ctx context.Context, req *pb.UpdateDidRequest) (*pb.UpdateDidResponse, error) {
+	var ifMatch string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ifMatch = strings.Join(md.Get("if-match"), ",")
+	}
+	err := s.svc.UpdateDid(ctx, &io.UpdateDidReq{
+		Did:      req.Did,
+		Document: pb.ToDDO(req.Document),
+	}, ifMatch)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.UpdateDidResponse{}, nil
+}
+
+// RevokeDid deactivates the DID
+func (s *Server) RevokeDid(ctx context.Context, req *pb.RevokeDidRequest) (*pb.RevokeDidResponse, error) {
+	err := s.svc.RevokeDid(ctx, &io.RevokeDidReq{
+		Did:   req.Did,
+		Proof: pb.ToProof(req.Proof),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.RevokeDidResponse{}, nil
+}
+
+// WatchEvents streams the registry events until the client leaves
+func (s *Server) WatchEvents(req *pb.WatchEventsRequest, stream pb.DidService_WatchEventsServer) error {
+	reg := s.svc.Registry
+
+	var after uint64
+	if req.LastEventId != nil {
+		after = *req.LastEventId
+	} else {
+		var err error
+		if after, err = reg.LastEventSeq(); err != nil {
+			return status.Errorf(codes.Internal, "Read the event sequence failed: %v", err)
+		}
+	}
+
+	var types map[registry.EventType]bool
+	if len(req.Types) > 0 {
+		types = make(map[registry.EventType]bool)
+		for _, t := range req.Types {
+			types[registry.EventType(t)] = true
+		}
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.drain:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := reg.Watch(ctx, after, func(e registry.Event) error {
+		if types != nil && !types[e.Type] {
+			return nil
+		}
+		e, ok := apiV1.ReadableEvent(ctx, e)
+		if !ok {
+			return nil
+		}
+		return stream.Send(&pb.Event{
+			Seq:         e.Seq,
+			Type:        string(e.Type),
+			Did:         e.Did,
+			Version:     int32(e.Version),
+			Fingerprint: e.Fingerprint,
+			Dids:        e.Dids,
+			Time:        timestamppb.New(e.Time),
+		})
+	})
+	switch {
+	case err == registry.ErrEventsExpired:
+		// The client has to resynchronize before watching again
+		return status.Error(codes.OutOfRange, err.Error())
+	case err == registry.ErrWatchLagging:
+		logger.Ctx(stream.Context()).Warn("gRPC event stream fell behind, closed")
+		return status.Error(codes.Unavailable, err.Error())
+	case err != nil && stream.Context().Err() == nil:
+		select {
+		case <-s.drain:
+			// The client resumes on another server with the last event ID
+			return status.Error(codes.Unavailable, "The server is shutting down")
+		default:
+		}
+		return status.Errorf(codes.Internal, "Watch the events failed: %v", err)
+	}
+	return nil
+}
+
+// toStatus maps the code of the service error to a gRPC status
+func toStatus(err error) error {
+	code := codes.Internal
+	switch apiV1.ErrorCodeOf(err) {
+	case apiV1.ErrInvalidRequest, apiV1.ErrInvalidSignature, apiV1.ErrUnsupportedKeyType:
+		code = codes.InvalidArgument
+	case apiV1.ErrUnauthenticated:
+		code = codes.Unauthenticated
+	case apiV1.ErrPermissionDenied:
+		code = codes.PermissionDenied
+	case apiV1.ErrDidNotFound, apiV1.ErrNotFound:
+		code = codes.NotFound
+	case apiV1.ErrConflict, apiV1.ErrFeatureDisabled:
+		code = codes.FailedPrecondition
+	case apiV1.ErrRateLimited:
+		code = codes.ResourceExhausted
+	case apiV1.ErrPreconditionFailed:
+		code = codes.FailedPrecondition
+	case apiV1.ErrKeyReused:
+		code = codes.InvalidArgument
+	case apiV1.ErrInProgress:
+		code = codes.Aborted
+	case apiV1.ErrBackendUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,296 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	apiGrpc "github.com/ewangplay/serval/api/grpc"
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/idempotency"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	sdk "github.com/ewangplay/serval/sdk/go"
+	pb "github.com/ewangplay/serval/sdk/go/servalpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newClient(t *testing.T, reg *registry.Registry) *sdk.GrpcClient {
+	return newAuthClient(t, reg, nil)
+}
+
+// newAuthClient serves the API with the calls authenticated by the guard
+func newAuthClient(t *testing.T, reg *registry.Registry, guard *auth.Guard, opts ...grpc.DialOption) *sdk.GrpcClient {
+	return newServerClient(t, reg, apiGrpc.ServerOptions(guard, nil, nil), opts...)
+}
+
+func newServerClient(t *testing.T, reg *registry.Registry, serverOpts []grpc.ServerOption, opts ...grpc.DialOption) *sdk.GrpcClient {
+	err := log.InitLogger(&log.LoggerConfig{
+		Module:   "serval-test",
+		LogLevel: "error",
+		Writer:   &bytes.Buffer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer(serverOpts...)
+	pb.RegisterDidServiceServer(gs, apiGrpc.NewServer(reg))
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	opts = append(opts,
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c, err := sdk.NewGrpcClient("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestDidLifecycle(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	c := newClient(t, reg)
+	ctx := context.Background()
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := c.CreateDid(ctx, &io.CreateDidReq{Did: id.Did, Document: ddo}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The document survives the round trip, its signature still verifies
+	resp, err := c.ResolveDid(ctx, id.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reg.Verify(&resp.Document); err != nil {
+		t.Fatalf("Resolved document does not verify: %v", err)
+	}
+	if resp.Metadata == nil || resp.Metadata.Version != 1 {
+		t.Fatalf("Unexpected metadata: %+v", resp.Metadata)
+	}
+
+	ddo.Controller = "did:example:controller"
+	id.Sign(t, reg, &ddo)
+	if err = c.UpdateDid(ctx, &io.UpdateDidReq{Did: id.Did, Document: ddo}); err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := registrytest.NewIdentity(t, reg.CSP())
+	attacker.Did = id.Did
+	err = c.UpdateDid(ctx, &io.UpdateDidReq{Did: id.Did, Document: attacker.Document(t, reg)})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("UpdateDid should refuse another signer, got %v", err)
+	}
+
+	err = c.RevokeDid(ctx, &io.RevokeDidReq{Did: id.Did, Proof: id.RevokeProof(t, reg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ResolveDid(ctx, id.Did); status.Code(err) != codes.NotFound {
+		t.Fatalf("Revoked DID should not resolve, got %v", err)
+	}
+
+	err = c.CreateDid(ctx, &io.CreateDidReq{Did: "did:example:bad", Document: io.DDO{ID: "did:example:bad"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("CreateDid should refuse an invalid document, got %v", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	c := newClient(t, reg)
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the change log from the start, only the revocations
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var after uint64
+	var got []*pb.Event
+	err := c.WatchEvents(ctx, &after, []string{string(registry.EventRevoked)}, func(e *pb.Event) error {
+		got = append(got, e)
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("WatchEvents should end with the context, got %v", err)
+	}
+	if len(got) != 1 || got[0].Did != id.Did || got[0].Seq != 2 {
+		t.Fatalf("Unexpected events: %+v", got)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	digest := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	guard, err := auth.New(&auth.Options{
+		Enabled: true,
+		APIKeys: []auth.APIKey{
+			{Name: "writer", SHA256: digest("writer-key")},
+			{Name: "reader", SHA256: digest("reader-key")},
+		},
+		Policies: []auth.Policy{
+			{Principals: []string{"apikey:writer"}, Actions: []auth.Action{auth.ActionCreate, auth.ActionRead}, Namespaces: []string{"did:example:"}},
+			{Principals: []string{"apikey:reader"}, Actions: []auth.Action{auth.ActionRead}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registrytest.NewRegistry(t)
+	ctx := context.Background()
+	id := registrytest.NewIdentity(t, reg.CSP())
+	req := &io.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)}
+
+	anonymous := newAuthClient(t, reg, guard)
+	if _, err := anonymous.ResolveDid(ctx, id.Did); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ResolveDid without credentials = %v, want Unauthenticated", err)
+	}
+
+	reader := newAuthClient(t, reg, guard, grpc.WithPerRPCCredentials(sdk.APIKeyCredentials("reader-key")))
+	if err := reader.CreateDid(ctx, req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("CreateDid by the reader = %v, want PermissionDenied", err)
+	}
+
+	writer := newAuthClient(t, reg, guard, grpc.WithPerRPCCredentials(sdk.APIKeyCredentials("writer-key")))
+	if err := writer.CreateDid(ctx, req); err != nil {
+		t.Fatalf("CreateDid by the writer failed: %v", err)
+	}
+	if _, err := reader.ResolveDid(ctx, id.Did); err != nil {
+		t.Errorf("ResolveDid by the reader failed: %v", err)
+	}
+
+	// The namespaces of the policy are checked by the service
+	other := &io.CreateDidReq{Did: "did:other:" + id.Did, Document: req.Document}
+	if err := writer.CreateDid(ctx, other); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("CreateDid out of the namespace = %v, want PermissionDenied", err)
+	}
+
+	wrong := newAuthClient(t, reg, guard, grpc.WithPerRPCCredentials(sdk.APIKeyCredentials("wrong-key")))
+	if _, err := wrong.ResolveDid(ctx, id.Did); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ResolveDid with a wrong key = %v, want Unauthenticated", err)
+	}
+	// The events of the DIDs out of the namespaces are not streamed
+	for _, did := range []string{strings.Replace(id.Did, "did:example:", "did:other:", 1), ""} {
+		next := registrytest.NewIdentity(t, reg.CSP())
+		if did != "" {
+			next.Did = did
+		}
+		ddo := next.Document(t, reg)
+		if err := reg.Create(next.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var after uint64
+	var seqs []uint64
+	err = writer.WatchEvents(watchCtx, &after, nil, func(e *pb.Event) error {
+		seqs = append(seqs, e.Seq)
+		if e.Seq == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || !reflect.DeepEqual(seqs, []uint64{1, 3}) {
+		t.Errorf("WatchEvents by the writer = %v %v, want the events 1 and 3", seqs, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.Options{
+		Enabled: true,
+		Client:  ratelimit.Budget{Read: ratelimit.Limit{Rate: 0.01, Burst: 1}},
+		DID:     ratelimit.Budget{Write: ratelimit.Limit{Rate: 0.01, Burst: 1}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.Close()
+	reg := registrytest.NewRegistry(t)
+	c := newServerClient(t, reg, apiGrpc.ServerOptions(nil, limiter, nil))
+	ctx := context.Background()
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	req := &io.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)}
+	if err := c.CreateDid(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDid(ctx, req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("The second CreateDid of the DID = %v, want ResourceExhausted", err)
+	}
+
+	if _, err := c.ResolveDid(ctx, id.Did); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ResolveDid(ctx, id.Did); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("The second ResolveDid = %v, want ResourceExhausted", err)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	keeper, err := idempotency.New(idempotency.Options{Enabled: true}, reg.Store())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keeper.Close()
+	c := newServerClient(t, reg, apiGrpc.ServerOptions(nil, nil, keeper))
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "idempotency-key", "create-1")
+	for i := 0; i < 2; i++ {
+		if err := c.CreateDid(ctx, &io.CreateDidReq{Did: id.Did, Document: ddo}); err != nil {
+			t.Fatalf("CreateDid %d failed: %v", i, err)
+		}
+	}
+	if meta, _, _ := reg.Metadata(id.Did); meta.Version != 1 {
+		t.Fatalf("Expected the create to be applied once, at version %d", meta.Version)
+	}
+	other := registrytest.NewIdentity(t, reg.CSP())
+	err = c.CreateDid(ctx, &io.CreateDidReq{Did: other.Did, Document: other.Document(t, reg)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateDid with a reused key = %v, want InvalidArgument", err)
+	}
+
+	ddo.Controller = "did:example:controller"
+	id.Sign(t, reg, &ddo)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "if-match", `"2"`)
+	err = c.UpdateDid(ctx, &io.UpdateDidReq{Did: id.Did, Document: ddo})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UpdateDid of another version = %v, want FailedPrecondition", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "if-match", `"1"`)
+	if err = c.UpdateDid(ctx, &io.UpdateDidReq{Did: id.Did, Document: ddo}); err != nil {
+		t.Errorf("UpdateDid of the version failed: %v", err)
+	}
+}
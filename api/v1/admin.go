@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/registry"
+	"github.com/gin-gonic/gin"
+)
+
+// ExportRegistry handles the /api/v1/admin/export request to stream the
+// whole registry as JSON Lines, closed by the signed manifest
+func ExportRegistry(c *ctx.Context) {
+	filename := fmt.Sprintf("serval-%s.jsonl", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	// The body is already on its way, so a failure can only be logged.
+	// The manifest is missing then, and an import refuses the dump.
+	manifest, err := c.Registry.Export(c.Writer, c.AppKey)
+	if err != nil {
+		logFor(c).Error("Export the registry failed: %v", err)
+		return
+	}
+
+	logFor(c).Info("Exported %d DID records, checksum %s", manifest.Records, manifest.Checksum)
+}
+
+// ImportRegistry handles the /api/v1/admin/import request to load a dump
+// written by ExportRegistry. Pass dryRun=true to only verify the dump.
+func ImportRegistry(c *ctx.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+
+	report, err := c.Registry.Import(c.Request.Body, c.AppKey, registry.ImportOptions{
+		DryRun: dryRun,
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("Import the registry failed: %v", err)
+		logFor(c).Error(errMsg)
+		if report != nil {
+			FailWithDetailed(ErrInternal, report, errMsg, c.Context)
+		} else {
+			FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		}
+		return
+	}
+
+	logFor(c).Info("Imported %d of %d DID records, %d rejected", report.Imported, report.Records, len(report.Rejected))
+
+	OkWithData(report, c.Context)
+}
+
+// StartMigration handles the POST /api/v1/admin/migrate request to copy the
+// records to the dual write store in the background. Pass dryRun=true or
+// verify=true to only compare both stores.
+func StartMigration(c *ctx.Context) {
+	ds, ok := adapter.Find[*adapter.DualStore](c.Store)
+	if !ok {
+		FailWithMessage(ErrFeatureDisabled, "Dual write is not configured", c.Context)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	verify, _ := strconv.ParseBool(c.Query("verify"))
+	err := ds.StartMigration(adapter.MigrateOptions{
+		DryRun: dryRun,
+		Verify: verify,
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("Start the migration failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrConflict, errMsg, c.Context)
+		return
+	}
+
+	logFor(c).Info("Migration started, dryRun: %v, verify: %v", dryRun, verify)
+
+	OkWithMessage("Migration started", c.Context)
+}
+
+// MigrationStatus handles the GET /api/v1/admin/migrate request to report
+// the progress of the last migration
+func MigrationStatus(c *ctx.Context) {
+	ds, ok := adapter.Find[*adapter.DualStore](c.Store)
+	if !ok {
+		FailWithMessage(ErrFeatureDisabled, "Dual write is not configured", c.Context)
+		return
+	}
+
+	report, running, err := ds.MigrationStatus()
+	status := gin.H{
+		"running": running,
+		"report":  report,
+		"pending": len(ds.Pending()),
+	}
+	if err != nil {
+		status["error"] = err.Error()
+	}
+
+	OkWithData(status, c.Context)
+}
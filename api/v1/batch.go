@@ -0,0 +1,67 @@
+package v1
+
+import (
+	"fmt"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/io"
+)
+
+// MaxBatchItems is the max number of items of a batch request
+const MaxBatchItems = 1000
+
+// BatchCreateDid handles the /api/v1/did/batch/create request to create
+// up to MaxBatchItems DIDs, the result of each item is reported back
+func BatchCreateDid(c *ctx.Context) {
+	var req io.BatchCreateReq
+	err := c.BindJSON(&req)
+	if err == nil {
+		err = checkBatchSize(len(req.Items))
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	resp, err := NewService(c.Registry).BatchCreateDid(c.Request.Context(), &req)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	logFor(c).Info("BatchCreateDid: %d created, %d failed, atomic: %v", resp.Created, resp.Failed, req.Atomic)
+
+	OkWithData(resp, c.Context)
+}
+
+// BatchResolveDid handles the /api/v1/did/batch/resolve request to resolve
+// up to MaxBatchItems DIDs, the result of each DID is reported back
+func BatchResolveDid(c *ctx.Context) {
+	var req io.BatchResolveReq
+	err := c.BindJSON(&req)
+	if err == nil {
+		err = checkBatchSize(len(req.Dids))
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	resp := NewService(c.Registry).BatchResolveDid(c.Request.Context(), req.Dids)
+
+	OkWithData(resp, c.Context)
+}
+
+func checkBatchSize(n int) error {
+	if n == 0 {
+		return fmt.Errorf("The batch is empty")
+	}
+	if n > MaxBatchItems {
+		return fmt.Errorf("The batch has %d items, at most %d are allowed", n, MaxBatchItems)
+	}
+	return nil
+}
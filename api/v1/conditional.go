@@ -0,0 +1,89 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/io"
+	"golang.org/x/text/language"
+)
+
+// DefaultCacheControl lets the caches keep the resolved documents, but they
+// revalidate them before every use, so a revocation shows up at once
+const DefaultCacheControl = "no-cache"
+
+// documentETag returns the strong validator of the resolution,
+// "<version>-<hash>": the version of the document, that If-Match checks
+// before an update, then the hash of the document, of its metadata and of
+// the language of the envelope, so it changes with any byte of the response
+func documentETag(resp *io.ResolveDidResp, lang language.Tag) string {
+	data, _ := json.Marshal(resp)
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte{0})
+	h.Write([]byte(lang.String()))
+
+	version := 1
+	if resp.Metadata != nil && resp.Metadata.Version > 0 {
+		version = resp.Metadata.Version
+	}
+	return fmt.Sprintf(`"%d-%s"`, version, hex.EncodeToString(h.Sum(nil)[:16]))
+}
+
+// documentModified returns the Last-Modified time of the resolution, the
+// time the registry last wrote the document, zero when unknown. The times
+// of the document are set by its signer and are not used. The report of a
+// compromised key changes the metadata, not the document, and is only
+// caught by the ETag.
+func documentModified(resp *io.ResolveDidResp) time.Time {
+	meta := resp.Metadata
+	if meta == nil || len(meta.CompromisedKeys) > 0 {
+		return time.Time{}
+	}
+	modified := meta.Updated
+	if modified.IsZero() {
+		modified = meta.Created
+	}
+	return modified.UTC().Truncate(time.Second)
+}
+
+// notModified sets the validators of the resolution on the response, and
+// tells whether the request holds them already. If-None-Match takes
+// precedence over If-Modified-Since.
+func notModified(c *ctx.Context, resp *io.ResolveDidResp) bool {
+	etag := documentETag(resp, requestLanguage(c.Context))
+	modified := documentModified(resp)
+
+	c.Header("ETag", etag)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	c.Header("Cache-Control", c.CacheControl)
+	c.Header("Vary", "Accept-Language")
+
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		return etagMatch(inm, etag)
+	}
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
+
+// etagMatch compares the If-None-Match list with the weak comparison
+func etagMatch(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
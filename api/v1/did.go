@@ -4,174 +4,207 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	ctx "github.com/ewangplay/serval/context"
 	"github.com/ewangplay/serval/io"
-	"github.com/ewangplay/serval/log"
-	"github.com/ewangplay/serval/utils"
+	"github.com/ewangplay/serval/registry"
 )
 
 // CreateDid handles the /api/v1/did/create request to create a DID
 func CreateDid(c *ctx.Context) {
-	var err error
+	var req io.CreateDidReq
 
 	// Parse the request body
-	req, err := parseCreateDidReq(c)
+	err := c.BindJSON(&req)
 	if err != nil {
 		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusBadRequest, errMsg, c.Context)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
 		return
 	}
 
 	// debug
 	data, _ := json.Marshal(req)
-	log.Debug("CreateDid request: %s", string(data))
+	logFor(c).Debug("CreateDid request: %s", string(data))
 
-	// Set the DID/DDO record to store
-	err = c.Store.Set(req.Did, req.Document)
+	err = NewService(c.Registry).CreateDid(c.Request.Context(), &req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Set the DID/DDO record to store failed: %v", err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusInternalServerError, errMsg, c.Context)
+		fail(c, err)
 		return
 	}
 
 	Ok(c.Context)
 }
 
-func parseCreateDidReq(c *ctx.Context) (*io.CreateDidReq, error) {
-	var err error
-	var req io.CreateDidReq
-
-	err = c.BindJSON(&req)
-	if err != nil {
-		return nil, err
-	}
-
-	// Verify the DID document
-	err = utils.VerifyDDO(c.CSP, c.Qsign, &req.Document)
-	if err != nil {
-		return nil, err
-	}
-
-	return &req, nil
-}
-
 // ResolveDid handles the /api/v1/did/resolve request to resolve a DID
 // Request URL: http://IP:Port/api/v1/did/resolve/:did
 func ResolveDid(c *ctx.Context) {
 	// Retrieve did from path param
 	did := c.Param("did")
 
-	// Get the DID/DDO record from store
-	var ddo io.DDO
-	found, err := c.Store.Get(did, &ddo)
+	// Get the verified DID/DDO record from store
+	resp, err := NewService(c.Registry).ResolveDid(c.Request.Context(), did)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to retrieve the DID document (%v) from store: %v", did, err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusInternalServerError, errMsg, c.Context)
+		// The caches check again for a DID that is not found, or revoked
+		c.Header("Cache-Control", "no-cache")
+		fail(c, err)
 		return
 	}
-	if !found {
-		errMsg := fmt.Sprintf("DID document (%v) not found", did)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusInternalServerError, errMsg, c.Context)
+
+	if notModified(c, resp) {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
-	// Verify the DID document
-	err = utils.VerifyDDO(c.CSP, c.Qsign, &ddo)
+	logFor(c).Debug("ResolveDid response: %v", resp)
+
+	OkWithData(resp, c.Context)
+}
+
+func documentMetadata(meta *registry.Metadata) *io.DocumentMetadata {
+	return &io.DocumentMetadata{
+		Version:         meta.Version,
+		Created:         meta.Created,
+		Updated:         meta.Updated,
+		Deactivated:     meta.Deactivated,
+		CompromisedKeys: meta.CompromisedKeys,
+	}
+}
+
+// UpdateDid handles the /api/v1/did/update request to replace the document
+// of a DID, the new document must be signed by an authentication key of
+// the current one. It is the HTTP endpoint of the UpdateDid of the gRPC API.
+func UpdateDid(c *ctx.Context) {
+	var req io.UpdateDidReq
+
+	// Parse the request body
+	err := c.BindJSON(&req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to verify the DID document (%v): %v", did, err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusInternalServerError, errMsg, c.Context)
+		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
 		return
 	}
 
-	// Response body
-	resp := io.ResolveDidResp{
-		Did:      did,
-		Document: ddo,
-	}
+	// debug
+	data, _ := json.Marshal(req)
+	logFor(c).Debug("UpdateDid request: %s", string(data))
 
-	log.Debug("ResolveDid response: %v", resp)
+	err = NewService(c.Registry).UpdateDid(c.Request.Context(), &req, c.GetHeader("If-Match"))
+	if err != nil {
+		fail(c, err)
+		return
+	}
 
-	OkWithData(resp, c.Context)
+	Ok(c.Context)
 }
 
 // RevokeDid handles the /api/v1/did/revoke request to revoke a DID
 func RevokeDid(c *ctx.Context) {
-	var err error
+	var req io.RevokeDidReq
 
 	// Parse the request body
-	req, err := parseRevokeDidReq(c)
+	err := c.BindJSON(&req)
 	if err != nil {
 		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusBadRequest, errMsg, c.Context)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
 		return
 	}
 
 	// debug
 	data, _ := json.Marshal(req)
-	log.Debug("RevokeDid request: %s", string(data))
+	logFor(c).Debug("RevokeDid request: %s", string(data))
 
-	// Delete the DID/DDO record from store
-	err = c.Store.Delete(req.Did)
+	err = NewService(c.Registry).RevokeDid(c.Request.Context(), &req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Delete the DID/DDO (%s) record from store failed: %v", req.Did, err)
-		log.Error(errMsg)
-		FailWithMessage(http.StatusInternalServerError, errMsg, c.Context)
+		fail(c, err)
 		return
 	}
 
 	Ok(c.Context)
 }
 
-func parseRevokeDidReq(c *ctx.Context) (*io.RevokeDidReq, error) {
-	var err error
-	var req io.RevokeDidReq
+// fail logs the error of the service and answers with its status
+func fail(c *ctx.Context, err error) {
+	logFor(c).Error(err.Error())
+	FailWithError(err, c.Context)
+}
 
-	err = c.BindJSON(&req)
+// ListDids handles the /api/v1/did request to list the DIDs page by page
+// Request URL: http://IP:Port/api/v1/did?controller=&keyType=&serviceType=
+// &createdAfter=&createdBefore=&updatedAfter=&updatedBefore=&deactivated=&cursor=&limit=
+func ListDids(c *ctx.Context) {
+	opts, err := parseListDidsReq(c)
 	if err != nil {
-		return nil, err
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
 	}
 
-	// Check the params
-	if req.Did == "" {
-		err = fmt.Errorf("The DID parameter cannot be empty")
-		return nil, err
+	dids, next, err := c.Registry.List(*opts)
+	if err != nil {
+		errMsg := fmt.Sprintf("List the DIDs failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+		return
 	}
-	if req.Proof.Type == "" || req.Proof.Creator == "" || req.Proof.SignatureValue == "" {
-		err = fmt.Errorf("The Proof parameter cannot be empty")
-		return nil, err
+	dids = readableDids(c.Request.Context(), dids)
+	if dids == nil {
+		dids = []io.DidSummary{}
 	}
 
-	// Verify the proof
-	var ddo io.DDO
-	found, err := c.Store.Get(req.Did, &ddo)
-	if err != nil {
-		return nil, err
+	OkWithData(io.ListDidsResp{
+		Dids:       dids,
+		NextCursor: next,
+	}, c.Context)
+}
+
+func parseListDidsReq(c *ctx.Context) (*registry.ListOptions, error) {
+	var err error
+	opts := &registry.ListOptions{
+		Controller:  c.Query("controller"),
+		KeyType:     c.Query("keyType"),
+		ServiceType: c.Query("serviceType"),
+		Cursor:      c.Query("cursor"),
+	}
+
+	times := map[string]*time.Time{
+		"createdAfter":  &opts.CreatedAfter,
+		"createdBefore": &opts.CreatedBefore,
+		"updatedAfter":  &opts.UpdatedAfter,
+		"updatedBefore": &opts.UpdatedBefore,
 	}
-	if !found {
-		err = fmt.Errorf("DID document (%v) not found", req.Did)
-		return nil, err
+	for name, t := range times {
+		if v := c.Query(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("The %s parameter is not a RFC 3339 time", name)
+			}
+		}
 	}
 
-	// Verify the DID document
-	err = utils.VerifyDDO(c.CSP, c.Qsign, &ddo)
-	if err != nil {
-		return nil, err
+	if v := c.Query("deactivated"); v != "" {
+		deactivated, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("The deactivated parameter is not a boolean")
+		}
+		opts.Deactivated = &deactivated
 	}
 
-	valid, err := utils.VerifyProof(c.CSP, req.Did, &req.Proof, &ddo)
-	if err != nil {
-		return nil, err
+	if v := c.Query("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit <= 0 {
+			return nil, fmt.Errorf("The limit parameter must be a positive integer")
+		}
 	}
-	if !valid {
-		return nil, fmt.Errorf("Failed to verify the signature of the Proof")
+
+	if opts.Cursor != "" {
+		if _, err = registry.DecodeCursor(opts.Cursor); err != nil {
+			return nil, err
+		}
 	}
 
-	return &req, nil
+	return opts, nil
 }
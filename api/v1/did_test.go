@@ -0,0 +1,386 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/gin-gonic/gin"
+)
+
+type testEnv struct {
+	ctx.Context
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	gin.SetMode(gin.TestMode)
+
+	err := log.InitLogger(&log.LoggerConfig{
+		Module:   "serval-test",
+		LogLevel: "error",
+		Writer:   &bytes.Buffer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registrytest.NewRegistry(t)
+
+	env := &testEnv{}
+	env.Store = reg.Store()
+	env.CSP = reg.CSP()
+	env.Qsign = reg.Qsign()
+	env.Registry = reg
+	env.AppKey = registrytest.NewAppKey(t, reg.CSP())
+	return env
+}
+
+// call invokes the handler in-process and decodes the response envelope
+func (env *testEnv) call(t *testing.T, h func(*ctx.Context), method, url string, body any, params gin.Params) (int, io.Response) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, url, &reqBody)
+	c.Params = params
+
+	context := env.Context
+	context.Context = c
+	h(&context)
+
+	var resp io.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Decode response %q failed: %v", w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+func (env *testEnv) create(t *testing.T, did string, ddo io.DDO) (int, io.Response) {
+	req := io.CreateDidReq{Did: did, Document: ddo}
+	return env.call(t, CreateDid, http.MethodPost, "/api/v1/did/create", req, nil)
+}
+
+func (env *testEnv) resolve(t *testing.T, did string) (int, io.Response) {
+	return env.call(t, ResolveDid, http.MethodGet, "/api/v1/did/resolve/"+did, nil, gin.Params{{Key: "did", Value: did}})
+}
+
+func (env *testEnv) update(t *testing.T, did string, ddo io.DDO) (int, io.Response) {
+	req := io.UpdateDidReq{Did: did, Document: ddo}
+	return env.call(t, UpdateDid, http.MethodPost, "/api/v1/did/update", req, nil)
+}
+
+func (env *testEnv) revoke(t *testing.T, did string, proof io.Proof) (int, io.Response) {
+	req := io.RevokeDidReq{Did: did, Proof: proof}
+	return env.call(t, RevokeDid, http.MethodPost, "/api/v1/did/revoke", req, nil)
+}
+
+func TestDidLifecycle(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	did := id.Did
+
+	status, resp := env.create(t, did, id.Document(t, env.Registry))
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("CreateDid failed: %d %+v", status, resp)
+	}
+
+	status, resp = env.resolve(t, did)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("ResolveDid failed: %d %+v", status, resp)
+	}
+	data, _ := json.Marshal(resp.Data)
+	var result io.ResolveDidResp
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Did != did || result.Document.ID != did {
+		t.Fatalf("Resolved the wrong document: %+v", result)
+	}
+
+	status, resp = env.revoke(t, did, id.RevokeProof(t, env.Registry))
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("RevokeDid failed: %d %+v", status, resp)
+	}
+
+	status, _ = env.resolve(t, did)
+	if status == http.StatusOK {
+		t.Fatal("Revoked DID should not resolve")
+	}
+}
+
+func TestCreateDidExisting(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	ddo := id.Document(t, env.Registry)
+	if status, resp := env.create(t, id.Did, ddo); status != http.StatusOK {
+		t.Fatalf("CreateDid failed: %d %+v", status, resp)
+	}
+
+	// Another caller cannot replace the live document with a create
+	other := registrytest.NewIdentity(t, env.CSP)
+	taken := other.Document(t, env.Registry)
+	taken.ID = id.Did
+	other.Sign(t, env.Registry, &taken)
+	if status, resp := env.create(t, id.Did, taken); status != http.StatusConflict || resp.Error != ErrConflict.Name {
+		t.Fatalf("Creating a live DID should conflict: %d %+v", status, resp)
+	}
+
+	// Nor undo a revocation
+	if status, resp := env.revoke(t, id.Did, id.RevokeProof(t, env.Registry)); status != http.StatusOK {
+		t.Fatalf("RevokeDid failed: %d %+v", status, resp)
+	}
+	if status, resp := env.create(t, id.Did, ddo); status != http.StatusConflict {
+		t.Fatalf("Creating a revoked DID should conflict: %d %+v", status, resp)
+	}
+
+	// The document must be the one of the DID, out of the keys of the registry
+	for _, did := range []string{other.Did, "serval:idxversion"} {
+		if status, resp := env.create(t, did, ddo); status != http.StatusBadRequest {
+			t.Errorf("Creating %v with the document of %v should be refused: %d %+v", did, id.Did, status, resp)
+		}
+	}
+	if _, found, _ := env.Registry.Metadata("serval:idxversion"); found {
+		t.Error("The registry wrote a record out of the DIDs")
+	}
+}
+
+func TestCreateDidInvalidSignature(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	did := id.Did
+
+	ddo := id.Document(t, env.Registry)
+	ddo.Controller = "did:example:tampered"
+
+	status, resp := env.create(t, did, ddo)
+	if status != http.StatusBadRequest || resp.Code == SUCCESS {
+		t.Fatalf("CreateDid should reject a tampered document: %d %+v", status, resp)
+	}
+
+	status, _ = env.resolve(t, did)
+	if status == http.StatusOK {
+		t.Fatal("Rejected DID should not resolve")
+	}
+}
+
+func TestResolveDidNotFound(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.resolve(t, "did:example:missing")
+	if status == http.StatusOK || resp.Code == SUCCESS {
+		t.Fatalf("ResolveDid should fail for a missing DID: %d %+v", status, resp)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	live := id.Document(t, env.Registry)
+	if status, resp := env.create(t, id.Did, live); status != http.StatusOK {
+		t.Fatalf("CreateDid failed: %d %+v", status, resp)
+	}
+
+	tampered := registrytest.NewIdentity(t, env.CSP)
+	tamperedDDO := tampered.Document(t, env.Registry)
+	tamperedDDO.Controller = "did:example:tampered"
+
+	unsupported := registrytest.NewIdentity(t, env.CSP)
+	unsupportedDDO := unsupported.Document(t, env.Registry)
+	unsupportedDDO.PublicKey[0].Type = "RSA"
+	unsupportedDDO.Proof.Type = "RSA"
+
+	attacker := registrytest.NewIdentity(t, env.CSP)
+	attacker.Did = id.Did
+
+	missing := registrytest.NewIdentity(t, env.CSP)
+
+	cases := []struct {
+		name string
+		call func() (int, io.Response)
+		code ErrorCode
+	}{
+		{"resolve missing", func() (int, io.Response) { return env.resolve(t, missing.Did) }, ErrDidNotFound},
+		{"create tampered", func() (int, io.Response) { return env.create(t, tampered.Did, tamperedDDO) }, ErrInvalidSignature},
+		{"create unsupported", func() (int, io.Response) { return env.create(t, unsupported.Did, unsupportedDDO) }, ErrUnsupportedKeyType},
+		{"update by another signer", func() (int, io.Response) { return env.update(t, id.Did, attacker.Document(t, env.Registry)) }, ErrPermissionDenied},
+		{"revoke missing", func() (int, io.Response) { return env.revoke(t, missing.Did, missing.RevokeProof(t, env.Registry)) }, ErrDidNotFound},
+	}
+	for _, c := range cases {
+		status, resp := c.call()
+		if status != c.code.Status || resp.Code != c.code.Code || resp.Error != c.code.Name {
+			t.Errorf("%s: expected %+v, got %d %+v", c.name, c.code, status, resp)
+		}
+	}
+}
+
+func TestRevokeDidInvalidProof(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	did := id.Did
+
+	status, _ := env.create(t, did, id.Document(t, env.Registry))
+	if status != http.StatusOK {
+		t.Fatalf("CreateDid failed: %d", status)
+	}
+
+	// Proof signed for another DID must be rejected
+	other := registrytest.NewIdentity(t, env.CSP)
+	other.RecoveryKey = id.RecoveryKey
+	proof := other.RevokeProof(t, env.Registry)
+	status, resp := env.revoke(t, did, proof)
+	if status != http.StatusBadRequest || resp.Code == SUCCESS {
+		t.Fatalf("RevokeDid should reject an invalid proof: %d %+v", status, resp)
+	}
+
+	status, _ = env.resolve(t, did)
+	if status != http.StatusOK {
+		t.Fatal("DID should still resolve after a rejected revocation")
+	}
+}
+
+func TestUpdateDid(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	did := id.Did
+
+	ddo := id.Document(t, env.Registry)
+	status, _ := env.create(t, did, ddo)
+	if status != http.StatusOK {
+		t.Fatalf("CreateDid failed: %d", status)
+	}
+
+	ddo.Controller = "did:example:controller"
+	id.Sign(t, env.Registry, &ddo)
+	status, resp := env.update(t, did, ddo)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("UpdateDid failed: %d %+v", status, resp)
+	}
+	got, meta, err := env.Registry.Resolve(did)
+	if err != nil || got.Controller != ddo.Controller || meta.Version != 2 {
+		t.Fatalf("Update not applied: %+v %+v %v", got, meta, err)
+	}
+
+	// A document signed by a key the current document does not list is refused
+	attacker := registrytest.NewIdentity(t, env.CSP)
+	attacker.Did = did
+	forged := attacker.Document(t, env.Registry)
+	status, resp = env.update(t, did, forged)
+	if status != http.StatusForbidden || resp.Code == SUCCESS {
+		t.Fatalf("UpdateDid should refuse another signer: %d %+v", status, resp)
+	}
+
+	missing := registrytest.NewIdentity(t, env.CSP)
+	status, _ = env.update(t, missing.Did, missing.Document(t, env.Registry))
+	if status != http.StatusNotFound {
+		t.Fatalf("UpdateDid of a missing DID should answer 404, got %d", status)
+	}
+}
+
+func TestListDids(t *testing.T) {
+	env := newTestEnv(t)
+	for i := 0; i < 3; i++ {
+		id := registrytest.NewIdentity(t, env.CSP)
+		if status, _ := env.create(t, id.Did, id.Document(t, env.Registry)); status != http.StatusOK {
+			t.Fatalf("CreateDid failed: %d", status)
+		}
+	}
+
+	var dids []string
+	url := "/api/v1/did?limit=2&keyType=ED25519"
+	for {
+		status, resp := env.call(t, ListDids, http.MethodGet, url, nil, nil)
+		if status != http.StatusOK || resp.Code != SUCCESS {
+			t.Fatalf("ListDids failed: %d %+v", status, resp)
+		}
+		data, _ := json.Marshal(resp.Data)
+		var page io.ListDidsResp
+		if err := json.Unmarshal(data, &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range page.Dids {
+			dids = append(dids, item.Did)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		url = "/api/v1/did?limit=2&keyType=ED25519&cursor=" + page.NextCursor
+	}
+	if len(dids) != 3 {
+		t.Fatalf("Unexpected DIDs: %v", dids)
+	}
+
+	for _, query := range []string{"limit=0", "deactivated=maybe", "createdAfter=yesterday", "cursor=%25"} {
+		status, _ := env.call(t, ListDids, http.MethodGet, "/api/v1/did?"+query, nil, nil)
+		if status != http.StatusBadRequest {
+			t.Fatalf("ListDids should reject %v: %d", query, status)
+		}
+	}
+}
+
+func TestBatchCreateResolve(t *testing.T) {
+	env := newTestEnv(t)
+
+	var req io.BatchCreateReq
+	for i := 0; i < 3; i++ {
+		id := registrytest.NewIdentity(t, env.CSP)
+		req.Items = append(req.Items, io.CreateDidReq{Did: id.Did, Document: id.Document(t, env.Registry)})
+	}
+	req.Items[1].Document.Controller = "did:example:tampered"
+
+	status, resp := env.call(t, BatchCreateDid, http.MethodPost, "/api/v1/did/batch/create", req, nil)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("BatchCreateDid failed: %d %+v", status, resp)
+	}
+	data, _ := json.Marshal(resp.Data)
+	var created io.BatchCreateResp
+	if err := json.Unmarshal(data, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Created != 2 || created.Failed != 1 || created.Results[1].Ok || created.Results[1].Code != ErrInvalidSignature.Name {
+		t.Fatalf("Unexpected results: %+v", created)
+	}
+
+	// The items get the checks and the errors of CreateDid
+	again := io.BatchCreateReq{Items: []io.CreateDidReq{req.Items[0], req.Items[2]}}
+	again.Items[1].Did = "did:example:other"
+	status, resp = env.call(t, BatchCreateDid, http.MethodPost, "/api/v1/did/batch/create", again, nil)
+	data, _ = json.Marshal(resp.Data)
+	created = io.BatchCreateResp{}
+	json.Unmarshal(data, &created)
+	if status != http.StatusOK || created.Failed != 2 ||
+		created.Results[0].Code != ErrConflict.Name || created.Results[1].Code != ErrInvalidRequest.Name {
+		t.Fatalf("Unexpected results: %d %+v", status, created)
+	}
+
+	// The records of the registry are out of reach
+	dids := io.BatchResolveReq{Dids: []string{req.Items[0].Did, req.Items[1].Did, "serval:meta:" + req.Items[0].Did}}
+	status, resp = env.call(t, BatchResolveDid, http.MethodPost, "/api/v1/did/batch/resolve", dids, nil)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("BatchResolveDid failed: %d %+v", status, resp)
+	}
+	data, _ = json.Marshal(resp.Data)
+	var resolved io.BatchResolveResp
+	if err := json.Unmarshal(data, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Results[0].Document == nil || resolved.Results[1].Code != ErrDidNotFound.Name ||
+		resolved.Results[2].Document != nil || resolved.Results[2].Code != ErrInvalidRequest.Name {
+		t.Fatalf("Unexpected results: %+v", resolved)
+	}
+
+	status, _ = env.call(t, BatchResolveDid, http.MethodPost, "/api/v1/did/batch/resolve", io.BatchResolveReq{}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("BatchResolveDid should reject an empty batch: %d", status)
+	}
+}
@@ -0,0 +1,234 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/registry"
+	"github.com/gorilla/websocket"
+)
+
+// heartbeatInterval keeps the idle event streams open through proxies
+const heartbeatInterval = 15 * time.Second
+
+// Close code sent on the WebSocket when the resume point is no longer in the change log
+const closeEventsExpired = 4410
+
+var upgrader = websocket.Upgrader{
+	// The stream is read-only and public, like the resolve endpoint
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// parseEventsReq returns the sequence number to resume after and the
+// event types to send. Without Last-Event-ID the stream starts with the
+// next event.
+func parseEventsReq(c *ctx.Context) (uint64, map[registry.EventType]bool, error) {
+	var after uint64
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("lastEventId")
+	}
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			return 0, nil, fmt.Errorf("The Last-Event-ID is not a sequence number")
+		}
+	} else {
+		var err error
+		if after, err = c.Registry.LastEventSeq(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var types map[registry.EventType]bool
+	if v := c.Query("types"); v != "" {
+		types = make(map[registry.EventType]bool)
+		for _, t := range strings.Split(v, ",") {
+			types[registry.EventType(strings.TrimSpace(t))] = true
+		}
+	}
+	return after, types, nil
+}
+
+// Events handles the /api/v1/events request to stream the registry events
+// as Server-Sent Events. Each event carries its sequence number as id, so
+// the client resumes with Last-Event-ID after a reconnection.
+// Request URL: http://IP:Port/api/v1/events?types=did.revoked,did.updated
+func Events(c *ctx.Context) {
+	after, types, err := parseEventsReq(c)
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	// The writes of the events and of the heartbeats must not interleave
+	var mu sync.Mutex
+	started := false
+	write := func(format string, args ...any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !started {
+			c.Status(http.StatusOK)
+			started = true
+		}
+		if _, err := fmt.Fprintf(c.Writer, format, args...); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				write(": ping\n\n")
+			}
+		}
+	}()
+
+	// Send the headers right away, the first event may take a while
+	if err = write(": connected\n\n"); err != nil {
+		return
+	}
+
+	watchCtx, cancel := streamContext(c)
+	defer cancel()
+	err = c.Registry.Watch(watchCtx, after, func(e registry.Event) error {
+		if types != nil && !types[e.Type] {
+			return nil
+		}
+		e, ok := ReadableEvent(c.Request.Context(), e)
+		if !ok {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return write("id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	})
+	switch err {
+	case registry.ErrEventsExpired:
+		// The client has to resynchronize, tell it through a final event
+		write("event: expired\ndata: %s\n\n", strconv.Quote(err.Error()))
+	case registry.ErrWatchLagging:
+		logFor(c).Warn("Event stream of %v fell behind, closed", c.ClientIP())
+	}
+}
+
+// EventsWebSocket handles the /api/v1/events/ws request to stream the
+// registry events over a WebSocket, one JSON event per text message.
+// Resume with the lastEventId param, browsers cannot set headers.
+func EventsWebSocket(c *ctx.Context) {
+	after, types, err := parseEventsReq(c)
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logFor(c).Error("Upgrade the event stream to WebSocket failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Read the connection to answer pings and notice when the client leaves
+	watchCtx, cancel := streamContext(c)
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatInterval))
+			}
+		}
+	}()
+
+	err = c.Registry.Watch(watchCtx, after, func(e registry.Event) error {
+		if types != nil && !types[e.Type] {
+			return nil
+		}
+		e, ok := ReadableEvent(c.Request.Context(), e)
+		if !ok {
+			return nil
+		}
+		return conn.WriteJSON(e)
+	})
+
+	code, reason := websocket.CloseNormalClosure, ""
+	switch {
+	case err == registry.ErrEventsExpired:
+		code, reason = closeEventsExpired, err.Error()
+	case err == registry.ErrWatchLagging:
+		logFor(c).Warn("Event stream of %v fell behind, closed", c.ClientIP())
+		code, reason = websocket.CloseTryAgainLater, err.Error()
+	case isClosed(c.Shutdown):
+		// The client resumes on another server with the last event ID
+		code, reason = websocket.CloseGoingAway, "The server is shutting down"
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+// streamContext returns the context of an event stream, it is done when
+// the client leaves or the server drains
+func streamContext(c *ctx.Context) (context.Context, context.CancelFunc) {
+	watchCtx, cancel := context.WithCancel(c.Request.Context())
+	if c.Shutdown != nil {
+		go func() {
+			select {
+			case <-c.Shutdown:
+				cancel()
+			case <-watchCtx.Done():
+			}
+		}()
+	}
+	return watchCtx, cancel
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	if ch == nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
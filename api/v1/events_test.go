@@ -0,0 +1,128 @@
+package v1
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// serve exposes the handler on a local server, the streams need a real connection
+func (env *testEnv) serve(t *testing.T, path string, h func(*ctx.Context)) *httptest.Server {
+	r := gin.New()
+	r.GET(path, func(c *gin.Context) {
+		context := env.Context
+		context.Context = c
+		h(&context)
+	})
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (env *testEnv) createIdentity(t *testing.T) string {
+	id := registrytest.NewIdentity(t, env.CSP)
+	ddo := id.Document(t, env.Registry)
+	if err := env.Registry.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	return id.Did
+}
+
+func TestEventsSSE(t *testing.T) {
+	env := newTestEnv(t)
+	first := env.createIdentity(t)
+	srv := env.serve(t, "/api/v1/events", Events)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/events?types=did.created", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %v", ct)
+	}
+
+	events := make(chan registry.Event)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+				var e registry.Event
+				json.Unmarshal([]byte(data), &e)
+				events <- e
+			}
+		}
+		close(events)
+	}()
+
+	// The first event is replayed from the change log, the second one is live
+	if e := <-events; e.Seq != 1 || e.Did != first {
+		t.Fatalf("Unexpected replayed event: %+v", e)
+	}
+	second := env.createIdentity(t)
+	select {
+	case e := <-events:
+		if e.Seq != 2 || e.Did != second {
+			t.Fatalf("Unexpected live event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the live event")
+	}
+}
+
+func TestEventsWebSocket(t *testing.T) {
+	env := newTestEnv(t)
+	first := env.createIdentity(t)
+	srv := env.serve(t, "/api/v1/events/ws", EventsWebSocket)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/events/ws?lastEventId=0"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var e registry.Event
+	if err = conn.ReadJSON(&e); err != nil || e.Seq != 1 || e.Did != first {
+		t.Fatalf("Unexpected replayed event: %+v %v", e, err)
+	}
+	second := env.createIdentity(t)
+	if err = conn.ReadJSON(&e); err != nil || e.Seq != 2 || e.Did != second {
+		t.Fatalf("Unexpected live event: %+v %v", e, err)
+	}
+}
+
+func TestEventsShutdown(t *testing.T) {
+	env := newTestEnv(t)
+	shutdown := make(chan struct{})
+	env.Shutdown = shutdown
+	srv := env.serve(t, "/api/v1/events/ws", EventsWebSocket)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/events/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The stream ends when the server drains, the client resumes elsewhere
+	close(shutdown)
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("Expected the going away close, got %v", err)
+	}
+}
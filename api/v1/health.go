@@ -0,0 +1,30 @@
+package v1
+
+import (
+	"net/http"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/health"
+	"github.com/gin-gonic/gin"
+)
+
+// Healthz handles the /healthz liveness probe, answering is enough
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, health.Report{Status: health.StatusOK})
+}
+
+// Readyz handles the /readyz readiness probe, it checks the store backend
+// and the crypto service provider, and fails while the server drains
+func Readyz(c *ctx.Context) {
+	report := &health.Report{Status: health.StatusOK}
+	if c.Health != nil {
+		report = c.Health.Check(c.Request.Context())
+	}
+
+	status := http.StatusOK
+	if !report.Ready() {
+		logFor(c).Warn("Readiness check failed: %v %v", report.Status, report.Checks)
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
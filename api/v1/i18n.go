@@ -0,0 +1,117 @@
+package v1
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// languageKey is the key of the language of the messages in the gin context
+const languageKey = "language"
+
+// msgSuccess is the message key of the successful responses
+const msgSuccess = "SUCCESS"
+
+// Languages lists the languages of the messages
+var Languages = []language.Tag{language.English, language.SimplifiedChinese}
+
+// messages holds the translations of the response messages, keyed by the
+// string code of the error catalogue
+var messages = map[language.Tag]map[string]string{
+	language.English: {
+		msgSuccess:                 "Success",
+		ErrInvalidRequest.Name:     "The request is invalid",
+		ErrInvalidSignature.Name:   "The signature is invalid",
+		ErrUnsupportedKeyType.Name: "The key type is not supported",
+		ErrPermissionDenied.Name:   "Permission denied",
+		ErrDidNotFound.Name:        "The DID does not exist",
+		ErrNotFound.Name:           "The resource does not exist",
+		ErrConflict.Name:           "The operation conflicts with the current state",
+		ErrFeatureDisabled.Name:    "The feature is not enabled",
+		ErrBatchAborted.Name:       "The batch was aborted",
+		ErrUnauthenticated.Name:    "Authentication required",
+		ErrRateLimited.Name:        "Too many requests, retry later",
+		ErrPreconditionFailed.Name: "The document changed since the version of the request",
+		ErrKeyReused.Name:          "The idempotency key was used with another request",
+		ErrInProgress.Name:         "The request is still in progress, retry later",
+		ErrInternal.Name:           "Internal server error",
+		ErrBackendUnavailable.Name: "The storage backend is unavailable",
+	},
+	language.SimplifiedChinese: {
+		msgSuccess:                 "操作成功",
+		ErrInvalidRequest.Name:     "请求无效",
+		ErrInvalidSignature.Name:   "签名无效",
+		ErrUnsupportedKeyType.Name: "不支持的密钥类型",
+		ErrPermissionDenied.Name:   "没有权限",
+		ErrDidNotFound.Name:        "DID 不存在",
+		ErrNotFound.Name:           "资源不存在",
+		ErrConflict.Name:           "操作与当前状态冲突",
+		ErrFeatureDisabled.Name:    "功能未启用",
+		ErrBatchAborted.Name:       "批量操作已中止",
+		ErrUnauthenticated.Name:    "需要身份认证",
+		ErrRateLimited.Name:        "请求过于频繁，请稍后重试",
+		ErrPreconditionFailed.Name: "文档已在请求的版本之后被修改",
+		ErrKeyReused.Name:          "幂等键已被用于其他请求",
+		ErrInProgress.Name:         "请求仍在处理中，请稍后重试",
+		ErrInternal.Name:           "服务器内部错误",
+		ErrBackendUnavailable.Name: "存储后端不可用",
+	},
+}
+
+// ParseLanguage returns the supported language matching the BCP 47 tag
+func ParseLanguage(s string) (language.Tag, error) {
+	tag, err := language.Parse(s)
+	if err != nil {
+		return language.Und, fmt.Errorf("invalid language %q: %v", s, err)
+	}
+	_, i, conf := language.NewMatcher(Languages).Match(tag)
+	if conf == language.No {
+		return language.Und, fmt.Errorf("language %q is not supported, use one of %v", s, Languages)
+	}
+	return Languages[i], nil
+}
+
+// Localize selects the language of the response messages from the
+// Accept-Language header, def is used when none of them is supported
+func Localize(def language.Tag) gin.HandlerFunc {
+	supported := []language.Tag{def}
+	for _, tag := range Languages {
+		if tag != def {
+			supported = append(supported, tag)
+		}
+	}
+	matcher := language.NewMatcher(supported)
+
+	return func(c *gin.Context) {
+		tag := def
+		if accept := c.GetHeader("Accept-Language"); accept != "" {
+			if tags, _, err := language.ParseAcceptLanguage(accept); err == nil && len(tags) > 0 {
+				if _, i, conf := matcher.Match(tags...); conf != language.No {
+					tag = supported[i]
+				}
+			}
+		}
+		c.Set(languageKey, tag)
+		c.Header("Content-Language", tag.String())
+		c.Next()
+	}
+}
+
+// requestLanguage returns the language selected by Localize, English
+// when it did not run
+func requestLanguage(c *gin.Context) language.Tag {
+	if v, ok := c.Get(languageKey); ok {
+		return v.(language.Tag)
+	}
+	return language.English
+}
+
+// message returns the message of the key in the language of the request
+func message(c *gin.Context, key string) string {
+	tag := requestLanguage(c)
+	if msg, ok := messages[tag][key]; ok {
+		return msg
+	}
+	return messages[language.English][key]
+}
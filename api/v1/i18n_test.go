@@ -0,0 +1,72 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+func TestLocalize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		def    language.Tag
+		accept string
+		msg    string
+	}{
+		{language.English, "", "The DID does not exist"},
+		{language.SimplifiedChinese, "", "DID 不存在"},
+		{language.English, "zh-CN,zh;q=0.9", "DID 不存在"},
+		{language.SimplifiedChinese, "en-US", "The DID does not exist"},
+		{language.SimplifiedChinese, "fr-FR", "DID 不存在"},
+		{language.English, "fr, zh;q=0.5", "DID 不存在"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest("GET", "/api/v1/did/resolve/did:example:missing", nil)
+		if c.accept != "" {
+			ctx.Request.Header.Set("Accept-Language", c.accept)
+		}
+
+		Localize(c.def)(ctx)
+		FailWithMessage(ErrDidNotFound, "DID document (did:example:missing) not found", ctx)
+
+		var resp io.Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Msg != c.msg || resp.Detail != "DID document (did:example:missing) not found" {
+			t.Errorf("Default %v, Accept-Language %q: unexpected response %+v", c.def, c.accept, resp)
+		}
+	}
+}
+
+func TestMessagesTranslated(t *testing.T) {
+	for _, tag := range Languages {
+		if messages[tag][msgSuccess] == "" {
+			t.Errorf("The success message has no %v translation", tag)
+		}
+		for _, code := range ErrorCodes {
+			if messages[tag][code.Name] == "" {
+				t.Errorf("%v has no %v translation", code.Name, tag)
+			}
+		}
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	if tag, err := ParseLanguage("zh-CN"); err != nil || tag != language.SimplifiedChinese {
+		t.Fatalf("Parse zh-CN failed: %v %v", tag, err)
+	}
+	if tag, err := ParseLanguage("en"); err != nil || tag != language.English {
+		t.Fatalf("Parse en failed: %v %v", tag, err)
+	}
+	if _, err := ParseLanguage("fr"); err == nil {
+		t.Fatal("fr should not be supported")
+	}
+}
@@ -0,0 +1,116 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry"
+)
+
+// KeyDids handles the /api/v1/keys/:fingerprint/dids request to list the
+// DIDs whose documents list the public key, revoked ones included.
+// It takes the same filter and paging params as ListDids.
+func KeyDids(c *ctx.Context) {
+	fingerprint, err := registry.ParseFingerprint(c.Param("fingerprint"))
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	opts, err := parseListDidsReq(c)
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+	opts.KeyFingerprint = fingerprint
+
+	dids, next, err := c.Registry.List(*opts)
+	if err != nil {
+		errMsg := fmt.Sprintf("List the DIDs of the key (%v) failed: %v", fingerprint, err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+		return
+	}
+	dids = readableDids(c.Request.Context(), dids)
+	if dids == nil {
+		dids = []io.DidSummary{}
+	}
+
+	OkWithData(io.ListDidsResp{
+		Dids:       dids,
+		NextCursor: next,
+	}, c.Context)
+}
+
+// ReportCompromise handles the /api/v1/admin/keys/:fingerprint/compromise
+// request to flag a public key as compromised in the resolution metadata
+// of every document listing it
+func ReportCompromise(c *ctx.Context) {
+	fingerprint, err := registry.ParseFingerprint(c.Param("fingerprint"))
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request params failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	var req io.ReportCompromiseReq
+	if c.Request.ContentLength != 0 {
+		if err = c.BindJSON(&req); err != nil {
+			errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+			logFor(c).Error(errMsg)
+			FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+			return
+		}
+	}
+
+	report, dids, err := c.Registry.ReportCompromise(fingerprint, req.Reason)
+	if err != nil {
+		errMsg := fmt.Sprintf("Report the key (%v) as compromised failed: %v", fingerprint, err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+		return
+	}
+	if dids == nil {
+		dids = []string{}
+	}
+
+	logFor(c).Warn("Key %v reported as compromised, %d DIDs affected", fingerprint, len(dids))
+
+	OkWithData(io.ReportCompromiseResp{
+		Fingerprint: report.Fingerprint,
+		Reason:      report.Reason,
+		Reported:    report.Reported,
+		Dids:        dids,
+	}, c.Context)
+}
+
+// AppKeys handles the /api/v1/appkeys request to publish the application
+// keys, the current one signs the exports and the retired ones still
+// verify the former exports
+func AppKeys(c *ctx.Context) {
+	k := c.AppKey
+	resp := io.AppKeysResp{
+		Current: io.AppKey{
+			ID:           k.ID,
+			Type:         k.Type,
+			PublicKeyHex: k.PublicKeyHex(),
+		},
+		Retired: []io.AppKey{},
+	}
+	for _, r := range k.Retired {
+		resp.Retired = append(resp.Retired, io.AppKey{
+			ID:           r.ID,
+			Type:         strings.ToUpper(r.Type),
+			PublicKeyHex: strings.ToLower(r.PublicKeyHex),
+			Retired:      r.Retired,
+		})
+	}
+	OkWithData(resp, c.Context)
+}
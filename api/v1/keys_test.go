@@ -0,0 +1,63 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/ewangplay/serval/utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyDidsAndCompromise(t *testing.T) {
+	env := newTestEnv(t)
+	id := registrytest.NewIdentity(t, env.CSP)
+	if status, _ := env.create(t, id.Did, id.Document(t, env.Registry)); status != http.StatusOK {
+		t.Fatalf("CreateDid failed: %d", status)
+	}
+
+	fp, err := utils.KeyFingerprint(registrytest.PublicKeyHex(t, id.RecoveryKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := gin.Params{{Key: "fingerprint", Value: fp}}
+
+	status, resp := env.call(t, KeyDids, http.MethodGet, "/api/v1/keys/"+fp+"/dids", nil, params)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("KeyDids failed: %d %+v", status, resp)
+	}
+	data, _ := json.Marshal(resp.Data)
+	var page io.ListDidsResp
+	if err = json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Dids) != 1 || page.Dids[0].Did != id.Did {
+		t.Fatalf("Unexpected DIDs: %+v", page)
+	}
+
+	req := io.ReportCompromiseReq{Reason: "lost device"}
+	status, resp = env.call(t, ReportCompromise, http.MethodPost, "/api/v1/admin/keys/"+fp+"/compromise", req, params)
+	if status != http.StatusOK || resp.Code != SUCCESS {
+		t.Fatalf("ReportCompromise failed: %d %+v", status, resp)
+	}
+
+	status, resp = env.resolve(t, id.Did)
+	if status != http.StatusOK {
+		t.Fatalf("ResolveDid failed: %d %+v", status, resp)
+	}
+	data, _ = json.Marshal(resp.Data)
+	var result io.ResolveDidResp
+	if err = json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Metadata == nil || len(result.Metadata.CompromisedKeys) != 1 {
+		t.Fatalf("Compromised key not flagged: %+v", result.Metadata)
+	}
+
+	bad := gin.Params{{Key: "fingerprint", Value: "xyz"}}
+	if status, _ = env.call(t, KeyDids, http.MethodGet, "/api/v1/keys/xyz/dids", nil, bad); status != http.StatusBadRequest {
+		t.Fatalf("KeyDids should reject an invalid fingerprint: %d", status)
+	}
+}
@@ -0,0 +1,49 @@
+package v1
+
+import (
+	"fmt"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+)
+
+// LogLevels handles the GET /api/v1/admin/log/levels request to list the
+// levels of the log modules
+func LogLevels(c *ctx.Context) {
+	OkWithData(log.Levels(), c.Context)
+}
+
+// SetLogLevel handles the PUT /api/v1/admin/log/levels/:module request to
+// change the level of a log module, the level of the config is back after
+// a restart
+func SetLogLevel(c *ctx.Context) {
+	module := c.Param("module")
+
+	var req io.SetLogLevelReq
+	err := c.BindJSON(&req)
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+	if _, err = log.ParseLevel(req.Level); err != nil || req.Level == "" {
+		errMsg := fmt.Sprintf("Parse the log level failed: %q", req.Level)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	err = log.SetLevel(module, req.Level)
+	if err != nil {
+		errMsg := fmt.Sprintf("Set the log level failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrNotFound, errMsg, c.Context)
+		return
+	}
+
+	logFor(c).Warn("Log level of %s set to %s", module, req.Level)
+
+	OkWithData(log.Levels(), c.Context)
+}
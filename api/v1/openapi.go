@@ -0,0 +1,32 @@
+package v1
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec is the OpenAPI document of the /api/v1 routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// LoadOpenAPI parses and checks the OpenAPI document of the API
+func LoadOpenAPI() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, err
+	}
+	if err = doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// OpenAPI handles the /api/v1/openapi.json request
+func OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPISpec)
+}
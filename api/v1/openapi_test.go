@@ -0,0 +1,22 @@
+package v1
+
+import (
+	"testing"
+)
+
+func TestOpenAPIErrorCatalogue(t *testing.T) {
+	doc, err := LoadOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enum := doc.Components.Schemas["ErrorCode"].Value.Enum
+	if len(enum) != len(ErrorCodes) {
+		t.Fatalf("The OpenAPI document lists %d error codes, the catalogue %d", len(enum), len(ErrorCodes))
+	}
+	for i, code := range ErrorCodes {
+		if enum[i] != code.Name {
+			t.Errorf("Error code %d is %v in the OpenAPI document, %v in the catalogue", i, enum[i], code.Name)
+		}
+	}
+}
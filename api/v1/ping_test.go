@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
 )
 
 func ExamplePong() {
@@ -15,8 +16,10 @@ func ExamplePong() {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 	c.Request = httptest.NewRequest("GET", "http://localhost:8080/api/v1/ping", nil)
+	c.Request.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
 
 	// Call target handler
+	Localize(language.English)(c)
 	Pong(c)
 
 	// Verify the results returned
@@ -28,5 +31,5 @@ func ExamplePong() {
 	// Output:
 	// 200
 	// application/json; charset=utf-8
-	// {"message":"pong"}
+	// {"code":0,"data":{"message":"pong"},"msg":"操作成功"}
 }
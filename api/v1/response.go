@@ -3,17 +3,77 @@ package v1
 import (
 	"net/http"
 
+	ctx "github.com/ewangplay/serval/context"
 	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
 	"github.com/gin-gonic/gin"
 )
 
+var logger = log.Module("api")
+
+// logFor returns the logger of the handlers, the logs carry the ID and the
+// trace of the request
+func logFor(c *ctx.Context) *log.Logger {
+	return logger.Ctx(c.Request.Context())
+}
+
 const (
-	ERROR   = -1
 	SUCCESS = 0
 )
 
+// ErrorCode is an entry of the error catalogue. The numeric and the string
+// codes are stable, clients may rely on them, the messages may change.
+type ErrorCode struct {
+	// Code is the code of the response envelope
+	Code int
+	// Name is the error of the response envelope
+	Name string
+	// Status is the HTTP status of the response
+	Status int
+}
+
+// The error catalogue, the 1xxx codes are the faults of the client and
+// the 2xxx ones the faults of the server
+var (
+	ErrInvalidRequest     = ErrorCode{1001, "INVALID_REQUEST", http.StatusBadRequest}
+	ErrInvalidSignature   = ErrorCode{1002, "INVALID_SIGNATURE", http.StatusBadRequest}
+	ErrUnsupportedKeyType = ErrorCode{1003, "UNSUPPORTED_KEY_TYPE", http.StatusBadRequest}
+	ErrPermissionDenied   = ErrorCode{1004, "PERMISSION_DENIED", http.StatusForbidden}
+	ErrDidNotFound        = ErrorCode{1005, "DID_NOT_FOUND", http.StatusNotFound}
+	ErrNotFound           = ErrorCode{1006, "NOT_FOUND", http.StatusNotFound}
+	ErrConflict           = ErrorCode{1007, "CONFLICT", http.StatusConflict}
+	ErrFeatureDisabled    = ErrorCode{1008, "FEATURE_DISABLED", http.StatusConflict}
+	ErrBatchAborted       = ErrorCode{1009, "BATCH_ABORTED", http.StatusConflict}
+	ErrUnauthenticated    = ErrorCode{1010, "UNAUTHENTICATED", http.StatusUnauthorized}
+	ErrRateLimited        = ErrorCode{1011, "RATE_LIMITED", http.StatusTooManyRequests}
+	ErrPreconditionFailed = ErrorCode{1012, "PRECONDITION_FAILED", http.StatusPreconditionFailed}
+	ErrKeyReused          = ErrorCode{1013, "IDEMPOTENCY_KEY_REUSED", http.StatusUnprocessableEntity}
+	ErrInProgress         = ErrorCode{1014, "REQUEST_IN_PROGRESS", http.StatusConflict}
+	ErrInternal           = ErrorCode{2001, "INTERNAL", http.StatusInternalServerError}
+	ErrBackendUnavailable = ErrorCode{2002, "BACKEND_UNAVAILABLE", http.StatusServiceUnavailable}
+)
+
+// ErrorCodes lists the error catalogue
+var ErrorCodes = []ErrorCode{
+	ErrInvalidRequest,
+	ErrInvalidSignature,
+	ErrUnsupportedKeyType,
+	ErrPermissionDenied,
+	ErrDidNotFound,
+	ErrNotFound,
+	ErrConflict,
+	ErrFeatureDisabled,
+	ErrBatchAborted,
+	ErrUnauthenticated,
+	ErrRateLimited,
+	ErrPreconditionFailed,
+	ErrKeyReused,
+	ErrInProgress,
+	ErrInternal,
+	ErrBackendUnavailable,
+}
+
 func SuccResult(code int, data any, msg string, c *gin.Context) {
-	// 开始时间
 	c.JSON(http.StatusOK, io.Response{
 		Code: code,
 		Msg:  msg,
@@ -21,17 +81,20 @@ func SuccResult(code int, data any, msg string, c *gin.Context) {
 	})
 }
 
-func FailResult(status int, code int, data any, msg string, c *gin.Context) {
-	// 开始时间
-	c.AbortWithStatusJSON(status, io.Response{
-		Code: code,
-		Msg:  msg,
-		Data: data,
+// FailResult answers with the message of the code in the language of the
+// request, the detail tells the reason of the failure
+func FailResult(code ErrorCode, data any, detail string, c *gin.Context) {
+	c.AbortWithStatusJSON(code.Status, io.Response{
+		Code:   code.Code,
+		Error:  code.Name,
+		Msg:    message(c, code.Name),
+		Detail: detail,
+		Data:   data,
 	})
 }
 
 func Ok(c *gin.Context) {
-	SuccResult(SUCCESS, map[string]any{}, "操作成功", c)
+	SuccResult(SUCCESS, map[string]any{}, message(c, msgSuccess), c)
 }
 
 func OkWithMessage(message string, c *gin.Context) {
@@ -39,21 +102,26 @@ func OkWithMessage(message string, c *gin.Context) {
 }
 
 func OkWithData(data any, c *gin.Context) {
-	SuccResult(SUCCESS, data, "操作成功", c)
+	SuccResult(SUCCESS, data, message(c, msgSuccess), c)
 }
 
 func OkWithDetailed(data any, message string, c *gin.Context) {
 	SuccResult(SUCCESS, data, message, c)
 }
 
-func Fail(status int, c *gin.Context) {
-	FailResult(status, ERROR, map[string]any{}, "操作失败", c)
+func Fail(code ErrorCode, c *gin.Context) {
+	FailResult(code, map[string]any{}, "", c)
+}
+
+func FailWithMessage(code ErrorCode, detail string, c *gin.Context) {
+	FailResult(code, map[string]any{}, detail, c)
 }
 
-func FailWithMessage(status int, message string, c *gin.Context) {
-	FailResult(status, ERROR, map[string]any{}, message, c)
+func FailWithDetailed(code ErrorCode, data any, detail string, c *gin.Context) {
+	FailResult(code, data, detail, c)
 }
 
-func FailWithDetailed(status int, data any, message string, c *gin.Context) {
-	FailResult(status, ERROR, data, message, c)
+// FailWithError answers with the code of the error, see Error
+func FailWithError(err error, c *gin.Context) {
+	FailResult(ErrorCodeOf(err), map[string]any{}, err.Error(), c)
 }
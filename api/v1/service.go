@@ -0,0 +1,446 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/metrics"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/utils"
+)
+
+// Error is the failure of an operation, with its code in the error catalogue
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorf(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ErrorCodeOf returns the code of the error, ErrInternal unless it is an *Error
+func ErrorCodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrInternal
+}
+
+// ErrorStatus returns the HTTP status of the error
+func ErrorStatus(err error) int {
+	return ErrorCodeOf(err).Status
+}
+
+// verifyErrorCode tells why the verification of a document or a proof failed
+func verifyErrorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, utils.ErrUnsupportedKeyType):
+		return ErrUnsupportedKeyType
+	case errors.Is(err, utils.ErrInvalidSignature):
+		return ErrInvalidSignature
+	}
+	return ErrInvalidRequest
+}
+
+// storeErrorCode tells a stored document failing its verification, a fault
+// of the server, from a failure of the storage backend
+func storeErrorCode(err error) ErrorCode {
+	if errors.Is(err, utils.ErrUnsupportedKeyType) || errors.Is(err, utils.ErrInvalidSignature) {
+		return ErrInternal
+	}
+	return ErrBackendUnavailable
+}
+
+// authorize checks the principal of the context may perform the action on
+// the DID, see auth.Check
+func authorize(ctx context.Context, action auth.Action, did string) error {
+	if err := auth.Check(ctx, action, did); err != nil {
+		return errorf(ErrPermissionDenied, "%v", err)
+	}
+	return nil
+}
+
+// readableDids returns the DIDs of the list the principal of the context
+// may read
+func readableDids(ctx context.Context, dids []io.DidSummary) []io.DidSummary {
+	readable := dids[:0]
+	for _, d := range dids {
+		if auth.Check(ctx, auth.ActionRead, d.Did) == nil {
+			readable = append(readable, d)
+		}
+	}
+	return readable
+}
+
+// ReadableEvent returns the event as the principal of the context may see
+// it. The events of the DIDs it may not read are left out, and the event
+// of a compromised key only lists the DIDs it may read.
+func ReadableEvent(ctx context.Context, e registry.Event) (registry.Event, bool) {
+	if e.Did != "" && auth.Check(ctx, auth.ActionRead, e.Did) != nil {
+		return e, false
+	}
+	if e.Dids != nil {
+		var dids []string
+		for _, did := range e.Dids {
+			if auth.Check(ctx, auth.ActionRead, did) == nil {
+				dids = append(dids, did)
+			}
+		}
+		e.Dids = dids
+	}
+	return e, true
+}
+
+// Service implements the DID operations shared by the HTTP and the gRPC
+// APIs, the context carries the principal of the caller when the
+// authentication is enabled
+type Service struct {
+	Registry *registry.Registry
+}
+
+// NewService creates the service on top of the registry
+func NewService(reg *registry.Registry) *Service {
+	return &Service{Registry: reg}
+}
+
+// CreateDid verifies and stores the document of a new DID, an existing
+// one, live or revoked, is a conflict
+func (s *Service) CreateDid(ctx context.Context, req *io.CreateDidReq) error {
+	reg := s.Registry.WithContext(ctx)
+	if err := checkCreate(ctx, reg, req.Did, &req.Document); err != nil {
+		return err
+	}
+
+	// Set the DID/DDO record to store
+	return createError(req.Did, reg.Create(req.Did, &req.Document))
+}
+
+// checkCreate runs the checks of the document of a new DID before it is stored
+func checkCreate(ctx context.Context, reg *registry.Registry, did string, ddo *io.DDO) error {
+	if err := registry.ValidDid(did); err != nil {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: %v", err)
+	}
+	if err := authorize(ctx, auth.ActionCreate, did); err != nil {
+		return err
+	}
+	if ddo.ID != did {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: The document id (%v) does not match the DID", ddo.ID)
+	}
+
+	// Verify the DID document
+	if err := reg.Verify(ddo); err != nil {
+		return errorf(verifyErrorCode(err), "Parse the request body failed: %v", err)
+	}
+	return nil
+}
+
+// createError returns the error of storing the document of a new DID
+func createError(did string, err error) error {
+	if err == registry.ErrExists {
+		return errorf(ErrConflict, "DID document (%v) already exists, update it instead", did)
+	}
+	if err != nil {
+		return errorf(ErrBackendUnavailable, "Set the DID/DDO record to store failed: %v", err)
+	}
+	return nil
+}
+
+// ResolveDid returns the verified DID document and its metadata
+func (s *Service) ResolveDid(ctx context.Context, did string) (*io.ResolveDidResp, error) {
+	if err := checkResolve(ctx, did); err != nil {
+		return nil, err
+	}
+	reg := s.Registry.WithContext(ctx)
+
+	ddo, meta, err := reg.Resolve(did)
+	if err != nil {
+		return nil, resolveError(did, err)
+	}
+
+	return &io.ResolveDidResp{
+		Did:      did,
+		Document: *ddo,
+		Metadata: documentMetadata(meta),
+	}, nil
+}
+
+// checkResolve runs the checks of a DID before it is read
+func checkResolve(ctx context.Context, did string) error {
+	if err := registry.ValidDid(did); err != nil {
+		return errorf(ErrInvalidRequest, "Parse the request params failed: %v", err)
+	}
+	return authorize(ctx, auth.ActionRead, did)
+}
+
+// resolveError returns the error of resolving the DID
+func resolveError(did string, err error) error {
+	if err == registry.ErrNotFound {
+		return errorf(ErrDidNotFound, "DID document (%v) not found", did)
+	}
+	return errorf(storeErrorCode(err), "Failed to resolve the DID document (%v): %v", did, err)
+}
+
+// BatchCreateDid creates the DIDs of the batch, every item goes through the
+// checks of CreateDid. The batch is refused as a whole when a DID is out of
+// the namespaces granted to the caller.
+func (s *Service) BatchCreateDid(ctx context.Context, req *io.BatchCreateReq) (*io.BatchCreateResp, error) {
+	for i := range req.Items {
+		if err := authorize(ctx, auth.ActionCreate, req.Items[i].Did); err != nil {
+			return nil, err
+		}
+	}
+	reg := s.Registry.WithContext(ctx)
+
+	items := make([]registry.BatchItem, len(req.Items))
+	for i := range req.Items {
+		items[i] = registry.BatchItem{
+			Did:      req.Items[i].Did,
+			Document: &req.Items[i].Document,
+		}
+	}
+	errs, err := reg.CreateBatch(items, req.Atomic, func(item registry.BatchItem) error {
+		return checkCreate(ctx, reg, item.Did, item.Document)
+	})
+	if err != nil {
+		return nil, errorf(ErrBackendUnavailable, "Create the batch of DIDs failed: %v", err)
+	}
+
+	resp := &io.BatchCreateResp{
+		Results: make([]io.BatchItemResult, len(items)),
+	}
+	for i, err := range errs {
+		resp.Results[i] = io.BatchItemResult{Did: items[i].Did, Ok: err == nil}
+		if err != nil {
+			err = batchItemError(items[i].Did, err)
+			resp.Results[i].Error = err.Error()
+			resp.Results[i].Code = ErrorCodeOf(err).Name
+			resp.Failed++
+		} else {
+			resp.Created++
+		}
+	}
+	return resp, nil
+}
+
+// batchItemError returns the error of an item of a batch creation
+func batchItemError(did string, err error) error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case err == registry.ErrBatchAborted:
+		return errorf(ErrBatchAborted, "%v", err)
+	case errors.Is(err, registry.ErrInvalidItem):
+		return errorf(ErrInvalidRequest, "%v", err)
+	}
+	return createError(did, err)
+}
+
+// BatchResolveDid resolves the DIDs of the batch, every DID goes through
+// the checks of ResolveDid and the failed ones are reported in their result
+func (s *Service) BatchResolveDid(ctx context.Context, dids []string) *io.BatchResolveResp {
+	resp := &io.BatchResolveResp{
+		Results: make([]io.BatchResolveResult, len(dids)),
+	}
+	var valid []string
+	var index []int
+	for i, did := range dids {
+		if err := checkResolve(ctx, did); err != nil {
+			resp.Results[i] = io.BatchResolveResult{Did: did, Error: err.Error(), Code: ErrorCodeOf(err).Name}
+			continue
+		}
+		valid = append(valid, did)
+		index = append(index, i)
+	}
+
+	for j, res := range s.Registry.WithContext(ctx).ResolveBatch(valid) {
+		i := index[j]
+		if res.Err != nil {
+			err := resolveError(res.Did, res.Err)
+			resp.Results[i] = io.BatchResolveResult{Did: res.Did, Error: err.Error(), Code: ErrorCodeOf(err).Name}
+			continue
+		}
+		resp.Results[i] = io.BatchResolveResult{
+			Did:      res.Did,
+			Document: res.Document,
+			Metadata: documentMetadata(res.Metadata),
+		}
+	}
+	return resp
+}
+
+// UpdateDid replaces the document of a live DID. The new document must be
+// signed by one of the authentication keys of the current one. Unless
+// ifMatch is empty, the version of the current document must match it, see
+// versionMatch.
+func (s *Service) UpdateDid(ctx context.Context, req *io.UpdateDidReq, ifMatch string) error {
+	if req.Did == "" {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: The DID parameter cannot be empty")
+	}
+	if err := registry.ValidDid(req.Did); err != nil {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: %v", err)
+	}
+	if err := authorize(ctx, auth.ActionUpdate, req.Did); err != nil {
+		return err
+	}
+	reg := s.Registry.WithContext(ctx)
+	if req.Document.ID != req.Did {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: The document id (%v) does not match the DID", req.Document.ID)
+	}
+	err := reg.Verify(&req.Document)
+	if err != nil {
+		return errorf(verifyErrorCode(err), "Parse the request body failed: %v", err)
+	}
+
+	err = reg.Update(req.Did, &req.Document, func(current *io.DDO) error {
+		if ifMatch != "" {
+			if err := checkVersion(reg, req.Did, ifMatch); err != nil {
+				return err
+			}
+		}
+		return authorizeUpdate(current, &req.Document)
+	})
+	switch err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return err
+	}
+	if err == registry.ErrNotFound {
+		return errorf(ErrDidNotFound, "DID document (%v) not found", req.Did)
+	}
+	return errorf(ErrBackendUnavailable, "Update the DID/DDO (%s) record failed: %v", req.Did, err)
+}
+
+// checkVersion checks the version of the current document matches the
+// If-Match precondition, the caller holds the lock of the DID
+func checkVersion(reg *registry.Registry, did, ifMatch string) error {
+	version := 1
+	meta, found, err := reg.Metadata(did)
+	if err != nil {
+		return err
+	}
+	if found {
+		version = meta.Version
+	}
+	ok, err := versionMatch(ifMatch, version)
+	if err != nil {
+		return errorf(ErrInvalidRequest, "Parse the If-Match precondition failed: %v", err)
+	}
+	if !ok {
+		return errorf(ErrPreconditionFailed, "The DID document (%v) is at version %d, not %s", did, version, ifMatch)
+	}
+	return nil
+}
+
+// versionMatch tells whether the If-Match list of entity tags holding
+// versions matches the version. A tag is the version, like "3", or the ETag
+// of a resolution, like "3-<hash>", whose version alone is compared: the
+// update applies to the document whatever the language of the resolution.
+// * matches any version, and the weak tags never match.
+func versionMatch(ifMatch string, version int) (bool, error) {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true, nil
+		}
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(strings.Trim(tag, `"`), "-")
+		v, err := strconv.Atoi(prefix)
+		if err != nil {
+			return false, fmt.Errorf("%q is not a version", tag)
+		}
+		if v == version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorizeUpdate checks the new document is signed by an authentication
+// key of the current document
+func authorizeUpdate(current, next *io.DDO) error {
+	creator := next.Proof.Creator
+	authorized := false
+	for _, id := range current.Authentication {
+		if id == creator {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return errorf(ErrPermissionDenied, "The signer (%v) is not an authentication key of the current document", creator)
+	}
+
+	// The signature was verified with the key listed in the new document,
+	// it must be the same key as in the current one
+	keyHex := func(ddo *io.DDO) string {
+		for _, pk := range ddo.PublicKey {
+			if pk.ID == creator {
+				return pk.PublicKeyHex
+			}
+		}
+		return ""
+	}
+	if k := keyHex(current); k == "" || k != keyHex(next) {
+		return errorf(ErrPermissionDenied, "The signer (%v) does not match the key of the current document", creator)
+	}
+	return nil
+}
+
+// RevokeDid checks the proof signed by the recovery key and deactivates the DID
+func (s *Service) RevokeDid(ctx context.Context, req *io.RevokeDidReq) error {
+	// Check the params
+	if req.Did == "" {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: The DID parameter cannot be empty")
+	}
+	if err := registry.ValidDid(req.Did); err != nil {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: %v", err)
+	}
+	if err := authorize(ctx, auth.ActionRevoke, req.Did); err != nil {
+		return err
+	}
+	reg := s.Registry.WithContext(ctx)
+	if req.Proof.Type == "" || req.Proof.Creator == "" || req.Proof.SignatureValue == "" {
+		return errorf(ErrInvalidRequest, "Parse the request body failed: The Proof parameter cannot be empty")
+	}
+
+	// Get and verify the DID document
+	ddo, _, err := reg.Resolve(req.Did)
+	if err == registry.ErrNotFound {
+		return errorf(ErrDidNotFound, "DID document (%v) not found", req.Did)
+	}
+	if err != nil {
+		return errorf(storeErrorCode(err), "Failed to resolve the DID document (%v): %v", req.Did, err)
+	}
+
+	// Verify the proof
+	valid, err := utils.VerifyProof(reg.CSP(), req.Did, &req.Proof, ddo)
+	metrics.ObserveVerification(metrics.TargetProof, req.Proof.Type, valid, err)
+	if err != nil {
+		return errorf(verifyErrorCode(err), "Parse the request body failed: %v", err)
+	}
+	if !valid {
+		return errorf(ErrInvalidSignature, "Parse the request body failed: Failed to verify the signature of the Proof")
+	}
+
+	// Deactivate the DID/DDO record, a tombstone stays in the store
+	err = reg.Revoke(req.Did)
+	if err != nil {
+		return errorf(ErrBackendUnavailable, "Delete the DID/DDO (%s) record from store failed: %v", req.Did, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package v1
+
+import (
+	"fmt"
+
+	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/webhook"
+)
+
+func webhooksEnabled(c *ctx.Context) bool {
+	if c.Webhooks == nil {
+		FailWithMessage(ErrFeatureDisabled, "Webhooks are not enabled", c.Context)
+		return false
+	}
+	return true
+}
+
+// Subscribe handles the POST /api/v1/admin/webhooks request to register a
+// callback. The response holds the secret signing the callbacks, it is
+// never returned again.
+func Subscribe(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	var req webhook.Subscription
+	err := c.BindJSON(&req)
+	if err != nil {
+		errMsg := fmt.Sprintf("Parse the request body failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	sub, err := c.Webhooks.Subscribe(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("Subscribe the webhook failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrInvalidRequest, errMsg, c.Context)
+		return
+	}
+
+	logFor(c).Info("Webhook %v subscribed to %v", sub.ID, sub.URL)
+
+	OkWithData(sub, c.Context)
+}
+
+// Subscriptions handles the GET /api/v1/admin/webhooks request to list the callbacks
+func Subscriptions(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	subs, err := c.Webhooks.Subscriptions()
+	if err != nil {
+		errMsg := fmt.Sprintf("List the webhooks failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+		return
+	}
+	if subs == nil {
+		subs = []webhook.Subscription{}
+	}
+
+	OkWithData(subs, c.Context)
+}
+
+// Unsubscribe handles the DELETE /api/v1/admin/webhooks/:id request to remove a callback
+func Unsubscribe(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	id := c.Param("id")
+	err := c.Webhooks.Unsubscribe(id)
+	if err != nil {
+		webhookFailure(c, fmt.Sprintf("Unsubscribe the webhook (%v) failed", id), err)
+		return
+	}
+
+	logFor(c).Info("Webhook %v unsubscribed", id)
+
+	Ok(c.Context)
+}
+
+// DeadLetters handles the GET /api/v1/admin/webhooks/deadletters request
+// to list the deliveries that failed every attempt
+func DeadLetters(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	dead, err := c.Webhooks.DeadLetters()
+	if err != nil {
+		errMsg := fmt.Sprintf("List the dead letters failed: %v", err)
+		logFor(c).Error(errMsg)
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+		return
+	}
+	if dead == nil {
+		dead = []webhook.Delivery{}
+	}
+
+	OkWithData(dead, c.Context)
+}
+
+// Redeliver handles the POST /api/v1/admin/webhooks/deadletters/:id/retry
+// request to queue a dead letter again
+func Redeliver(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	id := c.Param("id")
+	err := c.Webhooks.Redeliver(id)
+	if err != nil {
+		webhookFailure(c, fmt.Sprintf("Redeliver the dead letter (%v) failed", id), err)
+		return
+	}
+
+	Ok(c.Context)
+}
+
+// DropDeadLetter handles the DELETE /api/v1/admin/webhooks/deadletters/:id
+// request to discard a dead letter
+func DropDeadLetter(c *ctx.Context) {
+	if !webhooksEnabled(c) {
+		return
+	}
+
+	id := c.Param("id")
+	err := c.Webhooks.DropDeadLetter(id)
+	if err != nil {
+		webhookFailure(c, fmt.Sprintf("Drop the dead letter (%v) failed", id), err)
+		return
+	}
+
+	Ok(c.Context)
+}
+
+func webhookFailure(c *ctx.Context, msg string, err error) {
+	errMsg := fmt.Sprintf("%s: %v", msg, err)
+	logFor(c).Error(errMsg)
+	if err == webhook.ErrNotFound {
+		FailWithMessage(ErrNotFound, errMsg, c.Context)
+	} else {
+		FailWithMessage(ErrBackendUnavailable, errMsg, c.Context)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	cl "github.com/ewangplay/cryptolib"
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/config"
+	sio "github.com/ewangplay/serval/io"
+)
+
+const appKeyUsage = `Usage:
+  serval appkey new -keystore file -id id
+  serval appkey import -keystore file [-config file]
+  serval appkey rotate -keystore file -id id
+
+The passphrase of the keystore is read from -passphrase-file, or else from
+the environment variable named by -passphrase-env (SERVAL_KEYSTORE_PASSPHRASE).`
+
+// runAppKey handles `serval appkey`, it manages the keystore file of the
+// application key: new generates a key, import moves the privateKeyHex of
+// the config into a keystore, and rotate replaces the key by a new one,
+// keeping the former public key to verify the exports it signed
+func runAppKey(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, appKeyUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("appkey "+args[0], flag.ExitOnError)
+	keystore := fs.String("keystore", "", "path to the keystore file")
+	id := fs.String("id", "", "id of the new key, like did:example:123#keys-2")
+	filename := fs.String("config", "serval.yaml", "path to config file holding privateKeyHex, for import")
+	passphraseFile := fs.String("passphrase-file", "", "path to a file holding the passphrase")
+	passphraseEnv := fs.String("passphrase-env", adapter.DefaultPassphraseEnv, "environment variable holding the passphrase")
+	fs.Parse(args[1:])
+
+	if *keystore == "" {
+		fmt.Fprintln(os.Stderr, "The -keystore file is required")
+		os.Exit(2)
+	}
+	passphrase, err := adapter.ReadSecret(*passphraseFile, *passphraseEnv, adapter.DefaultPassphraseEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Read the passphrase failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	var (
+		ks   *adapter.Keystore
+		verb string
+	)
+	switch args[0] {
+	case "new":
+		verb = "Generate"
+		ks, err = newKeystore(*keystore, *id, passphrase)
+	case "import":
+		verb = "Import"
+		ks, err = importKeystore(*keystore, *filename, passphrase)
+	case "rotate":
+		verb = "Rotate"
+		ks, err = rotateKeystore(*keystore, *id, passphrase)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown appkey command %q, use new, import or rotate\n", args[0])
+		os.Exit(2)
+	}
+	if err == nil {
+		err = adapter.WriteKeystore(*keystore, ks)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s the application key failed: %v\n", verb, err)
+		os.Exit(1)
+	}
+
+	data, _ := json.MarshalIndent(publicKeys(ks), "", "  ")
+	fmt.Println(string(data))
+	if args[0] == "rotate" {
+		fmt.Fprintln(os.Stderr, "Restart serval to sign with the new key, GET /api/v1/appkeys publishes it")
+	}
+}
+
+func newKeystore(filename, id string, passphrase []byte) (*adapter.Keystore, error) {
+	if id == "" {
+		return nil, fmt.Errorf("the -id of the key is required")
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return nil, fmt.Errorf("%s exists, use rotate to replace its key", filename)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.NewKeystore(id, cl.ED25519, priv, passphrase)
+}
+
+func importKeystore(filename, configFile string, passphrase []byte) (*adapter.Keystore, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return nil, fmt.Errorf("%s exists", filename)
+	}
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	opts := cfg.AppKey
+	if opts.Source != "" && opts.Source != adapter.AppKeySourceConfig {
+		return nil, fmt.Errorf("the config reads the key from the %s source, not from privateKeyHex", opts.Source)
+	}
+	priv, err := hex.DecodeString(opts.PrivateKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("decode the application private key failed: %v", err)
+	}
+	ks, err := adapter.NewKeystore(opts.ID, opts.Type, priv, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks.Retired = opts.Retired
+	return ks, nil
+}
+
+func rotateKeystore(filename, id string, passphrase []byte) (*adapter.Keystore, error) {
+	if id == "" {
+		return nil, fmt.Errorf("the -id of the new key is required")
+	}
+	ks, err := adapter.ReadKeystore(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ks.Rotate(id, priv, passphrase, time.Now())
+}
+
+func publicKeys(ks *adapter.Keystore) sio.AppKeysResp {
+	resp := sio.AppKeysResp{
+		Current: sio.AppKey{ID: ks.ID, Type: ks.Type, PublicKeyHex: ks.PublicKeyHex},
+		Retired: []sio.AppKey{},
+	}
+	for _, r := range ks.Retired {
+		resp.Retired = append(resp.Retired, sio.AppKey{
+			ID:           r.ID,
+			Type:         r.Type,
+			PublicKeyHex: r.PublicKeyHex,
+			Retired:      r.Retired,
+		})
+	}
+	return resp
+}
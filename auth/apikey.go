@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// APIKey is an accepted API key. Only the digest of the key is configured,
+// generate it with `printf %s "$KEY" | sha256sum`.
+type APIKey struct {
+	// Name names the principal, apikey:<name>
+	Name string
+	// SHA256 is the hex encoded SHA-256 digest of the key
+	SHA256 string
+}
+
+type apiKeys struct {
+	names   []string
+	digests [][]byte
+}
+
+func newAPIKeys(keys []APIKey) (*apiKeys, error) {
+	s := &apiKeys{}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API key without name")
+		}
+		if seen[k.Name] {
+			return nil, fmt.Errorf("API key %s is defined twice", k.Name)
+		}
+		seen[k.Name] = true
+
+		digest, err := hex.DecodeString(k.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("API key %s: sha256 is not a hex encoded SHA-256 digest", k.Name)
+		}
+		s.names = append(s.names, k.Name)
+		s.digests = append(s.digests, digest)
+	}
+	return s, nil
+}
+
+// lookup returns the name of the key, the digests are compared in
+// constant time
+func (s *apiKeys) lookup(key string) (string, bool) {
+	digest := sha256.Sum256([]byte(key))
+	name, found := "", false
+	for i := range s.digests {
+		if subtle.ConstantTimeCompare(digest[:], s.digests[i]) == 1 {
+			name, found = s.names[i], true
+		}
+	}
+	return name, found
+}
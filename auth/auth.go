@@ -0,0 +1,328 @@
+// Package auth authenticates the callers of the APIs and checks what they
+// may do. A caller presents an API key, a bearer JWT or a TLS client
+// certificate, the policies grant the actions and the DID namespaces.
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Action is an operation guarded by the policies
+type Action string
+
+const (
+	// ActionRead resolves and lists the DIDs and watches the events
+	ActionRead Action = "did.read"
+	// ActionCreate registers new DIDs
+	ActionCreate Action = "did.create"
+	// ActionUpdate replaces DID documents
+	ActionUpdate Action = "did.update"
+	// ActionRevoke deactivates DIDs
+	ActionRevoke Action = "did.revoke"
+	// ActionAdmin calls the /api/v1/admin endpoints
+	ActionAdmin Action = "admin"
+)
+
+// Actions lists the actions a policy may grant
+var Actions = []Action{ActionRead, ActionCreate, ActionUpdate, ActionRevoke, ActionAdmin}
+
+// The authentication methods, they qualify the name of the principals
+const (
+	MethodAPIKey = "apikey"
+	MethodJWT    = "jwt"
+	MethodMTLS   = "mtls"
+)
+
+// Anonymous is the name of the principal of the requests without credentials
+const Anonymous = "anonymous"
+
+var (
+	// ErrUnauthenticated is returned when the credentials are invalid
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when no policy grants the action
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Options defines the authentication methods and the policies
+type Options struct {
+	Enabled bool
+	// AnonymousRead lets the requests without credentials resolve and list
+	// the DIDs and watch the events
+	AnonymousRead bool
+	// APIKeys are the keys accepted in the X-API-Key header or with the
+	// ApiKey scheme of the Authorization header
+	APIKeys []APIKey
+	// JWT verifies the bearer tokens, they are refused when it has no key
+	JWT JWTOptions
+	// MTLS accepts the verified client certificates of the TLS connections
+	MTLS MTLSOptions
+	// Policies grant the actions to the principals
+	Policies []Policy
+}
+
+// MTLSOptions defines the client certificate authentication
+type MTLSOptions struct {
+	// Enabled names the principal after the common name of the client
+	// certificate, the TLS listener must verify it against the client CA
+	Enabled bool
+}
+
+// Policy grants actions on DID namespaces to principals
+type Policy struct {
+	// Principals are path.Match patterns of the qualified names of the
+	// principals, such as "apikey:ci", "jwt:*" or "*". The anonymous
+	// principal only matches the pattern "anonymous".
+	Principals []string
+	// Actions are the granted actions
+	Actions []Action
+	// Namespaces are the DID prefixes the actions are granted on, such as
+	// "did:example:" or "did:example:org1:", all of the DIDs when empty
+	Namespaces []string
+}
+
+func (p *Policy) validate() error {
+	if len(p.Principals) == 0 {
+		return fmt.Errorf("no principals")
+	}
+	for _, pattern := range p.Principals {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("principal pattern %q: %v", pattern, err)
+		}
+	}
+	if len(p.Actions) == 0 {
+		return fmt.Errorf("no actions")
+	}
+	for _, action := range p.Actions {
+		if !knownAction(action) {
+			return fmt.Errorf("unknown action %q, use one of %v", action, Actions)
+		}
+	}
+	for _, ns := range p.Namespaces {
+		if !strings.HasPrefix(ns, "did:") {
+			return fmt.Errorf("namespace %q is not a DID prefix", ns)
+		}
+	}
+	return nil
+}
+
+func knownAction(action Action) bool {
+	for _, a := range Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) appliesTo(name string) bool {
+	for _, pattern := range p.Principals {
+		if name == Anonymous {
+			if pattern == Anonymous {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) grants(action Action) bool {
+	for _, a := range p.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) covers(did string) bool {
+	if len(p.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range p.Namespaces {
+		if strings.HasPrefix(did, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller
+type Principal struct {
+	// Name is qualified by the method, such as apikey:ci, jwt:alice or
+	// mtls:node1, or Anonymous
+	Name string
+	// Method is how the principal authenticated, empty when anonymous
+	Method string
+
+	grants []Policy
+}
+
+// Anonymous tells whether the request came without credentials
+func (p *Principal) Anonymous() bool {
+	return p.Method == ""
+}
+
+// Allowed tells whether the principal may perform the action on some
+// namespace, Authorize checks the DID itself
+func (p *Principal) Allowed(action Action) bool {
+	for i := range p.grants {
+		if p.grants[i].grants(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks the principal may perform the action on the DID
+func (p *Principal) Authorize(action Action, did string) error {
+	for i := range p.grants {
+		if p.grants[i].grants(action) && p.grants[i].covers(did) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s may not perform %s on %s", ErrForbidden, p.Name, action, did)
+}
+
+// Credentials are what a request presents to authenticate
+type Credentials struct {
+	// Authorization is the Authorization header, "Bearer <jwt>" or
+	// "ApiKey <key>"
+	Authorization string
+	// APIKey is the X-API-Key header
+	APIKey string
+	// TLS is the state of the TLS connection, nil over plain text
+	TLS *tls.ConnectionState
+}
+
+// FromRequest returns the credentials of the HTTP request
+func FromRequest(r *http.Request) Credentials {
+	return Credentials{
+		Authorization: r.Header.Get("Authorization"),
+		APIKey:        r.Header.Get("X-API-Key"),
+		TLS:           r.TLS,
+	}
+}
+
+// Guard authenticates the requests and finds the policies of the principals
+type Guard struct {
+	apiKeys  *apiKeys
+	jwt      *jwtVerifier
+	mtls     bool
+	policies []Policy
+}
+
+// Validate checks the API keys and the policies, the key files of the JWT
+// are only read by New
+func (o *Options) Validate() error {
+	if _, err := newAPIKeys(o.APIKeys); err != nil {
+		return err
+	}
+	for i := range o.Policies {
+		if err := o.Policies[i].validate(); err != nil {
+			return fmt.Errorf("policy %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// New creates the guard, it fails when the options are invalid
+func New(opts *Options) (*Guard, error) {
+	g := &Guard{mtls: opts.MTLS.Enabled}
+
+	var err error
+	if err = opts.Validate(); err != nil {
+		return nil, err
+	}
+	if g.apiKeys, err = newAPIKeys(opts.APIKeys); err != nil {
+		return nil, err
+	}
+	if g.jwt, err = newJWTVerifier(&opts.JWT); err != nil {
+		return nil, err
+	}
+	g.policies = append(g.policies, opts.Policies...)
+	if opts.AnonymousRead {
+		g.policies = append(g.policies, Policy{
+			Principals: []string{Anonymous},
+			Actions:    []Action{ActionRead},
+		})
+	}
+	return g, nil
+}
+
+// Authenticate returns the principal presenting the credentials, the
+// anonymous one when there are none. Invalid credentials fail with
+// ErrUnauthenticated rather than falling back to anonymous.
+func (g *Guard) Authenticate(cred Credentials) (*Principal, error) {
+	p := &Principal{Name: Anonymous}
+
+	scheme, value, _ := strings.Cut(cred.Authorization, " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		if g.jwt == nil {
+			return nil, fmt.Errorf("%w: bearer tokens are not accepted", ErrUnauthenticated)
+		}
+		name, err := g.jwt.verify(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+		}
+		p.Name, p.Method = MethodJWT+":"+name, MethodJWT
+	case strings.EqualFold(scheme, "ApiKey"):
+		cred.APIKey = strings.TrimSpace(value)
+		fallthrough
+	case cred.Authorization == "" && cred.APIKey != "":
+		name, ok := g.apiKeys.lookup(cred.APIKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+		}
+		p.Name, p.Method = MethodAPIKey+":"+name, MethodAPIKey
+	case cred.Authorization != "":
+		return nil, fmt.Errorf("%w: unsupported authorization scheme %q", ErrUnauthenticated, scheme)
+	case g.mtls && cred.TLS != nil && len(cred.TLS.VerifiedChains) > 0:
+		cert := cred.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName == "" {
+			return nil, fmt.Errorf("%w: the client certificate has no common name", ErrUnauthenticated)
+		}
+		p.Name, p.Method = MethodMTLS+":"+cert.Subject.CommonName, MethodMTLS
+	}
+
+	for i := range g.policies {
+		if g.policies[i].appliesTo(p.Name) {
+			p.grants = append(p.grants, g.policies[i])
+		}
+	}
+	return p, nil
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of the context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the context
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Check authorizes the action on the DID for the principal of the context.
+// A context without principal comes from a server with the authentication
+// disabled, everything is allowed.
+func Check(ctx context.Context, action Action, did string) error {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return p.Authorize(action, did)
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func digest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newGuard(t *testing.T, opts *Options) *Guard {
+	g, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return g
+}
+
+func testOptions() *Options {
+	return &Options{
+		Enabled:       true,
+		AnonymousRead: true,
+		APIKeys: []APIKey{
+			{Name: "org1", SHA256: digest("org1-key")},
+			{Name: "ops", SHA256: digest("ops-key")},
+		},
+		JWT:  JWTOptions{HMACSecret: testSecret, Issuer: "https://idp.example.com", Audience: "serval"},
+		MTLS: MTLSOptions{Enabled: true},
+		Policies: []Policy{
+			{
+				Principals: []string{"apikey:org1", "jwt:*"},
+				Actions:    []Action{ActionRead, ActionCreate, ActionUpdate, ActionRevoke},
+				Namespaces: []string{"did:example:org1:"},
+			},
+			{
+				Principals: []string{"apikey:ops", "mtls:node*"},
+				Actions:    []Action{ActionAdmin},
+			},
+		},
+	}
+}
+
+func token(t *testing.T, claims jwt.MapClaims) string {
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAPIKey(t *testing.T) {
+	g := newGuard(t, testOptions())
+
+	for _, cred := range []Credentials{
+		{APIKey: "org1-key"},
+		{Authorization: "ApiKey org1-key"},
+	} {
+		p, err := g.Authenticate(cred)
+		if err != nil {
+			t.Fatalf("Authenticate %+v failed: %v", cred, err)
+		}
+		if p.Name != "apikey:org1" || p.Anonymous() {
+			t.Errorf("Principal = %+v", p)
+		}
+		if err := p.Authorize(ActionCreate, "did:example:org1:abc"); err != nil {
+			t.Errorf("Authorize in the namespace failed: %v", err)
+		}
+		if err := p.Authorize(ActionCreate, "did:example:org2:abc"); !errors.Is(err, ErrForbidden) {
+			t.Errorf("Authorize out of the namespace = %v, want ErrForbidden", err)
+		}
+		if p.Allowed(ActionAdmin) {
+			t.Errorf("org1 is allowed to administrate")
+		}
+	}
+
+	if _, err := g.Authenticate(Credentials{APIKey: "wrong"}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate with a wrong key = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	g := newGuard(t, testOptions())
+	exp := time.Now().Add(time.Hour).Unix()
+
+	good := token(t, jwt.MapClaims{"sub": "alice", "iss": "https://idp.example.com", "aud": "serval", "exp": exp})
+	p, err := g.Authenticate(Credentials{Authorization: "Bearer " + good})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Name != "jwt:alice" || !p.Allowed(ActionCreate) {
+		t.Errorf("Principal = %+v", p)
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"expired":        {"sub": "alice", "iss": "https://idp.example.com", "aud": "serval", "exp": time.Now().Add(-time.Hour).Unix()},
+		"wrong issuer":   {"sub": "alice", "iss": "https://evil.example.com", "aud": "serval", "exp": exp},
+		"wrong audience": {"sub": "alice", "iss": "https://idp.example.com", "aud": "other", "exp": exp},
+		"no subject":     {"iss": "https://idp.example.com", "aud": "serval", "exp": exp},
+	} {
+		_, err := g.Authenticate(Credentials{Authorization: "Bearer " + token(t, claims)})
+		if !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("Authenticate with %s token = %v, want ErrUnauthenticated", name, err)
+		}
+	}
+
+	// A token signed with an other algorithm is refused
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	es, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "alice"}).SignedString(key)
+	if _, err := g.Authenticate(Credentials{Authorization: "Bearer " + es}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate with ES256 token = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestJWTPublicKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	file := filepath.Join(t.TempDir(), "issuer.pem")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	g := newGuard(t, &Options{JWT: JWTOptions{PublicKeyFile: file, NameClaim: "client_id"}})
+	s, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"client_id": "ci"}).SignedString(key)
+	p, err := g.Authenticate(Credentials{Authorization: "Bearer " + s})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Name != "jwt:ci" {
+		t.Errorf("Name = %v, want jwt:ci", p.Name)
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	g := newGuard(t, testOptions())
+	state := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "node1"}}}},
+	}
+
+	p, err := g.Authenticate(Credentials{TLS: state})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Name != "mtls:node1" || !p.Allowed(ActionAdmin) {
+		t.Errorf("Principal = %+v", p)
+	}
+
+	// Unverified certificates are ignored
+	p, err = g.Authenticate(Credentials{TLS: &tls.ConnectionState{}})
+	if err != nil || !p.Anonymous() {
+		t.Errorf("Authenticate without verified chain = %+v, %v, want anonymous", p, err)
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	opts := testOptions()
+	// The wildcard does not match the anonymous principal
+	opts.Policies = append(opts.Policies, Policy{Principals: []string{"*"}, Actions: []Action{ActionCreate}})
+	g := newGuard(t, opts)
+
+	p, err := g.Authenticate(Credentials{})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if !p.Anonymous() || !p.Allowed(ActionRead) || p.Allowed(ActionCreate) {
+		t.Errorf("Principal = %+v", p)
+	}
+
+	opts.AnonymousRead = false
+	p, _ = newGuard(t, opts).Authenticate(Credentials{})
+	if p.Allowed(ActionRead) {
+		t.Errorf("Anonymous read allowed with AnonymousRead off")
+	}
+
+	if _, err := g.Authenticate(Credentials{Authorization: "Basic Zm9vOmJhcg=="}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate with Basic = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(context.Background(), ActionCreate, "did:example:abc"); err != nil {
+		t.Errorf("Check without principal = %v, want nil", err)
+	}
+
+	p, _ := newGuard(t, testOptions()).Authenticate(Credentials{APIKey: "org1-key"})
+	ctx := NewContext(context.Background(), p)
+	if err := Check(ctx, ActionRevoke, "did:example:org1:abc"); err != nil {
+		t.Errorf("Check = %v, want nil", err)
+	}
+	if err := Check(ctx, ActionRevoke, "did:example:abc"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Check = %v, want ErrForbidden", err)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for name, opts := range map[string]*Options{
+		"bad digest":     {APIKeys: []APIKey{{Name: "k", SHA256: "abc"}}},
+		"duplicate key":  {APIKeys: []APIKey{{Name: "k", SHA256: digest("a")}, {Name: "k", SHA256: digest("b")}}},
+		"two JWT keys":   {JWT: JWTOptions{HMACSecret: "s", PublicKeyFile: "f"}},
+		"unknown action": {Policies: []Policy{{Principals: []string{"*"}, Actions: []Action{"did.delete"}}}},
+		"bad namespace":  {Policies: []Policy{{Principals: []string{"*"}, Actions: []Action{ActionRead}, Namespaces: []string{"example"}}}},
+		"bad pattern":    {Policies: []Policy{{Principals: []string{"["}, Actions: []Action{ActionRead}}}},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("New with %s succeeded", name)
+		}
+	}
+}
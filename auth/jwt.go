@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWTOptions defines how the bearer tokens are verified, set either the
+// HMAC secret or the public key of the issuer
+type JWTOptions struct {
+	// HMACSecret verifies the HS256, HS384 and HS512 tokens
+	HMACSecret string
+	// PublicKeyFile is the PEM encoded RSA, ECDSA or Ed25519 public key
+	// verifying the RS*, PS*, ES* or EdDSA tokens
+	PublicKeyFile string
+	// Issuer and Audience are checked against the iss and aud claims when set
+	Issuer   string
+	Audience string
+	// NameClaim is the claim naming the principal, jwt:<name>, sub by default
+	NameClaim string
+}
+
+type jwtVerifier struct {
+	key       any
+	methods   []string
+	issuer    string
+	audience  string
+	nameClaim string
+}
+
+// newJWTVerifier returns nil when the options have no key
+func newJWTVerifier(opts *JWTOptions) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		issuer:    opts.Issuer,
+		audience:  opts.Audience,
+		nameClaim: opts.NameClaim,
+	}
+	if v.nameClaim == "" {
+		v.nameClaim = "sub"
+	}
+
+	switch {
+	case opts.HMACSecret != "" && opts.PublicKeyFile != "":
+		return nil, fmt.Errorf("JWT: set either hmacSecret or publicKeyFile")
+	case opts.HMACSecret != "":
+		v.key = []byte(opts.HMACSecret)
+		v.methods = []string{"HS256", "HS384", "HS512"}
+	case opts.PublicKeyFile != "":
+		key, err := readPublicKey(opts.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("JWT: %v", err)
+		}
+		v.key = key
+		switch key.(type) {
+		case *rsa.PublicKey:
+			v.methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+		case *ecdsa.PublicKey:
+			v.methods = []string{"ES256", "ES384", "ES512"}
+		case ed25519.PublicKey:
+			v.methods = []string{"EdDSA"}
+		default:
+			return nil, fmt.Errorf("JWT: unsupported public key type %T", key)
+		}
+	default:
+		return nil, nil
+	}
+	return v, nil
+}
+
+func readPublicKey(filename string) (any, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse the public key %s failed: %v", filename, err)
+	}
+	return key, nil
+}
+
+// verify checks the signature and the claims of the token and returns the
+// name of the principal
+func (v *jwtVerifier) verify(token string) (string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return v.key, nil
+	}, jwt.WithValidMethods(v.methods))
+	if err != nil {
+		return "", err
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return "", fmt.Errorf("the token is not issued by %s", v.issuer)
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return "", fmt.Errorf("the token is not intended for %s", v.audience)
+	}
+	name, _ := claims[v.nameClaim].(string)
+	if name == "" {
+		return "", fmt.Errorf("the token has no %s claim", v.nameClaim)
+	}
+	return name, nil
+}
@@ -1,23 +1,391 @@
+// Package config reads the settings of the server from a YAML file, where
+// every setting can be overridden by an environment variable named after
+// its path: SERVAL_STORE_BACKEND overrides store.backend.
 package config
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/idempotency"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/ewangplay/serval/tlsconfig"
+	"github.com/ewangplay/serval/tracing"
+	"github.com/ewangplay/serval/webhook"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
-// InitConfig reads config file to viper instance
-func InitConfig(filename string) error {
-	var err error
+// EnvPrefix starts the names of the environment variables
+const EnvPrefix = "SERVAL"
 
-	if _, err = os.Stat(filename); os.IsNotExist(err) {
-		return err
+// Config holds all the settings, sampleconfig/serval.yaml documents them
+type Config struct {
+	Server      Server
+	Grpc        Grpc
+	Auth        auth.Options
+	RateLimit   ratelimit.Options
+	Idempotency idempotency.Options
+	AppKey      adapter.AppKeyOptions
+	Events      Events
+	Webhook     webhook.Options
+	Tracing     tracing.Options
+	Log         Log
+	Store       adapter.StoreOptions
+}
+
+// Server holds the settings of the HTTP server
+type Server struct {
+	Port string
+	// Admin serves the /api/v1/admin endpoints
+	Admin bool
+	// Language of the messages when the Accept-Language header matches none
+	Language string
+	// DrainDelay is how long /readyz fails before the listeners close
+	DrainDelay time.Duration
+	// ShutdownTimeout bounds the wait for the requests in flight, 30s by default
+	ShutdownTimeout time.Duration
+	// ProbeTimeout bounds the probes of /readyz
+	ProbeTimeout time.Duration
+	// Metrics serves /metrics
+	Metrics bool
+	// CacheControl is the Cache-Control header of the resolved documents,
+	// no-cache by default
+	CacheControl string
+	// TrustedProxies are the addresses or CIDRs of the proxies whose
+	// X-Forwarded-For header gives the client address, none by default
+	TrustedProxies []string
+	TLS            tlsconfig.Options
+}
+
+// Grpc holds the settings of the gRPC server
+type Grpc struct {
+	// Port of the gRPC API, disabled when empty
+	Port string
+}
+
+// Events holds the settings of the change log
+type Events struct {
+	// Retention is the number of events kept
+	Retention int
+}
+
+// Log holds the settings of the logs
+type Log struct {
+	Level  string
+	Levels map[string]string
+	Format string
+	// Path is the directory of the log files
+	Path string
+	// MaxSize is the size of a log file before rolling, in megabytes
+	MaxSize     int64
+	RotateDaily bool
+}
+
+// Load reads the config file, applies the environment overrides and
+// decodes the settings. An unknown setting fails the load, Validate
+// checks the values.
+func Load(filename string) (*Config, error) {
+	return load(filename, true)
+}
+
+// LoadFile reads the config file like Load, without the environment
+// overrides, like the config of the target of a migration
+func LoadFile(filename string) (*Config, error) {
+	return load(filename, false)
+}
+
+func load(filename string, env bool) (*Config, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return decode(v, env)
+}
+
+func decode(v *viper.Viper, env bool) (*Config, error) {
+	s := newSchema(reflect.TypeOf(Config{}))
+	for key, leaf := range s.leaves {
+		if env && leaf.env {
+			v.BindEnv(key, EnvName(key))
+		}
 	}
 
-	viper.SetConfigFile(filename)
-	err = viper.ReadInConfig()
+	if errs := s.unknownKeys(v.AllKeys()); len(errs) > 0 {
+		return nil, errs
+	}
+
+	var cfg Config
+	err := v.Unmarshal(&cfg, func(dc *mapstructure.DecoderConfig) {
+		// The unknown settings in the lists, like auth.apiKeys
+		dc.ErrorUnused = true
+	})
 	if err != nil {
-		return err
+		return nil, decodeErrors(err)
+	}
+	return &cfg, nil
+}
+
+// EnvName returns the environment variable overriding the setting
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// EnvNames returns the environment variables of all the settings, sorted.
+// The lists, like auth.policies, and the maps, like log.levels, can only
+// be set in the file.
+func EnvNames() []string {
+	s := newSchema(reflect.TypeOf(Config{}))
+	var names []string
+	for key, leaf := range s.leaves {
+		if leaf.env {
+			names = append(names, EnvName(key))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schema lists the settings of the config struct, by their lower case
+// path as viper reports them
+type schema struct {
+	leaves   map[string]leaf
+	sections map[string]string
+	// maps take any key, like log.levels.webhook
+	maps map[string]bool
+}
+
+type leaf struct {
+	// name is the path as written in the docs, like log.maxSize
+	name string
+	// env is false for the lists of structs and the interfaces
+	env bool
+}
+
+func newSchema(t reflect.Type) *schema {
+	s := &schema{
+		leaves:   make(map[string]leaf),
+		sections: make(map[string]string),
+		maps:     make(map[string]bool),
+	}
+	s.walk(t, "", "", make(map[reflect.Type]int))
+	return s
+}
+
+func (s *schema) walk(t reflect.Type, key, name string, seen map[reflect.Type]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		field := fieldName(f)
+		if field == "-" {
+			continue
+		}
+		k, n := strings.ToLower(field), field
+		if key != "" {
+			k, n = key+"."+k, name+"."+n
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}):
+			// store.dualWrite is a store of its own, one level deep
+			if seen[ft] > 1 {
+				s.maps[k] = true
+				continue
+			}
+			seen[ft]++
+			s.sections[k] = n
+			s.walk(ft, k, n, seen)
+			seen[ft]--
+		case ft.Kind() == reflect.Map:
+			s.maps[k] = true
+			s.sections[k] = n
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct, ft.Kind() == reflect.Interface:
+			s.leaves[k] = leaf{name: n}
+		default:
+			s.leaves[k] = leaf{name: n, env: true}
+		}
+	}
+}
+
+// fieldName returns the name of the setting of the field, its mapstructure
+// tag or its name in lower camel case
+func fieldName(f reflect.StructField) string {
+	if tag, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ","); tag != "" {
+		return tag
+	}
+	return lowerCamel(f.Name)
+}
+
+// lowerCamel turns a Go name into the name of a setting: APIKeys is
+// apiKeys, KEK is kek
+func lowerCamel(s string) string {
+	r := []rune(s)
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+	if n > 1 && n < len(r) && unicode.IsLower(r[n]) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
+
+func (s *schema) known(key string) bool {
+	if _, ok := s.leaves[key]; ok {
+		return true
+	}
+	if _, ok := s.sections[key]; ok {
+		return true
+	}
+	for k := key; k != ""; {
+		if s.maps[k] {
+			return true
+		}
+		i := strings.LastIndex(k, ".")
+		if i < 0 {
+			break
+		}
+		k = k[:i]
+	}
+	return false
+}
+
+func (s *schema) unknownKeys(keys []string) Errors {
+	var errs Errors
+	reported := make(map[string]bool)
+	sort.Strings(keys)
+	for _, key := range keys {
+		if s.known(key) {
+			continue
+		}
+		// Report the unknown section rather than its settings
+		parts := strings.Split(key, ".")
+		for i := 1; i < len(parts); i++ {
+			if k := strings.Join(parts[:i], "."); !s.known(k) {
+				key = k
+				break
+			}
+		}
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+		msg := "unknown setting"
+		if name := s.suggest(key); name != "" {
+			msg += fmt.Sprintf(", did you mean %s?", name)
+		}
+		errs = append(errs, &FieldError{Path: key, Msg: msg})
+	}
+	return errs
+}
+
+// suggest returns the setting of the same section with the closest name
+func (s *schema) suggest(key string) string {
+	parent, last := "", key
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		parent, last = key[:i+1], key[i+1:]
+	}
+	best, bestDist := "", 3
+	consider := func(k, name string) {
+		if !strings.HasPrefix(k, parent) || strings.Contains(k[len(parent):], ".") {
+			return
+		}
+		d := distance(normalize(last), normalize(k[len(parent):]))
+		if d < bestDist || d == bestDist && name < best {
+			best, bestDist = name, d
+		}
+	}
+	for k, l := range s.leaves {
+		consider(k, l.name)
+	}
+	for k, name := range s.sections {
+		consider(k, name)
+	}
+	return best
+}
+
+func normalize(s string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(s))
+}
+
+// distance is the Levenshtein distance of a and b
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var decodePattern = regexp.MustCompile(`^'([^']*)' (.*)$`)
+
+// decodeErrors turns the errors of mapstructure into field errors
+func decodeErrors(err error) Errors {
+	me, ok := err.(*mapstructure.Error)
+	if !ok {
+		return Errors{&FieldError{Msg: err.Error()}}
+	}
+	var errs Errors
+	for _, e := range me.Errors {
+		if m := decodePattern.FindStringSubmatch(e); m != nil {
+			errs = append(errs, &FieldError{Path: settingPath(m[1]), Msg: m[2]})
+		} else {
+			errs = append(errs, &FieldError{Msg: e})
+		}
+	}
+	return errs
+}
+
+// settingPath turns the path of a field, like Auth.APIKeys[0], into the
+// path of its setting
+func settingPath(path string) string {
+	parts := strings.Split(path, ".")
+	for i, p := range parts {
+		name, index, _ := strings.Cut(p, "[")
+		parts[i] = lowerCamel(name)
+		if index != "" {
+			parts[i] += "[" + index
+		}
 	}
-	return nil
+	return strings.Join(parts, ".")
 }
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+)
+
+const sampleConfig = "../sampleconfig/serval.yaml"
+
+func writeConfig(t *testing.T, yaml string) string {
+	filename := filepath.Join(t.TempDir(), "serval.yaml")
+	if err := os.WriteFile(filename, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// paths returns the sorted paths of the field errors of err
+func paths(t *testing.T, err error) []string {
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected field errors, got %v", err)
+	}
+	var p []string
+	for _, e := range errs {
+		p = append(p, e.Path)
+	}
+	sort.Strings(p)
+	return p
+}
+
+func TestSampleConfig(t *testing.T) {
+	cfg, err := Load(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatalf("The sample config is invalid:\n%v", err)
+	}
+	if cfg.Store.Backend != "badgerdb" || cfg.Store.Cache.Size != 10000 || cfg.Log.MaxSize != 100 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func TestUnknownSettings(t *testing.T) {
+	filename := writeConfig(t, `
+server:
+    port: 8099
+    shutdowntimout: 5s
+log:
+    max_size: 10
+    levels:
+        webhook: debug
+store:
+    backend: memory
+    dualWrite:
+        backend: memory
+        cach:
+            size: 10
+`)
+	_, err := Load(filename)
+	if got, want := paths(t, err), []string{"log.max_size", "server.shutdowntimout", "store.dualwrite.cach"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	if msg := err.(Errors)[0].Msg; msg != "unknown setting, did you mean log.maxSize?" {
+		t.Errorf("Unexpected message %q", msg)
+	}
+
+	filename = writeConfig(t, `
+auth:
+    apiKeys:
+        - name: org1
+          sha265: 5994471abb01112afcc18159f6cc74b4f511b99806da59b3caf5a9c173cacfc5
+`)
+	_, err = Load(filename)
+	if got := paths(t, err); !reflect.DeepEqual(got, []string{"auth.apiKeys[0]"}) {
+		t.Errorf("Unexpected paths %v", got)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv("SERVAL_STORE_BACKEND", "memory")
+	t.Setenv("SERVAL_STORE_ENCRYPTION_KEK", "000102030405060708090a0b0c0d0e0f")
+	t.Setenv("SERVAL_LOG_MAXSIZE", "7")
+	t.Setenv("SERVAL_SERVER_ADMIN", "true")
+	t.Setenv("SERVAL_SERVER_TRUSTEDPROXIES", "10.0.0.1,10.0.0.2")
+
+	cfg, err := Load(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Store.Backend != "memory" || cfg.Log.MaxSize != 7 || !cfg.Server.Admin {
+		t.Errorf("The environment does not override the file: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Server.TrustedProxies, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("The environment does not override the list: %v", cfg.Server.TrustedProxies)
+	}
+	if cfg.Store.Encryption == nil || cfg.Store.Encryption.KEK != "000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("The environment does not create the section: %+v", cfg.Store.Encryption)
+	}
+
+	cfg, err = LoadFile(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Store.Backend != "badgerdb" || cfg.Store.Encryption != nil {
+		t.Errorf("LoadFile applies the environment: %+v", cfg.Store)
+	}
+
+	if name := EnvName("store.cache.ttl"); name != "SERVAL_STORE_CACHE_TTL" {
+		t.Errorf("Unexpected name %s", name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := Load(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.Port = "http"
+	cfg.Server.TLS.RequireClientCert = true
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "proxy.local"}
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.DID.Write.Rate = -1
+	cfg.Auth.Enabled = true
+	cfg.Auth.Policies[0].Actions = append(cfg.Auth.Policies[0].Actions, "did.delete")
+	cfg.AppKey.PrivateKeyHex = "zz"
+	cfg.Log.Level = "loud"
+	cfg.Log.Levels = map[string]string{"webhook": "chatty"}
+	cfg.Tracing.Exporter = "file"
+	cfg.Tracing.File = ""
+	cfg.Store.Backend = "hlfabric"
+	cfg.Store.Hlfabric.ChannelName = ""
+
+	want := []string{
+		"appKey",
+		"auth",
+		"log.level",
+		"log.levels.webhook",
+		"rateLimit",
+		"server.port",
+		"server.tls.requireClientCert",
+		"server.trustedProxies[1]",
+		"store.hlfabric.channelName",
+		// The sample config enables the idempotency
+		"store.keyIndex",
+		"tracing.file",
+	}
+	if got := paths(t, cfg.Validate()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+}
+
+func TestValidateAdmin(t *testing.T) {
+	cfg, err := Load(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.Admin = true
+	cfg.Auth.Enabled = false
+
+	want := []string{"server.admin"}
+	if got := paths(t, cfg.Validate()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateRotateShared(t *testing.T) {
+	opts := &adapter.StoreOptions{
+		Backend:    "memory",
+		Encryption: &adapter.CryptOptions{KEK: "00", RotateInterval: time.Hour},
+	}
+	if err := ValidateStore(opts); err != nil {
+		t.Fatalf("Rotation on a single node refused: %v", err)
+	}
+
+	opts.Backend, opts.KeyIndex = "hlfabric", true
+	got := paths(t, ValidateStore(opts))
+	if !contains(got, "store.encryption.rotateInterval") {
+		t.Errorf("Expected the rotation refused on hlfabric, got %v", got)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSampleAppKey(t *testing.T) {
+	cfg, err := Load(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sample starts without a keystore to set up first
+	key, err := adapter.InitAppKey(&cfg.AppKey)
+	if err != nil {
+		t.Fatalf("Init the application key of the sample failed: %v", err)
+	}
+	key.Close()
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/tracing"
+)
+
+// FieldError is an invalid setting
+type FieldError struct {
+	// Path is the path of the setting, like store.backend
+	Path string
+	Msg  string
+}
+
+func (e *FieldError) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// Errors are all the invalid settings of a config
+type Errors []*FieldError
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// validator collects the errors of the settings
+type validator struct {
+	errs Errors
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	v.errs = append(v.errs, &FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(path, value string) {
+	if value == "" {
+		v.fail(path, "is required")
+	}
+}
+
+func (v *validator) port(path, value string, required bool) {
+	if value == "" {
+		if required {
+			v.fail(path, "is required")
+		}
+		return
+	}
+	if p, err := strconv.Atoi(value); err != nil || p < 1 || p > 65535 {
+		v.fail(path, "%q is not a port number", value)
+	}
+}
+
+func (v *validator) nonNegative(path string, d time.Duration) {
+	if d < 0 {
+		v.fail(path, "must not be negative")
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return
+		}
+	}
+	v.fail(path, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks the values of the settings, the error lists all the
+// invalid ones. The files named by the settings are not read.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	s := &c.Server
+	v.port("server.port", s.Port, true)
+	if s.Language != "" {
+		if _, err := apiV1.ParseLanguage(s.Language); err != nil {
+			v.fail("server.language", "%v", err)
+		}
+	}
+	v.nonNegative("server.drainDelay", s.DrainDelay)
+	v.nonNegative("server.shutdownTimeout", s.ShutdownTimeout)
+	v.nonNegative("server.probeTimeout", s.ProbeTimeout)
+	if s.TLS.Enabled() {
+		v.required("server.tls.certFile", s.TLS.CertFile)
+		v.required("server.tls.keyFile", s.TLS.KeyFile)
+		if s.TLS.MinVersion != "" {
+			v.oneOf("server.tls.minVersion", s.TLS.MinVersion, "1.2", "1.3")
+		}
+		v.nonNegative("server.tls.reloadInterval", s.TLS.ReloadInterval)
+	}
+	if s.TLS.RequireClientCert && s.TLS.ClientCAFile == "" {
+		v.fail("server.tls.requireClientCert", "needs server.tls.clientCAFile")
+	}
+	for i, proxy := range s.TrustedProxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			v.fail(fmt.Sprintf("server.trustedProxies[%d]", i), "%q is not an IP address or a CIDR", proxy)
+		}
+	}
+
+	// The admin endpoints export and import the registry, and call the URLs
+	// of the webhooks, they are never served to anyone
+	if s.Admin && !c.Auth.Enabled {
+		v.fail("server.admin", "needs auth.enabled")
+	}
+
+	v.port("grpc.port", c.Grpc.Port, false)
+
+	if c.Auth.Enabled {
+		if err := c.Auth.Validate(); err != nil {
+			v.fail("auth", "%v", err)
+		}
+		if c.Auth.MTLS.Enabled && s.TLS.ClientCAFile == "" {
+			v.fail("auth.mtls.enabled", "needs server.tls.clientCAFile")
+		}
+	}
+
+	if c.RateLimit.Enabled {
+		if err := c.RateLimit.Validate(); err != nil {
+			v.fail("rateLimit", "%v", err)
+		}
+	}
+
+	// The features scanning the store in the background
+	for feature, enabled := range map[string]bool{
+		"webhook.enabled":       c.Webhook.Enabled,
+		"idempotency.enabled":   c.Idempotency.Enabled,
+		"rateLimit.distributed": c.RateLimit.Enabled && c.RateLimit.Distributed,
+	} {
+		if enabled && !scans(&c.Store) {
+			v.fail("store.keyIndex", "is required by %s on the %s backend", feature, c.Store.Backend)
+		}
+	}
+
+	if err := c.Idempotency.Validate(); err != nil {
+		v.fail("idempotency", "%v", err)
+	}
+
+	// The keystore and the token are only read at startup, the passphrase
+	// or the PIN may be missing where the config is checked
+	if err := c.AppKey.Validate(); err != nil {
+		v.fail("appKey", "%v", err)
+	}
+
+	if c.Events.Retention < 0 {
+		v.fail("events.retention", "must not be negative")
+	}
+
+	w := &c.Webhook
+	v.nonNegative("webhook.pollInterval", w.PollInterval)
+	v.nonNegative("webhook.timeout", w.Timeout)
+	v.nonNegative("webhook.minBackoff", w.MinBackoff)
+	v.nonNegative("webhook.maxBackoff", w.MaxBackoff)
+	if w.MaxAttempts < 0 {
+		v.fail("webhook.maxAttempts", "must not be negative")
+	}
+	if w.Workers < 0 {
+		v.fail("webhook.workers", "must not be negative")
+	}
+
+	t := &c.Tracing
+	if t.Exporter != "" {
+		v.oneOf("tracing.exporter", t.Exporter, tracing.ExporterOTLP, tracing.ExporterFile, tracing.ExporterStdout)
+		if t.Exporter == tracing.ExporterFile {
+			v.required("tracing.file", t.File)
+		}
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		v.fail("tracing.sampleRatio", "must be between 0 and 1")
+	}
+
+	l := &c.Log
+	if _, err := log.ParseLevel(l.Level); err != nil {
+		v.fail("log.level", "%v", err)
+	}
+	for module, level := range l.Levels {
+		if _, err := log.ParseLevel(level); err != nil {
+			v.fail("log.levels."+module, "%v", err)
+		}
+	}
+	if l.Format != "" {
+		v.oneOf("log.format", l.Format, log.FormatJSON, log.FormatText)
+	}
+	v.required("log.path", l.Path)
+	if l.MaxSize < 0 {
+		v.fail("log.maxSize", "must not be negative")
+	}
+
+	validateStore(v, "store", &c.Store)
+	return v.err()
+}
+
+// ValidateStore checks the settings of a store alone, like the target of
+// a migration
+func ValidateStore(opts *adapter.StoreOptions) error {
+	v := &validator{}
+	validateStore(v, "store", opts)
+	return v.err()
+}
+
+func validateStore(v *validator, path string, opts *adapter.StoreOptions) {
+	switch opts.Backend {
+	case "memory":
+	case "badgerdb":
+		if opts.Badgerdb == nil {
+			v.fail(path+".badgerdb", "is required by the badgerdb backend")
+		} else {
+			v.required(path+".badgerdb.dir", opts.Badgerdb.Dir)
+		}
+	case "hlfabric":
+		if h := opts.Hlfabric; h == nil {
+			v.fail(path+".hlfabric", "is required by the hlfabric backend")
+		} else {
+			v.required(path+".hlfabric.channelName", h.ChannelName)
+			v.required(path+".hlfabric.contractID", h.ContractID)
+			v.required(path+".hlfabric.mspID", h.MspID)
+			v.required(path+".hlfabric.walletPath", h.WalletPath)
+			v.required(path+".hlfabric.ccpPath", h.CcpPath)
+			v.required(path+".hlfabric.appUser.name", h.AppUser.Name)
+		}
+	case "":
+		v.fail(path+".backend", "is required")
+	default:
+		v.fail(path+".backend", "%q is not one of memory, badgerdb, hlfabric", opts.Backend)
+	}
+
+	if c := opts.Cache; c != nil {
+		if c.Size < 0 {
+			v.fail(path+".cache.size", "must not be negative")
+		}
+		v.nonNegative(path+".cache.ttl", c.TTL)
+	}
+
+	if e := opts.Encryption; e != nil {
+		if !scans(opts) {
+			// The records are re-encrypted by scanning the store
+			v.fail(path+".keyIndex", "is required by the encryption on the %s backend", opts.Backend)
+		}
+		if (e.KEK == "") == (e.KEKFile == "") {
+			v.fail(path+".encryption", "set either kek or kekFile")
+		}
+		if e.PreviousKEK != "" && e.PreviousKEKFile != "" {
+			v.fail(path+".encryption", "set either previousKEK or previousKEKFile")
+		}
+		v.nonNegative(path+".encryption.rotateInterval", e.RotateInterval)
+		if e.RotateInterval > 0 && opts.Backend == "hlfabric" {
+			// The other nodes would keep writing with the retired data key
+			v.fail(path+".encryption.rotateInterval", "needs a single node, the hlfabric backend is shared")
+		}
+	}
+
+	if opts.DualWrite != nil {
+		validateStore(v, path+".dualWrite", opts.DualWrite)
+	}
+}
+
+// scans tells whether the store can enumerate its keys
+func scans(opts *adapter.StoreOptions) bool {
+	return opts.Backend != "hlfabric" || opts.KeyIndex
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ewangplay/serval/config"
+)
+
+// runConfig handles `serval config check`, it validates the config file
+// with the environment overrides, so that CI can check a config before
+// it is deployed, and `serval config env`, it lists the environment
+// variables overriding the settings
+func runConfig(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: serval config check [-config file] | serval config env")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "check":
+		fs := flag.NewFlagSet("config check", flag.ExitOnError)
+		filename := fs.String("config", "serval.yaml", "path to config file")
+		fs.Parse(args[1:])
+
+		cfg, err := config.Load(*filename)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", *filename, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", *filename)
+	case "env":
+		for _, name := range config.EnvNames() {
+			fmt.Println(name)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown config command %q, use check or env\n", args[0])
+		os.Exit(2)
+	}
+}
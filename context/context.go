@@ -2,6 +2,10 @@ package context
 
 import (
 	cl "github.com/ewangplay/cryptolib"
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/health"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/webhook"
 	"github.com/gin-gonic/gin"
 	"github.com/jerray/qsign"
 	"github.com/philippgille/gokv"
@@ -9,7 +13,17 @@ import (
 
 type Context struct {
 	*gin.Context
-	Store gokv.Store
-	CSP   cl.CSP
-	Qsign *qsign.Qsign
+	Store    gokv.Store
+	CSP      cl.CSP
+	Qsign    *qsign.Qsign
+	Registry *registry.Registry
+	AppKey   *adapter.AppKey
+	// Webhooks is nil when the webhooks are disabled
+	Webhooks *webhook.Notifier
+	// Health runs the readiness probes, nil when there are none
+	Health *health.Checker
+	// Shutdown is closed when the server drains, the event streams end
+	Shutdown <-chan struct{}
+	// CacheControl is the Cache-Control header of the resolved documents
+	CacheControl string
 }
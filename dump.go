@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ewangplay/serval/registry"
+)
+
+// runExport handles `serval export`, it writes the whole registry as
+// JSON Lines closed by the manifest signed with the app key
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	filename := fs.String("config", "serval.yaml", "path to config file")
+	output := fs.String("o", "-", "path to the dump file, - for stdout")
+	fs.Parse(args)
+
+	svc := initService(*filename)
+	defer svc.store.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Create the dump file failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := svc.registry.Export(w, svc.appKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d DID records, checksum %s\n", manifest.Records, manifest.Checksum)
+}
+
+// runImport handles `serval import`, it loads a dump written by export
+// and prints the report of the records it rejected
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	filename := fs.String("config", "serval.yaml", "path to config file")
+	input := fs.String("i", "-", "path to the dump file, - for stdin")
+	dryRun := fs.Bool("dry-run", false, "verify the dump without writing anything")
+	fs.Parse(args)
+
+	svc := initService(*filename)
+	defer svc.store.Close()
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Open the dump file failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	report, err := svc.registry.Import(r, svc.appKey, registry.ImportOptions{DryRun: *dryRun})
+	if report != nil {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		os.Exit(1)
+	}
+	if len(report.Rejected) > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,112 @@
+// Package health reports whether the server is ready to serve requests,
+// for the readiness probes of the orchestrators.
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout bounds a probe when the checker has no timeout
+const DefaultTimeout = 2 * time.Second
+
+// Status values of the report and of the checks
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusDraining    = "draining"
+)
+
+// Probe checks a dependency, like the store backend
+type Probe func(ctx context.Context) error
+
+// Report is the result of the readiness checks
+type Report struct {
+	// Status is StatusOK when every check passed
+	Status string `json:"status"`
+	// Checks holds StatusOK or the failure of every check
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Ready tells whether the report allows to serve requests
+func (r *Report) Ready() bool {
+	return r.Status == StatusOK
+}
+
+// Checker runs the probes of the dependencies
+type Checker struct {
+	timeout  time.Duration
+	names    []string
+	probes   []Probe
+	draining atomic.Bool
+}
+
+// NewChecker creates the checker, timeout bounds every probe
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{timeout: timeout}
+}
+
+// Add registers the probe of a dependency, before the checker is used
+func (h *Checker) Add(name string, probe Probe) {
+	h.names = append(h.names, name)
+	h.probes = append(h.probes, probe)
+}
+
+// Drain makes the server unready, so that no new requests are routed to it
+// while it shuts down
+func (h *Checker) Drain() {
+	h.draining.Store(true)
+}
+
+// Check runs the probes in parallel
+func (h *Checker) Check(ctx context.Context) *Report {
+	if h.draining.Load() {
+		return &Report{Status: StatusDraining}
+	}
+
+	report := &Report{Status: StatusOK, Checks: make(map[string]string, len(h.probes))}
+	results := make([]error, len(h.probes))
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range h.probes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = run(ctx, h.probes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range results {
+		if err != nil {
+			report.Status = StatusUnavailable
+			report.Checks[h.names[i]] = err.Error()
+		} else {
+			report.Checks[h.names[i]] = StatusOK
+		}
+	}
+	return report
+}
+
+// run returns when the probe is done or the context expires, a stuck
+// backend call is left behind
+func run(ctx context.Context, probe Probe) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- probe(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	h := NewChecker(50 * time.Millisecond)
+	h.Add("store", func(context.Context) error { return nil })
+	h.Add("csp", func(context.Context) error { return nil })
+
+	report := h.Check(context.Background())
+	if !report.Ready() || report.Checks["store"] != StatusOK || report.Checks["csp"] != StatusOK {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	h.Add("fabric", func(context.Context) error { return errors.New("peer unreachable") })
+	report = h.Check(context.Background())
+	if report.Ready() || report.Status != StatusUnavailable || report.Checks["fabric"] != "peer unreachable" {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	h := NewChecker(20 * time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	h.Add("store", func(context.Context) error {
+		<-block
+		return nil
+	})
+
+	start := time.Now()
+	report := h.Check(context.Background())
+	if report.Ready() || time.Since(start) > time.Second {
+		t.Fatalf("A stuck probe should fail on time: %+v", report)
+	}
+}
+
+func TestCheckerDrain(t *testing.T) {
+	h := NewChecker(0)
+	h.Add("store", func(context.Context) error { return nil })
+	h.Drain()
+	if report := h.Check(context.Background()); report.Ready() || report.Status != StatusDraining {
+		t.Fatalf("Unexpected report while draining: %+v", report)
+	}
+}
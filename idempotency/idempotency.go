@@ -0,0 +1,247 @@
+// Package idempotency keeps the responses of the write requests sent with
+// an Idempotency-Key, so that a retry of a request, like after a timeout,
+// gets the response of the first attempt instead of applying it twice.
+//
+// The keys belong to the clients, the record of a key is stored under the
+// hash of the client and of the key:
+//
+//	serval:idempotency:<sha256>  the response of a request, or its lease
+//	                             while it runs
+//
+// A record is reserved before the request runs and completed after it. The
+// reservation is atomic on a node, two nodes receiving the same key at the
+// same instant may both run the request.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/philippgille/gokv"
+)
+
+const recordPrefix = "serval:idempotency:"
+
+// MaxKeyLength bounds the length of an Idempotency-Key
+const MaxKeyLength = 255
+
+// lease is how long a reservation blocks the key, a node that stopped while
+// running the request releases it after that
+const lease = time.Minute
+
+var logger = log.Module("idempotency")
+
+var (
+	// ErrInProgress is returned while the first request with the key runs
+	ErrInProgress = errors.New("a request with the same idempotency key is in progress")
+	// ErrKeyReused is returned when the key was used with another request
+	ErrKeyReused = errors.New("the idempotency key was used with another request")
+)
+
+// Options defines how the responses are kept
+type Options struct {
+	Enabled bool
+	// Window is how long the responses are replayed, 24h by default
+	Window time.Duration
+}
+
+// Validate checks the options
+func (o *Options) Validate() error {
+	if o.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	return nil
+}
+
+// Record is the response of a request
+type Record struct {
+	// Fingerprint is the hash of the request, the key cannot be used for
+	// another request
+	Fingerprint string `json:"fingerprint"`
+	// Done is false while the request runs
+	Done bool `json:"done"`
+	// Status is the HTTP status, or the gRPC code, of the response
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Keeper stores the records of the keys
+type Keeper struct {
+	opts  Options
+	store gokv.Store
+	now   func() time.Time
+
+	// mu makes the reservation of a key atomic on the node
+	mu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates the keeper of the records. The store should not be behind a
+// read cache, see adapter.Uncached.
+func New(opts Options, store gokv.Store) (*Keeper, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Window == 0 {
+		opts.Window = 24 * time.Hour
+	}
+	k := &Keeper{
+		opts:  opts,
+		store: store,
+		now:   time.Now,
+		done:  make(chan struct{}),
+	}
+	k.wg.Add(1)
+	go k.loop()
+	return k, nil
+}
+
+// Window returns how long the responses are replayed
+func (k *Keeper) Window() time.Duration {
+	return k.opts.Window
+}
+
+// Fingerprint returns the hash of the parts of a request
+func Fingerprint(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidKey checks the key is made of 1 to MaxKeyLength visible ASCII
+// characters
+func ValidKey(key string) bool {
+	if key == "" || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func recordKey(client, key string) string {
+	sum := sha256.Sum256([]byte(client + "\x00" + key))
+	return recordPrefix + hex.EncodeToString(sum[:])
+}
+
+// Begin returns the completed record of the key to replay, or else
+// reserves the key for the request and returns nil. It fails with
+// ErrInProgress or ErrKeyReused.
+func (k *Keeper) Begin(client, key, fingerprint string) (*Record, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	var rec Record
+	found, err := k.store.Get(recordKey(client, key), &rec)
+	if err != nil {
+		return nil, err
+	}
+	if found && now.Before(rec.Expires) {
+		switch {
+		case rec.Fingerprint != fingerprint:
+			return nil, ErrKeyReused
+		case !rec.Done:
+			return nil, ErrInProgress
+		}
+		return &rec, nil
+	}
+
+	rec = Record{Fingerprint: fingerprint, Created: now, Expires: now.Add(lease)}
+	return nil, k.store.Set(recordKey(client, key), rec)
+}
+
+// Complete keeps the response of the request for the window
+func (k *Keeper) Complete(client, key string, rec *Record) error {
+	now := k.now()
+	rec.Done = true
+	rec.Created = now
+	rec.Expires = now.Add(k.opts.Window)
+	return k.store.Set(recordKey(client, key), rec)
+}
+
+// Abort releases the key, the request may be sent again with it, like
+// after a failure of the server
+func (k *Keeper) Abort(client, key string) error {
+	return k.store.Delete(recordKey(client, key))
+}
+
+// Close stops the removal of the expired records
+func (k *Keeper) Close() error {
+	close(k.done)
+	k.wg.Wait()
+	return nil
+}
+
+func (k *Keeper) loop() {
+	defer k.wg.Done()
+
+	interval := k.opts.Window / 24
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			if err := k.sweep(); err != nil {
+				logger.Warn("Remove the expired idempotency records failed: %v", err)
+			}
+		}
+	}
+}
+
+// sweep removes the expired records
+func (k *Keeper) sweep() error {
+	now := k.now()
+	var expired []string
+	err := adapter.Scan(k.store, recordPrefix, func(key string) error {
+		var rec Record
+		found, err := k.store.Get(key, &rec)
+		if err == nil && found && !now.Before(rec.Expires) {
+			expired = append(expired, key)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Checked again under the lock, the key may have been reserved since
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range expired {
+		var rec Record
+		found, err := k.store.Get(key, &rec)
+		if err != nil {
+			return err
+		}
+		if !found || now.Before(rec.Expires) {
+			continue
+		}
+		if err := k.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package idempotency
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+)
+
+func newKeeper(t *testing.T) (*Keeper, *time.Time) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	k, err := New(Options{Enabled: true, Window: time.Hour}, adapter.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { k.Close() })
+	now := time.Unix(1700000000, 0)
+	k.now = func() time.Time { return now }
+	return k, &now
+}
+
+func TestKeeper(t *testing.T) {
+	k, now := newKeeper(t)
+	fp := Fingerprint([]byte("POST"), []byte("/api/v1/did/create"), []byte(`{"did":"did:example:1"}`))
+
+	rec, err := k.Begin("apikey:org1", "key-1", fp)
+	if rec != nil || err != nil {
+		t.Fatalf("Expected the key to be reserved: %+v %v", rec, err)
+	}
+	if _, err = k.Begin("apikey:org1", "key-1", fp); err != ErrInProgress {
+		t.Errorf("Expected ErrInProgress, got %v", err)
+	}
+	if _, err = k.Begin("apikey:org1", "key-1", Fingerprint([]byte("other"))); err != ErrKeyReused {
+		t.Errorf("Expected ErrKeyReused, got %v", err)
+	}
+	// The keys of the clients are apart
+	if rec, err = k.Begin("apikey:org2", "key-1", fp); rec != nil || err != nil {
+		t.Errorf("Expected the key of another client to be reserved: %+v %v", rec, err)
+	}
+
+	if err = k.Complete("apikey:org1", "key-1", &Record{Fingerprint: fp, Status: 200, Body: []byte(`{"code":0}`)}); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = k.Begin("apikey:org1", "key-1", fp)
+	if err != nil || rec == nil || rec.Status != 200 || string(rec.Body) != `{"code":0}` {
+		t.Fatalf("Expected the response to replay: %+v %v", rec, err)
+	}
+
+	// After the window the key is free again, and the record is removed
+	*now = now.Add(time.Hour)
+	if err = k.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := k.store.Get(recordKey("apikey:org1", "key-1"), &Record{}); found {
+		t.Error("Expected the expired record to be removed")
+	}
+	if rec, err = k.Begin("apikey:org1", "key-1", Fingerprint([]byte("other"))); rec != nil || err != nil {
+		t.Errorf("Expected the expired key to be reserved: %+v %v", rec, err)
+	}
+}
+
+func TestKeeperLease(t *testing.T) {
+	k, now := newKeeper(t)
+	fp := Fingerprint([]byte("request"))
+
+	// A request that failed releases the key
+	k.Begin("apikey:org1", "key-1", fp)
+	if err := k.Abort("apikey:org1", "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := k.Begin("apikey:org1", "key-1", fp); rec != nil || err != nil {
+		t.Fatalf("Expected the released key to be reserved: %+v %v", rec, err)
+	}
+
+	// A request that never completed releases it after the lease
+	*now = now.Add(lease)
+	if rec, err := k.Begin("apikey:org1", "key-1", fp); rec != nil || err != nil {
+		t.Fatalf("Expected the leased key to be reserved: %+v %v", rec, err)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"8e03978e-40d5-43e8-bc93-6894a57f9324": true,
+		"":                                     false,
+		"with space":                           false,
+		"é":                                    false,
+		string(bytes.Repeat([]byte("k"), 256)): false,
+	} {
+		if ValidKey(key) != valid {
+			t.Errorf("ValidKey(%q) != %v", key, valid)
+		}
+	}
+}
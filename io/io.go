@@ -97,8 +97,26 @@ type CreateDidReq struct {
 	Document DDO    `json:"document"`
 }
 
+// DocumentMetadata represents the resolution metadata of a DID document
+type DocumentMetadata struct {
+	Version     int       `json:"version"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Deactivated bool      `json:"deactivated"`
+	// CompromisedKeys lists the IDs of the public keys reported as compromised
+	CompromisedKeys []string `json:"compromisedKeys,omitempty"`
+}
+
 // ResolveDidResp represents the ResolveDid response
 type ResolveDidResp struct {
+	Did      string            `json:"did"`
+	Document DDO               `json:"document"`
+	Metadata *DocumentMetadata `json:"metadata,omitempty"`
+}
+
+// UpdateDidReq represents the UpdateDid request body, the new document
+// must be signed by an authentication key of the current one
+type UpdateDidReq struct {
 	Did      string `json:"did"`
 	Document DDO    `json:"document"`
 }
@@ -111,7 +129,105 @@ type RevokeDidReq struct {
 
 // Response represents the response body
 type Response struct {
-	Code int    `json:"code"`
-	Data any    `json:"data"`
-	Msg  string `json:"msg"`
+	// Code is 0 on success, else the numeric code of the error
+	Code int `json:"code"`
+	// Error is the string code of the error, like DID_NOT_FOUND
+	Error string `json:"error,omitempty"`
+	Data  any    `json:"data"`
+	// Msg is the message of the code, in the language of the request
+	Msg string `json:"msg"`
+	// Detail tells the reason of the failure
+	Detail string `json:"detail,omitempty"`
+}
+
+// DidSummary represents one DID in the ListDids response
+type DidSummary struct {
+	Did         string    `json:"did"`
+	Controller  string    `json:"controller,omitempty"`
+	Version     int       `json:"version"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Deactivated bool      `json:"deactivated"`
+}
+
+// ListDidsResp represents the ListDids response
+type ListDidsResp struct {
+	Dids       []DidSummary `json:"dids"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// ReportCompromiseReq represents the ReportCompromise request body
+type ReportCompromiseReq struct {
+	Reason string `json:"reason"`
+}
+
+// ReportCompromiseResp represents the ReportCompromise response
+type ReportCompromiseResp struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason,omitempty"`
+	Reported    time.Time `json:"reported"`
+	Dids        []string  `json:"dids"`
+}
+
+// AppKey represents an application key in the AppKeys response
+type AppKey struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	PublicKeyHex string `json:"publicKeyHex"`
+	// Retired is when the key was rotated, missing when unknown
+	Retired *time.Time `json:"retired,omitempty"`
+}
+
+// AppKeysResp represents the AppKeys response
+type AppKeysResp struct {
+	Current AppKey   `json:"current"`
+	Retired []AppKey `json:"retired"`
+}
+
+// SetLogLevelReq represents the SetLogLevel request body
+type SetLogLevelReq struct {
+	Level string `json:"level"`
+}
+
+// BatchCreateReq represents the BatchCreate request body
+type BatchCreateReq struct {
+	Items []CreateDidReq `json:"items"`
+	// Atomic stores either all the documents or none of them
+	Atomic bool `json:"atomic"`
+}
+
+// BatchItemResult represents the result of one item of a batch
+type BatchItemResult struct {
+	Did   string `json:"did"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Code is the string code of the error
+	Code string `json:"code,omitempty"`
+}
+
+// BatchCreateResp represents the BatchCreate response
+type BatchCreateResp struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// BatchResolveReq represents the BatchResolve request body
+type BatchResolveReq struct {
+	Dids []string `json:"dids"`
+}
+
+// BatchResolveResult represents the result of one DID of BatchResolve
+type BatchResolveResult struct {
+	Did      string            `json:"did"`
+	Document *DDO              `json:"document,omitempty"`
+	Metadata *DocumentMetadata `json:"metadata,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	// Code is the string code of the error
+	Code string `json:"code,omitempty"`
+}
+
+// BatchResolveResp represents the BatchResolve response
+type BatchResolveResp struct {
+	Results []BatchResolveResult `json:"results"`
 }
@@ -1,91 +1,311 @@
+// Package log writes the structured logs of the server, one JSON object
+// per line. Every package logs through its module, whose level can be
+// changed at runtime, and the logs of a request carry its ID and trace.
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	l "github.com/apsdehal/go-logger"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Formats of the logs
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// LevelFatal is logged by Fatal before the process exits
+const LevelFatal = slog.Level(12)
+
 // LoggerConfig defines the config for Logger
 type LoggerConfig struct {
-	Module   string
-	Color    int
+	// Module names the logs of the package level functions
+	Module string
+	// LogLevel is debug, info, warn, error or fatal, info by default
 	LogLevel string
-	Writer   io.Writer
+	// Levels overrides the level of some modules, like {"webhook": "debug"}
+	Levels map[string]string
+	// Format is json or text, json by default
+	Format string
+	Writer io.Writer
 }
 
-var gLogger *l.Logger
+// Logger logs the messages of a module
+type Logger struct {
+	m     *module
+	ctx   context.Context
+	attrs []any
+}
+
+type module struct {
+	name  string
+	level slog.LevelVar
+}
+
+var (
+	mu       sync.Mutex
+	modules  = make(map[string]*module)
+	handler  slog.Handler
+	defLevel = slog.LevelInfo
+	gLogger  *Logger
+)
 
 // InitLogger initializes logger instance
 // This method MUST be called before calling any other method.
 func InitLogger(conf *LoggerConfig) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
 	// If logger has been initialized, return directly
-	if gLogger != nil {
+	if handler != nil {
 		return nil
 	}
 
-	gLogger, err = l.New(
-		conf.Module,
-		conf.Color,
-		conf.Writer,
-		parseLogLevel(conf.LogLevel))
+	level, err := ParseLevel(conf.LogLevel)
 	if err != nil {
 		return err
 	}
+	levels := make(map[string]slog.Level, len(conf.Levels))
+	for name, s := range conf.Levels {
+		if levels[name], err = ParseLevel(s); err != nil {
+			return fmt.Errorf("level of module %s: %v", name, err)
+		}
+	}
 
+	opts := &slog.HandlerOptions{
+		// The modules filter the records
+		Level:       slog.Level(-128),
+		ReplaceAttr: replaceAttr,
+	}
+	switch strings.ToLower(conf.Format) {
+	case "", FormatJSON:
+		handler = slog.NewJSONHandler(conf.Writer, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(conf.Writer, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, use json or text", conf.Format)
+	}
+
+	defLevel = level
+	for _, m := range modules {
+		m.level.Set(level)
+	}
+	for name, l := range levels {
+		moduleLocked(name).level.Set(l)
+	}
+	gLogger = &Logger{m: moduleLocked(conf.Module)}
 	return nil
 }
 
-func parseLogLevel(levelstr string) l.LogLevel {
-	lvl := l.InfoLevel
-	switch strings.ToLower(levelstr) {
+// ParseLevel parses debug, info, warn, error or fatal, the empty string
+// is info
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
 	case "debug":
-		lvl = l.DebugLevel
-	case "info":
-		lvl = l.InfoLevel
-	case "warn":
-		lvl = l.WarningLevel
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
 	case "error":
-		lvl = l.ErrorLevel
+		return slog.LevelError, nil
 	case "fatal":
-		lvl = l.CriticalLevel
+		return LevelFatal, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn, error or fatal", s)
+}
+
+func levelName(l slog.Level) string {
+	if l >= LevelFatal {
+		return "fatal"
 	}
-	return lvl
+	return strings.ToLower(l.String())
+}
+
+// Module returns the logger of the module, the packages keep theirs in a
+// package variable
+func Module(name string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return &Logger{m: moduleLocked(name)}
+}
+
+func moduleLocked(name string) *module {
+	m, ok := modules[name]
+	if !ok {
+		m = &module{name: name}
+		m.level.Set(defLevel)
+		modules[name] = m
+	}
+	return m
+}
+
+// Levels returns the level of every module
+func Levels() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	levels := make(map[string]string, len(modules))
+	for name, m := range modules {
+		levels[name] = levelName(m.level.Level())
+	}
+	return levels
+}
+
+// ModuleNames returns the names of the modules, sorted
+func ModuleNames() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetLevel changes the level of a module until the restart
+func SetLevel(name, level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := modules[name]
+	if !ok {
+		return fmt.Errorf("unknown log module %q", name)
+	}
+	m.level.Set(l)
+	return nil
+}
+
+// Ctx returns the logger adding the request ID and the trace of ctx to
+// the logs
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	l2 := *l
+	l2.ctx = ctx
+	return &l2
+}
+
+// With returns the logger adding the key value pairs to the logs
+func (l *Logger) With(args ...any) *Logger {
+	l2 := *l
+	l2.attrs = append(l.attrs[:len(l.attrs):len(l.attrs)], args...)
+	return &l2
+}
+
+// Enabled reports whether the module logs the level
+func (l *Logger) Enabled(level slog.Level) bool {
+	return level >= l.m.level.Level()
+}
+
+// Fatal logs the message and exits the process
+func (l *Logger) Fatal(format string, args ...any) {
+	l.log(LevelFatal, format, args)
+	os.Exit(1)
+}
+
+// Error ...
+func (l *Logger) Error(format string, args ...any) {
+	l.log(slog.LevelError, format, args)
+}
+
+// Warn ...
+func (l *Logger) Warn(format string, args ...any) {
+	l.log(slog.LevelWarn, format, args)
+}
+
+// Info ...
+func (l *Logger) Info(format string, args ...any) {
+	l.log(slog.LevelInfo, format, args)
+}
+
+// Debug ...
+func (l *Logger) Debug(format string, args ...any) {
+	l.log(slog.LevelDebug, format, args)
+}
+
+func (l *Logger) log(level slog.Level, format string, args []any) {
+	checkInitState()
+	if !l.Enabled(level) {
+		return
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	r := slog.NewRecord(time.Now(), level, Redact(msg), 0)
+	r.AddAttrs(slog.String("module", l.m.name))
+
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	r.Add(l.attrs...)
+	handler.Handle(ctx, r)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns the context of a request carrying its ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request, empty outside a request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
 
 // Fatal ...
 func Fatal(format string, args ...any) {
 	checkInitState()
-	gLogger.Fatalf(format, args...)
+	gLogger.Fatal(format, args...)
 }
 
 // Error ...
 func Error(format string, args ...any) {
 	checkInitState()
-	gLogger.Errorf(format, args...)
+	gLogger.Error(format, args...)
 }
 
 // Warn ...
 func Warn(format string, args ...any) {
 	checkInitState()
-	gLogger.Warningf(format, args...)
+	gLogger.Warn(format, args...)
 }
 
 // Info ...
 func Info(format string, args ...any) {
 	checkInitState()
-	gLogger.Infof(format, args...)
+	gLogger.Info(format, args...)
 }
 
 // Debug ...
 func Debug(format string, args ...any) {
 	checkInitState()
-	gLogger.Debugf(format, args...)
+	gLogger.Debug(format, args...)
 }
 
 func checkInitState() {
-	if gLogger == nil {
+	if handler == nil {
 		panic("logger not initialized")
 	}
 }
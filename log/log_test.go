@@ -0,0 +1,129 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initTest initializes the logger again, writing to the returned buffer
+func initTest(t *testing.T, conf LoggerConfig) *bytes.Buffer {
+	var buf bytes.Buffer
+	mu.Lock()
+	handler = nil
+	mu.Unlock()
+	conf.Writer = &buf
+	if err := InitLogger(&conf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestJSON(t *testing.T) {
+	buf := initTest(t, LoggerConfig{Module: "serval-test", LogLevel: "info"})
+
+	Debug("dropped")
+	Info("Created %d DIDs", 3)
+	Error("100% failed")
+
+	recs := records(t, buf)
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 records, got %v", recs)
+	}
+	if recs[0]["level"] != "info" || recs[0]["module"] != "serval-test" || recs[0]["msg"] != "Created 3 DIDs" {
+		t.Errorf("Unexpected record %v", recs[0])
+	}
+	if recs[1]["level"] != "error" || recs[1]["msg"] != "100% failed" {
+		t.Errorf("Unexpected record %v", recs[1])
+	}
+}
+
+func TestModuleLevels(t *testing.T) {
+	buf := initTest(t, LoggerConfig{Module: "serval-test", LogLevel: "warn", Levels: map[string]string{"hooks": "debug"}})
+	hooks, api := Module("hooks"), Module("test-api")
+
+	hooks.Debug("kept")
+	api.Info("dropped")
+	if levels := Levels(); levels["hooks"] != "debug" || levels["test-api"] != "warn" {
+		t.Fatalf("Unexpected levels %v", levels)
+	}
+
+	if err := SetLevel("test-api", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	api.Debug("kept after the change")
+	if err := SetLevel("no-such-module", "debug"); err == nil {
+		t.Error("Expected error for an unknown module")
+	}
+	if err := SetLevel("test-api", "verbose"); err == nil {
+		t.Error("Expected error for an unknown level")
+	}
+
+	recs := records(t, buf)
+	if len(recs) != 2 || recs[0]["module"] != "hooks" || recs[1]["msg"] != "kept after the change" {
+		t.Fatalf("Unexpected records %v", recs)
+	}
+}
+
+func TestContext(t *testing.T) {
+	buf := initTest(t, LoggerConfig{Module: "serval-test"})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	ctx = WithRequestID(ctx, "req-1")
+	Module("test-ctx").Ctx(ctx).With("did", "did:example:1").Info("resolved")
+
+	recs := records(t, buf)
+	if len(recs) != 1 {
+		t.Fatalf("Expected 1 record, got %v", recs)
+	}
+	rec := recs[0]
+	if rec["request_id"] != "req-1" || rec["trace_id"] != traceID.String() || rec["span_id"] != spanID.String() || rec["did"] != "did:example:1" {
+		t.Errorf("Unexpected record %v", rec)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	buf := initTest(t, LoggerConfig{Module: "serval-test"})
+	AddSecret("8f56b044cf1a9d67cd16")
+
+	Info("appKey %s", "8f56b044cf1a9d67cd16")
+	Info(`request {"id":"k1","privateKeyHex":"abcdef","type":"Ed25519"}`)
+	Info("Authorization: Bearer eyJhbGciOi, next")
+	Module("test-redact").With("secret", "s3cr3t", "hmacSecret", "abc").Info("subscribed")
+
+	for _, rec := range records(t, buf) {
+		line, _ := json.Marshal(rec)
+		for _, secret := range []string{"8f56b044cf1a9d67cd16", "abcdef", "eyJhbGciOi", "s3cr3t"} {
+			if strings.Contains(string(line), secret) {
+				t.Errorf("The secret %s is in %s", secret, line)
+			}
+		}
+	}
+	if got := Redact(`{"id":"k1","privateKeyHex":"abcdef","type":"Ed25519"}`); got != `{"id":"k1","privateKeyHex":"[REDACTED]","type":"Ed25519"}` {
+		t.Errorf("Unexpected redaction %s", got)
+	}
+	if got := Redact("/api/v1/events?token=abc&types=did.created"); got != "/api/v1/events?token=[REDACTED]&types=did.created" {
+		t.Errorf("Unexpected redaction %s", got)
+	}
+}
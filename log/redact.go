@@ -0,0 +1,81 @@
+package log
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces the secrets in the logs
+const Redacted = "[REDACTED]"
+
+// secretKeys are the parts of the names of the attributes holding secrets
+var secretKeys = []string{"password", "passwd", "secret", "token", "privatekey", "private_key", "apikey", "api_key", "authorization", "cookie"}
+
+// secretPattern matches the secrets assigned in the messages, in JSON like
+// "privateKeyHex":"8f56..." and in forms like password=abc or
+// Authorization: Bearer abc
+var secretPattern = regexp.MustCompile(`(?i)("?[\w-]*(?:password|passwd|secret|token|private_?key|api_?key|authorization)[\w-]*"?\s*[:=]\s*)("[^"]*"|(?:bearer\s+|basic\s+)?[^\s,;&"}\]]+)`)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// AddSecret redacts the value wherever it shows in the logs, like the
+// keys and the credentials read from the config
+func AddSecret(s string) {
+	// Short values would redact random parts of the messages
+	if len(s) < 8 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, s)
+}
+
+// Redact replaces the secrets in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	secretsMu.RUnlock()
+
+	return secretPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := secretPattern.FindStringSubmatch(m)
+		if strings.HasPrefix(sub[2], `"`) {
+			return sub[1] + `"` + Redacted + `"`
+		}
+		return sub[1] + Redacted
+	})
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range secretKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceAttr redacts the attributes named like secrets and the secrets in
+// the string values, and names the levels in lower case
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case len(groups) == 0 && a.Key == slog.LevelKey:
+		if l, ok := a.Value.Any().(slog.Level); ok {
+			return slog.String(slog.LevelKey, levelName(l))
+		}
+	case len(groups) == 0 && (a.Key == slog.MessageKey || a.Key == slog.TimeKey):
+		// The message is redacted when it is formatted
+	case isSecretKey(a.Key):
+		return slog.String(a.Key, Redacted)
+	case a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	}
+	return a
+}
@@ -1,40 +1,319 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ewangplay/rwriter"
 	"github.com/ewangplay/serval/adapter"
+	apiGrpc "github.com/ewangplay/serval/api/grpc"
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
 	"github.com/ewangplay/serval/config"
+	"github.com/ewangplay/serval/health"
+	"github.com/ewangplay/serval/idempotency"
 	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/ewangplay/serval/registry"
 	"github.com/ewangplay/serval/router"
-	"github.com/spf13/viper"
+	pb "github.com/ewangplay/serval/sdk/go/servalpb"
+	"github.com/ewangplay/serval/tlsconfig"
+	"github.com/ewangplay/serval/tracing"
+	"github.com/ewangplay/serval/webhook"
+	"github.com/philippgille/gokv"
+	"golang.org/x/text/language"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// service holds the components shared by the server and the subcommands
+type service struct {
+	cfg      *config.Config
+	w        io.Writer
+	store    gokv.Store
+	registry *registry.Registry
+	appKey   *adapter.AppKey
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		case "appkey":
+			runAppKey(os.Args[2:])
+			return
+		}
+	}
+
 	var filename = flag.String("config", "serval.yaml", "path to config file")
 	flag.Parse()
 
+	// exitCode is the status of the process once the deferred calls ran
+	exitCode := 0
+	defer func() { os.Exit(exitCode) }()
+
+	svc := initService(*filename)
+	defer svc.store.Close()
+	defer svc.appKey.Close()
+
+	cfg := svc.cfg
+
+	// Init webhooks
+	var notifier *webhook.Notifier
+	if cfg.Webhook.Enabled {
+		notifier = webhook.NewNotifier(svc.store, cfg.Webhook)
+		svc.registry.OnEvent(notifier.Notify)
+		notifier.Start()
+		defer notifier.Close()
+	}
+
+	// Init tracing
+	if cfg.Tracing.Exporter != "" {
+		provider, err := tracing.Init(&cfg.Tracing)
+		if err != nil {
+			fmt.Printf("Init tracing failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+		defer provider.Shutdown(context.Background())
+	}
+
+	// Init authentication
+	var guard *auth.Guard
+	var err error
+	if cfg.Auth.Enabled {
+		guard, err = auth.New(&cfg.Auth)
+		if err != nil {
+			fmt.Printf("Init authentication failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+	}
+
+	// Init TLS, the certificates are reloaded when their files change
+	var reloader *tlsconfig.Reloader
+	if cfg.Server.TLS.Enabled() {
+		reloader, err = tlsconfig.NewReloader(&cfg.Server.TLS)
+		if err != nil {
+			fmt.Printf("Init TLS failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+		reloader.Start()
+		defer reloader.Close()
+	}
+
+	lang := language.English
+	if v := cfg.Server.Language; v != "" {
+		if lang, err = apiV1.ParseLanguage(v); err != nil {
+			fmt.Printf("Read the server language failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+	}
+
+	// Readiness probes of the store backend and the crypto service provider
+	checker := health.NewChecker(cfg.Server.ProbeTimeout)
+	checker.Add("store", func(context.Context) error {
+		return adapter.ProbeStore(svc.store)
+	})
+	checker.Add("csp", func(context.Context) error {
+		return adapter.ProbeCSP(svc.registry.CSP(), svc.appKey)
+	})
+	shutdown := make(chan struct{})
+
+	// Init the rate limits, the nodes share their counters through the
+	// store, read past its cache
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimit.Enabled {
+		limiter, err = ratelimit.New(cfg.RateLimit, adapter.Uncached(svc.store))
+		if err != nil {
+			fmt.Printf("Init rate limits failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+		defer limiter.Close()
+	}
+
+	// Keep the responses of the retried writes, shared by the nodes
+	var keeper *idempotency.Keeper
+	if cfg.Idempotency.Enabled {
+		keeper, err = idempotency.New(cfg.Idempotency, adapter.Uncached(svc.store))
+		if err != nil {
+			fmt.Printf("Init idempotency failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+		defer keeper.Close()
+	}
+
+	// Init router
+	r := router.InitRouter(&router.Options{
+		Writer:         svc.w,
+		Registry:       svc.registry,
+		AppKey:         svc.appKey,
+		Webhooks:       notifier,
+		EnableAdmin:    cfg.Server.Admin,
+		Language:       lang,
+		Auth:           guard,
+		Health:         checker,
+		Shutdown:       shutdown,
+		EnableMetrics:  cfg.Server.Metrics,
+		RateLimiter:    limiter,
+		TrustedProxies: cfg.Server.TrustedProxies,
+		CacheControl:   cfg.Server.CacheControl,
+		Idempotency:    keeper,
+	})
+
+	// Serve the gRPC API next to the HTTP one
+	var gs *grpc.Server
+	var grpcSrv *apiGrpc.Server
+	if port := cfg.Grpc.Port; port != "" {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+		if err != nil {
+			fmt.Printf("Listen on the gRPC port failed: %v\n", err)
+			exitCode = 1
+			return
+		}
+		grpcOpts := apiGrpc.ServerOptions(guard, limiter, keeper)
+		if reloader != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(reloader.Config())))
+		}
+		gs = grpc.NewServer(grpcOpts...)
+		grpcSrv = apiGrpc.NewServer(svc.registry)
+		pb.RegisterDidServiceServer(gs, grpcSrv)
+		go gs.Serve(lis)
+	}
+
+	// listen and serve on 0.0.0.0:<port>
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.Server.Port),
+		Handler: r,
+	}
+	serveErr := make(chan error, 1)
+	if reloader != nil {
+		srv.TLSConfig = reloader.Config()
+		go func() { serveErr <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	// Drain on SIGINT or SIGTERM, the deferred calls then stop the
+	// notifier and close the store last
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err = <-serveErr:
+		fmt.Printf("Serve HTTP failed: %v\n", err)
+		exitCode = 1
+	case <-sigCtx.Done():
+		log.Info("Shutting down, draining the requests in flight")
+	}
+	drain(&cfg.Server, srv, gs, grpcSrv, checker, shutdown)
+	log.Info("Shut down")
+}
+
+// drain fails the readiness probe, ends the event streams and waits for the
+// requests in flight, up to server.shutdownTimeout
+func drain(opts *config.Server, srv *http.Server, gs *grpc.Server, grpcSrv *apiGrpc.Server, checker *health.Checker, shutdown chan struct{}) {
+	timeout := opts.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	// Give the load balancers the time to notice the server is not ready
+	checker.Drain()
+	time.Sleep(opts.DrainDelay)
+	close(shutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if gs != nil {
+		// The gRPC calls get half of the time, the HTTP requests and the
+		// closing of the store the rest
+		grpcCtx, grpcCancel := context.WithTimeout(ctx, timeout/2)
+		defer grpcCancel()
+		grpcSrv.Drain()
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-grpcCtx.Done():
+			// Cut the calls still running at the deadline
+			gs.Stop()
+		}
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error("Drain the HTTP requests failed: %v", err)
+		srv.Close()
+	}
+}
+
+// secrets returns the settings redacted from the logs
+func secrets(cfg *config.Config) []string {
+	s := []string{cfg.AppKey.PrivateKeyHex, cfg.Auth.JWT.HMACSecret}
+	if e := cfg.Store.Encryption; e != nil {
+		s = append(s, e.KEK, e.PreviousKEK)
+	}
+	k := &cfg.AppKey
+	switch k.Source {
+	case adapter.AppKeySourceKeystore:
+		if p, err := adapter.ReadSecret(k.Keystore.PassphraseFile, k.Keystore.PassphraseEnv, adapter.DefaultPassphraseEnv); err == nil {
+			s = append(s, string(p))
+		}
+	case adapter.AppKeySourcePKCS11:
+		if p, err := adapter.ReadSecret(k.PKCS11.PINFile, k.PKCS11.PINEnv, adapter.DefaultPINEnv); err == nil {
+			s = append(s, string(p))
+		}
+	}
+	return s
+}
+
+// initService initializes the config, logger, store and keys,
+// it exits the process on failure
+func initService(filename string) *service {
 	// Init configure
-	err := config.InitConfig(*filename)
+	cfg, err := config.Load(filename)
 	if err != nil {
-		fmt.Printf("Init config failed: %v\n", err)
+		fmt.Printf("Read the config %s failed:\n%v\n", filename, err)
+		os.Exit(1)
+	}
+	if err = cfg.Validate(); err != nil {
+		fmt.Printf("Invalid config %s:\n%v\n", filename, err)
 		os.Exit(1)
 	}
-
-	// Debug prints all configuration registries for debugging
-	viper.Debug()
 
 	// New Rotate Writer
 	var w io.Writer
 	rwCfg := &rwriter.Config{
 		Module:      "serval",
-		Path:        viper.GetString("log.path"),
-		MaxSize:     viper.GetInt64("log.maxSize"),
-		RotateDaily: viper.GetBool("log.rotateDaily"),
+		Path:        cfg.Log.Path,
+		MaxSize:     cfg.Log.MaxSize,
+		RotateDaily: cfg.Log.RotateDaily,
 	}
 	w, err = rwriter.NewRotateWriter(rwCfg)
 	if err != nil {
@@ -45,8 +324,9 @@ func main() {
 	// Init Logger
 	logCfg := &log.LoggerConfig{
 		Module:   "serval",
-		LogLevel: viper.GetString("log.level"),
-		Color:    0,
+		LogLevel: cfg.Log.Level,
+		Levels:   cfg.Log.Levels,
+		Format:   cfg.Log.Format,
 		Writer:   w,
 	}
 	err = log.InitLogger(logCfg)
@@ -54,20 +334,10 @@ func main() {
 		fmt.Printf("Init logger failed: %v\n", err)
 		os.Exit(1)
 	}
-
-	// Init Store
-	var opts adapter.StoreOptions
-	err = viper.UnmarshalKey("store", &opts)
-	if err != nil {
-		fmt.Printf("Read store options failed: %v\n", err)
-		os.Exit(1)
+	for _, secret := range secrets(cfg) {
+		log.AddSecret(secret)
 	}
-	store, err := adapter.InitStore(&opts)
-	if err != nil {
-		fmt.Printf("Init store failed: %v\n", err)
-		os.Exit(1)
-	}
-	defer store.Close()
+	log.Info("Loaded the config from %s", filename)
 
 	// Init cryptolib
 	csp, err := adapter.InitCryptolib()
@@ -83,9 +353,37 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Init router
-	r := router.InitRouter(w, store, csp, qsign)
+	// Init application key
+	appKey, err := adapter.InitAppKey(&cfg.AppKey)
+	if err != nil {
+		fmt.Printf("Init application key failed: %v\n", err)
+		os.Exit(1)
+	}
 
-	// listen and serve on 0.0.0.0:<port>
-	r.Run(fmt.Sprintf(":%s", viper.GetString("server.port")))
+	// Init Store last, the failures after it close it before exiting
+	store, err := adapter.InitStore(&cfg.Store)
+	if err != nil {
+		fmt.Printf("Init store failed: %v\n", err)
+		appKey.Close()
+		os.Exit(1)
+	}
+
+	// Build the DID indexes of the records written by older releases
+	reg := registry.New(store, csp, qsign)
+	reg.SetEventRetention(cfg.Events.Retention)
+	err = reg.EnsureIndexes()
+	if err != nil {
+		fmt.Printf("Init DID indexes failed: %v\n", err)
+		store.Close()
+		appKey.Close()
+		os.Exit(1)
+	}
+
+	return &service{
+		cfg:      cfg,
+		w:        w,
+		store:    store,
+		registry: reg,
+		appKey:   appKey,
+	}
 }
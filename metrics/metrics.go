@@ -0,0 +1,196 @@
+// Package metrics holds the Prometheus collectors of the server, exposed
+// on /metrics. The collectors are registered in the default registry, so
+// that the Go runtime and process metrics are exposed next to them.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ewangplay/serval/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "serval"
+
+// Results of the verifications
+const (
+	ResultValid       = "valid"
+	ResultInvalid     = "invalid"
+	ResultUnsupported = "unsupported"
+	ResultError       = "error"
+)
+
+// Targets of the verifications, the signature of a document or the proof
+// of a revocation
+const (
+	TargetDocument = "document"
+	TargetProof    = "proof"
+)
+
+// Results of the cache lookups
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// unmatched labels the requests matching no route, so that scans of
+// random paths do not create new series
+const unmatched = "unmatched"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	verifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verifications_total",
+		Help:      "Signature verifications by target, key type and result.",
+	}, []string{"target", "key_type", "result"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_operation_duration_seconds",
+		Help:      "Latency of the store backend operations.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"backend", "op"})
+
+	storeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_errors_total",
+		Help:      "Failed store backend operations.",
+	}, []string{"backend", "op"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Lookups of the store cache by result, hit or miss.",
+	}, []string{"result"})
+
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "Entries evicted from the store cache to make room.",
+	})
+
+	documents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_total",
+		Help:      "DID documents written by operation, created, updated or revoked.",
+	}, []string{"op"})
+
+	eventLogFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_log_failures_total",
+		Help:      "Events of committed writes that could not be appended to the change log.",
+	})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests refused by the rate limits, by the scope of the empty bucket, client or did, and by class, read or write.",
+	}, []string{"scope", "class"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts the requests and observes their latency, by the route
+// pattern rather than the path, to keep the number of series bounded
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatched
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveVerification counts a verification of the target by its outcome,
+// valid tells the outcome of the verifications that did not fail
+func ObserveVerification(target, keyType string, valid bool, err error) {
+	result := ResultValid
+	switch {
+	case errors.Is(err, utils.ErrInvalidSignature):
+		result = ResultInvalid
+	case errors.Is(err, utils.ErrUnsupportedKeyType):
+		result = ResultUnsupported
+	case err != nil:
+		result = ResultError
+	case !valid:
+		result = ResultInvalid
+	}
+	verifications.WithLabelValues(target, keyTypeLabel(keyType), result).Inc()
+}
+
+// keyTypeLabel folds the key types given by the clients, the unknown ones
+// are reported as other
+func keyTypeLabel(keyType string) string {
+	switch t := strings.ToLower(keyType); t {
+	case "ed25519", "ecdsa", "rsa", "sm2":
+		return t
+	case "":
+		return "none"
+	default:
+		return "other"
+	}
+}
+
+// ObserveStore observes the latency of a store operation, and counts it
+// as failed when err is set
+func ObserveStore(backend, op string, start time.Time, err error) {
+	storeDuration.WithLabelValues(backend, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storeErrors.WithLabelValues(backend, op).Inc()
+	}
+}
+
+// ObserveCache counts a lookup of the store cache, CacheHit or CacheMiss
+func ObserveCache(result string) {
+	cacheRequests.WithLabelValues(result).Inc()
+}
+
+// ObserveEviction counts an entry evicted from the store cache
+func ObserveEviction() {
+	cacheEvictions.Inc()
+}
+
+// ObserveDocument counts a document written by the op, like created or revoked
+func ObserveDocument(op string) {
+	documents.WithLabelValues(op).Inc()
+}
+
+// ObserveEventLogFailure counts an event missing from the change log
+func ObserveEventLogFailure() {
+	eventLogFailures.Inc()
+}
+
+// ObserveRateLimited counts a request refused by an empty bucket of the
+// scope, client or did, for the class of the request, read or write
+func ObserveRateLimited(scope, class string) {
+	rateLimited.WithLabelValues(scope, class).Inc()
+}
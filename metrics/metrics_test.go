@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveVerification(t *testing.T) {
+	cases := []struct {
+		valid  bool
+		err    error
+		result string
+	}{
+		{true, nil, ResultValid},
+		{false, nil, ResultInvalid},
+		{false, fmt.Errorf("wrapped: %w", utils.ErrInvalidSignature), ResultInvalid},
+		{false, fmt.Errorf("wrapped: %w", utils.ErrUnsupportedKeyType), ResultUnsupported},
+		{false, errors.New("hash failed"), ResultError},
+	}
+	for _, c := range cases {
+		counter := verifications.WithLabelValues(TargetProof, "ed25519", c.result)
+		before := testutil.ToFloat64(counter)
+		ObserveVerification(TargetProof, "Ed25519", c.valid, c.err)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%v %v: %s counted %v times", c.valid, c.err, c.result, got)
+		}
+	}
+}
+
+func TestKeyTypeLabel(t *testing.T) {
+	for keyType, label := range map[string]string{
+		"ED25519":     "ed25519",
+		"":            "none",
+		"made-up-key": "other",
+	} {
+		if got := keyTypeLabel(keyType); got != label {
+			t.Errorf("keyTypeLabel(%q) = %q, want %q", keyType, got, label)
+		}
+	}
+}
+
+func TestObserveStore(t *testing.T) {
+	errors0 := testutil.ToFloat64(storeErrors.WithLabelValues("test", "get"))
+	ObserveStore("test", "get", time.Now(), nil)
+	ObserveStore("test", "get", time.Now(), errors.New("unavailable"))
+	if got := testutil.ToFloat64(storeErrors.WithLabelValues("test", "get")) - errors0; got != 1 {
+		t.Errorf("Store errors counted %v times, want 1", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/config"
+)
+
+// runMigrate handles `serval migrate`, it copies every record of the store
+// configured in -config to the store configured in -target
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	filename := fs.String("config", "serval.yaml", "path to config file of the source store")
+	target := fs.String("target", "", "path to config file of the target store")
+	checkpoint := fs.String("checkpoint", "", "path to the checkpoint file to resume from")
+	reset := fs.Bool("reset", false, "remove the checkpoint and start over")
+	dryRun := fs.Bool("dry-run", false, "report the keys to copy without writing anything")
+	verify := fs.Bool("verify", false, "compare the target with the source instead of copying")
+	fs.Parse(args)
+
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "The -target config file is required")
+		os.Exit(1)
+	}
+	if *reset && *checkpoint != "" {
+		if err := os.Remove(*checkpoint); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Remove the checkpoint failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Only the store settings of both files are used, the environment
+	// overrides only apply to the source
+	srcCfg, err := config.Load(*filename)
+	if err == nil {
+		err = config.ValidateStore(&srcCfg.Store)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Read source config failed:\n%v\n", err)
+		os.Exit(1)
+	}
+	dstCfg, err := config.LoadFile(*target)
+	if err == nil {
+		err = config.ValidateStore(&dstCfg.Store)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Read target config failed:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	src, err := adapter.InitStore(&srcCfg.Store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Init source store failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer src.Close()
+
+	dst, err := adapter.InitStore(&dstCfg.Store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Init target store failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer dst.Close()
+
+	report, err := adapter.Migrate(src, dst, adapter.MigrateOptions{
+		Checkpoint: *checkpoint,
+		DryRun:     *dryRun,
+		Verify:     *verify,
+	})
+	if report != nil {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migrate failed: %v\n", err)
+		os.Exit(1)
+	}
+	if len(report.Missing) > 0 || len(report.Mismatched) > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,404 @@
+// Package ratelimit limits the rate of the requests with token buckets:
+// one bucket per client, by principal or by IP address, and one bucket per
+// target DID whatever the client, with separate budgets for the reads and
+// the writes.
+//
+// With Distributed set the nodes behind a load balancer share the budgets
+// through the store. Every node publishes what its buckets consumed, and
+// drains its own buckets by what the other nodes consumed since the last
+// exchange, so a client spreading its requests over the nodes gets the
+// budget of one node, give or take the consumption of one SyncInterval:
+//
+//	serval:ratelimit:<node>  the consumption of a node
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/metrics"
+	"github.com/ewangplay/serval/utils"
+	"github.com/philippgille/gokv"
+)
+
+const usagePrefix = "serval:ratelimit:"
+
+// Scopes of the buckets
+const (
+	ScopeClient = "client"
+	ScopeDID    = "did"
+)
+
+// Classes of the requests
+const (
+	ClassRead  = "read"
+	ClassWrite = "write"
+)
+
+var logger = log.Module("ratelimit")
+
+// Limit is the budget of a bucket
+type Limit struct {
+	// Rate is the number of requests per second refilling the bucket,
+	// 0 disables the limit
+	Rate float64
+	// Burst is the number of requests the bucket holds, the rate rounded
+	// up when unset
+	Burst int
+}
+
+// Budget holds the limits of the reads and of the writes, the writes
+// being the create, update, revoke and admin requests
+type Budget struct {
+	Read  Limit
+	Write Limit
+}
+
+// Options defines the limits of the requests
+type Options struct {
+	Enabled bool
+	// Client limits every client, by its principal when authenticated,
+	// else by its IP address
+	Client Budget
+	// DID limits the requests targeting a DID, whatever the client
+	DID Budget
+	// Distributed shares the budgets with the other nodes through the store
+	Distributed bool
+	// SyncInterval is how often the nodes exchange their consumption, 1s
+	// by default
+	SyncInterval time.Duration
+}
+
+// Validate checks the limits
+func (o *Options) Validate() error {
+	limits := []struct {
+		name  string
+		limit Limit
+	}{
+		{"client.read", o.Client.Read},
+		{"client.write", o.Client.Write},
+		{"did.read", o.DID.Read},
+		{"did.write", o.DID.Write},
+	}
+	for _, l := range limits {
+		if l.limit.Rate < 0 || math.IsNaN(l.limit.Rate) || math.IsInf(l.limit.Rate, 0) {
+			return fmt.Errorf("%s.rate must be a non negative number", l.name)
+		}
+		if l.limit.Burst < 0 {
+			return fmt.Errorf("%s.burst must not be negative", l.name)
+		}
+	}
+	if o.SyncInterval < 0 {
+		return fmt.Errorf("syncInterval must not be negative")
+	}
+	return nil
+}
+
+func (o *Options) setDefaults() {
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = time.Second
+	}
+	for _, l := range []*Limit{&o.Client.Read, &o.Client.Write, &o.DID.Read, &o.DID.Write} {
+		if l.Burst <= 0 {
+			l.Burst = int(math.Ceil(l.Rate))
+		}
+	}
+}
+
+// Request is what a request takes from the buckets
+type Request struct {
+	Write bool
+	// Client is the principal, or the IP address of the anonymous clients
+	Client string
+	// DIDs are the DIDs the request targets, like the items of a batch
+	DIDs []string
+}
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+	// taken is the consumption since the bucket was created, published to
+	// the other nodes
+	taken float64
+}
+
+// refill adds the tokens earned since the last call
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// wait returns the time until the bucket holds n tokens
+func (b *bucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// usage is the record of the consumption of a node
+type usage struct {
+	Node    string             `json:"node"`
+	Updated time.Time          `json:"updated"`
+	Taken   map[string]float64 `json:"taken"`
+}
+
+// Limiter holds the buckets of the clients and of the DIDs
+type Limiter struct {
+	opts Options
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	// The exchange with the other nodes, when distributed
+	store gokv.Store
+	node  string
+	// seen is the last consumption read from every other node
+	seen map[string]map[string]float64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates the limiter. The store is only used when the budgets are
+// distributed, it should not be behind a read cache, see adapter.Uncached.
+func New(opts Options, store gokv.Store) (*Limiter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts.setDefaults()
+	l := &Limiter{
+		opts:    opts,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+		seen:    make(map[string]map[string]float64),
+		done:    make(chan struct{}),
+	}
+	if opts.Distributed {
+		if store == nil {
+			return nil, fmt.Errorf("the distributed rate limits need a store")
+		}
+		l.store = store
+		l.node = utils.GenerateUUID()
+	}
+
+	l.wg.Add(1)
+	go l.loop()
+	return l, nil
+}
+
+func (l *Limiter) limit(scope, class string) Limit {
+	b := l.opts.Client
+	if scope == ScopeDID {
+		b = l.opts.DID
+	}
+	if class == ClassWrite {
+		return b.Write
+	}
+	return b.Read
+}
+
+// bucket returns the bucket of the key, scope:class:id, created full
+func (l *Limiter) bucket(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if ok {
+		b.refill(now)
+		return b
+	}
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	limit := l.limit(parts[0], parts[1])
+	if limit.Rate == 0 {
+		return nil
+	}
+	b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+	l.buckets[key] = b
+	return b
+}
+
+// Allow takes a token from the bucket of the client for every DID of the
+// request, at least one and at most the burst, and a token from the bucket
+// of every DID. When a bucket is short nothing is taken, Allow returns
+// false and the time until the request would be allowed.
+func (l *Limiter) Allow(r Request) (bool, time.Duration) {
+	class := ClassRead
+	if r.Write {
+		class = ClassWrite
+	}
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	type take struct {
+		b     *bucket
+		n     float64
+		scope string
+	}
+	var takes []take
+	if b := l.bucket(ScopeClient+":"+class+":"+r.Client, now); b != nil {
+		n := math.Max(1, math.Min(float64(len(r.DIDs)), float64(b.limit.Burst)))
+		takes = append(takes, take{b, n, ScopeClient})
+	}
+	seen := make(map[string]bool, len(r.DIDs))
+	for _, did := range r.DIDs {
+		if seen[did] {
+			continue
+		}
+		seen[did] = true
+		if b := l.bucket(ScopeDID+":"+class+":"+did, now); b != nil {
+			takes = append(takes, take{b, 1, ScopeDID})
+		}
+	}
+
+	var wait time.Duration
+	scope := ""
+	for _, t := range takes {
+		if w := t.b.wait(t.n); w > wait {
+			wait, scope = w, t.scope
+		}
+	}
+	if wait > 0 {
+		metrics.ObserveRateLimited(scope, class)
+		return false, wait
+	}
+	for _, t := range takes {
+		t.b.tokens -= t.n
+		t.b.taken += t.n
+	}
+	return true, 0
+}
+
+// Close stops the exchange with the other nodes and withdraws the
+// consumption of the node
+func (l *Limiter) Close() error {
+	close(l.done)
+	l.wg.Wait()
+	if l.store != nil {
+		return l.store.Delete(usagePrefix + l.node)
+	}
+	return nil
+}
+
+func (l *Limiter) loop() {
+	defer l.wg.Done()
+
+	// Without the exchange the loop only drops the idle buckets
+	interval := time.Minute
+	if l.store != nil {
+		interval = l.opts.SyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if l.store != nil {
+				if err := l.sync(); err != nil {
+					logger.Warn("Exchange the rate limit counters failed: %v", err)
+				}
+			}
+			l.evict()
+		}
+	}
+}
+
+// evict drops the buckets that are full again, they are created full
+func (l *Limiter) evict() {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// sync publishes the consumption of the node and applies the consumption
+// of the other nodes
+func (l *Limiter) sync() error {
+	now := l.now()
+	l.mu.Lock()
+	own := usage{Node: l.node, Updated: now.UTC(), Taken: make(map[string]float64)}
+	for key, b := range l.buckets {
+		if b.taken > 0 {
+			own.Taken[key] = b.taken
+		}
+	}
+	l.mu.Unlock()
+	if err := l.store.Set(usagePrefix+l.node, own); err != nil {
+		return err
+	}
+
+	// A node that stopped without withdrawing its record is ignored, then
+	// its record is removed
+	staleAfter := 3 * l.opts.SyncInterval
+	var others []usage
+	var stale []string
+	err := adapter.Scan(l.store, usagePrefix, func(k string) error {
+		if k == usagePrefix+l.node {
+			return nil
+		}
+		var u usage
+		found, err := l.store.Get(k, &u)
+		if err != nil || !found {
+			return err
+		}
+		switch age := now.Sub(u.Updated); {
+		case age > 10*staleAfter:
+			stale = append(stale, k)
+		case age <= staleAfter:
+			others = append(others, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		l.store.Delete(k)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]map[string]float64, len(others))
+	for _, u := range others {
+		prev, known := l.seen[u.Node]
+		seen[u.Node] = u.Taken
+		if !known {
+			// What a node consumed before it was first seen is already
+			// out of the window of the buckets
+			continue
+		}
+		for key, taken := range u.Taken {
+			n := taken - prev[key]
+			if n < 0 {
+				// The node dropped the bucket and created it again
+				n = taken
+			}
+			if n <= 0 {
+				continue
+			}
+			if b := l.bucket(key, now); b != nil {
+				b.tokens = math.Max(-float64(b.limit.Burst), b.tokens-n)
+			}
+		}
+	}
+	l.seen = seen
+	return nil
+}
@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/philippgille/gokv"
+)
+
+// clock is the time of the limiters, moved by the tests
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func newLimiter(t *testing.T, opts Options, store gokv.Store, c *clock) *Limiter {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	opts.Enabled = true
+	// The tests exchange the counters themselves
+	opts.SyncInterval = time.Hour
+	l, err := New(opts, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = c.now
+	return l
+}
+
+func allow(t *testing.T, l *Limiter, r Request, want bool) time.Duration {
+	t.Helper()
+	ok, wait := l.Allow(r)
+	if ok != want {
+		t.Fatalf("Expected %v for %+v, got %v", want, r, ok)
+	}
+	return wait
+}
+
+func TestAllow(t *testing.T) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := newLimiter(t, Options{
+		Client: Budget{
+			Read:  Limit{Rate: 1, Burst: 2},
+			Write: Limit{Rate: 0.5},
+		},
+	}, nil, c)
+	defer l.Close()
+
+	read := Request{Client: "apikey:org1"}
+	allow(t, l, read, true)
+	allow(t, l, read, true)
+	if wait := allow(t, l, read, false); wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %v", wait)
+	}
+
+	// The writes, the other clients and the unlimited DIDs have their own budget
+	allow(t, l, Request{Client: "apikey:org1", Write: true, DIDs: []string{"did:example:1"}}, true)
+	allow(t, l, Request{Client: "apikey:org1", Write: true}, false)
+	allow(t, l, Request{Client: "ip:10.0.0.1"}, true)
+
+	c.add(500 * time.Millisecond)
+	if wait := allow(t, l, read, false); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+	c.add(500 * time.Millisecond)
+	allow(t, l, read, true)
+
+	// The full buckets are dropped, and created full again
+	c.add(time.Hour)
+	l.evict()
+	if n := len(l.buckets); n != 0 {
+		t.Errorf("Expected no bucket left, got %d", n)
+	}
+	allow(t, l, read, true)
+	allow(t, l, read, true)
+}
+
+func TestAllowDIDs(t *testing.T) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := newLimiter(t, Options{
+		Client: Budget{Write: Limit{Rate: 1, Burst: 3}},
+		DID:    Budget{Write: Limit{Rate: 1, Burst: 1}},
+	}, nil, c)
+	defer l.Close()
+
+	// A batch takes a token per DID from the client, up to the burst, and
+	// a DID listed twice is taken once
+	batch := Request{Client: "apikey:org1", Write: true, DIDs: []string{"did:example:1", "did:example:2", "did:example:2", "did:example:3", "did:example:4"}}
+	allow(t, l, batch, true)
+	if b := l.buckets["client:write:apikey:org1"]; b.tokens != 0 || b.taken != 3 {
+		t.Errorf("Expected the batch to take 3 tokens, got %+v", b)
+	}
+
+	// The DID budget is shared by the clients
+	allow(t, l, Request{Client: "apikey:org2", Write: true, DIDs: []string{"did:example:2"}}, false)
+	allow(t, l, Request{Client: "apikey:org2", Write: true, DIDs: []string{"did:example:5"}}, true)
+
+	// A refused request takes nothing, org1 earned one token of the two
+	c.add(time.Second)
+	allow(t, l, Request{Client: "apikey:org1", Write: true, DIDs: []string{"did:example:5", "did:example:6"}}, false)
+	if b := l.buckets["did:write:did:example:6"]; b.tokens != 1 {
+		t.Errorf("Expected the refused request to leave the DID bucket full, got %+v", b)
+	}
+}
+
+func TestDistributed(t *testing.T) {
+	if _, err := New(Options{Distributed: true}, nil); err == nil {
+		t.Fatal("Expected the distributed limits to need a store")
+	}
+
+	store := adapter.NewMemoryStore()
+	c := &clock{t: time.Unix(1700000000, 0)}
+	opts := Options{
+		Client:      Budget{Read: Limit{Rate: 1, Burst: 4}},
+		Distributed: true,
+	}
+	a := newLimiter(t, opts, store, c)
+	defer a.Close()
+	b := newLimiter(t, opts, store, c)
+	exchange := func() {
+		for _, l := range []*Limiter{a, b} {
+			if err := l.sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The nodes see each other, then drain their buckets by what the other
+	// consumed since
+	read := Request{Client: "apikey:org1"}
+	allow(t, a, read, true)
+	exchange()
+	allow(t, a, read, true)
+	allow(t, a, read, true)
+	exchange()
+	allow(t, b, read, true)
+	allow(t, b, read, true)
+	allow(t, b, read, false)
+
+	// The record of a node stopped without withdrawing it is removed
+	var found bool
+	c.add(31 * time.Hour)
+	if err := b.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = store.Get(usagePrefix+a.node, &usage{}); found {
+		t.Error("Expected the stale record to be removed")
+	}
+	if found, _ = store.Get(usagePrefix+b.node, &usage{}); !found {
+		t.Error("Expected the record of the node")
+	}
+	b.Close()
+	if found, _ = store.Get(usagePrefix+b.node, &usage{}); found {
+		t.Error("Expected Close to withdraw the record")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, opts := range []Options{
+		{Client: Budget{Read: Limit{Rate: -1}}},
+		{DID: Budget{Write: Limit{Rate: 1, Burst: -1}}},
+		{SyncInterval: -time.Second},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", opts)
+		}
+	}
+}
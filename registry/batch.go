@@ -0,0 +1,250 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/ewangplay/serval/io"
+)
+
+// ErrBatchAborted is reported for the valid items of an atomic batch
+// that was not applied because another item failed
+var ErrBatchAborted = errors.New("batch aborted, another item failed")
+
+// ErrInvalidItem is matched by the errors of the batch items failing their
+// checks or the verification of their document
+var ErrInvalidItem = errors.New("invalid batch item")
+
+// invalidItem marks the error of an item failing its checks, it keeps the
+// message and the chain of the original error
+type invalidItem struct {
+	error
+}
+
+func (e invalidItem) Unwrap() error        { return e.error }
+func (e invalidItem) Is(target error) bool { return target == ErrInvalidItem }
+
+// BatchItem is one DID document of a batch
+type BatchItem struct {
+	Did      string
+	Document *io.DDO
+}
+
+// ResolveResult is the result of resolving one DID of a batch
+type ResolveResult struct {
+	Did      string
+	Document *io.DDO
+	Metadata *Metadata
+	Err      error
+}
+
+// parallel calls fn for every index in [0, n) on a pool of workers
+func parallel(n int, fn func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// checkItem is the check of the items of a batch when the caller gives none
+func (r *Registry) checkItem(item BatchItem) error {
+	if err := ValidDid(item.Did); err != nil {
+		return err
+	}
+	if item.Document.ID != item.Did {
+		return fmt.Errorf("the document id %v does not match the DID", item.Document.ID)
+	}
+	return r.Verify(item.Document)
+}
+
+// verifyBatch checks every item in parallel and returns the error of each
+func (r *Registry) verifyBatch(items []BatchItem, check func(BatchItem) error) []error {
+	errs := make([]error, len(items))
+	seen := make(map[string]int, len(items))
+	for i, item := range items {
+		switch {
+		case item.Document == nil:
+			errs[i] = fmt.Errorf("the document is missing")
+		default:
+			if j, ok := seen[item.Did]; ok {
+				errs[i] = fmt.Errorf("duplicate of item %d", j)
+			}
+			seen[item.Did] = i
+		}
+	}
+
+	if check == nil {
+		check = r.checkItem
+	}
+	parallel(len(items), func(i int) {
+		if errs[i] == nil {
+			errs[i] = check(items[i])
+		}
+	})
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = invalidItem{err}
+		}
+	}
+	return errs
+}
+
+// CreateBatch checks the items in parallel and stores the valid ones, it
+// returns the error of each item. The check of an item is called once its
+// document is known to be set and its DID unique in the batch, a nil check
+// verifies the DID and the document.
+//
+// With atomic set, nothing is stored unless every item is valid, and the
+// batch is written while the other writers of its DIDs are held off. If a
+// write fails the items already written are rolled back, so the batch is
+// all or nothing as long as the process does not crash in the middle of it.
+func (r *Registry) CreateBatch(items []BatchItem, atomic bool, check func(BatchItem) error) ([]error, error) {
+	errs := r.verifyBatch(items, check)
+
+	if !atomic {
+		r.snapshot.RLock()
+		defer r.snapshot.RUnlock()
+
+		parallel(len(items), func(i int) {
+			if errs[i] != nil {
+				return
+			}
+			entry, err := r.create(items[i].Did, items[i].Document)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			r.emit(entryEvent(items[i].Did, entry))
+		})
+		return errs, nil
+	}
+
+	if abortBatch(errs) {
+		return errs, nil
+	}
+
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+
+	dids := make([]string, len(items))
+	for i, item := range items {
+		dids[i] = item.Did
+	}
+	unlock := r.lockAll(dids)
+	defer unlock()
+
+	events := make([]Event, 0, len(items))
+	for i, item := range items {
+		entry, err := r.createLocked(item.Did, item.Document)
+		if err == nil {
+			events = append(events, entryEvent(item.Did, entry))
+			continue
+		}
+
+		errs[i] = err
+		abortBatch(errs)
+		for j := i - 1; j >= 0; j-- {
+			if err := r.uncreate(items[j].Did); err != nil {
+				return errs, fmt.Errorf("roll back %v failed: %v", items[j].Did, err)
+			}
+		}
+		return errs, nil
+	}
+
+	// The events of an atomic batch are only sent once it is applied
+	for _, e := range events {
+		r.emit(e)
+	}
+	return errs, nil
+}
+
+// abortBatch marks the valid items as aborted if any item failed
+func abortBatch(errs []error) bool {
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			failed = true
+			break
+		}
+	}
+	if failed {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = ErrBatchAborted
+			}
+		}
+	}
+	return failed
+}
+
+// ResolveBatch resolves the DIDs in parallel, the ones failing ValidDid
+// are not read
+func (r *Registry) ResolveBatch(dids []string) []ResolveResult {
+	results := make([]ResolveResult, len(dids))
+	parallel(len(dids), func(i int) {
+		res := &results[i]
+		res.Did = dids[i]
+		if res.Err = ValidDid(dids[i]); res.Err == nil {
+			res.Document, res.Metadata, res.Err = r.Resolve(dids[i])
+		}
+	})
+	return results
+}
+
+// lockAll locks the DIDs, taking their locks in ascending order so two
+// batches cannot deadlock, and returns the function unlocking them
+func (r *Registry) lockAll(dids []string) func() {
+	seen := make(map[int]bool, len(dids))
+	var stripes []int
+	for _, did := range dids {
+		if i := stripe(did); !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, i := range stripes {
+		r.locks[i].Lock()
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			r.locks[stripes[j]].Unlock()
+		}
+	}
+}
+
+// uncreate removes the record of a DID created by a batch, the metadata
+// first since it decides whether the DID exists. The caller holds the DID lock.
+func (r *Registry) uncreate(did string) error {
+	if err := r.store.Delete(metaKey(did)); err != nil {
+		return err
+	}
+	if err := r.store.Delete(did); err != nil {
+		return err
+	}
+	if err := r.unindex(did); err != nil {
+		return err
+	}
+	return r.store.Delete(historyKey(did, 1))
+}
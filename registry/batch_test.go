@@ -0,0 +1,161 @@
+package registry_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/philippgille/gokv"
+)
+
+// failingStore fails the writes of the document of one DID
+type failingStore struct {
+	gokv.Store
+	did string
+}
+
+func (s failingStore) Set(k string, v any) error {
+	if k == s.did {
+		return fmt.Errorf("injected failure")
+	}
+	return s.Store.Set(k, v)
+}
+
+func (s failingStore) Scan(prefix string, fn func(k string) error) error {
+	return adapter.Scan(s.Store, prefix, fn)
+}
+
+func batchItems(t *testing.T, reg *registry.Registry, n int) []registry.BatchItem {
+	items := make([]registry.BatchItem, n)
+	for i := range items {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		items[i] = registry.BatchItem{Did: id.Did, Document: &ddo}
+	}
+	return items
+}
+
+func TestCreateBatch(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	items := batchItems(t, reg, 20)
+	items[3].Document.Controller = "did:example:tampered"
+	items[7] = items[5]
+	items[9].Did = "serval:idxversion"
+	// A batch creates new DIDs only
+	if err := reg.Create(items[11].Did, items[11].Document); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := reg.CreateBatch(items, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if (i == 3 || i == 7 || i == 9 || i == 11) != (err != nil) {
+			t.Fatalf("Unexpected result of item %d: %v", i, err)
+		}
+	}
+	if errs[11] != registry.ErrExists {
+		t.Fatalf("Expected ErrExists for the existing DID, got %v", errs[11])
+	}
+	if _, _, err = reg.Resolve(items[3].Did); err != registry.ErrNotFound {
+		t.Fatalf("Invalid item should not be stored, got %v", err)
+	}
+
+	results := reg.ResolveBatch([]string{items[0].Did, items[3].Did})
+	if results[0].Err != nil || results[0].Document == nil || results[1].Err != registry.ErrNotFound {
+		t.Fatalf("Unexpected resolve results: %+v", results)
+	}
+}
+
+func TestCreateBatchAtomic(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	items := batchItems(t, reg, 5)
+	items[2].Document.Controller = "did:example:tampered"
+
+	errs, err := reg.CreateBatch(items, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if err == nil || (i != 2 && err != registry.ErrBatchAborted) {
+			t.Fatalf("Unexpected result of item %d: %v", i, err)
+		}
+	}
+	if dids := listAll(t, reg, registry.ListOptions{}); len(dids) != 0 {
+		t.Fatalf("Aborted batch stored DIDs: %v", dids)
+	}
+}
+
+func TestCreateBatchRollback(t *testing.T) {
+	base := registrytest.NewRegistry(t)
+	items := batchItems(t, base, 5)
+
+	reg := registry.New(failingStore{base.Store(), items[3].Did}, base.CSP(), base.Qsign())
+	errs, err := reg.CreateBatch(items, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[3] == nil || !strings.Contains(errs[3].Error(), "injected") {
+		t.Fatalf("Unexpected result of the failing item: %v", errs[3])
+	}
+
+	if dids := listAll(t, reg, registry.ListOptions{}); len(dids) != 0 {
+		t.Fatalf("Batch not rolled back: %v", dids)
+	}
+	if _, found, err := reg.Metadata(items[0].Did); err != nil || found {
+		t.Fatalf("Metadata not rolled back: %v %v", found, err)
+	}
+	if history, _ := reg.History(items[0].Did); len(history) != 0 {
+		t.Fatalf("History not rolled back: %+v", history)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{Controller: items[1].Did}); len(dids) != 0 {
+		t.Fatalf("Index not rolled back: %v", dids)
+	}
+}
+
+func TestCreateBatchAtomicConcurrent(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	items := batchItems(t, reg, 10)
+	reversed := make([]registry.BatchItem, len(items))
+	for i, item := range items {
+		reversed[len(items)-1-i] = item
+	}
+
+	// Both batches lock the same DIDs, listed in opposite orders
+	results := make(chan []error, 2)
+	for _, batch := range [][]registry.BatchItem{items, reversed} {
+		go func(batch []registry.BatchItem) {
+			errs, err := reg.CreateBatch(batch, true, nil)
+			if err != nil {
+				errs = []error{err}
+			}
+			results <- errs
+		}(batch)
+	}
+
+	applied := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case errs := <-results:
+			if len(errs) != len(items) {
+				t.Fatalf("Unexpected results: %v", errs)
+			}
+			if errs[0] == nil {
+				applied++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The batches deadlocked")
+		}
+	}
+	if applied != 1 {
+		t.Fatalf("Expected one batch applied, got %v", applied)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{}); len(dids) != len(items) {
+		t.Fatalf("Expected %v DIDs, got %v", len(items), dids)
+	}
+}
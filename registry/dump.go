@@ -0,0 +1,386 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	goio "io"
+	"os"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/io"
+)
+
+// DumpFormat identifies the layout of an export
+const DumpFormat = "serval-registry/1"
+
+const (
+	lineRecord   = "record"
+	lineManifest = "manifest"
+)
+
+// DumpRecord is one DID record of an export, tombstones carry no document
+type DumpRecord struct {
+	Type     string         `json:"type"`
+	Did      string         `json:"did"`
+	Document *io.DDO        `json:"document,omitempty"`
+	Metadata Metadata       `json:"metadata"`
+	History  []HistoryEntry `json:"history,omitempty"`
+}
+
+// Manifest closes an export. The checksum covers every record line,
+// and the signature of the app key covers the manifest itself.
+type Manifest struct {
+	Format       string    `json:"format"`
+	Created      time.Time `json:"created"`
+	Records      int       `json:"records"`
+	Checksum     string    `json:"checksum"`
+	KeyID        string    `json:"keyId"`
+	KeyType      string    `json:"keyType"`
+	PublicKeyHex string    `json:"publicKeyHex"`
+	Signature    string    `json:"signature,omitempty"`
+}
+
+type manifestLine struct {
+	Type     string    `json:"type"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+// RejectedRecord reports a record refused by Import
+type RejectedRecord struct {
+	Line   int    `json:"line"`
+	Did    string `json:"did"`
+	Reason string `json:"reason"`
+}
+
+// ImportReport summarizes an Import
+type ImportReport struct {
+	Manifest *Manifest        `json:"manifest"`
+	Records  int              `json:"records"`
+	Imported int              `json:"imported"`
+	Rejected []RejectedRecord `json:"rejected"`
+	DryRun   bool             `json:"dryRun"`
+}
+
+// ImportOptions defines the options of Import
+type ImportOptions struct {
+	// DryRun verifies the dump without writing anything
+	DryRun bool
+}
+
+func (m *Manifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+// Export writes every DID record, with its history and tombstones, as JSON
+// Lines, followed by the signed manifest. The copy is consistent: it is
+// first written to a temporary file while the writes are held off, then
+// streamed to w once they resume, so a slow reader does not block them.
+func (r *Registry) Export(w goio.Writer, appKey *adapter.AppKey) (*Manifest, error) {
+	tmp, err := os.CreateTemp("", "serval-export-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("create the export file failed: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	manifest, err := r.dump(tmp, appKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tmp.Seek(0, goio.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = goio.Copy(w, tmp); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// dump writes the export while the writes are held off
+func (r *Registry) dump(w goio.Writer, appKey *adapter.AppKey) (*Manifest, error) {
+	r.snapshot.Lock()
+	defer r.snapshot.Unlock()
+
+	bw := bufio.NewWriter(w)
+	sum := sha256.New()
+	count := 0
+
+	err := r.Dids(func(did string) error {
+		rec, err := r.dumpRecord(did)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		sum.Write(line)
+		if _, err = bw.Write(line); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("export the DID records failed: %v", err)
+	}
+
+	manifest := &Manifest{
+		Format:       DumpFormat,
+		Created:      time.Now(),
+		Records:      count,
+		Checksum:     hex.EncodeToString(sum.Sum(nil)),
+		KeyID:        appKey.ID,
+		KeyType:      appKey.Type,
+		PublicKeyHex: appKey.PublicKeyHex(),
+	}
+	data, err := manifest.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := appKey.Sign(r.csp, data)
+	if err != nil {
+		return nil, fmt.Errorf("sign the manifest failed: %v", err)
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	line, err := json.Marshal(manifestLine{Type: lineManifest, Manifest: manifest})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = bw.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	if err = bw.Flush(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (r *Registry) dumpRecord(did string) (*DumpRecord, error) {
+	rec := &DumpRecord{Type: lineRecord, Did: did}
+
+	var ddo io.DDO
+	found, err := r.store.Get(did, &ddo)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		rec.Document = &ddo
+	}
+
+	meta, found, err := r.Metadata(did)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		rec.Metadata = *meta
+	} else {
+		rec.Metadata = Metadata{Version: 1, Created: ddo.Created, Updated: ddo.Updated}
+	}
+
+	rec.History, err = r.History(did)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Import reads a dump written by Export. The manifest signature and the
+// checksum are checked before anything is written, then every document is
+// verified again and the records failing verification are reported back.
+func (r *Registry) Import(rd goio.Reader, appKey *adapter.AppKey, opts ImportOptions) (*ImportReport, error) {
+	records, lines, manifest, err := r.readDump(rd, appKey)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{
+		Manifest: manifest,
+		Records:  len(records),
+		Rejected: []RejectedRecord{},
+		DryRun:   opts.DryRun,
+	}
+
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+
+	for i, rec := range records {
+		if err := r.verifyRecord(rec); err != nil {
+			report.Rejected = append(report.Rejected, RejectedRecord{
+				Line:   lines[i],
+				Did:    rec.Did,
+				Reason: err.Error(),
+			})
+			continue
+		}
+		if !opts.DryRun {
+			if err := r.restore(rec); err != nil {
+				return report, fmt.Errorf("import %v failed: %v", rec.Did, err)
+			}
+		}
+		report.Imported++
+	}
+	return report, nil
+}
+
+func (r *Registry) readDump(rd goio.Reader, appKey *adapter.AppKey) ([]*DumpRecord, []int, *Manifest, error) {
+	var records []*DumpRecord
+	var lines []int
+	var manifest *Manifest
+	sum := sha256.New()
+
+	br := bufio.NewReader(rd)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == goio.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != goio.EOF {
+			return nil, nil, nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if manifest != nil {
+			return nil, nil, nil, fmt.Errorf("line %d: unexpected data after the manifest", n)
+		}
+
+		var probe struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(line, &probe); err != nil {
+			return nil, nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		switch probe.Type {
+		case lineRecord:
+			var rec DumpRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return nil, nil, nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			sum.Write(line)
+			records = append(records, &rec)
+			lines = append(lines, n)
+		case lineManifest:
+			var ml manifestLine
+			if err := json.Unmarshal(line, &ml); err != nil || ml.Manifest == nil {
+				return nil, nil, nil, fmt.Errorf("line %d: invalid manifest", n)
+			}
+			manifest = ml.Manifest
+		default:
+			return nil, nil, nil, fmt.Errorf("line %d: unknown line type %q", n, probe.Type)
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, nil, fmt.Errorf("the manifest is missing, the dump may be truncated")
+	}
+	if manifest.Format != DumpFormat {
+		return nil, nil, nil, fmt.Errorf("unsupported dump format: %v", manifest.Format)
+	}
+	if manifest.Records != len(records) {
+		return nil, nil, nil, fmt.Errorf("the manifest lists %d records, found %d", manifest.Records, len(records))
+	}
+	if checksum := hex.EncodeToString(sum.Sum(nil)); checksum != manifest.Checksum {
+		return nil, nil, nil, fmt.Errorf("checksum mismatch: %v != %v", checksum, manifest.Checksum)
+	}
+	if err := r.verifyManifest(manifest, appKey); err != nil {
+		return nil, nil, nil, err
+	}
+	return records, lines, manifest, nil
+}
+
+// verifyManifest checks the signature of the manifest with the application
+// key, or with the retired key it was signed with before a rotation
+func (r *Registry) verifyManifest(m *Manifest, appKey *adapter.AppKey) error {
+	key, ok := appKey.Lookup(m.KeyID, m.PublicKeyHex)
+	if !ok {
+		return fmt.Errorf("the manifest is signed by an unknown key: %v", m.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("the manifest signature is invalid")
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	valid, err := key.Verify(r.csp, data, signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("verifying the manifest signature failed")
+	}
+	return nil
+}
+
+func (r *Registry) verifyRecord(rec *DumpRecord) error {
+	if err := ValidDid(rec.Did); err != nil {
+		return err
+	}
+	if rec.Document != nil {
+		if rec.Document.ID != rec.Did {
+			return fmt.Errorf("the document id %v does not match the DID", rec.Document.ID)
+		}
+		if err := r.Verify(rec.Document); err != nil {
+			return fmt.Errorf("document: %v", err)
+		}
+	} else if !rec.Metadata.Deactivated {
+		return fmt.Errorf("the document is missing from a live record")
+	}
+
+	for _, entry := range rec.History {
+		if entry.Document == nil {
+			continue
+		}
+		if err := r.Verify(entry.Document); err != nil {
+			return fmt.Errorf("history version %d: %v", entry.Version, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) restore(rec *DumpRecord) error {
+	l := r.lock(rec.Did)
+	l.Lock()
+	defer l.Unlock()
+
+	for _, entry := range rec.History {
+		if err := r.store.Set(historyKey(rec.Did, entry.Version), entry); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if rec.Document != nil {
+		err = r.store.Set(rec.Did, rec.Document)
+	} else {
+		err = r.store.Delete(rec.Did)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Revoked DIDs are indexed with their last document
+	ddo := rec.Document
+	for i := len(rec.History) - 1; ddo == nil && i >= 0; i-- {
+		ddo = rec.History[i].Document
+	}
+	if ddo != nil {
+		if err = r.index(rec.Did, ddo); err != nil {
+			return err
+		}
+	}
+
+	return r.store.Set(metaKey(rec.Did), rec.Metadata)
+}
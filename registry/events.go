@@ -0,0 +1,338 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/metrics"
+	"github.com/philippgille/gokv"
+)
+
+// The events are kept in a change log, numbered by a sequence that only grows:
+//
+//	serval:events:<seq>  the event
+//	serval:eventseq      the last sequence number
+//
+// The nodes sharing a store share the change log. A node takes the number
+// following the last event logged in the store, and reads its event back to
+// make sure another node did not take the same number meanwhile. The store
+// has no compare-and-swap, so two nodes writing the same number at the same
+// instant may still lose one of the events.
+const (
+	eventPrefix           = "serval:events:"
+	eventSeqKey           = "serval:eventseq"
+	defaultEventRetention = 100000
+	watchBuffer           = 256
+	// watchPoll is how often a watcher reads the events of the other nodes
+	watchPoll = time.Second
+	// emitAttempts bounds the numbers tried for an event
+	emitAttempts = 10
+)
+
+// ErrEventsExpired is returned when resuming after an event dropped from the change log
+var ErrEventsExpired = errors.New("the change log does not go back that far")
+
+// ErrWatchLagging is returned when a watcher does not keep up with the events
+var ErrWatchLagging = errors.New("the watcher fell behind the events")
+
+// EventType is the kind of a registry event
+type EventType string
+
+const (
+	EventCreated        EventType = "did.created"
+	EventUpdated        EventType = "did.updated"
+	EventRevoked        EventType = "did.revoked"
+	EventKeyCompromised EventType = "key.compromised"
+)
+
+// EventTypes lists every event type
+var EventTypes = []EventType{EventCreated, EventUpdated, EventRevoked, EventKeyCompromised}
+
+var opEvents = map[Op]EventType{
+	OpCreate: EventCreated,
+	OpUpdate: EventUpdated,
+	OpRevoke: EventRevoked,
+}
+
+// Event is a change made to the registry
+type Event struct {
+	// ID is the decimal Seq
+	ID          string    `json:"id"`
+	Seq         uint64    `json:"seq"`
+	Type        EventType `json:"type"`
+	Did         string    `json:"did,omitempty"`
+	Version     int       `json:"version,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Dids        []string  `json:"dids,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func eventKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", eventPrefix, seq)
+}
+
+// SetEventRetention sets the number of events kept in the change log
+func (r *Registry) SetEventRetention(n int) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	r.retention = n
+}
+
+// OnEvent registers fn to be called after every change. The listeners are
+// called synchronously by the writer, in the order of the events.
+func (r *Registry) OnEvent(fn func(Event)) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	r.listeners = append(r.listeners, fn)
+}
+
+// eventLog returns the store of the change log, read past the cache since
+// the other nodes append to it
+func (r *Registry) eventLog() gokv.Store {
+	return adapter.Uncached(r.store)
+}
+
+// lastSeq returns the sequence number of the last event of the change log,
+// the caller holds eventsMu
+func (r *Registry) lastSeq() (uint64, error) {
+	if !r.seqLoaded {
+		if _, err := r.eventLog().Get(eventSeqKey, &r.seq); err != nil {
+			return 0, err
+		}
+		r.seqLoaded = true
+	}
+	seq, err := r.probeSeq(r.seq)
+	if err != nil {
+		return 0, err
+	}
+	r.seq = seq
+	return seq, nil
+}
+
+// probeSeq returns the sequence number of the last event from seq on,
+// skipping over the events logged by the other nodes
+func (r *Registry) probeSeq(seq uint64) (uint64, error) {
+	for {
+		_, found, err := r.readEvent(seq + 1)
+		if err != nil || !found {
+			return seq, err
+		}
+		seq++
+	}
+}
+
+func (r *Registry) readEvent(seq uint64) (Event, bool, error) {
+	var e Event
+	found, err := r.eventLog().Get(eventKey(seq), &e)
+	return e, found, err
+}
+
+// sameEvent reports whether the logged event is e, and not the one of
+// another node numbered the same
+func sameEvent(logged, e Event) bool {
+	return logged.Type == e.Type && logged.Did == e.Did && logged.Version == e.Version &&
+		logged.Fingerprint == e.Fingerprint && logged.Time.Equal(e.Time)
+}
+
+// emit numbers the event, appends it to the change log and hands it to
+// the listeners and the watchers. The write of the event is committed
+// already, so failing to log it is only reported: the listeners still get
+// it, the watchers miss it.
+func (r *Registry) emit(e Event) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+
+	err := r.logEvent(&e)
+	if err != nil {
+		metrics.ObserveEventLogFailure()
+		logger.Error("The %v event of %v%v is missing from the change log: %v", e.Type, e.Did, e.Fingerprint, err)
+	}
+
+	switch e.Type {
+	case EventCreated, EventUpdated, EventRevoked:
+		metrics.ObserveDocument(strings.TrimPrefix(string(e.Type), "did."))
+	}
+	for _, fn := range r.listeners {
+		fn(e)
+	}
+	if err != nil {
+		return
+	}
+	for ch := range r.watchers {
+		select {
+		case ch <- e:
+		default:
+			// Too slow, the watcher has to resume from the change log
+			delete(r.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// logEvent numbers the event and appends it to the change log, the caller
+// holds eventsMu
+func (r *Registry) logEvent(e *Event) error {
+	seq, err := r.lastSeq()
+	if err != nil {
+		return fmt.Errorf("read the event sequence failed: %v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt == emitAttempts {
+			return fmt.Errorf("log the event failed: no free sequence number after %v", seq)
+		}
+		e.Seq = seq + 1
+		e.ID = strconv.FormatUint(e.Seq, 10)
+		if err = r.eventLog().Set(eventKey(e.Seq), e); err != nil {
+			return fmt.Errorf("log the event failed: %v", err)
+		}
+		logged, _, err := r.readEvent(e.Seq)
+		if err != nil {
+			return fmt.Errorf("log the event failed: %v", err)
+		}
+		if sameEvent(logged, *e) {
+			break
+		}
+		// Another node took the number
+		if seq, err = r.probeSeq(e.Seq); err != nil {
+			return fmt.Errorf("read the event sequence failed: %v", err)
+		}
+	}
+	if err = r.eventLog().Set(eventSeqKey, e.Seq); err != nil {
+		return fmt.Errorf("log the event failed: %v", err)
+	}
+	r.seq = e.Seq
+
+	retention := r.retention
+	if retention <= 0 {
+		retention = defaultEventRetention
+	}
+	if e.Seq > uint64(retention) {
+		r.eventLog().Delete(eventKey(e.Seq - uint64(retention)))
+	}
+	return nil
+}
+
+func entryEvent(did string, entry *HistoryEntry) Event {
+	return Event{
+		Type:    opEvents[entry.Op],
+		Did:     did,
+		Version: entry.Version,
+		Time:    entry.Time,
+	}
+}
+
+// LastEventSeq returns the sequence number of the last event
+func (r *Registry) LastEventSeq() (uint64, error) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	return r.lastSeq()
+}
+
+// watch returns a channel receiving the events emitted from now on and the
+// sequence number of the last event before them
+func (r *Registry) watch() (chan Event, uint64, error) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	seq, err := r.lastSeq()
+	if err != nil {
+		return nil, 0, err
+	}
+	ch := make(chan Event, watchBuffer)
+	if r.watchers == nil {
+		r.watchers = make(map[chan Event]bool)
+	}
+	r.watchers[ch] = true
+	return ch, seq, nil
+}
+
+func (r *Registry) unwatch(ch chan Event) {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	if r.watchers[ch] {
+		delete(r.watchers, ch)
+		close(ch)
+	}
+}
+
+// Watch calls fn for every event after the sequence number, first the ones
+// of the change log then the new ones as they come, until the context is
+// done, fn fails, or the watcher falls behind with ErrWatchLagging.
+// It fails with ErrEventsExpired if the change log no longer holds the
+// event following after. The events of the other nodes are read from the
+// change log every watchPoll.
+func (r *Registry) Watch(ctx context.Context, after uint64, fn func(Event) error) error {
+	ch, last, err := r.watch()
+	if err != nil {
+		return err
+	}
+	defer r.unwatch(ch)
+
+	if last > after {
+		if _, found, err := r.readEvent(after + 1); err != nil {
+			return err
+		} else if !found {
+			return ErrEventsExpired
+		}
+	}
+	if err = r.replay(after, last, fn); err != nil {
+		return err
+	}
+	if after > last {
+		last = after
+	}
+
+	ticker := time.NewTicker(watchPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			seq, err := r.probeSeq(last)
+			if err != nil {
+				return err
+			}
+			if err = r.replay(last, seq, fn); err != nil {
+				return err
+			}
+			last = seq
+		case e, ok := <-ch:
+			if !ok {
+				return ErrWatchLagging
+			}
+			if e.Seq <= last {
+				continue
+			}
+			// The events of the other nodes logged before it
+			if err := r.replay(last, e.Seq-1, fn); err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+			last = e.Seq
+		}
+	}
+}
+
+// replay calls fn for the events of the change log in (after, to]
+func (r *Registry) replay(after, to uint64, fn func(Event) error) error {
+	for seq := after + 1; seq <= to; seq++ {
+		e, found, err := r.readEvent(seq)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+)
+
+func TestWatch(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Update(id.Did, &ddo, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Resume after the first event: the second one comes from the change
+	// log, the third one live
+	events := make(chan registry.Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- reg.Watch(ctx, 1, func(e registry.Event) error {
+			events <- e
+			if e.Seq == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	first := <-events
+	if first.Seq != 2 || first.ID != "2" || first.Type != registry.EventUpdated {
+		t.Fatalf("Unexpected replayed event: %+v", first)
+	}
+	if err := reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+	second := <-events
+	if second.Seq != 3 || second.Type != registry.EventRevoked || second.Did != id.Did {
+		t.Fatalf("Unexpected live event: %+v", second)
+	}
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Watch should stop with the context, got %v", err)
+	}
+
+	if seq, err := reg.LastEventSeq(); err != nil || seq != 3 {
+		t.Fatalf("Unexpected last event: %v %v", seq, err)
+	}
+}
+
+func TestWatchExpired(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	reg.SetEventRetention(2)
+	for i := 0; i < 4; i++ {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		if err := reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nop := func(registry.Event) error { return nil }
+	if err := reg.Watch(context.Background(), 1, nop); err != registry.ErrEventsExpired {
+		t.Fatalf("Resuming after a dropped event should fail, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var seqs []uint64
+	err := reg.Watch(ctx, 2, func(e registry.Event) error {
+		seqs = append(seqs, e.Seq)
+		if e.Seq == 4 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || len(seqs) != 2 {
+		t.Fatalf("Unexpected replay: %v %v", seqs, err)
+	}
+}
+
+func TestWatchNodes(t *testing.T) {
+	// Two nodes sharing the store
+	node1 := registrytest.NewRegistry(t)
+	node2 := registry.New(node1.Store(), node1.CSP(), node1.Qsign())
+	create := func(reg *registry.Registry) string {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		if err := reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+		return id.Did
+	}
+	create(node1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan registry.Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- node1.Watch(ctx, 0, func(e registry.Event) error {
+			events <- e
+			if e.Seq == 4 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	// Watching once the first event is replayed, the last event of node2
+	// is read from the change log
+	if e := <-events; e.Seq != 1 {
+		t.Fatalf("Unexpected replayed event: %+v", e)
+	}
+
+	// The nodes take turns, every event gets its own number
+	dids := []string{create(node2), create(node1), create(node2)}
+	for i, did := range dids {
+		e := <-events
+		if e.Seq != uint64(i+2) || e.Did != did {
+			t.Fatalf("Expected event %v of %v, got %+v", i+2, did, e)
+		}
+	}
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Watch should stop with the context, got %v", err)
+	}
+	if seq, err := node2.LastEventSeq(); err != nil || seq != 4 {
+		t.Fatalf("Unexpected last event: %v %v", seq, err)
+	}
+}
+
+// eventLogDown fails the writes of the change log
+type eventLogDown struct {
+	*adapter.MemoryStore
+}
+
+func (s *eventLogDown) Set(k string, v any) error {
+	if strings.HasPrefix(k, "serval:event") {
+		return errors.New("backend unavailable")
+	}
+	return s.MemoryStore.Set(k, v)
+}
+
+func TestEmitFailure(t *testing.T) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	base := registrytest.NewRegistry(t)
+	reg := registry.New(&eventLogDown{MemoryStore: adapter.NewMemoryStore()}, base.CSP(), base.Qsign())
+	var events []registry.Event
+	reg.OnEvent(func(e registry.Event) { events = append(events, e) })
+
+	// The writes are committed, the missing events do not fail them
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Update(id.Did, &ddo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, err := reg.Resolve(id.Did); err != nil || meta.Version != 2 {
+		t.Fatalf("Expected version 2, got %+v %v", meta, err)
+	}
+	if len(events) != 2 || events[1].Type != registry.EventUpdated {
+		t.Errorf("Expected the listeners to get the events, got %+v", events)
+	}
+}
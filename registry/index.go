@@ -0,0 +1,335 @@
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/utils"
+)
+
+// The secondary indexes map a field value of the DID documents to the DIDs:
+//
+//	serval:idx:<field>:<value>:<did>  one key per indexed term
+//	serval:terms:<did>                the index keys written for the DID
+//
+// Revoked DIDs keep the terms of their last document, so they can still be
+// searched for with the deactivated filter.
+const (
+	indexPrefix         = "serval:idx:"
+	termsPrefix         = "serval:terms:"
+	indexVersionKey     = "serval:idxversion"
+	indexVersion        = 2
+	fieldController     = "controller"
+	fieldKeyType        = "keytype"
+	fieldKeyFingerprint = "keyfp"
+	fieldServiceType    = "servicetype"
+	defaultListLimit    = 100
+	maxListLimit        = 1000
+)
+
+// ListOptions filters and pages the DIDs returned by List
+type ListOptions struct {
+	Controller  string
+	KeyType     string
+	ServiceType string
+	// KeyFingerprint selects the DIDs listing the public key, see utils.KeyFingerprint
+	KeyFingerprint string
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	UpdatedAfter   time.Time
+	UpdatedBefore  time.Time
+	// Deactivated selects live or revoked DIDs only, nil selects both
+	Deactivated *bool
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	// Limit is the page size, 100 by default and 1000 at most
+	Limit int
+}
+
+func termPrefix(field, value string) string {
+	return indexPrefix + field + ":" + url.QueryEscape(strings.ToLower(value)) + ":"
+}
+
+func termsKey(did string) string {
+	return termsPrefix + did
+}
+
+// terms returns the index keys of the DID document
+func terms(did string, ddo *io.DDO) []string {
+	set := make(map[string]bool)
+	if ddo.Controller != "" {
+		set[termPrefix(fieldController, ddo.Controller)+did] = true
+	}
+	for _, pk := range ddo.PublicKey {
+		set[termPrefix(fieldKeyType, pk.Type)+did] = true
+		if fp, err := utils.KeyFingerprint(pk.PublicKeyHex); err == nil {
+			set[termPrefix(fieldKeyFingerprint, fp)+did] = true
+		}
+	}
+	for _, svc := range ddo.Service {
+		set[termPrefix(fieldServiceType, string(svc.Type))+did] = true
+	}
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// index replaces the index keys of the DID by the ones of the document
+func (r *Registry) index(did string, ddo *io.DDO) error {
+	var old []string
+	_, err := r.store.Get(termsKey(did), &old)
+	if err != nil {
+		return err
+	}
+
+	keys := terms(did, ddo)
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+		if err = r.store.Set(k, true); err != nil {
+			return err
+		}
+	}
+	if err = r.store.Set(termsKey(did), keys); err != nil {
+		return err
+	}
+	for _, k := range old {
+		if !set[k] {
+			if err = r.store.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lastDocument returns the latest document of the DID, the one in the
+// history for revoked DIDs
+func (r *Registry) lastDocument(did string) (*io.DDO, error) {
+	var ddo io.DDO
+	found, err := r.store.Get(did, &ddo)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return &ddo, nil
+	}
+
+	history, err := r.History(did)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Document != nil {
+			return history[i].Document, nil
+		}
+	}
+	return nil, nil
+}
+
+// EnsureIndexes builds the secondary indexes of the records written before
+// the registry maintained them. It does nothing once they are up to date.
+func (r *Registry) EnsureIndexes() error {
+	var version int
+	_, err := r.store.Get(indexVersionKey, &version)
+	if err != nil {
+		return err
+	}
+	if version >= indexVersion {
+		return nil
+	}
+
+	r.snapshot.Lock()
+	defer r.snapshot.Unlock()
+
+	err = r.Dids(func(did string) error {
+		ddo, err := r.lastDocument(did)
+		if err != nil || ddo == nil {
+			return err
+		}
+		return r.index(did, ddo)
+	})
+	if err != nil {
+		return fmt.Errorf("build the DID indexes failed: %v", err)
+	}
+	return r.store.Set(indexVersionKey, indexVersion)
+}
+
+// EncodeCursor returns the cursor of the page starting after did
+func EncodeCursor(did string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(did))
+}
+
+// DecodeCursor returns the DID the cursor points after
+func DecodeCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor: %v", err)
+	}
+	return string(b), nil
+}
+
+// List returns a page of the DIDs matching the options in ascending order,
+// and the cursor of the next page, empty on the last one
+func (r *Registry) List(opts ListOptions) ([]io.DidSummary, string, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = defaultListLimit
+	}
+	if opts.Limit > maxListLimit {
+		opts.Limit = maxListLimit
+	}
+	after := ""
+	if opts.Cursor != "" {
+		var err error
+		if after, err = DecodeCursor(opts.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	candidates, err := r.candidates(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var items []io.DidSummary
+	for _, did := range candidates {
+		if did <= after {
+			continue
+		}
+		item, ok, err := r.summary(did, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			continue
+		}
+		if len(items) == opts.Limit {
+			return items, EncodeCursor(items[len(items)-1].Did), nil
+		}
+		items = append(items, *item)
+	}
+	return items, "", nil
+}
+
+// candidates returns the sorted DIDs matching the indexed filters
+func (r *Registry) candidates(opts ListOptions) ([]string, error) {
+	filters := map[string]string{
+		fieldController:     opts.Controller,
+		fieldKeyType:        opts.KeyType,
+		fieldServiceType:    opts.ServiceType,
+		fieldKeyFingerprint: opts.KeyFingerprint,
+	}
+
+	var result []string
+	indexed := false
+	for field, value := range filters {
+		if value == "" {
+			continue
+		}
+		prefix := termPrefix(field, value)
+		var dids []string
+		err := adapter.Scan(r.store, prefix, func(k string) error {
+			dids = append(dids, strings.TrimPrefix(k, prefix))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(dids)
+
+		if !indexed {
+			result, indexed = dids, true
+		} else {
+			result = intersect(result, dids)
+		}
+	}
+	if indexed {
+		return result, nil
+	}
+
+	err := r.Dids(func(did string) error {
+		result = append(result, did)
+		return nil
+	})
+	return result, err
+}
+
+// summary returns the summary of the DID if its metadata matches the options
+func (r *Registry) summary(did string, opts ListOptions) (*io.DidSummary, bool, error) {
+	meta, found, err := r.Metadata(did)
+	if err != nil {
+		return nil, false, err
+	}
+	var ddo io.DDO
+	live, err := r.store.Get(did, &ddo)
+	if err != nil {
+		return nil, false, err
+	}
+	if !found {
+		if !live {
+			return nil, false, nil
+		}
+		// Records written before the registry kept metadata
+		meta = &Metadata{Version: 1, Created: ddo.Created, Updated: ddo.Updated}
+	}
+
+	switch {
+	case opts.Deactivated != nil && *opts.Deactivated != meta.Deactivated,
+		!opts.CreatedAfter.IsZero() && !meta.Created.After(opts.CreatedAfter),
+		!opts.CreatedBefore.IsZero() && !meta.Created.Before(opts.CreatedBefore),
+		!opts.UpdatedAfter.IsZero() && !meta.Updated.After(opts.UpdatedAfter),
+		!opts.UpdatedBefore.IsZero() && !meta.Updated.Before(opts.UpdatedBefore):
+		return nil, false, nil
+	}
+
+	return &io.DidSummary{
+		Did:         did,
+		Controller:  ddo.Controller,
+		Version:     meta.Version,
+		Created:     meta.Created,
+		Updated:     meta.Updated,
+		Deactivated: meta.Deactivated,
+	}, true, nil
+}
+
+func intersect(a, b []string) []string {
+	var out []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// unindex removes the index keys of the DID
+func (r *Registry) unindex(did string) error {
+	var old []string
+	_, err := r.store.Get(termsKey(did), &old)
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err = r.store.Delete(k); err != nil {
+			return err
+		}
+	}
+	return r.store.Delete(termsKey(did))
+}
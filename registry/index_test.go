@@ -0,0 +1,105 @@
+package registry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+)
+
+func listAll(t *testing.T, reg *registry.Registry, opts registry.ListOptions) []string {
+	var dids []string
+	for {
+		page, next, err := reg.List(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > opts.Limit && opts.Limit > 0 {
+			t.Fatalf("Page larger than the limit: %d", len(page))
+		}
+		for _, item := range page {
+			dids = append(dids, item.Did)
+		}
+		if next == "" {
+			return dids
+		}
+		opts.Cursor = next
+	}
+}
+
+func TestList(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	controller := "did:example:controller"
+
+	var ids []*registrytest.Identity
+	for i := 0; i < 5; i++ {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		if i%2 == 0 {
+			ddo.Controller = controller
+			ddo.Service = []io.Service{{ID: id.Did + "#hub", Type: "IdentityHub", ServiceEndpoint: "https://hub.example.com"}}
+			id.Sign(t, reg, &ddo)
+		}
+		if err := reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := reg.Revoke(ids[0].Did); err != nil {
+		t.Fatal(err)
+	}
+
+	if dids := listAll(t, reg, registry.ListOptions{Limit: 2}); len(dids) != 5 {
+		t.Fatalf("Unexpected DIDs: %v", dids)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{Controller: controller, Limit: 1}); len(dids) != 3 {
+		t.Fatalf("Unexpected DIDs controlled by %v: %v", controller, dids)
+	}
+	live := false
+	dids := listAll(t, reg, registry.ListOptions{Controller: controller, ServiceType: "identityhub", Deactivated: &live})
+	if len(dids) != 2 {
+		t.Fatalf("Unexpected live DIDs with a hub: %v", dids)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{KeyType: "ed25519"}); len(dids) != 5 {
+		t.Fatalf("Unexpected DIDs with ED25519 keys: %v", dids)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{CreatedAfter: time.Now()}); len(dids) != 0 {
+		t.Fatalf("Unexpected DIDs created in the future: %v", dids)
+	}
+
+	// Updating the document moves it out of the old index
+	ddo := ids[2].Document(t, reg)
+	if err := reg.Update(ids[2].Did, &ddo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{Controller: controller}); len(dids) != 2 {
+		t.Fatalf("Unexpected DIDs after the update: %v", dids)
+	}
+
+	if _, _, err := reg.List(registry.ListOptions{Cursor: "%%%"}); err == nil {
+		t.Fatal("List should refuse an invalid cursor")
+	}
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	id := registrytest.NewIdentity(t, reg.CSP())
+
+	// A record written by an older release, without metadata nor indexes
+	ddo := id.Document(t, reg)
+	if err := reg.Store().Set(id.Did, ddo); err != nil {
+		t.Fatal(err)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{Controller: id.Did}); len(dids) != 0 {
+		t.Fatalf("Unexpected DIDs before indexing: %v", dids)
+	}
+
+	if err := reg.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{Controller: id.Did}); len(dids) != 1 {
+		t.Fatalf("Unexpected DIDs after indexing: %v", dids)
+	}
+}
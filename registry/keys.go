@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/utils"
+)
+
+// compromisedPrefix keys the reports of compromised public keys:
+//
+//	serval:compromised:<fingerprint>  the CompromisedKey report
+const compromisedPrefix = "serval:compromised:"
+
+const (
+	// compromisedTTL is how long a key found not compromised is trusted,
+	// before looking again for a report made on another node
+	compromisedTTL = 30 * time.Second
+	// compromisedCacheSize bounds the lookups kept in memory
+	compromisedCacheSize = 100000
+)
+
+// compromisedLookup is the last lookup of the report of a key. A report is
+// never withdrawn, so a key found compromised stays so.
+type compromisedLookup struct {
+	found   bool
+	checked time.Time
+}
+
+// CompromisedKey is the report of a compromised public key
+type CompromisedKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason,omitempty"`
+	Reported    time.Time `json:"reported"`
+}
+
+// ParseFingerprint checks and normalizes a key fingerprint
+func ParseFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(fingerprint)
+	b, err := hex.DecodeString(fingerprint)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid key fingerprint: %v", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+func compromisedKey(fingerprint string) string {
+	return compromisedPrefix + fingerprint
+}
+
+// ReportCompromise records the key as compromised and returns the DIDs
+// listing it. From then on the key is flagged in the resolution metadata
+// of every document listing it, including the ones created later.
+func (r *Registry) ReportCompromise(fingerprint, reason string) (*CompromisedKey, []string, error) {
+	fingerprint, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &CompromisedKey{
+		Fingerprint: fingerprint,
+		Reason:      reason,
+		Reported:    time.Now(),
+	}
+	if err = r.store.Set(compromisedKey(fingerprint), report); err != nil {
+		return nil, nil, err
+	}
+	r.cacheCompromised(fingerprint, true, report.Reported)
+
+	var dids []string
+	opts := ListOptions{KeyFingerprint: fingerprint, Limit: maxListLimit}
+	for {
+		page, next, err := r.List(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, item := range page {
+			dids = append(dids, item.Did)
+		}
+		if next == "" {
+			r.emit(Event{
+				Type:        EventKeyCompromised,
+				Fingerprint: fingerprint,
+				Dids:        dids,
+				Time:        report.Reported,
+			})
+			return report, dids, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// CompromisedKey returns the compromise report of the key
+func (r *Registry) CompromisedKey(fingerprint string) (*CompromisedKey, bool, error) {
+	fingerprint, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var report CompromisedKey
+	found, err := r.store.Get(compromisedKey(fingerprint), &report)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return &report, true, nil
+}
+
+// compromisedKeys returns the IDs of the public keys of the document
+// reported as compromised
+func (r *Registry) compromisedKeys(ddo *io.DDO) ([]string, error) {
+	var ids []string
+	for _, pk := range ddo.PublicKey {
+		fp, err := utils.KeyFingerprint(pk.PublicKeyHex)
+		if err != nil {
+			continue
+		}
+		found, err := r.isCompromised(fp)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			ids = append(ids, pk.ID)
+		}
+	}
+	return ids, nil
+}
+
+// isCompromised reports whether the key was reported as compromised, from
+// the last lookup while it holds
+func (r *Registry) isCompromised(fingerprint string) (bool, error) {
+	now := time.Now()
+	r.compromisedMu.Lock()
+	c, ok := r.compromised[fingerprint]
+	r.compromisedMu.Unlock()
+	if ok && (c.found || now.Sub(c.checked) < compromisedTTL) {
+		return c.found, nil
+	}
+
+	var raw json.RawMessage
+	found, err := r.store.Get(compromisedKey(fingerprint), &raw)
+	if err != nil {
+		return false, err
+	}
+	r.cacheCompromised(fingerprint, found, now)
+	return found, nil
+}
+
+func (r *Registry) cacheCompromised(fingerprint string, found bool, checked time.Time) {
+	r.compromisedMu.Lock()
+	defer r.compromisedMu.Unlock()
+
+	if r.compromised == nil {
+		r.compromised = make(map[string]compromisedLookup)
+	}
+	// A lookup started before the report must not hide it
+	if r.compromised[fingerprint].found {
+		return
+	}
+	if len(r.compromised) >= compromisedCacheSize {
+		for fp, c := range r.compromised {
+			if !c.found {
+				delete(r.compromised, fp)
+			}
+		}
+	}
+	r.compromised[fingerprint] = compromisedLookup{found: found, checked: checked}
+}
@@ -0,0 +1,121 @@
+package registry_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/ewangplay/serval/utils"
+)
+
+func TestReportCompromise(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+
+	// Two DIDs share the same authentication key, a third one does not
+	shared := registrytest.NewIdentity(t, reg.CSP())
+	other := registrytest.NewIdentity(t, reg.CSP())
+	other.AuthKey = shared.AuthKey
+	unrelated := registrytest.NewIdentity(t, reg.CSP())
+	for _, id := range []*registrytest.Identity{shared, other, unrelated} {
+		ddo := id.Document(t, reg)
+		if err := reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.Revoke(other.Did); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := utils.KeyFingerprint(registrytest.PublicKeyHex(t, shared.AuthKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dids := listAll(t, reg, registry.ListOptions{KeyFingerprint: fp}); len(dids) != 2 {
+		t.Fatalf("Unexpected DIDs listing the key: %v", dids)
+	}
+
+	report, dids, err := reg.ReportCompromise(fp, "leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Fingerprint != fp || len(dids) != 2 {
+		t.Fatalf("Unexpected report: %+v %v", report, dids)
+	}
+
+	_, meta, err := reg.Resolve(shared.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.CompromisedKeys) != 1 || meta.CompromisedKeys[0] != shared.Did+"#keys-1" {
+		t.Fatalf("Compromised key not flagged: %+v", meta)
+	}
+	if _, meta, _ = reg.Resolve(unrelated.Did); len(meta.CompromisedKeys) != 0 {
+		t.Fatalf("Unrelated DID flagged: %+v", meta)
+	}
+
+	if _, _, err = reg.ReportCompromise("not-a-fingerprint", ""); err == nil {
+		t.Fatal("ReportCompromise should refuse an invalid fingerprint")
+	}
+}
+
+// countingStore counts the reads of the keys with a prefix
+type countingStore struct {
+	*adapter.MemoryStore
+	prefix string
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingStore) Get(k string, v any) (bool, error) {
+	if strings.HasPrefix(k, s.prefix) {
+		s.mu.Lock()
+		s.reads++
+		s.mu.Unlock()
+	}
+	return s.MemoryStore.Get(k, v)
+}
+
+func TestCompromisedKeysCached(t *testing.T) {
+	base := registrytest.NewRegistry(t)
+	store := &countingStore{MemoryStore: adapter.NewMemoryStore(), prefix: "serval:compromised:"}
+	reg := registry.New(store, base.CSP(), base.Qsign())
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, meta, err := reg.Resolve(id.Did); err != nil || len(meta.CompromisedKeys) != 0 {
+			t.Fatalf("Unexpected resolution: %+v %v", meta, err)
+		}
+	}
+	keys := store.reads
+	if keys == 0 || keys > len(ddo.PublicKey) {
+		t.Fatalf("Expected the keys looked up once, got %v reads for %v keys", keys, len(ddo.PublicKey))
+	}
+
+	// The report is seen at once, without reading it back
+	fp, err := utils.KeyFingerprint(registrytest.PublicKeyHex(t, id.AuthKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = reg.ReportCompromise(fp, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := reg.Resolve(id.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.CompromisedKeys) != 1 || meta.CompromisedKeys[0] != id.Did+"#keys-1" {
+		t.Fatalf("Compromised key not flagged: %+v", meta)
+	}
+	if store.reads != keys {
+		t.Fatalf("Expected no more lookups, got %v reads", store.reads-keys)
+	}
+}
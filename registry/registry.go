@@ -0,0 +1,454 @@
+// Package registry keeps the DID records in the store.
+//
+// A DID document is stored under the DID itself. Next to it the registry
+// keeps the metadata of the record and every change made to it:
+//
+//	<did>                          current DID document
+//	serval:meta:<did>              metadata, kept as a tombstone after revocation
+//	serval:history:<did>:<version> one entry per change
+//
+// The secondary indexes used to list and search the DIDs are described
+// in index.go, the change log of the events in events.go.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cl "github.com/ewangplay/cryptolib"
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/metrics"
+	"github.com/ewangplay/serval/utils"
+	"github.com/jerray/qsign"
+	"github.com/philippgille/gokv"
+)
+
+var logger = log.Module("registry")
+
+const (
+	metaPrefix    = "serval:meta:"
+	historyPrefix = "serval:history:"
+	didPrefix     = "did:"
+	lockStripe    = 64
+)
+
+// ErrNotFound is returned when the DID document does not exist
+var ErrNotFound = errors.New("DID document not found")
+
+// ErrExists is returned when creating a DID that exists, live or revoked
+var ErrExists = errors.New("DID already exists")
+
+// Op is the kind of change made to a DID record
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+	OpRevoke Op = "revoke"
+)
+
+// Metadata holds the bookkeeping data of a DID record
+type Metadata struct {
+	Version     int       `json:"version"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Deactivated bool      `json:"deactivated"`
+
+	// CompromisedKeys lists the IDs of the public keys reported as
+	// compromised, it is filled on resolution and never stored
+	CompromisedKeys []string `json:"compromisedKeys,omitempty"`
+}
+
+// HistoryEntry is one change made to a DID record
+type HistoryEntry struct {
+	Version  int       `json:"version"`
+	Op       Op        `json:"op"`
+	Time     time.Time `json:"time"`
+	Document *io.DDO   `json:"document,omitempty"`
+}
+
+// Registry reads and writes the DID records
+type Registry struct {
+	store gokv.Store
+	csp   cl.CSP
+	qsign *qsign.Qsign
+	// ctx is the context of the request the registry is bound to, its
+	// span is the parent of the spans of the store calls and verifications
+	ctx context.Context
+
+	*state
+}
+
+// state is shared by the registry and the views bound to a request
+type state struct {
+	// snapshot is held shared by writers and exclusively while a
+	// consistent copy of the registry is taken
+	snapshot sync.RWMutex
+	// locks serializes the writes of the same DID
+	locks [lockStripe]sync.Mutex
+
+	// eventsMu serializes the events of the node, it guards the fields
+	// below. seq is the last sequence number the node saw, the change log
+	// may have grown past it on the other nodes.
+	eventsMu  sync.Mutex
+	seq       uint64
+	seqLoaded bool
+	retention int
+	listeners []func(Event)
+	watchers  map[chan Event]bool
+
+	// compromisedMu guards compromised, the last lookups of the reports of
+	// compromised keys by fingerprint
+	compromisedMu sync.Mutex
+	compromised   map[string]compromisedLookup
+}
+
+// New creates the registry on top of the store
+func New(store gokv.Store, csp cl.CSP, qs *qsign.Qsign) *Registry {
+	return &Registry{
+		store: store,
+		csp:   csp,
+		qsign: qs,
+		ctx:   context.Background(),
+		state: &state{},
+	}
+}
+
+// WithContext returns a view of the registry bound to the context of a
+// request, that traces its store calls and verifications in the request
+func (r *Registry) WithContext(ctx context.Context) *Registry {
+	return &Registry{
+		store: adapter.WithContext(r.store, ctx),
+		csp:   r.csp,
+		qsign: r.qsign,
+		ctx:   ctx,
+		state: r.state,
+	}
+}
+
+// Store returns the underlying store
+func (r *Registry) Store() gokv.Store {
+	return r.store
+}
+
+// CSP returns the crypto service provider used to verify documents
+func (r *Registry) CSP() cl.CSP {
+	return r.csp
+}
+
+// Qsign returns the Qsign instance used to digest documents
+func (r *Registry) Qsign() *qsign.Qsign {
+	return r.qsign
+}
+
+// Verify verifies the signature of the DID document
+func (r *Registry) Verify(ddo *io.DDO) error {
+	err := utils.VerifyDDOContext(r.ctx, r.csp, r.qsign, ddo)
+	metrics.ObserveVerification(metrics.TargetDocument, ddo.Proof.Type, err == nil, err)
+	return err
+}
+
+// ValidDid checks the DID can name a record. The DIDs start with did:,
+// which keeps the keys of the registry, starting with serval:, out of reach.
+func ValidDid(did string) error {
+	if !strings.HasPrefix(did, didPrefix) || len(did) == len(didPrefix) {
+		return fmt.Errorf("the DID (%v) does not start with %s", did, didPrefix)
+	}
+	return nil
+}
+
+func metaKey(did string) string {
+	return metaPrefix + did
+}
+
+func historyKey(did string, version int) string {
+	return fmt.Sprintf("%s%s:%010d", historyPrefix, did, version)
+}
+
+// stripe returns the index of the lock of the DID
+func stripe(did string) int {
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	return int(h.Sum32() % lockStripe)
+}
+
+func (r *Registry) lock(did string) *sync.Mutex {
+	return &r.locks[stripe(did)]
+}
+
+// Resolve returns the verified DID document and its metadata.
+// Documents verified before may be served from the store cache.
+func (r *Registry) Resolve(did string) (*io.DDO, *Metadata, error) {
+	var ddo io.DDO
+	found, err := adapter.GetVerified(r.store, did, &ddo, func() error {
+		return r.Verify(&ddo)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, ErrNotFound
+	}
+
+	meta, found, err := r.Metadata(did)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		// Records written before the registry kept metadata
+		meta = &Metadata{Version: 1, Created: ddo.Created, Updated: ddo.Updated}
+	}
+	if meta.Deactivated {
+		// Revoked on another node, the cache still held the document
+		return nil, nil, ErrNotFound
+	}
+	meta.CompromisedKeys, err = r.compromisedKeys(&ddo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ddo, meta, nil
+}
+
+// Metadata returns the metadata of the DID record, including revoked ones
+func (r *Registry) Metadata(did string) (*Metadata, bool, error) {
+	var meta Metadata
+	found, err := r.store.Get(metaKey(did), &meta)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return &meta, true, nil
+}
+
+// History returns the changes made to the DID record, oldest first
+func (r *Registry) History(did string) ([]HistoryEntry, error) {
+	meta, found, err := r.Metadata(did)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	for v := 1; v <= meta.Version; v++ {
+		var entry HistoryEntry
+		found, err := r.store.Get(historyKey(did, v), &entry)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Create stores the document of a new DID, the caller must have verified
+// it. It fails with ErrExists when the DID exists, a revoked DID cannot be
+// registered again.
+func (r *Registry) Create(did string, ddo *io.DDO) error {
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+
+	entry, err := r.create(did, ddo)
+	if err != nil {
+		return err
+	}
+	r.emit(entryEvent(did, entry))
+	return nil
+}
+
+// Update replaces the document of a live DID, the caller must have verified
+// it. The check, if any, is called with the current document under the DID
+// lock, so no other change can slip in between.
+func (r *Registry) Update(did string, ddo *io.DDO, check func(current *io.DDO) error) error {
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+
+	l := r.lock(did)
+	l.Lock()
+	defer l.Unlock()
+
+	var current io.DDO
+	found, err := r.store.Get(did, &current)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if check != nil {
+		if err = check(&current); err != nil {
+			return err
+		}
+	}
+
+	meta, found, err := r.Metadata(did)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// Records written before the registry kept metadata
+		meta = &Metadata{Created: current.Created}
+	}
+	now := time.Now()
+	meta.Version++
+	meta.Updated = now
+
+	entry := &HistoryEntry{
+		Version:  meta.Version,
+		Op:       OpUpdate,
+		Time:     now,
+		Document: ddo,
+	}
+	if err = r.write(did, meta, *entry); err != nil {
+		return err
+	}
+	r.emit(entryEvent(did, entry))
+	return nil
+}
+
+// create stores the DID document under the DID lock, the caller holds the snapshot lock
+func (r *Registry) create(did string, ddo *io.DDO) (*HistoryEntry, error) {
+	l := r.lock(did)
+	l.Lock()
+	defer l.Unlock()
+
+	return r.createLocked(did, ddo)
+}
+
+// createLocked stores the document of a new DID, the caller holds the DID lock
+func (r *Registry) createLocked(did string, ddo *io.DDO) (*HistoryEntry, error) {
+	if err := ValidDid(did); err != nil {
+		return nil, err
+	}
+	// The DID exists with its metadata, the tombstone of a revoked DID, or
+	// with a document written before the registry kept metadata
+	_, found, err := r.Metadata(did)
+	if err == nil && !found {
+		var raw json.RawMessage
+		found, err = r.store.Get(did, &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, ErrExists
+	}
+
+	now := time.Now()
+	meta := &Metadata{Version: 1, Created: now, Updated: now}
+	entry := &HistoryEntry{
+		Version:  meta.Version,
+		Op:       OpCreate,
+		Time:     now,
+		Document: ddo,
+	}
+	if err = r.write(did, meta, *entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Revoke deactivates the DID, its metadata and history stay as a tombstone
+func (r *Registry) Revoke(did string) error {
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+
+	l := r.lock(did)
+	l.Lock()
+	defer l.Unlock()
+
+	var ddo io.DDO
+	found, err := r.store.Get(did, &ddo)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	meta, found, err := r.Metadata(did)
+	if err != nil {
+		return err
+	}
+	if !found {
+		meta = &Metadata{Created: ddo.Created}
+	}
+	now := time.Now()
+	meta.Version++
+	meta.Updated = now
+	meta.Deactivated = true
+
+	entry := &HistoryEntry{
+		Version: meta.Version,
+		Op:      OpRevoke,
+		Time:    now,
+	}
+	if err = r.write(did, meta, *entry); err != nil {
+		return err
+	}
+	r.emit(entryEvent(did, entry))
+	return nil
+}
+
+// write applies one change: the history entry first, then the document,
+// and the metadata last, since the metadata decides which version is current
+func (r *Registry) write(did string, meta *Metadata, entry HistoryEntry) error {
+	err := r.store.Set(historyKey(did, entry.Version), entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.Document != nil {
+		err = r.store.Set(did, entry.Document)
+		if err == nil {
+			err = r.index(did, entry.Document)
+		}
+	} else {
+		err = r.store.Delete(did)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(metaKey(did), meta)
+}
+
+// Dids calls fn for every DID known to the registry, live or revoked,
+// in ascending order
+func (r *Registry) Dids(fn func(did string) error) error {
+	set := make(map[string]bool)
+	err := adapter.Scan(r.store, didPrefix, func(k string) error {
+		set[k] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = adapter.Scan(r.store, metaPrefix, func(k string) error {
+		set[strings.TrimPrefix(k, metaPrefix)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dids := make([]string, 0, len(set))
+	for did := range set {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+	for _, did := range dids {
+		if err = fn(did); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package registry_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+)
+
+func TestHistoryAndTombstone(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	id := registrytest.NewIdentity(t, reg.CSP())
+
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	ddo.Controller = "did:example:controller"
+	id.Sign(t, reg, &ddo)
+	// A create does not replace a live document
+	if err := reg.Create(id.Did, &ddo); err != registry.ErrExists {
+		t.Fatalf("Creating a live DID should fail with ErrExists, got %v", err)
+	}
+	if err := reg.Update(id.Did, &ddo, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, meta, err := reg.Resolve(id.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Controller != ddo.Controller || meta.Version != 2 || meta.Deactivated {
+		t.Fatalf("Unexpected record: %+v %+v", got, meta)
+	}
+
+	if err = reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = reg.Resolve(id.Did); err != registry.ErrNotFound {
+		t.Fatalf("Revoked DID should not resolve, got %v", err)
+	}
+	meta, found, err := reg.Metadata(id.Did)
+	if err != nil || !found || !meta.Deactivated || meta.Version != 3 {
+		t.Fatalf("Tombstone missing: %+v %v %v", meta, found, err)
+	}
+	// Nor undoes the revocation
+	if err = reg.Create(id.Did, &ddo); err != registry.ErrExists {
+		t.Fatalf("Creating a revoked DID should fail with ErrExists, got %v", err)
+	}
+	// The keys of the registry are out of reach
+	if err = reg.Create("serval:idxversion", &ddo); err == nil {
+		t.Fatal("Creating a record out of the did: keys should fail")
+	}
+
+	history, err := reg.History(id.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []registry.Op{registry.OpCreate, registry.OpUpdate, registry.OpRevoke}
+	if len(history) != len(ops) {
+		t.Fatalf("Unexpected history: %+v", history)
+	}
+	for i, op := range ops {
+		if history[i].Op != op || history[i].Version != i+1 {
+			t.Fatalf("Unexpected history entry %d: %+v", i, history[i])
+		}
+	}
+
+	if err = reg.Revoke("did:example:missing"); err != registry.ErrNotFound {
+		t.Fatalf("Revoking a missing DID should fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := registrytest.NewRegistry(t)
+	appKey := registrytest.NewAppKey(t, src.CSP())
+
+	var dids []string
+	for i := 0; i < 3; i++ {
+		id := registrytest.NewIdentity(t, src.CSP())
+		ddo := id.Document(t, src)
+		if err := src.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+		dids = append(dids, id.Did)
+	}
+	if err := src.Revoke(dids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	manifest, err := src.Export(&dump, appKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Records != 3 || manifest.Signature == "" {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+
+	dst := registrytest.NewRegistry(t)
+	report, err := dst.Import(bytes.NewReader(dump.Bytes()), appKey, registry.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 3 || len(report.Rejected) != 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	// The tombstone and the history come along
+	meta, found, err := dst.Metadata(dids[0])
+	if err != nil || !found || !meta.Deactivated {
+		t.Fatalf("Tombstone not imported: %+v %v %v", meta, found, err)
+	}
+	if history, _ := dst.History(dids[0]); len(history) != 2 {
+		t.Fatalf("History not imported: %+v", history)
+	}
+	for _, did := range dids[1:] {
+		if _, _, err := dst.Resolve(did); err != nil {
+			t.Fatalf("Resolve imported %v failed: %v", did, err)
+		}
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	src := registrytest.NewRegistry(t)
+	appKey := registrytest.NewAppKey(t, src.CSP())
+
+	id := registrytest.NewIdentity(t, src.CSP())
+	ddo := id.Document(t, src)
+	if err := src.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if _, err := src.Export(&dump, appKey); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(dump.String(), "\n")
+
+	// A truncated dump is refused as a whole
+	dst := registrytest.NewRegistry(t)
+	if _, err := dst.Import(strings.NewReader(lines[0]), appKey, registry.ImportOptions{}); err == nil {
+		t.Fatal("Import should refuse a dump without manifest")
+	}
+
+	// A tampered record breaks the checksum
+	tampered := strings.Replace(dump.String(), id.Did+"#keys-1", id.Did+"#keys-9", 1)
+	if _, err := dst.Import(strings.NewReader(tampered), appKey, registry.ImportOptions{}); err == nil {
+		t.Fatal("Import should refuse a dump with a checksum mismatch")
+	}
+
+	// Another app key cannot vouch for the dump
+	otherKey := registrytest.NewAppKey(t, src.CSP())
+	if _, err := dst.Import(strings.NewReader(dump.String()), otherKey, registry.ImportOptions{}); err == nil {
+		t.Fatal("Import should refuse a dump signed by an unknown key")
+	}
+
+	// A document failing verification is reported, the others are imported
+	bad := registrytest.NewIdentity(t, src.CSP())
+	badDDO := bad.Document(t, src)
+	badDDO.Controller = "did:example:tampered"
+	src.Store().Set(bad.Did, badDDO)
+	dump.Reset()
+	if _, err := src.Export(&dump, appKey); err != nil {
+		t.Fatal(err)
+	}
+	report, err := dst.Import(&dump, appKey, registry.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || len(report.Rejected) != 1 || report.Rejected[0].Did != bad.Did {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if _, _, err := dst.Resolve(bad.Did); err != registry.ErrNotFound {
+		t.Fatalf("Rejected record should not be imported, got %v", err)
+	}
+}
+
+func TestImportRetiredKey(t *testing.T) {
+	src := registrytest.NewRegistry(t)
+	oldKey := registrytest.NewAppKey(t, src.CSP())
+
+	id := registrytest.NewIdentity(t, src.CSP())
+	ddo := id.Document(t, src)
+	if err := src.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if _, err := src.Export(&dump, oldKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a rotation the dumps signed by the former key still import
+	newKey := registrytest.NewAppKey(t, src.CSP())
+	newKey.ID = "did:example:serval#keys-2"
+	newKey.Retired = []adapter.RetiredKey{{
+		ID:           oldKey.ID,
+		Type:         oldKey.Type,
+		PublicKeyHex: oldKey.PublicKeyHex(),
+	}}
+	dst := registrytest.NewRegistry(t)
+	report, err := dst.Import(bytes.NewReader(dump.Bytes()), newKey, registry.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	// The new dumps are signed by the new key
+	dump.Reset()
+	manifest, err := src.Export(&dump, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.KeyID != newKey.ID {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+}
+
+// stalledWriter blocks the writes until release is closed, like a client
+// that stopped reading
+type stalledWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+	buf     bytes.Buffer
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestExportStalledReader(t *testing.T) {
+	reg := registrytest.NewRegistry(t)
+	appKey := registrytest.NewAppKey(t, reg.CSP())
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &stalledWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, err := reg.Export(w, appKey)
+		done <- err
+	}()
+	<-w.writing
+
+	// The writes go on while the export waits for its reader
+	other := registrytest.NewIdentity(t, reg.CSP())
+	otherDdo := other.Document(t, reg)
+	created := make(chan error, 1)
+	go func() {
+		created <- reg.Create(other.Did, &otherDdo)
+	}()
+	select {
+	case err := <-created:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The export of a stalled reader blocks the writes")
+	}
+
+	close(w.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(w.buf.String(), "\n"); n != 2 {
+		t.Fatalf("Expected the record and the manifest, got %d lines", n)
+	}
+}
+
+func TestCacheNodes(t *testing.T) {
+	// Two nodes, each with its own cache in front of the shared backend
+	base := registrytest.NewRegistry(t)
+	backend := adapter.NewMemoryStore()
+	opts := adapter.CacheOptions{Size: 10, TTL: time.Hour}
+	node1 := registry.New(adapter.NewCacheStore(backend, opts), base.CSP(), base.Qsign())
+	node2 := registry.New(adapter.NewCacheStore(backend, opts), base.CSP(), base.Qsign())
+
+	id := registrytest.NewIdentity(t, node1.CSP())
+	ddo := id.Document(t, node1)
+	if err := node1.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := node2.Resolve(id.Did); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata is not cached, the version checks see the other node
+	if err := node1.Update(id.Did, &ddo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, err := node2.Resolve(id.Did); err != nil || meta.Version != 2 {
+		t.Fatalf("Expected version 2, got %+v %v", meta, err)
+	}
+
+	// Nor is the revocation hidden by the cached document
+	if err := node1.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := node2.Resolve(id.Did); err != registry.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
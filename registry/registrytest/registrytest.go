@@ -0,0 +1,130 @@
+// Package registrytest provides helpers to build signed DID documents
+// and in-memory registries for tests.
+package registrytest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	cl "github.com/ewangplay/cryptolib"
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/utils"
+)
+
+// NewRegistry returns a registry on top of a fresh memory store
+func NewRegistry(t *testing.T) *registry.Registry {
+	store, err := adapter.InitStore(&adapter.StoreOptions{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	csp, err := adapter.InitCryptolib()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := adapter.InitQsign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.New(store, csp, qs)
+}
+
+// NewAppKey generates an application key
+func NewAppKey(t *testing.T, csp cl.CSP) *adapter.AppKey {
+	k := GenKey(t, csp)
+	b, _ := k.Bytes()
+	appKey, err := adapter.InitAppKey(&adapter.AppKeyOptions{
+		ID:            "did:example:serval#keys-1",
+		Type:          cl.ED25519,
+		PrivateKeyHex: hex.EncodeToString(b),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appKey
+}
+
+// GenKey generates an ED25519 private key
+func GenKey(t *testing.T, csp cl.CSP) cl.Key {
+	k, err := csp.KeyGen(&cl.ED25519KeyGenOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// PublicKeyHex returns the hex encoded public key of k
+func PublicKeyHex(t *testing.T, k cl.Key) string {
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pub.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Identity is a DID with its authentication and recovery keys
+type Identity struct {
+	Did         string
+	AuthKey     cl.Key
+	RecoveryKey cl.Key
+}
+
+// NewIdentity generates a random DID and its keys
+func NewIdentity(t *testing.T, csp cl.CSP) *Identity {
+	return &Identity{
+		Did:         "did:example:" + utils.GenerateUUID(),
+		AuthKey:     GenKey(t, csp),
+		RecoveryKey: GenKey(t, csp),
+	}
+}
+
+// Document builds the DID document signed by the authentication key
+func (id *Identity) Document(t *testing.T, reg *registry.Registry) io.DDO {
+	now := time.Now()
+	ddo := io.DDO{
+		Context: "https://www.w3.org/ns/did/v1",
+		ID:      id.Did,
+		Version: 1,
+		PublicKey: io.PublicKeyList{
+			{ID: id.Did + "#keys-1", Type: cl.ED25519, PublicKeyHex: PublicKeyHex(t, id.AuthKey)},
+			{ID: id.Did + "#keys-2", Type: cl.ED25519, PublicKeyHex: PublicKeyHex(t, id.RecoveryKey)},
+		},
+		Controller:     id.Did,
+		Authentication: io.StringList{id.Did + "#keys-1"},
+		Recovery:       io.StringList{id.Did + "#keys-2"},
+		Created:        now,
+		Updated:        now,
+	}
+	id.Sign(t, reg, &ddo)
+	return ddo
+}
+
+// Sign signs the DID document with the authentication key
+func (id *Identity) Sign(t *testing.T, reg *registry.Registry, ddo *io.DDO) {
+	err := utils.SignDDO(reg.CSP(), reg.Qsign(), id.Did+"#keys-1", id.AuthKey, ddo)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// RevokeProof builds the revocation proof signed by the recovery key
+func (id *Identity) RevokeProof(t *testing.T, reg *registry.Registry) io.Proof {
+	sig, err := utils.SignProof(reg.CSP(), id.Did, id.RecoveryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return io.Proof{
+		Type:           cl.ED25519,
+		Creator:        id.Did + "#keys-2",
+		SignatureValue: base64.StdEncoding.EncodeToString(sig),
+	}
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"fmt"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// publicRoutes are served to everyone, even with the authentication enabled
+var publicRoutes = map[string]bool{
+	"GET " + apiPrefix + "/ping":         true,
+	"GET " + apiPrefix + "/openapi.json": true,
+	// The keys verifying the signed exports
+	"GET " + apiPrefix + "/appkeys": true,
+}
+
+// routeActions are the actions of the DID routes, the admin routes all
+// need auth.ActionAdmin. The handlers check the DIDs against the
+// namespaces of the policies.
+var routeActions = map[string]auth.Action{
+	"GET " + apiPrefix + "/did":                    auth.ActionRead,
+	"POST " + apiPrefix + "/did/create":            auth.ActionCreate,
+	"GET " + apiPrefix + "/did/resolve/:did":       auth.ActionRead,
+	"POST " + apiPrefix + "/did/update":            auth.ActionUpdate,
+	"POST " + apiPrefix + "/did/revoke":            auth.ActionRevoke,
+	"POST " + apiPrefix + "/did/batch/create":      auth.ActionCreate,
+	"POST " + apiPrefix + "/did/batch/resolve":     auth.ActionRead,
+	"GET " + apiPrefix + "/keys/:fingerprint/dids": auth.ActionRead,
+	"GET " + apiPrefix + "/events":                 auth.ActionRead,
+	"GET " + apiPrefix + "/events/ws":              auth.ActionRead,
+}
+
+// routeAction returns the action of the route, false for the public routes
+func routeAction(method, path string) (auth.Action, bool) {
+	key := method + " " + path
+	if publicRoutes[key] {
+		return "", false
+	}
+	if action, ok := routeActions[key]; ok {
+		return action, true
+	}
+	// The admin routes, a route missing from both lists is closed rather
+	// than open
+	return auth.ActionAdmin, true
+}
+
+// authenticate identifies the caller and checks a policy grants it the
+// action of the route, the principal is passed to the handlers in the
+// context of the request. It lets everything through when guard is nil.
+func authenticate(guard *auth.Guard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		action, guarded := routeAction(c.Request.Method, c.FullPath())
+		if guard == nil || !guarded {
+			c.Next()
+			return
+		}
+
+		p, err := guard.Authenticate(auth.FromRequest(c.Request))
+		if err != nil {
+			logger.Ctx(c.Request.Context()).Warn("Authenticate the request from %v failed: %v", c.ClientIP(), err)
+			c.Header("WWW-Authenticate", `Bearer realm="serval"`)
+			apiV1.FailWithMessage(apiV1.ErrUnauthenticated, err.Error(), c)
+			return
+		}
+		if !p.Allowed(action) {
+			if p.Anonymous() {
+				c.Header("WWW-Authenticate", `Bearer realm="serval"`)
+				apiV1.FailWithMessage(apiV1.ErrUnauthenticated, "The request has no credentials", c)
+				return
+			}
+			errMsg := fmt.Sprintf("%s may not perform %s", p.Name, action)
+			logger.Ctx(c.Request.Context()).Warn(errMsg)
+			apiV1.FailWithMessage(apiV1.ErrPermissionDenied, errMsg, c)
+			return
+		}
+
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), p))
+		c.Next()
+	}
+}
@@ -0,0 +1,241 @@
+package router
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
+	sio "github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/ewangplay/serval/utils"
+	"github.com/gin-gonic/gin"
+)
+
+func digest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newGuard(t *testing.T) *auth.Guard {
+	guard, err := auth.New(&auth.Options{
+		Enabled:       true,
+		AnonymousRead: true,
+		APIKeys: []auth.APIKey{
+			{Name: "org1", SHA256: digest("org1-key")},
+			{Name: "ops", SHA256: digest("ops-key")},
+		},
+		Policies: []auth.Policy{
+			{
+				Principals: []string{"apikey:org1"},
+				Actions:    []auth.Action{auth.ActionCreate, auth.ActionUpdate, auth.ActionRevoke},
+				Namespaces: []string{"did:example:"},
+			},
+			{Principals: []string{"apikey:ops"}, Actions: []auth.Action{auth.ActionAdmin}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guard
+}
+
+func request(method, url, apiKey, body string) *http.Request {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	return req
+}
+
+func TestRouteActions(t *testing.T) {
+	r, _ := newTestRouter(t)
+	for _, route := range r.Routes() {
+		if !strings.HasPrefix(route.Path, apiPrefix) {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		_, action := routeActions[key]
+		admin := strings.HasPrefix(route.Path, apiPrefix+"/admin/")
+		if !publicRoutes[key] && !action && !admin {
+			t.Errorf("Route %v has no action", key)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	r, reg := newAuthRouter(t, newGuard(t))
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)})
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+		code   apiV1.ErrorCode
+	}{
+		{"ping", request(http.MethodGet, "/api/v1/ping", "", ""), http.StatusOK, apiV1.ErrorCode{}},
+		{"anonymous create", request(http.MethodPost, "/api/v1/did/create", "", string(body)), http.StatusUnauthorized, apiV1.ErrUnauthenticated},
+		{"wrong key", request(http.MethodPost, "/api/v1/did/create", "wrong", string(body)), http.StatusUnauthorized, apiV1.ErrUnauthenticated},
+		{"admin create", request(http.MethodPost, "/api/v1/did/create", "ops-key", string(body)), http.StatusForbidden, apiV1.ErrPermissionDenied},
+		// Authentication comes before the validation of the body
+		{"anonymous invalid", request(http.MethodPost, "/api/v1/did/create", "", "{}"), http.StatusUnauthorized, apiV1.ErrUnauthenticated},
+		{"create", request(http.MethodPost, "/api/v1/did/create", "org1-key", string(body)), http.StatusOK, apiV1.ErrorCode{}},
+		{"anonymous resolve", request(http.MethodGet, "/api/v1/did/resolve/"+id.Did, "", ""), http.StatusOK, apiV1.ErrorCode{}},
+		{"anonymous admin", request(http.MethodGet, "/api/v1/admin/migrate", "", ""), http.StatusUnauthorized, apiV1.ErrUnauthenticated},
+		{"org1 admin", request(http.MethodGet, "/api/v1/admin/migrate", "org1-key", ""), http.StatusForbidden, apiV1.ErrPermissionDenied},
+		{"ops admin", request(http.MethodGet, "/api/v1/admin/migrate", "ops-key", ""), http.StatusConflict, apiV1.ErrFeatureDisabled},
+	}
+	for _, c := range cases {
+		status, resp := serveRequest(r, c.req)
+		if status != c.status || resp.Error != c.code.Name {
+			t.Errorf("%s: %d %+v, want %d %v", c.name, status, resp, c.status, c.code.Name)
+		}
+	}
+
+	// The namespaces are checked against the DIDs of the requests
+	other := registrytest.NewIdentity(t, reg.CSP())
+	other.Did = strings.Replace(other.Did, "did:example:", "did:other:", 1)
+	body, _ = json.Marshal(sio.BatchCreateReq{Items: []sio.CreateDidReq{{Did: other.Did, Document: other.Document(t, reg)}}})
+	status, resp := serveRequest(r, request(http.MethodPost, "/api/v1/did/batch/create", "org1-key", string(body)))
+	if status != http.StatusForbidden || resp.Error != apiV1.ErrPermissionDenied.Name {
+		t.Errorf("Batch create out of the namespace: %d %+v", status, resp)
+	}
+}
+
+func TestCreateOnlyKey(t *testing.T) {
+	guard, err := auth.New(&auth.Options{
+		Enabled:       true,
+		AnonymousRead: true,
+		APIKeys:       []auth.APIKey{{Name: "minter", SHA256: digest("minter-key")}},
+		Policies: []auth.Policy{{
+			Principals: []string{"apikey:minter"},
+			Actions:    []auth.Action{auth.ActionCreate},
+			Namespaces: []string{"did:example:"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, reg := newAuthRouter(t, guard)
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err = reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+
+	// A document of the same DID with the keys of the caller, validly signed
+	hijack := registrytest.NewIdentity(t, reg.CSP())
+	hijack.Did = id.Did
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: hijack.Document(t, reg)})
+	status, resp := serveRequest(r, request(http.MethodPost, "/api/v1/did/create", "minter-key", string(body)))
+	if status != http.StatusConflict || resp.Error != apiV1.ErrConflict.Name {
+		t.Errorf("Create of an existing DID: %d %+v", status, resp)
+	}
+	status, resp = serveRequest(r, request(http.MethodPost, "/api/v1/did/update", "minter-key", string(body)))
+	if status != http.StatusForbidden || resp.Error != apiV1.ErrPermissionDenied.Name {
+		t.Errorf("Update with a create-only key: %d %+v", status, resp)
+	}
+	current, meta, err := reg.Resolve(id.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.PublicKey[0].PublicKeyHex != ddo.PublicKey[0].PublicKeyHex || meta.Version != 1 {
+		t.Errorf("The DID changed: %+v %+v", current.PublicKey, meta)
+	}
+
+	// Nor register a revoked one again
+	if err = reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+	status, resp = serveRequest(r, request(http.MethodPost, "/api/v1/did/create", "minter-key", string(body)))
+	if status != http.StatusConflict || resp.Error != apiV1.ErrConflict.Name {
+		t.Errorf("Create of a revoked DID: %d %+v", status, resp)
+	}
+	if meta, _, err = reg.Metadata(id.Did); err != nil || meta.Version != 2 || !meta.Deactivated {
+		t.Errorf("The revoked DID changed: %+v %v", meta, err)
+	}
+}
+
+func TestReadNamespaces(t *testing.T) {
+	guard, err := auth.New(&auth.Options{
+		Enabled: true,
+		APIKeys: []auth.APIKey{{Name: "org1", SHA256: digest("org1-key")}},
+		Policies: []auth.Policy{{
+			Principals: []string{"apikey:org1"},
+			Actions:    []auth.Action{auth.ActionRead},
+			Namespaces: []string{"did:example:org1:"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, reg := newAuthRouter(t, guard)
+
+	// Two DIDs sharing a key, one per namespace
+	var dids []string
+	shared := registrytest.GenKey(t, reg.CSP())
+	for _, org := range []string{"org2", "org1"} {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		id.Did = strings.Replace(id.Did, "did:example:", "did:example:"+org+":", 1)
+		id.AuthKey = shared
+		ddo := id.Document(t, reg)
+		if err = reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+		dids = append(dids, id.Did)
+	}
+	fp, _ := utils.KeyFingerprint(registrytest.PublicKeyHex(t, shared))
+
+	for _, url := range []string{"/api/v1/did", "/api/v1/keys/" + fp + "/dids"} {
+		status, resp := serveRequest(r, request(http.MethodGet, url, "org1-key", ""))
+		data, _ := json.Marshal(resp.Data)
+		var list sio.ListDidsResp
+		json.Unmarshal(data, &list)
+		if status != http.StatusOK || len(list.Dids) != 1 || list.Dids[0].Did != dids[1] {
+			t.Errorf("%v: %d %+v, want only %v", url, status, list, dids[1])
+		}
+	}
+
+	if _, _, err = reg.ReportCompromise(fp, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/events", nil)
+	req.Header.Set("X-API-Key", "org1-key")
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The creation in org2 is left out, the compromise lists org1 only
+	var events []registry.Event
+	sc := bufio.NewScanner(resp.Body)
+	for len(events) < 2 && sc.Scan() {
+		if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+			var e registry.Event
+			json.Unmarshal([]byte(data), &e)
+			events = append(events, e)
+		}
+	}
+	if len(events) != 2 || events[0].Seq != 2 || events[0].Did != dids[1] ||
+		events[1].Type != registry.EventKeyCompromised || !reflect.DeepEqual(events[1].Dids, dids[1:]) {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/idempotency"
+	"github.com/gin-gonic/gin"
+)
+
+// The headers of the idempotent requests
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	headerReplayed       = "Idempotent-Replayed"
+)
+
+// idempotentRoutes are the writes replayed for an Idempotency-Key
+var idempotentRoutes = map[string]bool{
+	"POST " + apiPrefix + "/did/create":       true,
+	"POST " + apiPrefix + "/did/update":       true,
+	"POST " + apiPrefix + "/did/revoke":       true,
+	"POST " + apiPrefix + "/did/batch/create": true,
+}
+
+// responseRecorder copies the body of the response
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent replays the response of a write sent again with the same
+// Idempotency-Key by the same client. The failures of the server and the
+// refusals of the rate limits are not kept, the request runs again. It
+// lets everything through when keeper is nil.
+func idempotent(keeper *idempotency.Keeper) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(headerIdempotencyKey)
+		if keeper == nil || key == "" || !idempotentRoutes[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		if !idempotency.ValidKey(key) {
+			errMsg := fmt.Sprintf("The %s header must be 1 to %d visible ASCII characters", headerIdempotencyKey, idempotency.MaxKeyLength)
+			apiV1.FailWithMessage(apiV1.ErrInvalidRequest, errMsg, c)
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			apiV1.FailWithMessage(apiV1.ErrInvalidRequest, fmt.Sprintf("Read the request body failed: %v", err), c)
+			return
+		}
+		// The precondition is part of the request, a retry sends it again
+		fingerprint := idempotency.Fingerprint([]byte(c.Request.Method), []byte(c.Request.URL.Path),
+			[]byte(c.GetHeader("If-Match")), body)
+
+		client := clientID(c)
+		rec, err := keeper.Begin(client, key, fingerprint)
+		switch err {
+		case nil:
+		case idempotency.ErrKeyReused:
+			apiV1.FailWithMessage(apiV1.ErrKeyReused, fmt.Sprintf("The %s %v was used with another request", headerIdempotencyKey, key), c)
+			return
+		case idempotency.ErrInProgress:
+			c.Header("Retry-After", "1")
+			apiV1.FailWithMessage(apiV1.ErrInProgress, fmt.Sprintf("The request with the %s %v is in progress", headerIdempotencyKey, key), c)
+			return
+		default:
+			apiV1.FailWithMessage(apiV1.ErrBackendUnavailable, fmt.Sprintf("Read the idempotency record failed: %v", err), c)
+			return
+		}
+		if rec != nil {
+			logger.Ctx(c.Request.Context()).Debug("Replay the response of the %s %v", headerIdempotencyKey, key)
+			c.Header(headerReplayed, "true")
+			c.Data(rec.Status, rec.ContentType, rec.Body)
+			c.Abort()
+			return
+		}
+
+		w := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		status := w.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			err = keeper.Abort(client, key)
+		} else {
+			err = keeper.Complete(client, key, &idempotency.Record{
+				Fingerprint: fingerprint,
+				Status:      status,
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        w.body.Bytes(),
+			})
+		}
+		if err != nil {
+			logger.Ctx(c.Request.Context()).Warn("Keep the response of the %s %v failed: %v", headerIdempotencyKey, key, err)
+		}
+	}
+}
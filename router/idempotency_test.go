@@ -0,0 +1,107 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/idempotency"
+	sio "github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/registry/registrytest"
+)
+
+func TestIdempotency(t *testing.T) {
+	_, reg := newTestRouter(t)
+	keeper, err := idempotency.New(idempotency.Options{Enabled: true}, reg.Store())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keeper.Close()
+	r := InitRouter(&Options{
+		Writer:      io.Discard,
+		Registry:    reg,
+		AppKey:      registrytest.NewAppKey(t, reg.CSP()),
+		Idempotency: keeper,
+	})
+
+	send := func(url, key, ifMatch string, body any) (*httptest.ResponseRecorder, sio.Response) {
+		data, _ := json.Marshal(body)
+		req := request(http.MethodPost, url, "", string(data))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp sio.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+	version := func(did string) int {
+		meta, _, err := reg.Metadata(did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.Version
+	}
+
+	// A retry gets the response of the first request, which is applied once
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	create := sio.CreateDidReq{Did: id.Did, Document: ddo}
+	for i, replayed := range []string{"", "true"} {
+		w, resp := send("/api/v1/did/create", "create-1", "", create)
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != replayed {
+			t.Fatalf("Create %d: %d %v %+v", i, w.Code, w.Header(), resp)
+		}
+	}
+	if v := version(id.Did); v != 1 {
+		t.Fatalf("Expected the create to be applied once, at version %d", v)
+	}
+
+	other := registrytest.NewIdentity(t, reg.CSP())
+	if w, resp := send("/api/v1/did/create", "create-1", "", sio.CreateDidReq{Did: other.Did, Document: other.Document(t, reg)}); w.Code != http.StatusUnprocessableEntity || resp.Error != apiV1.ErrKeyReused.Name {
+		t.Errorf("Expected the key reused with another request to be refused: %d %+v", w.Code, resp)
+	}
+	if w, resp := send("/api/v1/did/create", "with space", "", create); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid key to be refused: %d %+v", w.Code, resp)
+	}
+
+	// The update is refused once the document moved on from the version
+	ddo.Controller = "did:example:controller"
+	id.Sign(t, reg, &ddo)
+	update := sio.UpdateDidReq{Did: id.Did, Document: ddo}
+	cases := []struct {
+		ifMatch string
+		status  int
+		code    apiV1.ErrorCode
+	}{
+		{`"2"`, http.StatusPreconditionFailed, apiV1.ErrPreconditionFailed},
+		{"latest", http.StatusBadRequest, apiV1.ErrInvalidRequest},
+		{`W/"1"`, http.StatusPreconditionFailed, apiV1.ErrPreconditionFailed},
+		{`"3", "1"`, http.StatusOK, apiV1.ErrorCode{}},
+		{`"1"`, http.StatusPreconditionFailed, apiV1.ErrPreconditionFailed},
+		{"*", http.StatusOK, apiV1.ErrorCode{}},
+	}
+	for _, c := range cases {
+		if w, resp := send("/api/v1/did/update", "", c.ifMatch, update); w.Code != c.status || resp.Error != c.code.Name {
+			t.Errorf("If-Match %s: %d %+v, want %d %v", c.ifMatch, w.Code, resp, c.status, c.code.Name)
+		}
+	}
+
+	// The retry of an update that was applied replays its success, instead
+	// of failing its precondition
+	for i := 0; i < 2; i++ {
+		if w, resp := send("/api/v1/did/update", "update-1", `"3"`, update); w.Code != http.StatusOK {
+			t.Errorf("Update %d: %d %+v", i, w.Code, resp)
+		}
+	}
+	if v := version(id.Did); v != 4 {
+		t.Errorf("Expected the update to be applied once, at version %d", v)
+	}
+}
@@ -0,0 +1,94 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/ewangplay/serval/log"
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the ID of the request, the callers may set it to
+// find their requests in the logs
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey keeps the ID in the gin context for the access log
+const requestIDKey = "requestID"
+
+// maxRequestIDLen bounds the IDs taken from the callers
+const maxRequestIDLen = 128
+
+var logger = log.Module("router")
+
+// requestID takes the ID of the request from its X-Request-ID header, or
+// generates one, and echoes it in the response. The logs of the handlers
+// find it in the context of the request.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(log.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessRecord is a line of the access log
+type accessRecord struct {
+	Time      string  `json:"time"`
+	Level     string  `json:"level"`
+	Module    string  `json:"module"`
+	Msg       string  `json:"msg"`
+	RequestID string  `json:"request_id,omitempty"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	ClientIP  string  `json:"client_ip"`
+	Bytes     int     `json:"bytes"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// formatAccess writes the access log as JSON lines like the other logs,
+// the secrets in the query strings are redacted
+func formatAccess(p gin.LogFormatterParams) string {
+	id, _ := p.Keys[requestIDKey].(string)
+	line, _ := json.Marshal(accessRecord{
+		Time:      p.TimeStamp.Format(time.RFC3339Nano),
+		Level:     "info",
+		Module:    "access",
+		Msg:       "request",
+		RequestID: id,
+		Method:    p.Method,
+		Path:      log.Redact(p.Path),
+		Status:    p.StatusCode,
+		LatencyMs: float64(p.Latency.Microseconds()) / 1000,
+		ClientIP:  p.ClientIP,
+		Bytes:     p.BodySize,
+		Error:     p.ErrorMessage,
+	})
+	return string(line) + "\n"
+}
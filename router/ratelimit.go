@@ -0,0 +1,100 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// didBodies are the routes naming their target DIDs in the JSON body
+var didBodies = map[string]bool{
+	"POST " + apiPrefix + "/did/create":        true,
+	"POST " + apiPrefix + "/did/update":        true,
+	"POST " + apiPrefix + "/did/revoke":        true,
+	"POST " + apiPrefix + "/did/batch/create":  true,
+	"POST " + apiPrefix + "/did/batch/resolve": true,
+}
+
+// rateLimit takes the tokens of the request from the buckets of the client
+// and of the target DIDs, before the body is validated and the signatures
+// verified. It lets everything through when limiter is nil.
+func rateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil {
+			c.Next()
+			return
+		}
+
+		action, guarded := routeAction(c.Request.Method, c.FullPath())
+		r := ratelimit.Request{
+			Write:  guarded && action != auth.ActionRead,
+			Client: clientID(c),
+			DIDs:   targetDids(c),
+		}
+		if ok, wait := limiter.Allow(r); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			errMsg := fmt.Sprintf("%v exhausted its rate limit, retry in %ds", r.Client, seconds)
+			logger.Ctx(c.Request.Context()).Debug(errMsg)
+			apiV1.FailWithMessage(apiV1.ErrRateLimited, errMsg, c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// clientID returns the principal of the request, or the IP address of the
+// anonymous ones
+func clientID(c *gin.Context) string {
+	if p, ok := auth.FromContext(c.Request.Context()); ok && !p.Anonymous() {
+		return p.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// targetDids returns the DIDs of the path or of the body, the body is put
+// back for the handler. An invalid body targets no DID, the validation of
+// the request refuses it.
+func targetDids(c *gin.Context) []string {
+	if did := c.Param("did"); did != "" {
+		return []string{did}
+	}
+	if !didBodies[c.Request.Method+" "+c.FullPath()] || c.Request.Body == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var body struct {
+		Did   string   `json:"did"`
+		Dids  []string `json:"dids"`
+		Items []struct {
+			Did string `json:"did"`
+		} `json:"items"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return nil
+	}
+
+	dids := body.Dids
+	if body.Did != "" {
+		dids = append(dids, body.Did)
+	}
+	for _, item := range body.Items {
+		if item.Did != "" {
+			dids = append(dids, item.Did)
+		}
+	}
+	return dids
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	sio "github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/gin-gonic/gin"
+)
+
+func newLimitedRouter(t *testing.T, trustedProxies []string) (*gin.Engine, *Options) {
+	_, reg := newAuthRouter(t, nil)
+	limiter, err := ratelimit.New(ratelimit.Options{
+		Enabled: true,
+		// Slow enough for the buckets not to refill during the test
+		Client: ratelimit.Budget{Read: ratelimit.Limit{Rate: 0.01, Burst: 1}},
+		DID:    ratelimit.Budget{Write: ratelimit.Limit{Rate: 0.01, Burst: 1}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { limiter.Close() })
+
+	opts := &Options{
+		Writer:         io.Discard,
+		Registry:       reg,
+		AppKey:         registrytest.NewAppKey(t, reg.CSP()),
+		Auth:           newGuard(t),
+		RateLimiter:    limiter,
+		TrustedProxies: trustedProxies,
+	}
+	return InitRouter(opts), opts
+}
+
+func TestRateLimit(t *testing.T) {
+	r, opts := newLimitedRouter(t, nil)
+	reg := opts.Registry
+
+	// The anonymous clients are limited by address, X-Forwarded-For is
+	// ignored from an untrusted proxy
+	resolve := func(forwarded string) *http.Request {
+		req := request(http.MethodGet, "/api/v1/did/resolve/did:example:unknown", "", "")
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+	if status, resp := serveRequest(r, resolve("")); status == http.StatusTooManyRequests {
+		t.Fatalf("The first read is limited: %+v", resp)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, resolve("198.51.100.7"))
+	var resp sio.Response
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusTooManyRequests || resp.Error != apiV1.ErrRateLimited.Name {
+		t.Fatalf("Expected the second read to be limited: %d %+v", w.Code, resp)
+	}
+	if v := w.Header().Get("Retry-After"); v != "100" {
+		t.Errorf("Unexpected Retry-After %q", v)
+	}
+
+	// The writes of a DID are limited whoever the client, and the body is
+	// left intact for the handler
+	id := registrytest.NewIdentity(t, reg.CSP())
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)})
+	if status, resp := serveRequest(r, request(http.MethodPost, "/api/v1/did/create", "org1-key", string(body))); status != http.StatusOK {
+		t.Fatalf("Create failed: %d %+v", status, resp)
+	}
+	status, resp := serveRequest(r, request(http.MethodPost, "/api/v1/did/create", "org1-key", string(body)))
+	if status != http.StatusTooManyRequests || resp.Error != apiV1.ErrRateLimited.Name {
+		t.Errorf("Expected the second write of the DID to be limited: %d %+v", status, resp)
+	}
+
+	// Behind a trusted proxy the clients are told apart by X-Forwarded-For
+	r, _ = newLimitedRouter(t, []string{"192.0.2.0/24"})
+	for _, forwarded := range []string{"198.51.100.7", "198.51.100.8"} {
+		if status, resp := serveRequest(r, resolve(forwarded)); status == http.StatusTooManyRequests {
+			t.Errorf("The first read of %s is limited: %+v", forwarded, resp)
+		}
+	}
+}
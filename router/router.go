@@ -1,32 +1,143 @@
 package router
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 
-	cl "github.com/ewangplay/cryptolib"
+	"github.com/ewangplay/serval/adapter"
 	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
 	ctx "github.com/ewangplay/serval/context"
+	"github.com/ewangplay/serval/health"
+	"github.com/ewangplay/serval/idempotency"
+	"github.com/ewangplay/serval/metrics"
+	"github.com/ewangplay/serval/ratelimit"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/tracing"
+	"github.com/ewangplay/serval/webhook"
 	"github.com/gin-gonic/gin"
-	"github.com/jerray/qsign"
-	"github.com/philippgille/gokv"
+	"golang.org/x/text/language"
 )
 
+// Options holds the components the handlers depend on
+type Options struct {
+	// Writer receives the access log
+	Writer   io.Writer
+	Registry *registry.Registry
+	AppKey   *adapter.AppKey
+	// Webhooks is nil when the webhooks are disabled
+	Webhooks *webhook.Notifier
+	// EnableAdmin registers the /api/v1/admin endpoints
+	EnableAdmin bool
+	// Language is the language of the messages when the Accept-Language
+	// header matches none of apiV1.Languages, English when unset
+	Language language.Tag
+	// Auth authenticates the callers, nil when the authentication is disabled
+	Auth *auth.Guard
+	// Health runs the probes of /readyz, nil when there are none
+	Health *health.Checker
+	// Shutdown is closed when the server drains, the event streams end
+	Shutdown <-chan struct{}
+	// EnableMetrics instruments the requests and serves /metrics
+	EnableMetrics bool
+	// RateLimiter limits the requests of the clients and on the DIDs, nil
+	// when the rate limits are disabled
+	RateLimiter *ratelimit.Limiter
+	// TrustedProxies are the addresses of the proxies whose X-Forwarded-For
+	// tells the IP address of the client, none when empty
+	TrustedProxies []string
+	// CacheControl is the Cache-Control header of the resolved documents,
+	// apiV1.DefaultCacheControl when empty
+	CacheControl string
+	// Idempotency replays the writes sent again with an Idempotency-Key,
+	// nil when disabled
+	Idempotency *idempotency.Keeper
+}
+
 // InitRouter initializes the HTTP router
-func InitRouter(w io.Writer, store gokv.Store, csp cl.CSP, qsign *qsign.Qsign) *gin.Engine {
+func InitRouter(opts *Options) *gin.Engine {
 	r := gin.New()
+	if err := r.SetTrustedProxies(opts.TrustedProxies); err != nil {
+		panic(fmt.Sprintf("set the trusted proxies failed: %v", err))
+	}
+	// The span of the request is the parent of the spans of the handlers,
+	// the spans are dropped unless the tracing is set up
+	r.Use(tracing.Middleware())
+	if opts.EnableMetrics {
+		// Before Recovery, to count the requests that panicked as 500
+		r.Use(metrics.Middleware())
+	}
+	// The ID of the request goes into the access log and the logs of the handlers
+	r.Use(requestID())
 	// Recovery middleware recovers from any panics and writes a 500 if there was one.
 	r.Use(gin.Recovery())
-	r.Use(gin.LoggerWithWriter(w))
-	r.Use(initContext(store, csp, qsign))
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Output: opts.Writer, Formatter: formatAccess}))
+	r.Use(initContext(opts))
 
-	v1 := r.Group("/api/v1")
+	lang := opts.Language
+	if lang == language.Und {
+		lang = language.English
+	}
+	r.Use(apiV1.Localize(lang))
+
+	doc, err := apiV1.LoadOpenAPI()
+	if err != nil {
+		panic(fmt.Sprintf("load the OpenAPI document failed: %v", err))
+	}
+
+	// The probes of the orchestrator, out of the API
+	r.GET("/healthz", apiV1.Healthz)
+	r.GET("/readyz", convert(apiV1.Readyz))
+	if opts.EnableMetrics {
+		r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
+
+	v1 := r.Group(apiPrefix)
+	v1.Use(authenticate(opts.Auth))
+	// By principal, so after the authentication, and before the expensive
+	// validation and verification
+	v1.Use(rateLimit(opts.RateLimiter))
+	v1.Use(validateRequest(doc))
+	// After the validation, the invalid requests are not kept
+	v1.Use(idempotent(opts.Idempotency))
 	{
 		v1.GET("/ping", apiV1.Pong)
+		v1.GET("/openapi.json", apiV1.OpenAPI)
 
+		v1.GET("/did", convert(apiV1.ListDids))
 		v1.POST("/did/create", convert(apiV1.CreateDid))
 		v1.GET("/did/resolve/:did", convert(apiV1.ResolveDid))
+		v1.POST("/did/update", convert(apiV1.UpdateDid))
 		v1.POST("/did/revoke", convert(apiV1.RevokeDid))
+		v1.POST("/did/batch/create", convert(apiV1.BatchCreateDid))
+		v1.POST("/did/batch/resolve", convert(apiV1.BatchResolveDid))
+
+		v1.GET("/keys/:fingerprint/dids", convert(apiV1.KeyDids))
+		v1.GET("/appkeys", convert(apiV1.AppKeys))
+
+		v1.GET("/events", convert(apiV1.Events))
+		v1.GET("/events/ws", convert(apiV1.EventsWebSocket))
+	}
+
+	if opts.EnableAdmin {
+		admin := v1.Group("/admin")
+		{
+			admin.GET("/export", convert(apiV1.ExportRegistry))
+			admin.POST("/import", convert(apiV1.ImportRegistry))
+			admin.POST("/migrate", convert(apiV1.StartMigration))
+			admin.GET("/migrate", convert(apiV1.MigrationStatus))
+			admin.POST("/keys/:fingerprint/compromise", convert(apiV1.ReportCompromise))
+			admin.GET("/log/levels", convert(apiV1.LogLevels))
+			admin.PUT("/log/levels/:module", convert(apiV1.SetLogLevel))
+
+			admin.POST("/webhooks", convert(apiV1.Subscribe))
+			admin.GET("/webhooks", convert(apiV1.Subscriptions))
+			admin.DELETE("/webhooks/:id", convert(apiV1.Unsubscribe))
+			admin.GET("/webhooks/deadletters", convert(apiV1.DeadLetters))
+			admin.POST("/webhooks/deadletters/:id/retry", convert(apiV1.Redeliver))
+			admin.DELETE("/webhooks/deadletters/:id", convert(apiV1.DropDeadLetter))
+		}
 	}
 
 	return r
@@ -34,13 +145,23 @@ func InitRouter(w io.Writer, store gokv.Store, csp cl.CSP, qsign *qsign.Qsign) *
 
 type handlerFunc func(*ctx.Context)
 
-func initContext(store gokv.Store, csp cl.CSP, qsign *qsign.Qsign) gin.HandlerFunc {
+func initContext(opts *Options) gin.HandlerFunc {
+	cacheControl := opts.CacheControl
+	if cacheControl == "" {
+		cacheControl = apiV1.DefaultCacheControl
+	}
 	return func(c *gin.Context) {
 		context := &ctx.Context{
-			Context: c,
-			Store:   store,
-			CSP:     csp,
-			Qsign:   qsign,
+			Context:      c,
+			Store:        opts.Registry.Store(),
+			CSP:          opts.Registry.CSP(),
+			Qsign:        opts.Registry.Qsign(),
+			Registry:     opts.Registry.WithContext(c.Request.Context()),
+			AppKey:       opts.AppKey,
+			Webhooks:     opts.Webhooks,
+			Health:       opts.Health,
+			Shutdown:     opts.Shutdown,
+			CacheControl: cacheControl,
 		}
 		c.Set("context", context)
 
@@ -0,0 +1,436 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/ewangplay/serval/auth"
+	"github.com/ewangplay/serval/health"
+	sio "github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+	"github.com/ewangplay/serval/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, *registry.Registry) {
+	return newAuthRouter(t, nil)
+}
+
+// newAuthRouter serves the API with the requests authenticated by the guard
+func newAuthRouter(t *testing.T, guard *auth.Guard) (*gin.Engine, *registry.Registry) {
+	gin.SetMode(gin.TestMode)
+	err := log.InitLogger(&log.LoggerConfig{
+		Module:   "serval-test",
+		LogLevel: "error",
+		Writer:   &bytes.Buffer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registrytest.NewRegistry(t)
+	r := InitRouter(&Options{
+		Writer:      io.Discard,
+		Registry:    reg,
+		AppKey:      registrytest.NewAppKey(t, reg.CSP()),
+		EnableAdmin: true,
+		Auth:        guard,
+	})
+	return r, reg
+}
+
+func serve(r *gin.Engine, method, url, contentType, body string) (int, sio.Response) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return serveRequest(r, req)
+}
+
+func serveRequest(r *gin.Engine, req *http.Request) (int, sio.Response) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp sio.Response
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	r, _ := newTestRouter(t)
+	doc, err := apiV1.LoadOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			documented[method+" "+apiPrefix+path] = true
+		}
+	}
+	for _, route := range r.Routes() {
+		if !strings.HasPrefix(route.Path, apiPrefix) {
+			// The probes of the orchestrator are not part of the API
+			continue
+		}
+		key := route.Method + " " + pathParam.ReplaceAllString(route.Path, "{$1}")
+		if !documented[key] {
+			t.Errorf("Route %v is missing from the OpenAPI document", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Errorf("Operation %v of the OpenAPI document has no route", key)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	r, reg := newTestRouter(t)
+
+	status, _ := serve(r, http.MethodGet, "/api/v1/openapi.json", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("Serve the OpenAPI document failed: %d", status)
+	}
+
+	invalid := []struct {
+		method, url, contentType, body string
+	}{
+		{http.MethodPost, "/api/v1/did/create", gin.MIMEJSON, `{}`},
+		{http.MethodPost, "/api/v1/did/create", gin.MIMEJSON, `{"did": "did:example:1", "document": {"id": 1}}`},
+		{http.MethodPost, "/api/v1/did/create", gin.MIMEPOSTForm, `did=did:example:1`},
+		{http.MethodPost, "/api/v1/did/batch/resolve", gin.MIMEJSON, `{"dids": []}`},
+		{http.MethodGet, "/api/v1/did?limit=0", "", ""},
+		{http.MethodGet, "/api/v1/did?createdAfter=yesterday", "", ""},
+		{http.MethodGet, "/api/v1/keys/abc/dids", "", ""},
+	}
+	for _, c := range invalid {
+		status, resp := serve(r, c.method, c.url, c.contentType, c.body)
+		if status != http.StatusBadRequest || resp.Error != apiV1.ErrInvalidRequest.Name || !strings.HasPrefix(resp.Detail, "Validate the request failed") {
+			t.Errorf("%v %v %v should be refused: %d %+v", c.method, c.url, c.body, status, resp)
+		}
+	}
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)})
+	status, resp := serve(r, http.MethodPost, "/api/v1/did/create", gin.MIMEJSON, string(body))
+	if status != http.StatusOK || resp.Code != apiV1.SUCCESS {
+		t.Fatalf("CreateDid failed: %d %+v", status, resp)
+	}
+	status, resp = serve(r, http.MethodGet, "/api/v1/did?limit=10&deactivated=false", "", "")
+	if status != http.StatusOK || resp.Code != apiV1.SUCCESS {
+		t.Fatalf("ListDids failed: %d %+v", status, resp)
+	}
+
+	// The dump is streamed to the handler, which refuses the truncated one
+	status, resp = serve(r, http.MethodPost, "/api/v1/admin/import", "application/x-ndjson", "{}\n")
+	if status != http.StatusBadRequest || strings.HasPrefix(resp.Detail, "Validate the request failed") {
+		t.Fatalf("Import should reach the handler: %d %+v", status, resp)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	_, reg := newTestRouter(t)
+	appKey := registrytest.NewAppKey(t, reg.CSP())
+	checker := health.NewChecker(time.Second)
+	checker.Add("store", func(context.Context) error { return adapter.ProbeStore(reg.Store()) })
+	checker.Add("csp", func(context.Context) error { return adapter.ProbeCSP(reg.CSP(), appKey) })
+	r := InitRouter(&Options{
+		Writer:   io.Discard,
+		Registry: reg,
+		AppKey:   appKey,
+		Health:   checker,
+	})
+
+	probe := func(path string) (int, health.Report) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report health.Report
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w.Code, report
+	}
+
+	if status, _ := probe("/healthz"); status != http.StatusOK {
+		t.Fatalf("Liveness failed: %d", status)
+	}
+	status, report := probe("/readyz")
+	if status != http.StatusOK || report.Checks["store"] != health.StatusOK || report.Checks["csp"] != health.StatusOK {
+		t.Fatalf("Readiness failed: %d %+v", status, report)
+	}
+
+	checker.Drain()
+	if status, report = probe("/readyz"); status != http.StatusServiceUnavailable || report.Status != health.StatusDraining {
+		t.Fatalf("Readiness while draining: %d %+v", status, report)
+	}
+	if status, _ = probe("/healthz"); status != http.StatusOK {
+		t.Fatalf("Liveness while draining: %d", status)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, reg := newTestRouter(t)
+	r := InitRouter(&Options{
+		Writer:        io.Discard,
+		Registry:      reg,
+		AppKey:        registrytest.NewAppKey(t, reg.CSP()),
+		EnableMetrics: true,
+	})
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)})
+	if status, resp := serve(r, http.MethodPost, "/api/v1/did/create", gin.MIMEJSON, string(body)); status != http.StatusOK {
+		t.Fatalf("Create failed: %d %+v", status, resp)
+	}
+	serve(r, http.MethodGet, "/api/v1/did/resolve/"+id.Did, "", "")
+	serve(r, http.MethodGet, "/no/such/path", "", "")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Metrics failed: %d", w.Code)
+	}
+	for _, series := range []string{
+		`serval_http_requests_total{method="POST",route="/api/v1/did/create",status="200"}`,
+		`serval_http_request_duration_seconds_count{method="GET",route="/api/v1/did/resolve/:did",status="200"}`,
+		`serval_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`serval_verifications_total{key_type="ed25519",result="valid",target="document"}`,
+		`serval_store_operation_duration_seconds_count{backend="memory",op="set"}`,
+		`serval_documents_total{op="created"}`,
+	} {
+		if !strings.Contains(w.Body.String(), series) {
+			t.Errorf("Metrics miss %s", series)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	r, reg := newTestRouter(t)
+	id := registrytest.NewIdentity(t, reg.CSP())
+	body, _ := json.Marshal(sio.CreateDidReq{Did: id.Did, Document: id.Document(t, reg)})
+	if status, resp := serve(r, http.MethodPost, "/api/v1/did/create", gin.MIMEJSON, string(body)); status != http.StatusOK {
+		t.Fatalf("Create failed: %d %+v", status, resp)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["POST /api/v1/did/create"]
+	if !ok {
+		t.Fatalf("No server span in %v", spans)
+	}
+	for _, name := range []string{"utils.VerifyDDO", "store.set"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("No %s span", name)
+			continue
+		}
+		if s.SpanContext().TraceID() != server.SpanContext().TraceID() {
+			t.Errorf("The %s span is not in the trace of the request", name)
+		}
+	}
+	if verify, ok := spans["utils.VerifyDDO"]; ok && verify.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("The verification is not a child of the request")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	_, reg := newTestRouter(t)
+	var access bytes.Buffer
+	r := InitRouter(&Options{
+		Writer:   &access,
+		Registry: reg,
+		AppKey:   registrytest.NewAppKey(t, reg.CSP()),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/ping", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if id := w.Header().Get(RequestIDHeader); id != "req-42" {
+		t.Errorf("Expected the ID of the caller, got %q", id)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/ping", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	generated := w.Header().Get(RequestIDHeader)
+	if len(generated) != 32 {
+		t.Errorf("Expected a generated ID, got %q", generated)
+	}
+
+	dec := json.NewDecoder(&access)
+	for _, id := range []string{"req-42", generated} {
+		var rec accessRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.RequestID != id || rec.Path != "/api/v1/ping" || rec.Status != http.StatusOK {
+			t.Errorf("Unexpected access record %+v", rec)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	status, resp := serve(r, http.MethodGet, "/api/v1/admin/log/levels", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("List the levels failed: %d %+v", status, resp)
+	}
+	levels, _ := resp.Data.(map[string]any)
+	if _, ok := levels["webhook"]; !ok {
+		t.Fatalf("Expected the webhook module in %v", resp.Data)
+	}
+
+	status, resp = serve(r, http.MethodPut, "/api/v1/admin/log/levels/webhook", gin.MIMEJSON, `{"level":"debug"}`)
+	if status != http.StatusOK {
+		t.Fatalf("Set the level failed: %d %+v", status, resp)
+	}
+	if levels, _ := resp.Data.(map[string]any); levels["webhook"] != "debug" {
+		t.Errorf("Expected the webhook module at debug, got %v", resp.Data)
+	}
+	log.SetLevel("webhook", "error")
+
+	if status, resp = serve(r, http.MethodPut, "/api/v1/admin/log/levels/webhook", gin.MIMEJSON, `{"level":"verbose"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown level, got %d %+v", status, resp)
+	}
+	if status, resp = serve(r, http.MethodPut, "/api/v1/admin/log/levels/nosuch", gin.MIMEJSON, `{"level":"debug"}`); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown module, got %d %+v", status, resp)
+	}
+}
+
+func TestAppKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	reg := registrytest.NewRegistry(t)
+	appKey := registrytest.NewAppKey(t, reg.CSP())
+	retired := registrytest.NewAppKey(t, reg.CSP())
+	appKey.Retired = []adapter.RetiredKey{{ID: "did:example:serval#keys-0", Type: "Ed25519", PublicKeyHex: retired.PublicKeyHex()}}
+	guard, err := auth.New(&auth.Options{
+		Enabled: true,
+		APIKeys: []auth.APIKey{{Name: "ops", SHA256: digest("ops-key")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := InitRouter(&Options{Writer: io.Discard, Registry: reg, AppKey: appKey, Auth: guard})
+
+	// Served without credentials, to anyone verifying an export
+	status, resp := serve(r, http.MethodGet, "/api/v1/appkeys", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("AppKeys failed: %d %+v", status, resp)
+	}
+	data, _ := json.Marshal(resp.Data)
+	var keys sio.AppKeysResp
+	json.Unmarshal(data, &keys)
+	if keys.Current.ID != appKey.ID || keys.Current.PublicKeyHex != appKey.PublicKeyHex() {
+		t.Errorf("Unexpected current key: %+v", keys.Current)
+	}
+	if len(keys.Retired) != 1 || keys.Retired[0].Type != "ED25519" || keys.Retired[0].PublicKeyHex != retired.PublicKeyHex() {
+		t.Errorf("Unexpected retired keys: %+v", keys.Retired)
+	}
+}
+
+func TestConditionalResolve(t *testing.T) {
+	r, reg := newTestRouter(t)
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	// The times of the document are the signer's, not the registry's
+	ddo.Updated = time.Now().AddDate(1, 0, 0)
+	id.Sign(t, reg, &ddo)
+	if err := reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/did/resolve/"+id.Did, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := resolve("", "")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"1-`) || modified == "" || w.Header().Get("Cache-Control") != apiV1.DefaultCacheControl {
+		t.Fatalf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	if lm, err := http.ParseTime(modified); err != nil || lm.After(time.Now()) {
+		t.Fatalf("Expected the time of the write as Last-Modified, got %v %v", modified, err)
+	}
+
+	for _, c := range []struct{ header, value string }{
+		{"If-None-Match", etag},
+		{"If-None-Match", `"other", W/` + etag},
+		{"If-Modified-Since", modified},
+	} {
+		if w = resolve(c.header, c.value); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("%s: %s answered %d %v", c.header, c.value, w.Code, w.Header())
+		}
+	}
+	// Another language is another representation
+	if w = resolve("Accept-Language", "zh-CN"); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected another ETag in Chinese: %d %v", w.Code, w.Header())
+	}
+
+	// A compromised key changes the metadata, not the document
+	fp, _ := utils.KeyFingerprint(ddo.PublicKey[0].PublicKeyHex)
+	if _, _, err := reg.ReportCompromise(fp, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+	if w = resolve("If-None-Match", etag); w.Code != http.StatusOK || w.Header().Get("Last-Modified") != "" {
+		t.Errorf("Expected the compromised key to change the response: %d %v", w.Code, w.Header())
+	}
+
+	// The ETag of a resolution, in any language, is the If-Match of an update
+	update := func(ifMatch string) *httptest.ResponseRecorder {
+		ddo.Controller = "did:example:controller"
+		id.Sign(t, reg, &ddo)
+		body, _ := json.Marshal(sio.UpdateDidReq{Did: id.Did, Document: ddo})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/did/update", bytes.NewReader(body))
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	etag = resolve("Accept-Language", "zh-CN").Header().Get("ETag")
+	if w = update(etag); w.Code != http.StatusOK {
+		t.Errorf("Update with the ETag %v: %d %v", etag, w.Code, w.Body)
+	}
+	if w = update(etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Update with the former ETag %v: %d %v", etag, w.Code, w.Body)
+	}
+	if etag = resolve("", "").Header().Get("ETag"); !strings.HasPrefix(etag, `"2-`) {
+		t.Errorf("Expected the ETag of the version 2, got %v", etag)
+	}
+
+	if err := reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+	if w = resolve("If-None-Match", etag); w.Code != http.StatusNotFound || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected the revoked DID not to be found: %d %v", w.Code, w.Header())
+	}
+}
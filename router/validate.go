@@ -0,0 +1,106 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	apiV1 "github.com/ewangplay/serval/api/v1"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+)
+
+const apiPrefix = "/api/v1"
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+func init() {
+	// The schemas are in the published document, the errors only tell the field
+	openapi3.SchemaErrorDetailsDisabled = true
+}
+
+// validateRequest checks the requests against the OpenAPI document before
+// they reach the handlers. Routes missing from the document are let through.
+func validateRequest(doc *openapi3.T) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := openAPIRoute(doc, c)
+		if route == nil {
+			c.Next()
+			return
+		}
+
+		params := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			params[p.Key] = p.Value
+		}
+
+		// The credentials were checked by authenticate. Streamed bodies,
+		// like the dumps of the import, are not buffered to be validated.
+		opts := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+		if rb := route.Operation.RequestBody; rb != nil && rb.Value.Content.Get(gin.MIMEJSON) == nil {
+			opts.ExcludeRequestBody = true
+		}
+
+		err := openapi3filter.ValidateRequest(c.Request.Context(), &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options:    opts,
+		})
+		if err != nil {
+			errMsg := fmt.Sprintf("Validate the request failed: %v", validationMessage(err))
+			logger.Ctx(c.Request.Context()).Error(errMsg)
+			apiV1.FailWithMessage(apiV1.ErrInvalidRequest, errMsg, c)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// openAPIRoute returns the operation of the document matching the gin route
+func openAPIRoute(doc *openapi3.T, c *gin.Context) *routers.Route {
+	path := strings.TrimPrefix(c.FullPath(), apiPrefix)
+	if path == c.FullPath() {
+		return nil
+	}
+	path = pathParam.ReplaceAllString(path, "{$1}")
+
+	item := doc.Paths.Find(path)
+	if item == nil {
+		return nil
+	}
+	op := item.GetOperation(c.Request.Method)
+	if op == nil {
+		return nil
+	}
+	return &routers.Route{
+		Spec:      doc,
+		Path:      path,
+		PathItem:  item,
+		Method:    c.Request.Method,
+		Operation: op,
+	}
+}
+
+// validationMessage drops the request dump kin-openapi adds to the errors
+func validationMessage(err error) string {
+	switch e := err.(type) {
+	case *openapi3filter.RequestError:
+		if e.Err == nil {
+			return e.Reason
+		}
+		if e.Parameter != nil {
+			return fmt.Sprintf("parameter %q in %s: %v", e.Parameter.Name, e.Parameter.In, e.Err)
+		}
+		if e.RequestBody != nil {
+			return fmt.Sprintf("request body: %v", e.Err)
+		}
+		return e.Err.Error()
+	case *openapi3filter.SecurityRequirementsError:
+		return "security requirements failed"
+	}
+	return err.Error()
+}
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+# Creates a SoftHSM token holding an Ed25519 application key, to run the
+# pkcs11 key source and its tests locally:
+#
+#   eval `sh ./scripts/softhsm.sh`
+#   go test -tags pkcs11 ./adapter/
+
+set -e
+
+MODULE=${SOFTHSM_MODULE:-/usr/lib/softhsm/libsofthsm2.so}
+TOKEN=${SOFTHSM_TOKEN:-serval}
+LABEL=${SOFTHSM_KEY:-serval-appkey}
+PIN=${SOFTHSM_PIN:-1234}
+DIR=${SOFTHSM_DIR:-`mktemp -d`}
+
+mkdir -p $DIR/tokens
+cat > $DIR/softhsm2.conf <<EOF
+directories.tokendir = $DIR/tokens
+objectstore.backend = file
+EOF
+export SOFTHSM2_CONF=$DIR/softhsm2.conf
+
+softhsm2-util --init-token --free --label $TOKEN --pin $PIN --so-pin $PIN >&2
+pkcs11-tool --module $MODULE --token-label $TOKEN --login --pin $PIN \
+	--keypairgen --key-type EC:edwards25519 --label $LABEL >&2
+
+echo "export SOFTHSM2_CONF=$SOFTHSM2_CONF"
+echo "export SERVAL_TEST_PKCS11_MODULE=$MODULE"
+echo "export SERVAL_TEST_PKCS11_TOKEN=$TOKEN"
+echo "export SERVAL_TEST_PKCS11_KEY=$LABEL"
+echo "export SERVAL_PKCS11_PIN=$PIN"
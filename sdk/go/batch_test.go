@@ -0,0 +1,52 @@
+package client_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+func TestBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/did/batch/create":
+			var req io.BatchCreateReq
+			json.NewDecoder(r.Body).Decode(&req)
+			if !req.Atomic || len(req.Items) != 2 {
+				t.Errorf("Unexpected request: %+v", req)
+			}
+			json.NewEncoder(w).Encode(io.Response{Data: io.BatchCreateResp{Created: 2}})
+		case "/api/v1/did/batch/resolve":
+			var req io.BatchResolveReq
+			json.NewDecoder(r.Body).Decode(&req)
+			resp := io.BatchResolveResp{}
+			for _, did := range req.Dids {
+				resp.Results = append(resp.Results, io.BatchResolveResult{Did: did, Error: "DID document not found"})
+			}
+			json.NewEncoder(w).Encode(io.Response{Data: resp})
+		default:
+			t.Errorf("Unexpected request: %v", r.URL)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := c.BatchCreate([]io.CreateDidReq{{Did: "did:example:1"}, {Did: "did:example:2"}}, true)
+	if err != nil || created.Created != 2 {
+		t.Fatalf("BatchCreate failed: %+v %v", created, err)
+	}
+
+	resolved, err := c.BatchResolve([]string{"did:example:1"})
+	if err != nil || len(resolved.Results) != 1 || resolved.Results[0].Error == "" {
+		t.Fatalf("BatchResolve failed: %+v %v", resolved, err)
+	}
+}
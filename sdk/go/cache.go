@@ -0,0 +1,105 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+)
+
+// validated is a response kept to revalidate it with its ETag
+type validated struct {
+	url  string
+	etag string
+	data []byte
+}
+
+// validatorCache keeps the last used responses by URL, up to its size
+type validatorCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newValidatorCache(size int) *validatorCache {
+	return &validatorCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (vc *validatorCache) get(url string) (*validated, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	e, ok := vc.items[url]
+	if !ok {
+		return nil, false
+	}
+	vc.order.MoveToFront(e)
+	return e.Value.(*validated), true
+}
+
+func (vc *validatorCache) add(url, etag string, data []byte) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.size <= 0 {
+		return
+	}
+	v := &validated{url: url, etag: etag, data: data}
+	if e, ok := vc.items[url]; ok {
+		e.Value = v
+		vc.order.MoveToFront(e)
+		return
+	}
+	vc.items[url] = vc.order.PushFront(v)
+	for vc.order.Len() > vc.size {
+		oldest := vc.order.Back()
+		vc.order.Remove(oldest)
+		delete(vc.items, oldest.Value.(*validated).url)
+	}
+}
+
+func (vc *validatorCache) remove(url string) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if e, ok := vc.items[url]; ok {
+		vc.order.Remove(e)
+		delete(vc.items, url)
+	}
+}
+
+// maxVersions is the number of DIDs whose version the client remembers,
+// a forgotten one is updated without If-Match
+const maxVersions = 4096
+
+// versions keeps the version of the DIDs last resolved or updated by the
+// client, sent as If-Match by UpdateDid
+type versions struct {
+	mu    sync.Mutex
+	items map[string]int
+}
+
+func newVersions() *versions {
+	return &versions{items: make(map[string]int)}
+}
+
+func (vs *versions) get(did string) (int, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	v, ok := vs.items[did]
+	return v, ok
+}
+
+func (vs *versions) set(did string, version int) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if _, ok := vs.items[did]; !ok && len(vs.items) >= maxVersions {
+		for k := range vs.items {
+			delete(vs.items, k)
+			break
+		}
+	}
+	vs.items[did] = version
+}
+
+func (vs *versions) remove(did string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	delete(vs.items, did)
+}
@@ -0,0 +1,67 @@
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+func TestRevalidate(t *testing.T) {
+	const etag = `"v1"`
+	var (
+		revoked     bool
+		notModified int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if revoked {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(io.Response{Code: 1005, Error: "DID_NOT_FOUND", Data: map[string]any{}})
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(io.Response{Data: io.ResolveDidResp{Did: did, Document: io.DDO{ID: did}}})
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ddo, err := c.ResolveDid(did)
+		if err != nil || ddo.ID != did {
+			t.Fatalf("Resolve %d: %v %+v", i, err, ddo)
+		}
+	}
+	if notModified != 2 {
+		t.Errorf("Expected 2 revalidations, got %d", notModified)
+	}
+
+	// The revocation shows up, and drops the kept document
+	revoked = true
+	if _, err = c.ResolveDid(did); !errors.Is(err, sdk.ErrDidNotFound) {
+		t.Fatalf("Expected ErrDidNotFound, got %v", err)
+	}
+	revoked = false
+	if _, err = c.ResolveDid(did); err != nil || notModified != 2 {
+		t.Errorf("Expected a full response after the revocation: %v %d", err, notModified)
+	}
+
+	c.SetCacheSize(0)
+	c.ResolveDid(did)
+	c.ResolveDid(did)
+	if notModified != 2 {
+		t.Errorf("Expected no revalidation without a cache, got %d", notModified)
+	}
+}
@@ -1,33 +1,130 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/ewangplay/serval/io"
 )
 
 type Client struct {
+	// addr is the base URL of the server, like http://localhost:8099
 	addr string
 	c    *HttpClient
+	// ctx is the context of the requests, see WithContext
+	ctx context.Context
+	// versions are the versions UpdateDid sends as If-Match, shared with
+	// the clients of WithContext
+	versions *versions
 }
 
+// NewClient creates the client of the server at addr, host:port or an
+// http:// or https:// URL
 func NewClient(addr string) (*Client, error) {
+	return NewClientWithTLS(addr, nil)
+}
+
+// NewClientWithTLS creates the client of the server at addr, host:port or
+// an https:// URL, the connections are secured with the TLS options
+func NewClientWithTLS(addr string, opts *TLSOptions) (*Client, error) {
 	if len(addr) == 0 {
 		return nil, fmt.Errorf("addr must be set")
 	}
-	c, err := NewHttpClient()
+
+	var config *tls.Config
+	if opts != nil {
+		var err error
+		if config, err = opts.Config(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+	case strings.HasPrefix(addr, "http://"):
+		if config != nil {
+			return nil, fmt.Errorf("TLS options set for the plain text address %s", addr)
+		}
+	case config != nil:
+		addr = "https://" + addr
+	default:
+		addr = "http://" + addr
+	}
+
+	c, err := NewHttpClientWithTLS(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{addr, c}, nil
+	return &Client{addr: strings.TrimSuffix(addr, "/"), c: c, ctx: context.Background(), versions: newVersions()}, nil
+}
+
+// WithContext returns a client sending its requests with the context, the
+// requests are canceled with it and traced as children of its span
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// SetCacheSize sets the number of resolved documents kept to revalidate
+// them with If-None-Match, DefaultCacheSize by default, 0 disables it
+func (c *Client) SetCacheSize(size int) {
+	c.c.SetCacheSize(size)
+}
+
+// SetRetryPolicy sets how the failed requests are sent again,
+// DefaultRetryPolicy by default. The writes carry an Idempotency-Key, so
+// that a retry is applied once.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.c.SetRetryPolicy(policy)
+}
+
+// SetAPIKey authenticates the requests with the API key
+func (c *Client) SetAPIKey(key string) {
+	c.c.SetHeader("X-API-Key", key)
+}
+
+// SetBearerToken authenticates the requests with the JWT
+func (c *Client) SetBearerToken(token string) {
+	if token == "" {
+		c.c.SetHeader("Authorization", "")
+		return
+	}
+	c.c.SetHeader("Authorization", "Bearer "+token)
+}
+
+// postWrite posts the write with a new Idempotency-Key, kept by its
+// retries
+func (c *Client) postWrite(url string, req any, header http.Header) ([]byte, error) {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Idempotency-Key", hex.EncodeToString(key))
+
+	return c.c.PostContextWithHeader(c.ctx, url, reqBody, header)
 }
 
 func (c *Client) Ping() error {
-	url := fmt.Sprintf("http://%s/api/v1/ping", c.addr)
-	respBody, err := c.c.Get(url)
+	url := fmt.Sprintf("%s/api/v1/ping", c.addr)
+	respBody, err := c.c.GetContext(c.ctx, url)
 	if err != nil {
 		return err
 	}
@@ -46,14 +143,9 @@ func (c *Client) Ping() error {
 }
 
 func (c *Client) CreateDid(req *io.CreateDidReq) error {
-	url := fmt.Sprintf("http://%s/api/v1/did/create", c.addr)
+	url := fmt.Sprintf("%s/api/v1/did/create", c.addr)
 
-	reqBody, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-
-	respBody, err := c.c.Post(url, reqBody)
+	respBody, err := c.postWrite(url, req, nil)
 	if err != nil {
 		return err
 	}
@@ -64,13 +156,24 @@ func (c *Client) CreateDid(req *io.CreateDidReq) error {
 }
 
 func (c *Client) ResolveDid(did string) (*io.DDO, error) {
+	resp, err := c.ResolveDidWithMetadata(did)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Document, nil
+}
+
+// ResolveDidWithMetadata returns the DID document and its metadata, like
+// the version to update it with UpdateDidIfMatch. The client remembers the
+// version for the next UpdateDid of the DID.
+func (c *Client) ResolveDidWithMetadata(did string) (*io.ResolveDidResp, error) {
 	if did == "" {
 		return nil, fmt.Errorf("did cannot be empty")
 	}
 
-	url := fmt.Sprintf("http://%s/api/v1/did/resolve/%s", c.addr, did)
+	url := fmt.Sprintf("%s/api/v1/did/resolve/%s", c.addr, did)
 
-	respBody, err := c.c.Get(url)
+	respBody, err := c.c.GetContext(c.ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -83,23 +186,112 @@ func (c *Client) ResolveDid(did string) (*io.DDO, error) {
 		return nil, err
 	}
 
-	return &resp.Document, nil
+	if resp.Metadata != nil {
+		c.versions.set(did, resp.Metadata.Version)
+	} else {
+		c.versions.remove(did)
+	}
+	return &resp, nil
 }
 
-func (c *Client) RevokeDid(req *io.RevokeDidReq) error {
-	url := fmt.Sprintf("http://%s/api/v1/did/revoke", c.addr)
+// UpdateDid replaces the DID document, the new document must be signed
+// by an authentication key of the current one. When the client resolved
+// the DID with ResolveDidWithMetadata or updated it before, the update
+// is sent with that version as If-Match and fails with
+// ErrPreconditionFailed if the document changed since: resolve it again
+// and retry. Without a known version no precondition is sent.
+func (c *Client) UpdateDid(req *io.UpdateDidReq) error {
+	if version, ok := c.versions.get(req.Did); ok {
+		return c.UpdateDidIfMatch(req, version)
+	}
+	err := c.updateDid(req, nil)
+	if err == nil {
+		c.versions.remove(req.Did)
+	}
+	return err
+}
 
-	reqBody, err := json.Marshal(req)
+// UpdateDidIfMatch replaces the DID document if it is still at the
+// version, else it fails with ErrPreconditionFailed
+func (c *Client) UpdateDidIfMatch(req *io.UpdateDidReq, version int) error {
+	header := make(http.Header)
+	header.Set("If-Match", strconv.Quote(strconv.Itoa(version)))
+	err := c.updateDid(req, header)
+	switch {
+	case err == nil:
+		c.versions.set(req.Did, version+1)
+	case errors.Is(err, ErrPreconditionFailed):
+		c.versions.remove(req.Did)
+	}
+	return err
+}
+
+func (c *Client) updateDid(req *io.UpdateDidReq, header http.Header) error {
+	url := fmt.Sprintf("%s/api/v1/did/update", c.addr)
+
+	respBody, err := c.postWrite(url, req, header)
 	if err != nil {
 		return err
 	}
 
-	respBody, err := c.c.Post(url, reqBody)
+	fmt.Println("UpdateDid response: ", string(respBody))
+
+	return nil
+}
+
+func (c *Client) RevokeDid(req *io.RevokeDidReq) error {
+	url := fmt.Sprintf("%s/api/v1/did/revoke", c.addr)
+
+	respBody, err := c.postWrite(url, req, nil)
 	if err != nil {
 		return err
 	}
+	c.versions.remove(req.Did)
 
 	fmt.Println("RevokeDid response: ", string(respBody))
 
 	return nil
 }
+
+// BatchCreate creates the DIDs in one request, the result of each item
+// is reported back. With atomic set either all of them are created or none.
+func (c *Client) BatchCreate(items []io.CreateDidReq, atomic bool) (*io.BatchCreateResp, error) {
+	url := fmt.Sprintf("%s/api/v1/did/batch/create", c.addr)
+
+	respBody, err := c.postWrite(url, &io.BatchCreateReq{Items: items, Atomic: atomic}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp io.BatchCreateResp
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// BatchResolve resolves the DIDs in one request, the result of each DID
+// is reported back
+func (c *Client) BatchResolve(dids []string) (*io.BatchResolveResp, error) {
+	url := fmt.Sprintf("%s/api/v1/did/batch/resolve", c.addr)
+
+	reqBody, err := json.Marshal(&io.BatchResolveReq{Dids: dids})
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := c.c.PostContext(c.ctx, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp io.BatchResolveResp
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Error is a failure reported by the server. Match the kind of failure
+// with errors.Is and one of the Err values, or get the details with
+// errors.As:
+//
+//	var e *client.Error
+//	if errors.As(err, &e) && e.Status == http.StatusServiceUnavailable {
+//		// retry later
+//	}
+type Error struct {
+	// Status is the HTTP status of the response
+	Status int
+	// Code is the numeric code of the error
+	Code int
+	// Name is the string code of the error, like DID_NOT_FOUND. It is
+	// empty when the response is not the envelope of the API.
+	Name string
+	// Msg is the message of the code, in the language of the request
+	Msg string
+	// Detail tells the reason of the failure
+	Detail string
+	// RetryAfter is the wait asked by the server before a retry, like
+	// after a 429, zero when not told
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Msg
+	if e.Detail != "" {
+		msg = fmt.Sprintf("%v: %v", e.Msg, e.Detail)
+	}
+	if e.Name == "" {
+		return fmt.Sprintf("%d - %v", e.Status, msg)
+	}
+	return fmt.Sprintf("%d %v (%d) - %v", e.Status, e.Name, e.Code, msg)
+}
+
+// Is reports whether the target is an error of the same string code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Name != "" && t.Name == e.Name
+}
+
+// The errors of the catalogue of the API, to be matched with errors.Is
+var (
+	ErrInvalidRequest     = &Error{Code: 1001, Name: "INVALID_REQUEST"}
+	ErrInvalidSignature   = &Error{Code: 1002, Name: "INVALID_SIGNATURE"}
+	ErrUnsupportedKeyType = &Error{Code: 1003, Name: "UNSUPPORTED_KEY_TYPE"}
+	ErrPermissionDenied   = &Error{Code: 1004, Name: "PERMISSION_DENIED"}
+	ErrDidNotFound        = &Error{Code: 1005, Name: "DID_NOT_FOUND"}
+	ErrNotFound           = &Error{Code: 1006, Name: "NOT_FOUND"}
+	ErrConflict           = &Error{Code: 1007, Name: "CONFLICT"}
+	ErrFeatureDisabled    = &Error{Code: 1008, Name: "FEATURE_DISABLED"}
+	ErrBatchAborted       = &Error{Code: 1009, Name: "BATCH_ABORTED"}
+	ErrUnauthenticated    = &Error{Code: 1010, Name: "UNAUTHENTICATED"}
+	ErrRateLimited        = &Error{Code: 1011, Name: "RATE_LIMITED"}
+	ErrPreconditionFailed = &Error{Code: 1012, Name: "PRECONDITION_FAILED"}
+	ErrKeyReused          = &Error{Code: 1013, Name: "IDEMPOTENCY_KEY_REUSED"}
+	ErrInProgress         = &Error{Code: 1014, Name: "REQUEST_IN_PROGRESS"}
+	ErrInternal           = &Error{Code: 2001, Name: "INTERNAL"}
+	ErrBackendUnavailable = &Error{Code: 2002, Name: "BACKEND_UNAVAILABLE"}
+)
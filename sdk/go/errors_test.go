@@ -0,0 +1,46 @@
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+func TestTypedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/did/resolve/did:example:missing":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(io.Response{Code: 1005, Error: "DID_NOT_FOUND", Data: map[string]any{}, Msg: "The DID does not exist", Detail: "DID document (did:example:missing) not found"})
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>Bad Gateway</html>"))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ResolveDid("did:example:missing")
+	if !errors.Is(err, sdk.ErrDidNotFound) || errors.Is(err, sdk.ErrNotFound) {
+		t.Fatalf("Expected ErrDidNotFound, got %v", err)
+	}
+	var e *sdk.Error
+	if !errors.As(err, &e) || e.Status != http.StatusNotFound || e.Code != 1005 || e.Detail == "" {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+
+	_, err = c.ResolveDid("did:example:other")
+	if !errors.As(err, &e) || e.Status != http.StatusBadGateway || e.Name != "" {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+}
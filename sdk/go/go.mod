@@ -2,4 +2,22 @@ module github.com/ewangplay/serval/sdk/go
 
 go 1.18
 
-require github.com/ewangplay/serval/io v0.0.0-20220713065604-fe59ebea56d6
+require (
+	github.com/ewangplay/serval/io v0.0.0-20220713065604-fe59ebea56d6
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.28.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	golang.org/x/net v0.0.0-20220520000938-2e3eb7b945c2 // indirect
+	golang.org/x/sys v0.0.0-20220704084225-05e143d24a9e // indirect
+	golang.org/x/text v0.3.7 // indirect
+	google.golang.org/genproto v0.0.0-20220519153652-3a47de7e79bd // indirect
+)
+
+replace github.com/ewangplay/serval/io => ../../io
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ewangplay/serval/io"
+	pb "github.com/ewangplay/serval/sdk/go/servalpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// GrpcClient is the client of the gRPC API
+type GrpcClient struct {
+	conn *grpc.ClientConn
+	c    pb.DidServiceClient
+}
+
+// NewGrpcClient connects to the gRPC API listening on addr
+func NewGrpcClient(addr string, opts ...grpc.DialOption) (*GrpcClient, error) {
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("addr must be set")
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcClient{conn: conn, c: pb.NewDidServiceClient(conn)}, nil
+}
+
+// Close closes the connection
+func (c *GrpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// CreateDid registers the DID document
+func (c *GrpcClient) CreateDid(ctx context.Context, req *io.CreateDidReq) error {
+	_, err := c.c.CreateDid(ctx, &pb.CreateDidRequest{
+		Did:      req.Did,
+		Document: pb.FromDDO(&req.Document),
+	})
+	return err
+}
+
+// ResolveDid returns the DID document and its metadata
+func (c *GrpcClient) ResolveDid(ctx context.Context, did string) (*io.ResolveDidResp, error) {
+	if did == "" {
+		return nil, fmt.Errorf("did cannot be empty")
+	}
+	resp, err := c.c.ResolveDid(ctx, &pb.ResolveDidRequest{Did: did})
+	if err != nil {
+		return nil, err
+	}
+	return &io.ResolveDidResp{
+		Did:      resp.Did,
+		Document: pb.ToDDO(resp.Document),
+		Metadata: pb.ToMetadata(resp.Metadata),
+	}, nil
+}
+
+// UpdateDid replaces the DID document
+func (c *GrpcClient) UpdateDid(ctx context.Context, req *io.UpdateDidReq) error {
+	_, err := c.c.UpdateDid(ctx, &pb.UpdateDidRequest{
+		Did:      req.Did,
+		Document: pb.FromDDO(&req.Document),
+	})
+	return err
+}
+
+// RevokeDid deactivates the DID
+func (c *GrpcClient) RevokeDid(ctx context.Context, req *io.RevokeDidReq) error {
+	_, err := c.c.RevokeDid(ctx, &pb.RevokeDidRequest{
+		Did:   req.Did,
+		Proof: pb.FromProof(&req.Proof),
+	})
+	return err
+}
+
+// WatchEvents calls fn for every registry event after lastEventID, or
+// after the current one when lastEventID is nil, until the context is done
+// or fn fails. types selects the event types, none selects all of them.
+func (c *GrpcClient) WatchEvents(ctx context.Context, lastEventID *uint64, types []string, fn func(*pb.Event) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.c.WatchEvents(ctx, &pb.WatchEventsRequest{
+		LastEventId: lastEventID,
+		Types:       types,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// APIKeyCredentials authenticates the calls with the API key, pass them
+// with grpc.WithPerRPCCredentials
+func APIKeyCredentials(key string) credentials.PerRPCCredentials {
+	return metadataCredentials{"x-api-key", key}
+}
+
+// BearerCredentials authenticates the calls with the JWT, pass them with
+// grpc.WithPerRPCCredentials
+func BearerCredentials(token string) credentials.PerRPCCredentials {
+	return metadataCredentials{"authorization", "Bearer " + token}
+}
+
+type metadataCredentials struct {
+	key, value string
+}
+
+func (m metadataCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{m.key: m.value}, nil
+}
+
+// RequireTransportSecurity lets the credentials go over plain text
+// connections, which only suits a trusted network
+func (metadataCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -2,23 +2,87 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/ewangplay/serval/io"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer traces the requests, the spans are dropped until the application
+// sets a tracer provider
+var tracer = otel.Tracer("github.com/ewangplay/serval/sdk/go")
+
+// DefaultCacheSize is the number of responses the client revalidates
+const DefaultCacheSize = 256
+
+// RetryPolicy defines how the failed requests are sent again: after a
+// failure of the connection, like a timeout, a 429, 502, 503 or 504
+// response, or a request in progress. The gets are retried, the posts only
+// with an Idempotency-Key, the server then applies them once.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a request, 1 or less
+	// disables the retries
+	MaxAttempts int
+	// MinBackoff is the wait before the second attempt, doubled at every
+	// attempt up to MaxBackoff. A Retry-After of the server replaces it, the
+	// request fails when it is above MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of a new client
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, MinBackoff: 200 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// backoff returns the wait after the attempt, with a jitter so that the
+// clients failing together do not retry together
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.MinBackoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
 type HttpClient struct {
 	c *http.Client
+	// header is added to every request, like the credentials
+	header http.Header
+	// cache holds the last responses carrying an ETag
+	cache *validatorCache
+	// retry is the retry policy of the requests
+	retry RetryPolicy
 }
 
 func NewHttpClient() (*HttpClient, error) {
+	return NewHttpClientWithTLS(nil)
+}
+
+// NewHttpClientWithTLS creates the client with the TLS config of the https
+// connections, the default one when nil
+func NewHttpClientWithTLS(config *tls.Config) (*HttpClient, error) {
 	c := &http.Client{
 		Transport: &http.Transport{
+			TLSClientConfig: config,
 			Dial: func(netw, addr string) (net.Conn, error) {
 				conn, err := net.DialTimeout(netw, addr, time.Second*3)
 				if err != nil {
@@ -30,28 +94,193 @@ func NewHttpClient() (*HttpClient, error) {
 			ResponseHeaderTimeout: time.Second * 3,
 		},
 	}
-	return &HttpClient{c}, nil
+	return &HttpClient{
+		c:      c,
+		header: make(http.Header),
+		cache:  newValidatorCache(DefaultCacheSize),
+		retry:  DefaultRetryPolicy,
+	}, nil
+}
+
+// SetHeader sets a header of every request, an empty value removes it
+func (c *HttpClient) SetHeader(key, value string) {
+	if value == "" {
+		c.header.Del(key)
+		return
+	}
+	c.header.Set(key, value)
+}
+
+// SetCacheSize sets the number of responses kept to revalidate them, 0
+// disables the revalidation
+func (c *HttpClient) SetCacheSize(size int) {
+	c.cache = newValidatorCache(size)
+}
+
+// SetRetryPolicy sets how the failed requests are sent again
+func (c *HttpClient) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
 }
 
 func (c *HttpClient) Post(url string, data []byte) ([]byte, error) {
-	body := bytes.NewBuffer(data)
-	resp, err := c.c.Post(url, "application/json;charset=utf-8", body)
+	return c.PostContext(context.Background(), url, data)
+}
+
+// PostContext posts the data with the context of the request
+func (c *HttpClient) PostContext(ctx context.Context, url string, data []byte) ([]byte, error) {
+	return c.PostContextWithHeader(ctx, url, data, nil)
+}
+
+// PostContextWithHeader posts the data with the headers of the request,
+// like the Idempotency-Key that lets the post be retried
+func (c *HttpClient) PostContextWithHeader(ctx context.Context, url string, data []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	return c.parseResponse(resp)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	return c.do(req)
 }
 
 func (c *HttpClient) Get(url string) ([]byte, error) {
-	resp, err := c.c.Get(url)
+	return c.GetContext(context.Background(), url)
+}
+
+// GetContext gets the url with the context of the request. A response with
+// an ETag is kept, and sent again when the server answers 304 to the next
+// request of the url.
+func (c *HttpClient) GetContext(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	cached, found := c.cache.get(url)
+	if found {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, data, err := c.sendRetry(req)
 	if err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			// Like a revoked DID
+			c.cache.remove(url)
+		}
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusNotModified {
+		if !found {
+			return nil, &Error{Status: resp.StatusCode, Msg: resp.Status}
+		}
+		return cached.data, nil
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		c.cache.add(url, etag, data)
+	}
+	return data, nil
+}
+
+// do sends the request and returns the data of the response envelope
+func (c *HttpClient) do(req *http.Request) ([]byte, error) {
+	_, data, err := c.sendRetry(req)
+	return data, err
+}
+
+// sendRetry sends the request again after a transient failure, following
+// the retry policy
+func (c *HttpClient) sendRetry(req *http.Request) (*http.Response, []byte, error) {
+	policy := c.retry
+	if req.Method != http.MethodGet && req.Header.Get("Idempotency-Key") == "" {
+		policy.MaxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, nil, err
+			}
+			req.Body = body
+		}
+		resp, data, err := c.send(req)
+		if attempt >= policy.MaxAttempts || !retryable(req.Context(), err) {
+			return resp, data, err
+		}
+
+		wait := policy.backoff(attempt)
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > 0 {
+			if e.RetryAfter > policy.MaxBackoff {
+				return resp, data, err
+			}
+			wait = e.RetryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return resp, data, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable tells whether the failure is transient
+func retryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.Status {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return errors.Is(e, ErrInProgress)
+	}
+	// The request did not get a response, like after a timeout
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// send sends the request in a client span, the traceparent header carries
+// the span to the server. The body of a 304 response is not parsed.
+func (c *HttpClient) send(req *http.Request) (resp *http.Response, body []byte, err error) {
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	req = req.WithContext(ctx)
+
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err = c.c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
 
-	return c.parseResponse(resp)
+	if resp.StatusCode == http.StatusNotModified {
+		return resp, nil, nil
+	}
+	body, err = c.parseResponse(resp)
+	return resp, body, err
 }
 
 func (c *HttpClient) parseResponse(resp *http.Response) ([]byte, error) {
@@ -63,15 +292,22 @@ func (c *HttpClient) parseResponse(resp *http.Response) ([]byte, error) {
 	var r io.Response
 	err = json.Unmarshal(respBody, &r)
 	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			// Not the envelope of the API, like the error page of a proxy
+			return nil, &Error{Status: resp.StatusCode, Msg: resp.Status, RetryAfter: retryAfter(resp)}
+		}
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%v: %v - %v", resp.Status, r.Code, r.Msg)
-	}
-
-	if r.Code != 0 {
-		return nil, fmt.Errorf("%v - %v", r.Code, r.Msg)
+	if resp.StatusCode != http.StatusOK || r.Code != 0 {
+		return nil, &Error{
+			Status:     resp.StatusCode,
+			Code:       r.Code,
+			Name:       r.Error,
+			Msg:        r.Msg,
+			Detail:     r.Detail,
+			RetryAfter: retryAfter(resp),
+		}
 	}
 
 	rData, err := json.Marshal(r.Data)
@@ -81,3 +317,21 @@ func (c *HttpClient) parseResponse(resp *http.Response) ([]byte, error) {
 
 	return rData, nil
 }
+
+// retryAfter returns the wait of the Retry-After header, in seconds or an
+// HTTP date, zero without it
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
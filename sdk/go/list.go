@@ -0,0 +1,133 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ewangplay/serval/io"
+)
+
+// ListDidsOptions filters the DIDs returned by ListDids, zero values are ignored
+type ListDidsOptions struct {
+	Controller    string
+	KeyType       string
+	ServiceType   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Deactivated selects live or revoked DIDs only, nil selects both
+	Deactivated *bool
+	// Limit is the page size
+	Limit int
+}
+
+func (o *ListDidsOptions) query(cursor string) url.Values {
+	q := url.Values{}
+	if o != nil {
+		set := func(k, v string) {
+			if v != "" {
+				q.Set(k, v)
+			}
+		}
+		set("controller", o.Controller)
+		set("keyType", o.KeyType)
+		set("serviceType", o.ServiceType)
+		for k, t := range map[string]time.Time{
+			"createdAfter":  o.CreatedAfter,
+			"createdBefore": o.CreatedBefore,
+			"updatedAfter":  o.UpdatedAfter,
+			"updatedBefore": o.UpdatedBefore,
+		} {
+			if !t.IsZero() {
+				q.Set(k, t.Format(time.RFC3339))
+			}
+		}
+		if o.Deactivated != nil {
+			q.Set("deactivated", strconv.FormatBool(*o.Deactivated))
+		}
+		if o.Limit > 0 {
+			q.Set("limit", strconv.Itoa(o.Limit))
+		}
+	}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	return q
+}
+
+// ListDidsPage returns the page of DIDs starting at the cursor,
+// an empty cursor starts at the first page
+func (c *Client) ListDidsPage(opts *ListDidsOptions, cursor string) (*io.ListDidsResp, error) {
+	url := fmt.Sprintf("%s/api/v1/did?%s", c.addr, opts.query(cursor).Encode())
+
+	respBody, err := c.c.GetContext(c.ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp io.ListDidsResp
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// ListDids returns an iterator over all the DIDs matching the options,
+// the pages are fetched as the iteration goes
+//
+//	it := c.ListDids(&client.ListDidsOptions{Controller: did})
+//	for it.Next() {
+//		fmt.Println(it.Did().Did)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) ListDids(opts *ListDidsOptions) *DidIterator {
+	return &DidIterator{c: c, opts: opts}
+}
+
+// DidIterator iterates over the DIDs returned by ListDids
+type DidIterator struct {
+	c      *Client
+	opts   *ListDidsOptions
+	page   []io.DidSummary
+	pos    int
+	cursor string
+	done   bool
+	err    error
+}
+
+// Next advances to the next DID, it returns false at the end or on error
+func (it *DidIterator) Next() bool {
+	for it.pos >= len(it.page) {
+		if it.done || it.err != nil {
+			return false
+		}
+		resp, err := it.c.ListDidsPage(it.opts, it.cursor)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page, it.pos = resp.Dids, 0
+		it.cursor = resp.NextCursor
+		it.done = resp.NextCursor == ""
+	}
+	it.pos++
+	return true
+}
+
+// Did returns the current DID
+func (it *DidIterator) Did() io.DidSummary {
+	return it.page[it.pos-1]
+}
+
+// Err returns the error that stopped the iteration
+func (it *DidIterator) Err() error {
+	return it.err
+}
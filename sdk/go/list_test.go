@@ -0,0 +1,48 @@
+package client_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ewangplay/serval/io"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+func TestListDids(t *testing.T) {
+	pages := map[string]io.ListDidsResp{
+		"": {
+			Dids:       []io.DidSummary{{Did: "did:example:1"}, {Did: "did:example:2"}},
+			NextCursor: "page2",
+		},
+		"page2": {
+			Dids: []io.DidSummary{{Did: "did:example:3"}},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/did" || r.URL.Query().Get("controller") != "did:example:0" {
+			t.Errorf("Unexpected request: %v", r.URL)
+		}
+		json.NewEncoder(w).Encode(io.Response{Data: pages[r.URL.Query().Get("cursor")]})
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dids []string
+	it := c.ListDids(&sdk.ListDidsOptions{Controller: "did:example:0", Limit: 2})
+	for it.Next() {
+		dids = append(dids, it.Did().Did)
+	}
+	if err = it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(dids, ",") != "did:example:1,did:example:2,did:example:3" {
+		t.Fatalf("Unexpected DIDs: %v", dids)
+	}
+}
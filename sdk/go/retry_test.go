@@ -0,0 +1,158 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/io"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+func TestRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		keys     []string
+		ifMatch  []string
+		failures = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		switch {
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(io.Response{Code: 2002, Error: "BACKEND_UNAVAILABLE", Data: map[string]any{}})
+		case r.Header.Get("If-Match") == `"2"`:
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(io.Response{Code: 1012, Error: "PRECONDITION_FAILED", Data: map[string]any{}})
+		default:
+			json.NewEncoder(w).Encode(io.Response{Data: map[string]any{}})
+		}
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRetryPolicy(sdk.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+	// The retry sends the write again with the same key
+	if err = c.UpdateDidIfMatch(&io.UpdateDidReq{Did: did}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] || ifMatch[1] != `"1"` {
+		t.Fatalf("Expected a retry with the same key and precondition: %q %q", keys, ifMatch)
+	}
+	if err = c.CreateDid(&io.CreateDidReq{Did: did}); err != nil || keys[2] == keys[0] {
+		t.Errorf("Expected another key for another write: %v %q", err, keys)
+	}
+
+	// A failed precondition is not retried
+	err = c.UpdateDidIfMatch(&io.UpdateDidReq{Did: did}, 2)
+	if !errors.Is(err, sdk.ErrPreconditionFailed) || len(keys) != 4 {
+		t.Errorf("Expected ErrPreconditionFailed at once, got %v after %d requests", err, len(keys))
+	}
+
+	// Nor a post without a key, it could be applied twice
+	failures = 1
+	if _, err = c.BatchResolve([]string{did}); err == nil || len(keys) != 5 {
+		t.Errorf("Expected the post to fail at once, got %v after %d requests", err, len(keys))
+	}
+}
+
+func TestUpdateDidVersion(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		version = 3
+		ifMatch []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(io.Response{Data: io.ResolveDidResp{Did: did, Metadata: &io.DocumentMetadata{Version: version}}})
+			return
+		}
+		m := r.Header.Get("If-Match")
+		ifMatch = append(ifMatch, m)
+		if m != "" && m != strconv.Quote(strconv.Itoa(version)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(io.Response{Code: 1012, Error: "PRECONDITION_FAILED", Data: map[string]any{}})
+			return
+		}
+		version++
+		json.NewEncoder(w).Encode(io.Response{Data: map[string]any{}})
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a resolve no precondition is sent
+	if err = c.UpdateDid(&io.UpdateDidReq{Did: did}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then the resolved version is sent and followed by the updates
+	if _, err = c.WithContext(context.Background()).ResolveDidWithMetadata(did); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = c.UpdateDid(&io.UpdateDidReq{Did: did}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An update of another client fails the next one, which is then sent
+	// without a precondition until the DID is resolved again
+	mu.Lock()
+	version++
+	mu.Unlock()
+	if err = c.UpdateDid(&io.UpdateDidReq{Did: did}); !errors.Is(err, sdk.ErrPreconditionFailed) {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if err = c.UpdateDid(&io.UpdateDidReq{Did: did}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"", `"4"`, `"5"`, `"6"`, ""}
+	if strings.Join(ifMatch, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the If-Match %q, got %q", expected, ifMatch)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(io.Response{Code: 1011, Error: "RATE_LIMITED", Data: map[string]any{}})
+	}))
+	defer srv.Close()
+
+	c, err := sdk.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A wait above the longest backoff is left to the caller
+	_, err = c.ResolveDid(did)
+	var e *sdk.Error
+	if !errors.As(err, &e) || e.RetryAfter != time.Minute || requests != 1 {
+		t.Errorf("Expected the Retry-After to be reported, got %v after %d requests", err, requests)
+	}
+}
@@ -0,0 +1,134 @@
+package servalpb
+
+import (
+	"time"
+
+	"github.com/ewangplay/serval/io"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromDDO converts the DID document to its protobuf message
+func FromDDO(ddo *io.DDO) *Document {
+	d := &Document{
+		Context:        ddo.Context,
+		Id:             ddo.ID,
+		Version:        int32(ddo.Version),
+		Controller:     ddo.Controller,
+		Authentication: ddo.Authentication,
+		Recovery:       ddo.Recovery,
+		Proof:          FromProof(&ddo.Proof),
+		Created:        fromTime(ddo.Created),
+		Updated:        fromTime(ddo.Updated),
+	}
+	for _, k := range ddo.PublicKey {
+		d.PublicKey = append(d.PublicKey, &PublicKey{
+			Id:           k.ID,
+			Type:         k.Type,
+			PublicKeyHex: k.PublicKeyHex,
+		})
+	}
+	for _, s := range ddo.Service {
+		d.Service = append(d.Service, &Service{
+			Id:              s.ID,
+			Type:            string(s.Type),
+			ServiceEndpoint: s.ServiceEndpoint,
+		})
+	}
+	return d
+}
+
+// ToDDO converts the protobuf message to the DID document
+func ToDDO(d *Document) io.DDO {
+	if d == nil {
+		return io.DDO{}
+	}
+	ddo := io.DDO{
+		Context:        d.Context,
+		ID:             d.Id,
+		Version:        int8(d.Version),
+		Controller:     d.Controller,
+		Authentication: d.Authentication,
+		Recovery:       d.Recovery,
+		Proof:          ToProof(d.Proof),
+		Created:        toTime(d.Created),
+		Updated:        toTime(d.Updated),
+	}
+	for _, k := range d.PublicKey {
+		ddo.PublicKey = append(ddo.PublicKey, io.PublicKey{
+			ID:           k.Id,
+			Type:         k.Type,
+			PublicKeyHex: k.PublicKeyHex,
+		})
+	}
+	for _, s := range d.Service {
+		ddo.Service = append(ddo.Service, io.Service{
+			ID:              s.Id,
+			Type:            io.ServiceType(s.Type),
+			ServiceEndpoint: s.ServiceEndpoint,
+		})
+	}
+	return ddo
+}
+
+// FromProof converts the proof to its protobuf message
+func FromProof(p *io.Proof) *Proof {
+	return &Proof{
+		Type:           p.Type,
+		Creator:        p.Creator,
+		SignatureValue: p.SignatureValue,
+	}
+}
+
+// ToProof converts the protobuf message to the proof
+func ToProof(p *Proof) io.Proof {
+	if p == nil {
+		return io.Proof{}
+	}
+	return io.Proof{
+		Type:           p.Type,
+		Creator:        p.Creator,
+		SignatureValue: p.SignatureValue,
+	}
+}
+
+// FromMetadata converts the document metadata to its protobuf message
+func FromMetadata(m *io.DocumentMetadata) *DocumentMetadata {
+	if m == nil {
+		return nil
+	}
+	return &DocumentMetadata{
+		Version:         int32(m.Version),
+		Created:         fromTime(m.Created),
+		Updated:         fromTime(m.Updated),
+		Deactivated:     m.Deactivated,
+		CompromisedKeys: m.CompromisedKeys,
+	}
+}
+
+// ToMetadata converts the protobuf message to the document metadata
+func ToMetadata(m *DocumentMetadata) *io.DocumentMetadata {
+	if m == nil {
+		return nil
+	}
+	return &io.DocumentMetadata{
+		Version:         int(m.Version),
+		Created:         toTime(m.Created),
+		Updated:         toTime(m.Updated),
+		Deactivated:     m.Deactivated,
+		CompromisedKeys: m.CompromisedKeys,
+	}
+}
+
+func fromTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func toTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
@@ -0,0 +1,289 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: serval.proto
+
+package servalpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DidServiceClient is the client API for DidService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DidServiceClient interface {
+	// CreateDid registers the DID document
+	CreateDid(ctx context.Context, in *CreateDidRequest, opts ...grpc.CallOption) (*CreateDidResponse, error)
+	// ResolveDid returns the verified DID document and its metadata
+	ResolveDid(ctx context.Context, in *ResolveDidRequest, opts ...grpc.CallOption) (*ResolveDidResponse, error)
+	// UpdateDid replaces the DID document, the new document must be signed
+	// by an authentication key of the current one
+	UpdateDid(ctx context.Context, in *UpdateDidRequest, opts ...grpc.CallOption) (*UpdateDidResponse, error)
+	// RevokeDid deactivates the DID with a proof signed by the recovery key
+	RevokeDid(ctx context.Context, in *RevokeDidRequest, opts ...grpc.CallOption) (*RevokeDidResponse, error)
+	// WatchEvents streams the registry events, resuming after last_event_id
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (DidService_WatchEventsClient, error)
+}
+
+type didServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDidServiceClient(cc grpc.ClientConnInterface) DidServiceClient {
+	return &didServiceClient{cc}
+}
+
+func (c *didServiceClient) CreateDid(ctx context.Context, in *CreateDidRequest, opts ...grpc.CallOption) (*CreateDidResponse, error) {
+	out := new(CreateDidResponse)
+	err := c.cc.Invoke(ctx, "/serval.v1.DidService/CreateDid", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *didServiceClient) ResolveDid(ctx context.Context, in *ResolveDidRequest, opts ...grpc.CallOption) (*ResolveDidResponse, error) {
+	out := new(ResolveDidResponse)
+	err := c.cc.Invoke(ctx, "/serval.v1.DidService/ResolveDid", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *didServiceClient) UpdateDid(ctx context.Context, in *UpdateDidRequest, opts ...grpc.CallOption) (*UpdateDidResponse, error) {
+	out := new(UpdateDidResponse)
+	err := c.cc.Invoke(ctx, "/serval.v1.DidService/UpdateDid", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *didServiceClient) RevokeDid(ctx context.Context, in *RevokeDidRequest, opts ...grpc.CallOption) (*RevokeDidResponse, error) {
+	out := new(RevokeDidResponse)
+	err := c.cc.Invoke(ctx, "/serval.v1.DidService/RevokeDid", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *didServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (DidService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DidService_ServiceDesc.Streams[0], "/serval.v1.DidService/WatchEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &didServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DidService_WatchEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type didServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *didServiceWatchEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DidServiceServer is the server API for DidService service.
+// All implementations must embed UnimplementedDidServiceServer
+// for forward compatibility
+type DidServiceServer interface {
+	// CreateDid registers the DID document
+	CreateDid(context.Context, *CreateDidRequest) (*CreateDidResponse, error)
+	// ResolveDid returns the verified DID document and its metadata
+	ResolveDid(context.Context, *ResolveDidRequest) (*ResolveDidResponse, error)
+	// UpdateDid replaces the DID document, the new document must be signed
+	// by an authentication key of the current one
+	UpdateDid(context.Context, *UpdateDidRequest) (*UpdateDidResponse, error)
+	// RevokeDid deactivates the DID with a proof signed by the recovery key
+	RevokeDid(context.Context, *RevokeDidRequest) (*RevokeDidResponse, error)
+	// WatchEvents streams the registry events, resuming after last_event_id
+	WatchEvents(*WatchEventsRequest, DidService_WatchEventsServer) error
+	mustEmbedUnimplementedDidServiceServer()
+}
+
+// UnimplementedDidServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedDidServiceServer struct {
+}
+
+func (UnimplementedDidServiceServer) CreateDid(context.Context, *CreateDidRequest) (*CreateDidResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateDid not implemented")
+}
+func (UnimplementedDidServiceServer) ResolveDid(context.Context, *ResolveDidRequest) (*ResolveDidResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveDid not implemented")
+}
+func (UnimplementedDidServiceServer) UpdateDid(context.Context, *UpdateDidRequest) (*UpdateDidResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateDid not implemented")
+}
+func (UnimplementedDidServiceServer) RevokeDid(context.Context, *RevokeDidRequest) (*RevokeDidResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeDid not implemented")
+}
+func (UnimplementedDidServiceServer) WatchEvents(*WatchEventsRequest, DidService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedDidServiceServer) mustEmbedUnimplementedDidServiceServer() {}
+
+// UnsafeDidServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DidServiceServer will
+// result in compilation errors.
+type UnsafeDidServiceServer interface {
+	mustEmbedUnimplementedDidServiceServer()
+}
+
+func RegisterDidServiceServer(s grpc.ServiceRegistrar, srv DidServiceServer) {
+	s.RegisterService(&DidService_ServiceDesc, srv)
+}
+
+func _DidService_CreateDid_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateDidRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DidServiceServer).CreateDid(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/serval.v1.DidService/CreateDid",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DidServiceServer).CreateDid(ctx, req.(*CreateDidRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DidService_ResolveDid_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveDidRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DidServiceServer).ResolveDid(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/serval.v1.DidService/ResolveDid",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DidServiceServer).ResolveDid(ctx, req.(*ResolveDidRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DidService_UpdateDid_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateDidRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DidServiceServer).UpdateDid(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/serval.v1.DidService/UpdateDid",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DidServiceServer).UpdateDid(ctx, req.(*UpdateDidRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DidService_RevokeDid_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeDidRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DidServiceServer).RevokeDid(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/serval.v1.DidService/RevokeDid",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DidServiceServer).RevokeDid(ctx, req.(*RevokeDidRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DidService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DidServiceServer).WatchEvents(m, &didServiceWatchEventsServer{stream})
+}
+
+type DidService_WatchEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type didServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *didServiceWatchEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// DidService_ServiceDesc is the grpc.ServiceDesc for DidService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DidService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "serval.v1.DidService",
+	HandlerType: (*DidServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateDid",
+			Handler:    _DidService_CreateDid_Handler,
+		},
+		{
+			MethodName: "ResolveDid",
+			Handler:    _DidService_ResolveDid_Handler,
+		},
+		{
+			MethodName: "UpdateDid",
+			Handler:    _DidService_UpdateDid_Handler,
+		},
+		{
+			MethodName: "RevokeDid",
+			Handler:    _DidService_RevokeDid_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _DidService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "serval.proto",
+}
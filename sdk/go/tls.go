@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configures the TLS connections to the server
+type TLSOptions struct {
+	// CAFile is the PEM encoded CA verifying the server certificate, the
+	// system roots when empty
+	CAFile string
+	// CertFile and KeyFile are the PEM encoded client certificate and key
+	// presented to a server requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName is checked against the server certificate instead of the
+	// host of the address
+	ServerName string
+}
+
+// Config returns the TLS config of the options. Pass it to
+// credentials.NewTLS for the gRPC client.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.ServerName,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("the CA %s holds no certificate", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,214 @@
+// Package tlsconfig serves TLS with certificates reloaded from their files.
+// The files are polled, so that renewed certificates, and the symlinks
+// swapped by the secret mounts, are picked up without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ewangplay/serval/log"
+)
+
+var logger = log.Module("tls")
+
+// Options defines the server certificate and the client authentication
+type Options struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and key
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM encoded CA verifying the client certificates,
+	// the clients are not asked for one when empty
+	ClientCAFile string
+	// RequireClientCert refuses the connections without a verified client
+	// certificate, else the certificate is optional
+	RequireClientCert bool
+	// MinVersion is the oldest TLS version accepted, 1.2 by default
+	MinVersion string
+	// ReloadInterval is how often the files are checked for changes,
+	// 0 disables the reload
+	ReloadInterval time.Duration
+}
+
+// Enabled tells whether TLS is configured
+func (o *Options) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion returns the TLS version of the string, like 1.2 or 1.3
+func ParseVersion(s string) (uint16, error) {
+	v, ok := versions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// Reloader holds the current certificates and reloads them when their
+// files change
+type Reloader struct {
+	opts       Options
+	minVersion uint16
+
+	config  atomic.Value // *tls.Config
+	modTime map[string]time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReloader loads the certificates, call Start to watch the files
+func NewReloader(opts *Options) (*Reloader, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, fmt.Errorf("TLS needs both certFile and keyFile")
+	}
+	r := &Reloader{
+		opts:       *opts,
+		minVersion: tls.VersionTLS12,
+		done:       make(chan struct{}),
+	}
+	if opts.MinVersion != "" {
+		var err error
+		if r.minVersion, err = ParseVersion(opts.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RequireClientCert && opts.ClientCAFile == "" {
+		return nil, fmt.Errorf("requireClientCert needs the clientCAFile")
+	}
+
+	r.modTime = r.modTimes()
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns the TLS config of the servers, every handshake uses the
+// certificates loaded last
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+func (r *Reloader) current() *tls.Config {
+	return r.config.Load().(*tls.Config)
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) modTimes() map[string]time.Time {
+	m := make(map[string]time.Time)
+	for _, file := range r.files() {
+		if fi, err := os.Stat(file); err == nil {
+			m[file] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load the certificate %s failed: %v", r.opts.CertFile, err)
+	}
+	config := &tls.Config{
+		MinVersion:   r.minVersion,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read the client CA failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("the client CA %s holds no certificate", r.opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.opts.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.config.Store(config)
+	return nil
+}
+
+// Reload loads the certificates again when one of the files changed. The
+// current certificates stay in use when the new ones fail to load.
+func (r *Reloader) Reload() error {
+	modTime := r.modTimes()
+	changed := false
+	for _, file := range r.files() {
+		if !modTime[file].Equal(r.modTime[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	r.modTime = modTime
+	logger.Info("Reloaded the TLS certificate %s", r.opts.CertFile)
+	return nil
+}
+
+// Start polls the files every ReloadInterval
+func (r *Reloader) Start() {
+	if r.opts.ReloadInterval <= 0 {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.opts.ReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					logger.Error("Reload the TLS certificates failed, keeping the current ones: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops polling the files
+func (r *Reloader) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
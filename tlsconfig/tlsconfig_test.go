@@ -0,0 +1,208 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/io"
+	"github.com/ewangplay/serval/log"
+	sdk "github.com/ewangplay/serval/sdk/go"
+)
+
+// authority issues the certificates of the tests
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newAuthority(t *testing.T, dir string) *authority {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "serval test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &authority{cert: cert, key: key, dir: dir}
+	ca.write(t, "ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *authority) write(t *testing.T, name, typ string, der []byte) string {
+	file := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue writes the certificate and the key of the name, for a server
+// when it is an IP address
+func (ca *authority) issue(t *testing.T, name string, serial int64) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return ca.write(t, name+".crt", "CERTIFICATE", der), ca.write(t, name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+func serve(t *testing.T, r *Reloader) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			json.NewEncoder(w).Encode(io.Response{Data: map[string]string{"message": "pong"}})
+		}),
+		TLSConfig: r.Config(),
+	}
+	go srv.ServeTLS(lis, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return lis.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "error", Writer: &bytes.Buffer{}})
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	certFile, keyFile := ca.issue(t, "127.0.0.1", 2)
+	clientCert, clientKey := ca.issue(t, "node1", 3)
+
+	r, err := NewReloader(&Options{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      filepath.Join(dir, "ca.crt"),
+		RequireClientCert: true,
+		MinVersion:        "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	c, err := sdk.NewClientWithTLS(addr, &sdk.TLSOptions{
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CertFile: clientCert,
+		KeyFile:  clientKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Ping with the client certificate failed: %v", err)
+	}
+
+	c, _ = sdk.NewClientWithTLS("https://"+addr, &sdk.TLSOptions{CAFile: filepath.Join(dir, "ca.crt")})
+	if err := c.Ping(); err == nil {
+		t.Fatalf("Ping without client certificate succeeded")
+	}
+	if _, err := sdk.NewClientWithTLS("http://"+addr, &sdk.TLSOptions{}); err == nil {
+		t.Fatalf("TLS options accepted with an http:// address")
+	}
+}
+
+func TestReload(t *testing.T) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "error", Writer: &bytes.Buffer{}})
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	certFile, keyFile := ca.issue(t, "127.0.0.1", 2)
+
+	r, err := NewReloader(&Options{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	serial := func() int64 {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if s := serial(); s != 2 {
+		t.Fatalf("Serial = %d, want 2", s)
+	}
+
+	// A broken file keeps the current certificate
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	os.Chtimes(certFile, later, later)
+	if err := r.Reload(); err == nil {
+		t.Fatalf("Reload of a broken certificate succeeded")
+	}
+	if s := serial(); s != 2 {
+		t.Fatalf("Serial after a failed reload = %d, want 2", s)
+	}
+
+	// The renewed certificate is served to the new connections
+	ca.issue(t, "127.0.0.1", 4)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s := serial(); s != 4 {
+		t.Fatalf("Serial after the reload = %d, want 4", s)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	certFile, keyFile := ca.issue(t, "127.0.0.1", 2)
+
+	for name, opts := range map[string]*Options{
+		"no key":           {CertFile: certFile},
+		"bad version":      {CertFile: certFile, KeyFile: keyFile, MinVersion: "2.0"},
+		"required no CA":   {CertFile: certFile, KeyFile: keyFile, RequireClientCert: true},
+		"missing CA":       {CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.crt")},
+		"key of the chain": {CertFile: certFile, KeyFile: certFile},
+	} {
+		if _, err := NewReloader(opts); err == nil {
+			t.Errorf("NewReloader with %s succeeded", name)
+		}
+	}
+}
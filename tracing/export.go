@@ -0,0 +1,296 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// The spans are encoded as OTLP/JSON export requests, posted to the
+// collector or written one per line, so that a file can be replayed to a
+// collector later:
+//
+//	curl -H 'Content-Type: application/json' -d @line http://collector:4318/v1/traces
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resourceJSON `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resourceJSON struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeSpans struct {
+	Scope scopeJSON  `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scopeJSON struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type spanJSON struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Events            []eventJSON `json:"events,omitempty"`
+	Status            statusJSON  `json:"status"`
+}
+
+type eventJSON struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+// statusJSON holds the OTLP status code: 0 unset, 1 ok, 2 error
+type statusJSON struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+var statusCodes = map[codes.Code]int{
+	codes.Unset: 0,
+	codes.Ok:    1,
+	codes.Error: 2,
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeValue(v attribute.Value) anyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return anyValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return anyValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return anyValue{DoubleValue: &f}
+	case attribute.STRING:
+		s := v.AsString()
+		return anyValue{StringValue: &s}
+	case attribute.BOOLSLICE:
+		var a arrayValue
+		for _, b := range v.AsBoolSlice() {
+			a.Values = append(a.Values, encodeValue(attribute.BoolValue(b)))
+		}
+		return anyValue{ArrayValue: &a}
+	case attribute.INT64SLICE:
+		var a arrayValue
+		for _, i := range v.AsInt64Slice() {
+			a.Values = append(a.Values, encodeValue(attribute.Int64Value(i)))
+		}
+		return anyValue{ArrayValue: &a}
+	case attribute.FLOAT64SLICE:
+		var a arrayValue
+		for _, f := range v.AsFloat64Slice() {
+			a.Values = append(a.Values, encodeValue(attribute.Float64Value(f)))
+		}
+		return anyValue{ArrayValue: &a}
+	case attribute.STRINGSLICE:
+		var a arrayValue
+		for _, s := range v.AsStringSlice() {
+			a.Values = append(a.Values, encodeValue(attribute.StringValue(s)))
+		}
+		return anyValue{ArrayValue: &a}
+	default:
+		s := v.Emit()
+		return anyValue{StringValue: &s}
+	}
+}
+
+func encodeAttributes(attrs []attribute.KeyValue) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		kvs = append(kvs, keyValue{Key: string(kv.Key), Value: encodeValue(kv.Value)})
+	}
+	return kvs
+}
+
+func encodeSpan(s sdktrace.ReadOnlySpan) spanJSON {
+	sc := s.SpanContext()
+	span := spanJSON{
+		TraceID:           sc.TraceID().String(),
+		SpanID:            sc.SpanID().String(),
+		Name:              s.Name(),
+		Kind:              int(s.SpanKind()),
+		StartTimeUnixNano: unixNano(s.StartTime()),
+		EndTimeUnixNano:   unixNano(s.EndTime()),
+		Attributes:        encodeAttributes(s.Attributes()),
+		Status:            statusJSON{Code: statusCodes[s.Status().Code], Message: s.Status().Description},
+	}
+	if parent := s.Parent(); parent.IsValid() {
+		span.ParentSpanID = parent.SpanID().String()
+	}
+	for _, e := range s.Events() {
+		span.Events = append(span.Events, eventJSON{
+			TimeUnixNano: unixNano(e.Time),
+			Name:         e.Name,
+			Attributes:   encodeAttributes(e.Attributes),
+		})
+	}
+	return span
+}
+
+// encodeSpans groups the spans by resource and instrumentation scope
+func encodeSpans(spans []sdktrace.ReadOnlySpan) *exportRequest {
+	req := &exportRequest{}
+	resources := make(map[attribute.Distinct]int)
+	for _, s := range spans {
+		res := s.Resource()
+		key := res.Equivalent()
+		ri, ok := resources[key]
+		if !ok {
+			ri = len(req.ResourceSpans)
+			resources[key] = ri
+			req.ResourceSpans = append(req.ResourceSpans, resourceSpans{
+				Resource: resourceJSON{Attributes: encodeAttributes(res.Attributes())},
+			})
+		}
+		rs := &req.ResourceSpans[ri]
+
+		lib := s.InstrumentationLibrary()
+		si := -1
+		for i, ss := range rs.ScopeSpans {
+			if ss.Scope.Name == lib.Name && ss.Scope.Version == lib.Version {
+				si = i
+				break
+			}
+		}
+		if si < 0 {
+			si = len(rs.ScopeSpans)
+			rs.ScopeSpans = append(rs.ScopeSpans, scopeSpans{Scope: scopeJSON{Name: lib.Name, Version: lib.Version}})
+		}
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, encodeSpan(s))
+	}
+	return req
+}
+
+// otlpExporter posts the spans to the OTLP/HTTP endpoint of a collector
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func newOTLPExporter(endpoint string, headers map[string]string) *otlpExporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	body, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export the spans to %s failed: %v", e.endpoint, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("export the spans to %s failed: %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// writerExporter writes the spans of every batch as a line of JSON
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func newWriterExporter(w io.WriteCloser) *writerExporter {
+	return &writerExporter{w: w}
+}
+
+func newFileExporter(file string) (*writerExporter, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open the trace file failed: %v", err)
+	}
+	return newWriterExporter(f), nil
+}
+
+func (e *writerExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	line, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+func (e *writerExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Close()
+}
@@ -0,0 +1,143 @@
+// Package tracing traces the requests with OpenTelemetry. The traces are
+// propagated with the W3C trace context headers, and the spans exported
+// over OTLP/HTTP, or written to a file or stdout where no collector runs.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans
+const (
+	ExporterOTLP   = "otlp"
+	ExporterFile   = "file"
+	ExporterStdout = "stdout"
+)
+
+const (
+	defaultEndpoint    = "http://localhost:4318/v1/traces"
+	defaultServiceName = "serval"
+	instrumentation    = "github.com/ewangplay/serval/tracing"
+)
+
+// Options defines where the spans go
+type Options struct {
+	// Exporter is otlp, file or stdout, the tracing is disabled when empty
+	Exporter string
+	// Endpoint is the OTLP/HTTP traces URL of the collector,
+	// http://localhost:4318/v1/traces by default
+	Endpoint string
+	// Headers are sent with the spans to the collector, like its credentials
+	Headers map[string]string
+	// File receives the spans of the file exporter
+	File string
+	// SampleRatio is the ratio of the traces started by the server that
+	// are recorded, 1 by default. The traces started by the callers follow
+	// the sampling decision of their traceparent header.
+	SampleRatio float64
+	// ServiceName names the server in the traces, serval by default
+	ServiceName string
+}
+
+// Provider records the spans and hands them to the exporter
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// Init installs the tracer provider and the W3C trace context propagator
+// for the whole process, the spans are dropped until it is called
+func Init(opts *Options) (*Provider, error) {
+	exporter, err := newExporter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := opts.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	name := opts.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(name))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return &Provider{tp: tp}, nil
+}
+
+func newExporter(opts *Options) (sdktrace.SpanExporter, error) {
+	switch opts.Exporter {
+	case ExporterOTLP:
+		endpoint := opts.Endpoint
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		}
+		return newOTLPExporter(endpoint, opts.Headers), nil
+	case ExporterFile:
+		if opts.File == "" {
+			return nil, fmt.Errorf("the file exporter needs tracing.file")
+		}
+		return newFileExporter(opts.File)
+	case ExporterStdout:
+		return newWriterExporter(nopCloser{os.Stdout}), nil
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, use otlp, file or stdout", opts.Exporter)
+	}
+}
+
+// Shutdown exports the spans not exported yet and stops the exporter
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.tp.Shutdown(ctx)
+}
+
+// Middleware starts the span of every request, as a child of the span of
+// the caller when the request has a traceparent header. The handlers find
+// the span in the context of the request.
+func Middleware() gin.HandlerFunc {
+	tracer := otel.Tracer(instrumentation)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = "HTTP " + c.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(c.Request.URL.RequestURI()),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+func TestWriterExporter(t *testing.T) {
+	var buf bufferCloser
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(newWriterExporter(&buf)))
+	tracer := tp.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child", trace.WithAttributes(attribute.Int("n", 7)))
+	child.SetStatus(codes.Error, "failed")
+	child.End()
+	parent.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&buf)
+	var spans []spanJSON
+	for dec.More() {
+		var req exportRequest
+		if err := dec.Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				if ss.Scope.Name != "test" {
+					t.Errorf("Unexpected scope %q", ss.Scope.Name)
+				}
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("Unexpected spans %+v", spans)
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("The child %+v is not in the parent %+v", c, p)
+	}
+	if c.Status.Code != 2 || c.Status.Message != "failed" {
+		t.Errorf("Unexpected status %+v", c.Status)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "n" || *c.Attributes[0].Value.IntValue != "7" {
+		t.Errorf("Unexpected attributes %+v", c.Attributes)
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	for _, opts := range []*Options{{Exporter: "zipkin"}, {Exporter: ExporterFile}} {
+		if _, err := newExporter(opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware())
+	var inHandler trace.SpanContext
+	r.GET("/did/:did", func(c *gin.Context) {
+		inHandler = trace.SpanContextFromContext(c.Request.Context())
+		c.Status(http.StatusInternalServerError)
+	})
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/did/did:example:1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected one span, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "GET /did/:did" || s.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Unexpected span %s %v", s.Name(), s.SpanKind())
+	}
+	if s.SpanContext().TraceID().String() != traceID || s.Parent().SpanID().String() != spanID {
+		t.Errorf("The span does not continue the trace of the caller: %v", s.SpanContext())
+	}
+	if inHandler.SpanID() != s.SpanContext().SpanID() {
+		t.Errorf("The handler does not see the span of the request")
+	}
+	if s.Status().Code != codes.Error {
+		t.Errorf("Expected error status, got %v", s.Status())
+	}
+}
@@ -6,12 +6,18 @@ require (
 	github.com/ewangplay/cryptolib v0.6.0
 	github.com/ewangplay/serval/io v0.0.0-20220713065604-fe59ebea56d6
 	github.com/jerray/qsign v1.2.1
+	go.opentelemetry.io/otel v1.7.0
 )
 
 require (
 	github.com/btcsuite/btcd v0.20.1-beta // indirect
 	github.com/ethereum/go-ethereum v1.10.11 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
+	go.opentelemetry.io/otel/trace v1.7.0 // indirect
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
 	golang.org/x/sys v0.0.0-20210816183151-1e6c022a8912 // indirect
 )
+
+replace github.com/ewangplay/serval/io => ../io
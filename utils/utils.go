@@ -1,18 +1,49 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 
 	cl "github.com/ewangplay/cryptolib"
 	didio "github.com/ewangplay/serval/io"
 	"github.com/jerray/qsign"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// tracer traces the verifications, the spans are dropped until the
+// application sets a tracer provider
+var tracer = otel.Tracer("github.com/ewangplay/serval/utils")
+
+var (
+	// ErrUnsupportedKeyType is wrapped by the errors of the verification
+	// of a signature made with a key type that is not supported
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
+	// ErrInvalidSignature is wrapped by the errors of the verification
+	// of a malformed or wrong signature
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// verifyError keeps the message of the verification failure, and tells its kind
+type verifyError struct {
+	kind error
+	msg  string
+}
+
+func (e *verifyError) Error() string { return e.msg }
+func (e *verifyError) Unwrap() error { return e.kind }
+
+func verifyErrorf(kind error, format string, args ...any) error {
+	return &verifyError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
 // GenerateUUID returns a UUID as a string based on RFC 4122
 func GenerateUUID() string {
 	uuid := GenerateBytesUUID()
@@ -48,6 +79,16 @@ func SHA256(data []byte) string {
 	return hex.EncodeToString(cs)
 }
 
+// KeyFingerprint returns the fingerprint of the hex encoded public key,
+// the hex encoded SHA256 checksum of the raw key bytes
+func KeyFingerprint(publicKeyHex string) (string, error) {
+	b, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return "", fmt.Errorf("Decode the public key failed: %v", err)
+	}
+	return SHA256(b), nil
+}
+
 func SignDDO(csp cl.CSP, qs *qsign.Qsign, keyID string, key cl.Key, ddo *didio.DDO) (err error) {
 	data, err := qs.Digest(ddo)
 	if err != nil {
@@ -72,6 +113,21 @@ func SignDDO(csp cl.CSP, qs *qsign.Qsign, keyID string, key cl.Key, ddo *didio.D
 }
 
 func VerifyDDO(csp cl.CSP, qs *qsign.Qsign, ddo *didio.DDO) (err error) {
+	return VerifyDDOContext(context.Background(), csp, qs, ddo)
+}
+
+// VerifyDDOContext works like VerifyDDO, it traces the verification as a
+// child of the span of ctx, with spans for the digest and the signature check
+func VerifyDDOContext(ctx context.Context, csp cl.CSP, qs *qsign.Qsign, ddo *didio.DDO) (err error) {
+	ctx, span := tracer.Start(ctx, "utils.VerifyDDO")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	if csp == nil {
 		return fmt.Errorf("CSP provider is nil")
 	}
@@ -113,30 +169,36 @@ func VerifyDDO(csp cl.CSP, qs *qsign.Qsign, ddo *didio.DDO) (err error) {
 			PubKey: pubKeyBytes,
 		}
 	default:
-		return fmt.Errorf("unsupported key type: %v", pk.Type)
+		return verifyErrorf(ErrUnsupportedKeyType, "unsupported key type: %v", pk.Type)
 	}
+	span.SetAttributes(attribute.String("serval.key_type", pk.Type))
 
 	// Decode the signature of the DID document
 	signature, err := base64.StdEncoding.DecodeString(ddo.Proof.SignatureValue)
 	if err != nil {
-		return fmt.Errorf("The signature of the DID document is invalid")
+		return verifyErrorf(ErrInvalidSignature, "The signature of the DID document is invalid")
 	}
 
 	// Verifying the signature of the DID document
+	_, digestSpan := tracer.Start(ctx, "qsign.Digest")
 	data, err := qs.Digest(ddo)
+	digestSpan.End()
 	if err != nil {
 		return err
 	}
+	_, verifySpan := tracer.Start(ctx, "csp.Verify")
 	digest, err := csp.Hash(data, &cl.SHA256Opts{})
 	if err != nil {
+		verifySpan.End()
 		return err
 	}
 	valid, err := csp.Verify(k, digest, signature, nil)
+	verifySpan.End()
 	if err != nil {
 		return err
 	}
 	if !valid {
-		return fmt.Errorf("Verifying the signature of the DID document failed")
+		return verifyErrorf(ErrInvalidSignature, "Verifying the signature of the DID document failed")
 	}
 
 	return nil
@@ -181,12 +243,12 @@ func VerifyProof(csp cl.CSP, did string, proof *didio.Proof, ddo *didio.DDO) (va
 			PubKey: pubKeyBytes,
 		}
 	default:
-		return false, fmt.Errorf("unsupported key type for did: %v", pk.Type)
+		return false, verifyErrorf(ErrUnsupportedKeyType, "unsupported key type for did: %v", pk.Type)
 	}
 
 	signature, err := base64.StdEncoding.DecodeString(proof.SignatureValue)
 	if err != nil {
-		return false, fmt.Errorf("proof signature is invalid")
+		return false, verifyErrorf(ErrInvalidSignature, "proof signature is invalid")
 	}
 
 	digest, err := csp.Hash([]byte(did), &cl.SHA256Opts{})
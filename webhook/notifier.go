@@ -0,0 +1,339 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/utils"
+	"github.com/philippgille/gokv"
+)
+
+var logger = log.Module("webhook")
+
+// subscriptionsTTL is how long the subscriptions read by the notifier are
+// used, before reading the ones made on the other nodes
+const subscriptionsTTL = 30 * time.Second
+
+// Options defines the delivery options of the notifier
+type Options struct {
+	Enabled bool
+	// PollInterval is how often the outbox is checked for due deliveries
+	PollInterval time.Duration
+	// Timeout bounds one callback
+	Timeout time.Duration
+	// MaxAttempts is the number of attempts before a delivery is dead
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay between two attempts,
+	// it doubles after every failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Workers is the number of callbacks sent at the same time
+	Workers int
+}
+
+func (o *Options) setDefaults() {
+	if o.PollInterval <= 0 {
+		o.PollInterval = 5 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 10
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Hour
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+}
+
+// Notifier queues the registry events in the outbox and delivers them.
+// The nodes sharing the store share the outbox, a node leases a delivery
+// in the store before sending it so that the others leave it alone.
+type Notifier struct {
+	store  gokv.Store
+	opts   Options
+	client *http.Client
+	// owner names the node in the leases it takes
+	owner string
+
+	wakeup chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	inflight map[string]bool
+
+	// subsMu guards subs, the subscriptions read at subsRead
+	subsMu   sync.Mutex
+	subs     []Subscription
+	subsRead time.Time
+}
+
+// NewNotifier creates the notifier on top of the store, call Start to
+// begin the deliveries. The outbox is read past the cache of the store,
+// the other nodes write to it.
+func NewNotifier(store gokv.Store, opts Options) *Notifier {
+	opts.setDefaults()
+	return &Notifier{
+		store:    adapter.Uncached(store),
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		owner:    utils.GenerateUUID(),
+		wakeup:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		inflight: make(map[string]bool),
+	}
+}
+
+// Notify writes the deliveries of the event to the outbox, for every
+// subscription wanting it, before the write of the DID returns: they are
+// sent even if the process stops right after. It is meant to be
+// registered with Registry.OnEvent.
+func (n *Notifier) Notify(e registry.Event) {
+	subs, err := n.cachedSubscriptions()
+	if err != nil {
+		logger.Error("Read the webhook subscriptions failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	queued := false
+	for _, sub := range subs {
+		if !sub.wants(e.Type) {
+			continue
+		}
+		d := Delivery{
+			ID:           utils.GenerateUUID(),
+			Subscription: sub.ID,
+			Event:        e,
+			NextAttempt:  now,
+			Created:      now,
+		}
+		if err = n.store.Set(outboxPrefix+d.ID, d); err != nil {
+			logger.Error("Queue the %v event for %v failed: %v", e.Type, sub.URL, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		n.wake()
+	}
+}
+
+func (n *Notifier) wake() {
+	select {
+	case n.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Start begins delivering the outbox in the background
+func (n *Notifier) Start() {
+	n.wg.Add(1)
+	go n.run()
+}
+
+// Close stops the deliveries, the pending ones stay in the outbox
+func (n *Notifier) Close() error {
+	close(n.done)
+	n.wg.Wait()
+	return nil
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.opts.PollInterval)
+	defer ticker.Stop()
+
+	sem := make(chan struct{}, n.opts.Workers)
+	for {
+		n.dispatch(sem)
+
+		select {
+		case <-n.done:
+			// Wait for the callbacks in flight
+			for i := 0; i < cap(sem); i++ {
+				sem <- struct{}{}
+			}
+			return
+		case <-ticker.C:
+		case <-n.wakeup:
+		}
+	}
+}
+
+// dispatch sends the due deliveries of the outbox
+func (n *Notifier) dispatch(sem chan struct{}) {
+	pending, err := n.Pending()
+	if err != nil {
+		logger.Error("Read the webhook outbox failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, d := range pending {
+		if d.NextAttempt.After(now) || d.leasedBy(now) != "" {
+			continue
+		}
+		n.mu.Lock()
+		busy := n.inflight[d.ID]
+		n.inflight[d.ID] = true
+		n.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-n.done:
+			n.release(d.ID)
+			return
+		}
+		leased, ok := n.lease(d.ID)
+		if !ok {
+			<-sem
+			n.release(d.ID)
+			continue
+		}
+		go func(d Delivery) {
+			defer func() { <-sem }()
+			defer n.release(d.ID)
+			n.attempt(d)
+		}(*leased)
+	}
+}
+
+// lease takes the delivery for the time of one attempt, unless it is
+// delivered already or leased by another node. The lease is read back in
+// case another node took it meanwhile, the store has no compare-and-swap
+// so two nodes leasing it at the same instant may still both send it.
+func (n *Notifier) lease(id string) (*Delivery, bool) {
+	var d Delivery
+	found, err := n.store.Get(outboxPrefix+id, &d)
+	if err != nil || !found {
+		return nil, false
+	}
+	now := time.Now()
+	if d.NextAttempt.After(now) || d.leasedBy(now) != "" {
+		return nil, false
+	}
+
+	d.Owner = n.owner
+	d.LeaseUntil = now.Add(2 * n.opts.Timeout)
+	if err = n.store.Set(outboxPrefix+id, d); err != nil {
+		logger.Error("Lease the delivery %v failed: %v", id, err)
+		return nil, false
+	}
+	var leased Delivery
+	found, err = n.store.Get(outboxPrefix+id, &leased)
+	if err != nil || !found || leased.Owner != n.owner {
+		return nil, false
+	}
+	return &leased, true
+}
+
+func (n *Notifier) release(id string) {
+	n.mu.Lock()
+	delete(n.inflight, id)
+	n.mu.Unlock()
+}
+
+// attempt sends the delivery once and records the outcome
+func (n *Notifier) attempt(d Delivery) {
+	var sub Subscription
+	found, err := n.store.Get(subPrefix+d.Subscription, &sub)
+	if err != nil {
+		logger.Error("Read the webhook subscription %v failed: %v", d.Subscription, err)
+		return
+	}
+	if !found {
+		// Unsubscribed meanwhile
+		n.store.Delete(outboxPrefix + d.ID)
+		return
+	}
+
+	err = n.send(&sub, &d)
+	if err == nil {
+		if err = n.store.Delete(outboxPrefix + d.ID); err != nil {
+			logger.Error("Remove the delivery %v from the outbox failed: %v", d.ID, err)
+		}
+		return
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+	d.Owner, d.LeaseUntil = "", time.Time{}
+	if d.Attempts >= n.opts.MaxAttempts {
+		logger.Warn("Delivery %v of the %v event to %v failed %d times, moved to the dead letters: %v",
+			d.ID, d.Event.Type, sub.URL, d.Attempts, err)
+		if err = n.store.Set(deadPrefix+d.ID, d); err == nil {
+			err = n.store.Delete(outboxPrefix + d.ID)
+		}
+	} else {
+		d.NextAttempt = time.Now().Add(n.backoff(d.Attempts))
+		err = n.store.Set(outboxPrefix+d.ID, d)
+	}
+	if err != nil {
+		logger.Error("Update the delivery %v failed: %v", d.ID, err)
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts,
+// with up to 20% of jitter so the retries of many deliveries spread out
+func (n *Notifier) backoff(attempts int) time.Duration {
+	delay := n.opts.MinBackoff
+	for i := 1; i < attempts && delay < n.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > n.opts.MaxBackoff {
+		delay = n.opts.MaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func (n *Notifier) send(sub *Subscription, d *Delivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(d.Event.Type))
+	req.Header.Set(HeaderDelivery, d.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, ts, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback answered %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// Package webhook delivers the registry events to the HTTP callbacks of
+// the subscribers.
+//
+// Subscriptions, pending deliveries and dead letters are kept in the store:
+//
+//	serval:webhook:sub:<id>     a subscription
+//	serval:webhook:outbox:<id>  a delivery waiting for its next attempt
+//	serval:webhook:dead:<id>    a delivery that failed every attempt
+//
+// Every callback is a POST of the JSON encoded event, signed with the
+// secret of the subscription, see Sign.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/utils"
+)
+
+const (
+	subPrefix    = "serval:webhook:sub:"
+	outboxPrefix = "serval:webhook:outbox:"
+	deadPrefix   = "serval:webhook:dead:"
+)
+
+// The headers of a callback
+const (
+	HeaderEvent     = "X-Serval-Event"
+	HeaderDelivery  = "X-Serval-Delivery"
+	HeaderTimestamp = "X-Serval-Timestamp"
+	HeaderSignature = "X-Serval-Signature"
+)
+
+// ErrNotFound is returned when the subscription or the dead letter does not exist
+var ErrNotFound = errors.New("not found")
+
+// Subscription registers a callback URL for some event types
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the callbacks, it is only returned when subscribing
+	Secret string `json:"secret,omitempty"`
+	// Events selects the event types to send, empty selects all of them
+	Events  []registry.EventType `json:"events,omitempty"`
+	Created time.Time            `json:"created"`
+}
+
+func (s *Subscription) wants(t registry.EventType) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is one event to send to one subscription
+type Delivery struct {
+	ID           string         `json:"id"`
+	Subscription string         `json:"subscription"`
+	Event        registry.Event `json:"event"`
+	Attempts     int            `json:"attempts"`
+	NextAttempt  time.Time      `json:"nextAttempt"`
+	LastError    string         `json:"lastError,omitempty"`
+	Created      time.Time      `json:"created"`
+	// Owner is the node sending the delivery until LeaseUntil
+	Owner      string    `json:"owner,omitempty"`
+	LeaseUntil time.Time `json:"leaseUntil,omitempty"`
+}
+
+// leasedBy returns the node holding the lease of the delivery at the
+// time, if any
+func (d *Delivery) leasedBy(now time.Time) string {
+	if d.Owner == "" || !d.LeaseUntil.After(now) {
+		return ""
+	}
+	return d.Owner
+}
+
+// Sign returns the signature of the callback body sent at the timestamp,
+// the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed by the secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature of a callback, receivers should
+// also refuse timestamps too far in the past
+func VerifySignature(secret, timestamp string, body []byte, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature))
+}
+
+// Subscribe stores the subscription, a secret is generated when it has none
+func (n *Notifier) Subscribe(sub Subscription) (*Subscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid callback URL: %v", sub.URL)
+	}
+	for _, e := range sub.Events {
+		if !knownEvent(e) {
+			return nil, fmt.Errorf("unknown event type: %v", e)
+		}
+	}
+	if sub.Secret == "" {
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			return nil, err
+		}
+		sub.Secret = hex.EncodeToString(b)
+	}
+	sub.ID = utils.GenerateUUID()
+	sub.Created = time.Now()
+
+	if err = n.store.Set(subPrefix+sub.ID, sub); err != nil {
+		return nil, err
+	}
+	n.invalidate()
+	return &sub, nil
+}
+
+func knownEvent(t registry.EventType) bool {
+	for _, e := range registry.EventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriptions returns the subscriptions without their secrets
+func (n *Notifier) Subscriptions() ([]Subscription, error) {
+	subs, err := n.subscriptions()
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, err
+}
+
+// cachedSubscriptions returns the subscriptions read last, while they
+// are recent enough
+func (n *Notifier) cachedSubscriptions() ([]Subscription, error) {
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+	if !n.subsRead.IsZero() && time.Since(n.subsRead) < subscriptionsTTL {
+		return n.subs, nil
+	}
+
+	subs, err := n.subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	n.subs, n.subsRead = subs, time.Now()
+	return subs, nil
+}
+
+// invalidate drops the subscriptions read last
+func (n *Notifier) invalidate() {
+	n.subsMu.Lock()
+	n.subs, n.subsRead = nil, time.Time{}
+	n.subsMu.Unlock()
+}
+
+func (n *Notifier) subscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	err := adapter.Scan(n.store, subPrefix, func(k string) error {
+		var sub Subscription
+		found, err := n.store.Get(k, &sub)
+		if err != nil || !found {
+			return err
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+	return subs, err
+}
+
+// Unsubscribe deletes the subscription, its pending deliveries are dropped
+func (n *Notifier) Unsubscribe(id string) error {
+	found, err := n.store.Get(subPrefix+id, new(Subscription))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if err = n.store.Delete(subPrefix + id); err != nil {
+		return err
+	}
+	n.invalidate()
+	return nil
+}
+
+// DeadLetters returns the deliveries that failed every attempt
+func (n *Notifier) DeadLetters() ([]Delivery, error) {
+	return n.deliveries(deadPrefix)
+}
+
+// Pending returns the deliveries waiting in the outbox
+func (n *Notifier) Pending() ([]Delivery, error) {
+	return n.deliveries(outboxPrefix)
+}
+
+func (n *Notifier) deliveries(prefix string) ([]Delivery, error) {
+	var list []Delivery
+	err := adapter.Scan(n.store, prefix, func(k string) error {
+		var d Delivery
+		found, err := n.store.Get(k, &d)
+		if err != nil || !found {
+			return err
+		}
+		list = append(list, d)
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, err
+}
+
+// Redeliver moves the dead letter back to the outbox for a new round of attempts
+func (n *Notifier) Redeliver(id string) error {
+	var d Delivery
+	found, err := n.store.Get(deadPrefix+id, &d)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	d.Attempts = 0
+	d.NextAttempt = time.Now()
+	d.Owner, d.LeaseUntil = "", time.Time{}
+	if err = n.store.Set(outboxPrefix+id, d); err != nil {
+		return err
+	}
+	if err = n.store.Delete(deadPrefix + id); err != nil {
+		return err
+	}
+	n.wake()
+	return nil
+}
+
+// DropDeadLetter deletes the dead letter
+func (n *Notifier) DropDeadLetter(id string) error {
+	found, err := n.store.Get(deadPrefix+id, new(Delivery))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return n.store.Delete(deadPrefix + id)
+}
@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ewangplay/serval/adapter"
+	"github.com/ewangplay/serval/log"
+	"github.com/ewangplay/serval/registry"
+	"github.com/ewangplay/serval/registry/registrytest"
+)
+
+// receiver is a local callback endpoint failing the first requests
+type receiver struct {
+	*httptest.Server
+	secret string
+	fails  int
+
+	mu     sync.Mutex
+	events []registry.Event
+	calls  int
+}
+
+func newReceiver(t *testing.T, secret string, fails int) *receiver {
+	rcv := &receiver{secret: secret, fails: fails}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifySignature(rcv.secret, r.Header.Get(HeaderTimestamp), body, r.Header.Get(HeaderSignature)) {
+			t.Errorf("Invalid signature of delivery %v", r.Header.Get(HeaderDelivery))
+		}
+
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.calls++
+		if rcv.calls <= rcv.fails {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e registry.Event
+		json.Unmarshal(body, &e)
+		rcv.events = append(rcv.events, e)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) received() []registry.Event {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]registry.Event(nil), rcv.events...)
+}
+
+func newNotifier(t *testing.T, opts Options) (*registry.Registry, *Notifier) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	reg := registrytest.NewRegistry(t)
+	opts.PollInterval = 10 * time.Millisecond
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 5 * time.Millisecond
+	n := NewNotifier(reg.Store(), opts)
+	reg.OnEvent(n.Notify)
+	n.Start()
+	t.Cleanup(func() { n.Close() })
+	return reg, n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	reg, n := newNotifier(t, Options{})
+	all := newReceiver(t, "secret-1", 2)
+	revokes := newReceiver(t, "secret-2", 0)
+
+	if _, err := n.Subscribe(Subscription{URL: all.URL, Secret: all.secret}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := n.Subscribe(Subscription{URL: revokes.URL, Events: []registry.EventType{registry.EventRevoked}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokes.secret = sub.Secret
+
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err = reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if err = reg.Revoke(id.Did); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed attempts are retried
+	waitFor(t, "the deliveries", func() bool {
+		return len(all.received()) == 2 && len(revokes.received()) == 1
+	})
+	if e := revokes.received()[0]; e.Type != registry.EventRevoked || e.Did != id.Did || e.Version != 2 {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+	waitFor(t, "the outbox to drain", func() bool {
+		pending, _ := n.Pending()
+		return len(pending) == 0
+	})
+
+	subs, _ := n.Subscriptions()
+	if len(subs) != 2 || subs[0].Secret != "" {
+		t.Fatalf("Unexpected subscriptions: %+v", subs)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	reg, n := newNotifier(t, Options{MaxAttempts: 3})
+	rcv := newReceiver(t, "secret", 3)
+	sub, err := n.Subscribe(Subscription{URL: rcv.URL, Secret: rcv.secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := "ab" + string(bytes.Repeat([]byte("0"), 62))
+	if _, _, err = reg.ReportCompromise(fp, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var dead []Delivery
+	waitFor(t, "the dead letter", func() bool {
+		dead, _ = n.DeadLetters()
+		return len(dead) == 1
+	})
+	if dead[0].Attempts != 3 || dead[0].Event.Type != registry.EventKeyCompromised || dead[0].LastError == "" {
+		t.Fatalf("Unexpected dead letter: %+v", dead[0])
+	}
+
+	if err = n.Redeliver(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the redelivery", func() bool { return len(rcv.received()) == 1 })
+	if dead, _ = n.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("Redelivered dead letter still listed: %+v", dead)
+	}
+
+	if err = n.Unsubscribe(sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Unsubscribe(sub.ID); err != ErrNotFound {
+		t.Fatalf("Unsubscribe twice should fail with ErrNotFound, got %v", err)
+	}
+	if err = n.Redeliver("missing"); err != ErrNotFound {
+		t.Fatalf("Redeliver a missing dead letter should fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestNotifyDurable(t *testing.T) {
+	log.InitLogger(&log.LoggerConfig{Module: "serval-test", LogLevel: "fatal", Writer: &bytes.Buffer{}})
+
+	// The deliveries are in the outbox once the write returns, before the
+	// notifier runs
+	reg := registrytest.NewRegistry(t)
+	n := NewNotifier(reg.Store(), Options{PollInterval: time.Hour})
+	reg.OnEvent(n.Notify)
+
+	sub, err := n.Subscribe(Subscription{URL: "https://example.com/serval"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		if err = reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, _ := n.Pending(); len(pending) != 3 {
+		t.Fatalf("Expected 3 deliveries, got %v", len(pending))
+	}
+
+	// The events after the unsubscription are not queued for it
+	if err = n.Unsubscribe(sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	id := registrytest.NewIdentity(t, reg.CSP())
+	ddo := id.Document(t, reg)
+	if err = reg.Create(id.Did, &ddo); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := n.Pending(); len(pending) != 3 {
+		t.Fatalf("Expected 3 deliveries, got %v", len(pending))
+	}
+}
+
+func TestDeliverNodes(t *testing.T) {
+	reg, n := newNotifier(t, Options{})
+	rcv := newReceiver(t, "secret", 0)
+	if _, err := n.Subscribe(Subscription{URL: rcv.URL, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second node polling the same outbox
+	other := NewNotifier(reg.Store(), Options{PollInterval: 10 * time.Millisecond})
+	other.Start()
+	defer other.Close()
+
+	for i := 0; i < 5; i++ {
+		id := registrytest.NewIdentity(t, reg.CSP())
+		ddo := id.Document(t, reg)
+		if err := reg.Create(id.Did, &ddo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the deliveries", func() bool {
+		pending, _ := n.Pending()
+		return len(pending) == 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	if got := rcv.received(); len(got) != 5 {
+		t.Fatalf("Expected every event delivered once, got %v deliveries", len(got))
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	n := NewNotifier(adapter.NewMemoryStore(), Options{})
+	if _, err := n.Subscribe(Subscription{URL: "ftp://example.com"}); err == nil {
+		t.Fatal("Subscribe should refuse a non HTTP URL")
+	}
+	if _, err := n.Subscribe(Subscription{URL: "https://example.com", Events: []registry.EventType{"did.unknown"}}); err == nil {
+		t.Fatal("Subscribe should refuse an unknown event type")
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"did.created"}`)
+	sig := Sign("secret", 1700000000, body)
+	if !VerifySignature("secret", "1700000000", body, sig) {
+		t.Fatal("Valid signature refused")
+	}
+	if VerifySignature("secret", "1700000001", body, sig) || VerifySignature("other", "1700000000", body, sig) {
+		t.Fatal("Invalid signature accepted")
+	}
+}